@@ -0,0 +1,199 @@
+// Package bus fans out the updates of all speakers to independent subscribers. A subscription
+// is scoped by speakers and message types and ends with its context, e.g. after a deadline. The
+// bus keeps a short history per speaker, so that late subscribers can ask for the last known
+// values.
+package bus
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultHistory is the number of updates kept per speaker if not configured otherwise
+const DefaultHistory = 32
+
+// DefaultBuffer is the number of events buffered for a subscriber if not configured otherwise
+const DefaultBuffer = 16
+
+// Event is an update published on the bus
+// Time the update has been published
+// Type the message type of the update, e.g. "Volume"
+type Event struct {
+	Time    time.Time
+	Type    string
+	Update  soundtouch.Update
+	Speaker soundtouch.Speaker
+}
+
+// Filter selects the events of a subscription
+// Speakers names or device IDs of the speakers. All if empty
+// Types message types, e.g. "Volume". All if empty
+type Filter struct {
+	Speakers []string
+	Types    []string
+}
+
+func (f Filter) matches(e Event) bool {
+	if len(f.Speakers) > 0 && !slices.Contains(f.Speakers, e.Speaker.Name()) && !slices.Contains(f.Speakers, e.Speaker.DeviceID()) {
+		return false
+	}
+	return len(f.Types) == 0 || slices.Contains(f.Types, e.Type)
+}
+
+// Bus delivers published updates to all matching subscriptions
+type Bus struct {
+	history int
+
+	mu       sync.RWMutex
+	subs     map[*Subscription]struct{}
+	speakers map[string][]Event
+}
+
+// New creates a bus keeping history updates per speaker, DefaultHistory if not positive
+func New(history int) *Bus {
+	if history <= 0 {
+		history = DefaultHistory
+	}
+	return &Bus{
+		history:  history,
+		subs:     map[*Subscription]struct{}{},
+		speakers: map[string][]Event{},
+	}
+}
+
+// Publish records the update in the history of the speaker and hands it to every matching
+// subscription. Publish never blocks. A subscriber not keeping up misses the event.
+func (b *Bus) Publish(update soundtouch.Update, speaker soundtouch.Speaker) {
+	if update.Value == nil {
+		return
+	}
+	e := Event{
+		Time:    time.Now(),
+		Type:    reflect.TypeOf(update.Value).Name(),
+		Update:  update,
+		Speaker: speaker,
+	}
+
+	b.mu.Lock()
+	h := append(b.speakers[speaker.DeviceID()], e)
+	if len(h) > b.history {
+		h = h[len(h)-b.history:]
+	}
+	b.speakers[speaker.DeviceID()] = h
+	b.mu.Unlock()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		s.deliver(e)
+	}
+}
+
+// Subscribe returns a subscription to the events matching f. The subscription ends and its
+// channel is closed when ctx is done or Cancel is called. buffer events are buffered,
+// DefaultBuffer if not positive.
+func (b *Bus) Subscribe(ctx context.Context, f Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	s := &Subscription{
+		filter: f,
+		ch:     make(chan Event, buffer),
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.unsubscribe(s)
+	}()
+	return s
+}
+
+// SubscribeFor returns a subscription to the events matching f that ends after d
+func (b *Bus) SubscribeFor(ctx context.Context, d time.Duration, f Filter, buffer int) *Subscription {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	s := b.Subscribe(ctx, f, buffer)
+	unsubscribe := s.cancel
+	s.cancel = func() {
+		unsubscribe()
+		cancel()
+	}
+	return s
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+}
+
+// History returns the recent events of the speaker given by name or device ID, oldest first
+func (b *Bus) History(speaker string) []Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if h, ok := b.speakers[speaker]; ok {
+		return append([]Event(nil), h...)
+	}
+	for _, h := range b.speakers {
+		if len(h) > 0 && h[0].Speaker.Name() == speaker {
+			return append([]Event(nil), h...)
+		}
+	}
+	return nil
+}
+
+// Last returns the most recent event of the message type msgType of the speaker given by name
+// or device ID
+func (b *Bus) Last(speaker, msgType string) (Event, bool) {
+	h := b.History(speaker)
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].Type == msgType {
+			return h[i], true
+		}
+	}
+	return Event{}, false
+}
+
+// Subscription is a stream of events matching a filter
+type Subscription struct {
+	filter  Filter
+	ch      chan Event
+	cancel  context.CancelFunc
+	dropped atomic.Int64
+}
+
+// C returns the channel delivering the events. It is closed when the subscription ends.
+func (s *Subscription) C() <-chan Event { return s.ch }
+
+// Cancel ends the subscription
+func (s *Subscription) Cancel() { s.cancel() }
+
+// Dropped returns the number of events missed because the buffer was full
+func (s *Subscription) Dropped() int { return int(s.dropped.Load()) }
+
+// deliver hands e to the subscriber if it matches the filter. It is called with the read lock
+// of the bus held.
+func (s *Subscription) deliver(e Event) {
+	if !s.filter.matches(e) {
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
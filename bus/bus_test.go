@@ -0,0 +1,96 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func speaker(name, deviceID string) soundtouch.Speaker {
+	return soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: name, DeviceID: deviceID}}
+}
+
+func TestBus_Subscribe(t *testing.T) {
+	b := New(0)
+	office, kitchen := speaker("Office", "AA01"), speaker("Kitchen", "AA02")
+
+	all := b.Subscribe(context.Background(), Filter{}, 0)
+	volumes := b.Subscribe(context.Background(), Filter{Speakers: []string{"AA01"}, Types: []string{"Volume"}}, 0)
+
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20}}, office)
+	b.Publish(soundtouch.Update{Value: soundtouch.NowPlaying{}}, office)
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 30}}, kitchen)
+	all.Cancel()
+	volumes.Cancel()
+
+	var got []string
+	for e := range all.C() {
+		got = append(got, e.Speaker.Name()+" "+e.Type)
+	}
+	if len(got) != 3 {
+		t.Errorf("unfiltered subscription received %v, want 3 events", got)
+	}
+
+	got = nil
+	for e := range volumes.C() {
+		got = append(got, e.Speaker.Name()+" "+e.Type)
+	}
+	if len(got) != 1 || got[0] != "Office Volume" {
+		t.Errorf("filtered subscription received %v, want [Office Volume]", got)
+	}
+}
+
+func TestBus_SubscribeFor(t *testing.T) {
+	b := New(0)
+	s := b.SubscribeFor(context.Background(), 20*time.Millisecond, Filter{}, 0)
+
+	select {
+	case _, ok := <-s.C():
+		if ok {
+			t.Errorf("received an event without publishing")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("subscription not ended after its deadline")
+	}
+
+	// publishing after the deadline must not panic on the closed channel
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{}}, speaker("Office", "AA01"))
+}
+
+func TestBus_Dropped(t *testing.T) {
+	b := New(0)
+	s := b.Subscribe(context.Background(), Filter{}, 1)
+	defer s.Cancel()
+
+	for i := 0; i < 3; i++ {
+		b.Publish(soundtouch.Update{Value: soundtouch.Volume{}}, speaker("Office", "AA01"))
+	}
+	if s.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", s.Dropped())
+	}
+}
+
+func TestBus_History(t *testing.T) {
+	b := New(2)
+	office := speaker("Office", "AA01")
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 10}}, office)
+	b.Publish(soundtouch.Update{Value: soundtouch.NowPlaying{}}, office)
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20}}, office)
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 30}}, speaker("Kitchen", "AA02"))
+
+	if h := b.History("Office"); len(h) != 2 || h[0].Type != "NowPlaying" {
+		t.Errorf("History(Office) = %v, want the last 2 events", h)
+	}
+	e, ok := b.Last("AA01", "Volume")
+	if !ok || e.Update.Value.(soundtouch.Volume).TargetVolume != 20 {
+		t.Errorf("Last(AA01, Volume) = %v, %v, want volume 20", e, ok)
+	}
+	if _, ok := b.Last("Office", "ConnectionStateUpdated"); ok {
+		t.Errorf("Last(Office, ConnectionStateUpdated) found an event")
+	}
+	if h := b.History("Bathroom"); h != nil {
+		t.Errorf("History(Bathroom) = %v, want nil", h)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/history"
+)
+
+// historyCmd queries the listening sessions recorded by the history plugin
+type historyCmd struct {
+	Speaker string `help:"name of the speaker"`
+	Artist  string `help:"part of the artist"`
+	From    string `help:"first day, e.g. 2024-03-01"`
+	To      string `help:"last day, e.g. 2024-03-31"`
+	Limit   int    `help:"number of the latest sessions shown, all if 0"`
+}
+
+// Run lists the sessions stored in the file of the [history] section of the config file given
+// by --config matching the query
+func (h *historyCmd) Run() error {
+	tConfig, _, err := readConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	var config history.Config
+	for _, inst := range tConfig.Plugins {
+		if c, ok := inst.Config.(*history.Config); ok {
+			config = *c
+		}
+	}
+	d := history.NewHistory(config)
+
+	q := history.Query{Speaker: h.Speaker, Artist: h.Artist}
+	if h.From != "" {
+		if q.From, err = history.ParseDate(h.From); err != nil {
+			return fmt.Errorf("--from: %v", err)
+		}
+	}
+	if h.To != "" {
+		if q.To, err = history.ParseDate(h.To); err != nil {
+			return fmt.Errorf("--to: %v", err)
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+
+	sessions, err := d.Sessions(q)
+	if err != nil {
+		return err
+	}
+	if h.Limit > 0 && len(sessions) > h.Limit {
+		sessions = sessions[len(sessions)-h.Limit:]
+	}
+	return printSessions(os.Stdout, sessions)
+}
+
+// printSessions writes a table of the sessions followed by their total duration
+func printSessions(w io.Writer, sessions []history.Session) error {
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "No sessions found")
+		return nil
+	}
+	var total time.Duration
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tSPEAKER\tDURATION\tSOURCE\tARTIST\tALBUM/STATION\tTRACK\tPEAK\tENDED BY")
+	for _, s := range sessions {
+		album := s.Album
+		if album == "" {
+			album = s.Station
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Start.Format("2006-01-02 15:04"), s.Speaker,
+			s.Duration.Round(time.Second), s.Source, s.Artist, album, s.Track, s.PeakVolume, s.Reason)
+		total += s.Duration
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d sessions, %v in total\n", len(sessions), total.Round(time.Second))
+	return nil
+}
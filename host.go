@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+const hostName = "Host"
+
+const hostDescription = "Dispatches update messages to the configured plugins"
+
+// stopTimeout is the time a plugin is given to stop
+const stopTimeout = 10 * time.Second
+
+// hosted is a running plugin together with the configuration it has been created from
+type hosted struct {
+	instance *plugins.Instance
+	plugin   *plugins.Supervisor
+	filter   *plugins.Matcher
+}
+
+// host is the only plugin handed to the soundtouch network. It dispatches every update
+// to the configured plugins. This allows to exchange plugins at runtime without
+// restarting the speaker discovery. Every plugin is run by a supervisor, so that a slow or
+// panicking plugin doesn't affect the others.
+type host struct {
+	ctx       context.Context
+	bus       *bus.Bus
+	reconf    sync.Mutex
+	mu        sync.RWMutex
+	plugins   []hosted
+	suspended atomic.Bool
+}
+
+// newHost creates a host without any plugins. Hosted plugins are started with ctx.
+func newHost(ctx context.Context) *host {
+	return &host{ctx: ctx, bus: bus.New(bus.DefaultHistory)}
+}
+
+// Name returns the plugin name
+func (h *host) Name() string { return hostName }
+
+// Description returns a string explaining the purpose of this plugin
+func (h *host) Description() string { return hostDescription }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (h *host) SampleConfig() string { return "" }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (h *host) Terminate() bool { return false }
+
+// Disable temporarely the execution of all plugins
+func (h *host) Disable() { h.suspended.Store(true) }
+
+// Enable temporarely the execution of all plugins
+func (h *host) Enable() { h.suspended.Store(false) }
+
+// IsEnabled returns true if the host is not suspened
+func (h *host) IsEnabled() bool { return !h.suspended.Load() }
+
+// Execute publishes the update on the bus and hands it to all enabled plugins in
+// configuration order whose filter matches the update
+func (h *host) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if metrics.Enabled() && update.Value != nil {
+		metrics.Updates.Inc(speaker.Name(), reflect.TypeOf(update.Value).Name())
+	}
+	h.bus.Publish(update, speaker)
+
+	h.mu.RLock()
+	current := h.plugins
+	h.mu.RUnlock()
+
+	var values *plugins.Values
+	for _, p := range current {
+		if p.plugin.IsEnabled() {
+			if p.filter != nil && values == nil {
+				v := h.values(update, speaker)
+				values = &v
+			}
+			if p.filter == nil || p.filter.Match(*values) {
+				p.plugin.Execute(p.plugin.Name(), update, speaker)
+			}
+		}
+		if p.plugin.Terminate() {
+			return
+		}
+	}
+}
+
+// values returns the values filters are evaluated on. What the speaker plays and its volume
+// are taken from the bus, if the update doesn't tell.
+func (h *host) values(update soundtouch.Update, speaker soundtouch.Speaker) plugins.Values {
+	var np *soundtouch.NowPlaying
+	if e, ok := h.bus.Last(speaker.DeviceID(), "NowPlaying"); ok {
+		if v, ok := e.Update.Value.(soundtouch.NowPlaying); ok {
+			np = &v
+		}
+	}
+	var vol *soundtouch.Volume
+	if e, ok := h.bus.Last(speaker.DeviceID(), "Volume"); ok {
+		if v, ok := e.Update.Value.(soundtouch.Volume); ok {
+			vol = &v
+		}
+	}
+	return plugins.NewValues(update, speaker, np, vol, time.Now())
+}
+
+// Plugins returns the currently running plugins
+func (h *host) Plugins() []soundtouch.Plugin {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	pl := make([]soundtouch.Plugin, len(h.plugins))
+	for i, p := range h.plugins {
+		pl[i] = p.plugin
+	}
+	return pl
+}
+
+// apply replaces the running plugins by the configured instances. Plugins whose
+// configuration did not change are kept running, all other are created anew.
+// The returned diff describes the changes.
+func (h *host) apply(instances []*plugins.Instance) pluginDiff {
+	h.reconf.Lock()
+	defer h.reconf.Unlock()
+
+	h.mu.RLock()
+	current := h.plugins
+	h.mu.RUnlock()
+
+	running := map[string]hosted{}
+	for _, p := range current {
+		running[p.instance.ID()] = p
+	}
+
+	var diff pluginDiff
+	keep := map[string]bool{}
+	for _, inst := range instances {
+		id := inst.ID()
+		old, ok := running[id]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, id)
+		case reflect.DeepEqual(old.instance.Config, inst.Config) &&
+			old.instance.Supervision == inst.Supervision &&
+			reflect.DeepEqual(old.instance.Filter, inst.Filter):
+			diff.Unchanged = append(diff.Unchanged, id)
+			keep[id] = true
+		default:
+			diff.Changed = append(diff.Changed, id)
+		}
+	}
+
+	// retire first, so that replacements don't compete with their predecessors for resources
+	for _, old := range current {
+		if keep[old.instance.ID()] {
+			continue
+		}
+		if !slices.Contains(diff.Changed, old.instance.ID()) {
+			diff.Removed = append(diff.Removed, old.instance.ID())
+		}
+		retire(old)
+	}
+
+	next := make([]hosted, 0, len(instances))
+	for _, inst := range instances {
+		if keep[inst.ID()] {
+			next = append(next, running[inst.ID()])
+			continue
+		}
+		next = append(next, h.start(inst))
+	}
+
+	h.mu.Lock()
+	h.plugins = next
+	h.mu.Unlock()
+	return diff
+}
+
+// shutdown stops all plugins in reverse configuration order. Every plugin is given
+// timeout to stop.
+func (h *host) shutdown(timeout time.Duration) {
+	h.reconf.Lock()
+	defer h.reconf.Unlock()
+
+	h.mu.Lock()
+	current := h.plugins
+	h.plugins = nil
+	h.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"Plugin": hostName,
+	}).Infof("Stopping %d plugins, %v each\n", len(current), timeout)
+
+	for i := len(current) - 1; i >= 0; i-- {
+		stop(current[i], timeout)
+	}
+}
+
+// start creates and starts the plugin configured by inst
+func (h *host) start(inst *plugins.Instance) hosted {
+	p := hosted{instance: inst, plugin: plugins.Supervise(inst.Create(), inst.Supervision)}
+	if !inst.Filter.IsEmpty() {
+		m, err := inst.Filter.Compile()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Plugin": p.plugin.Name(),
+			}).Errorf("Invalid filter. Disabling plugin. %v\n", err)
+			p.plugin.Disable()
+		}
+		p.filter = m
+	}
+	plugins.SetHost(p.plugin, h)
+	plugins.SetBus(p.plugin, h.bus)
+	if err := plugins.Start(h.ctx, p.plugin); err != nil {
+		log.WithFields(log.Fields{
+			"Plugin": p.plugin.Name(),
+		}).Errorf("Failed to start. Disabling plugin. %v\n", err)
+		p.plugin.Disable()
+	}
+	return p
+}
+
+// retire disables and stops a plugin that is no longer hosted
+func retire(p hosted) {
+	p.plugin.Disable()
+	stop(p, stopTimeout)
+}
+
+// stop stops the plugin and waits at most timeout for it
+func stop(p hosted, timeout time.Duration) {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": p.plugin.Name(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		// updates still queued are executed before the plugin is stopped
+		if err := p.plugin.Close(ctx); err != nil {
+			done <- err
+			return
+		}
+		done <- plugins.Stop(ctx, p.plugin)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			mLogger.Errorf("Stopped with error after %v. %v\n", time.Since(started), err)
+			return
+		}
+		mLogger.Infof("Stopped after %v\n", time.Since(started))
+	case <-ctx.Done():
+		mLogger.Warnf("Not stopped within %v. Abandoning.\n", timeout)
+	}
+}
+
+// pluginDiff lists the ids of plugin instances by the way they have been affected by a
+// configuration change
+type pluginDiff struct {
+	Added     []string
+	Removed   []string
+	Changed   []string
+	Unchanged []string
+}
+
+// log writes the diff to the log
+func (d pluginDiff) log() {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": hostName,
+	})
+	mLogger.Infof("Plugins added: %v, removed: %v, changed: %v, unchanged: %v\n",
+		d.Added, d.Removed, d.Changed, d.Unchanged)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func TestHost_apply(t *testing.T) {
+	load := func(config string) tomlConfig {
+		tConfig := tomlConfig{Global: defaultGlobal}
+		if _, err := loadConfig([]byte(config), &tConfig); err != nil {
+			t.Fatalf("loadConfig() error = %v", err)
+		}
+		return tConfig
+	}
+
+	h := newHost(context.Background())
+	diff := h.apply(load(`
+[[logger]]
+alias = "office"
+speakers = ["Office"]
+
+[[logger]]
+alias = "kitchen"
+speakers = ["Kitchen"]
+`).Plugins)
+	if want := []string{"logger.office", "logger.kitchen"}; !reflect.DeepEqual(diff.Added, want) {
+		t.Errorf("apply() added = %v, want %v", diff.Added, want)
+	}
+	office, kitchen := h.Plugins()[0], h.Plugins()[1]
+
+	diff = h.apply(load(`
+[[logger]]
+alias = "office"
+speakers = ["Office"]
+
+[[logger]]
+alias = "kitchen"
+speakers = ["Kitchen", "Office"]
+
+[magicZone]
+`).Plugins)
+
+	want := pluginDiff{
+		Added:     []string{"magicZone"},
+		Changed:   []string{"logger.kitchen"},
+		Unchanged: []string{"logger.office"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("apply() = %+v, want %+v", diff, want)
+	}
+
+	pl := h.Plugins()
+	if len(pl) != 3 {
+		t.Fatalf("Plugins() len = %d, want 3", len(pl))
+	}
+	if pl[0] != office {
+		t.Errorf("apply() recreated unchanged plugin %v", office.Name())
+	}
+	if pl[1] == kitchen || kitchen.IsEnabled() {
+		t.Errorf("apply() kept changed plugin %v", kitchen.Name())
+	}
+
+	diff = h.apply(nil)
+	if want := []string{"logger.office", "logger.kitchen", "magicZone"}; !reflect.DeepEqual(diff.Removed, want) {
+		t.Errorf("apply() removed = %v, want %v", diff.Removed, want)
+	}
+}
+
+// stopRecorder records the order in which plugins are stopped
+type stopRecorder struct {
+	*host
+	name    string
+	stopped *[]string
+	hang    bool
+}
+
+func (s *stopRecorder) Name() string { return s.name }
+
+func (s *stopRecorder) Stop(ctx context.Context) error {
+	if s.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	*s.stopped = append(*s.stopped, s.name)
+	return nil
+}
+
+func TestHost_shutdown(t *testing.T) {
+	var stopped []string
+	h := newHost(context.Background())
+	for _, p := range []*stopRecorder{
+		{host: &host{}, name: "first", stopped: &stopped},
+		{host: &host{}, name: "hanging", stopped: &stopped, hang: true},
+		{host: &host{}, name: "last", stopped: &stopped},
+	} {
+		h.plugins = append(h.plugins, hosted{instance: &plugins.Instance{Section: p.name}, plugin: plugins.Supervise(p, plugins.Supervision{})})
+	}
+
+	start := time.Now()
+	h.shutdown(10 * time.Millisecond)
+
+	if want := []string{"last", "first"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("shutdown() stopped = %v, want %v", stopped, want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown() took %v despite timeout", elapsed)
+	}
+	if len(h.Plugins()) != 0 {
+		t.Errorf("shutdown() left %d plugins", len(h.Plugins()))
+	}
+}
+
+// executeRecorder counts its executions and panics if told so
+type executeRecorder struct {
+	*host
+	name     string
+	executed int
+	panics   bool
+}
+
+func (e *executeRecorder) Name() string { return e.name }
+
+func (e *executeRecorder) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	e.executed++
+	if e.panics {
+		panic("boom")
+	}
+}
+
+func TestHost_Execute(t *testing.T) {
+	metrics.Enable()
+	defer metrics.Disable()
+
+	h := newHost(context.Background())
+	first := &executeRecorder{host: &host{}, name: "first", panics: true}
+	filtered := &executeRecorder{host: &host{}, name: "filtered"}
+	last := &executeRecorder{host: &host{}, name: "last"}
+	for _, p := range []*executeRecorder{first, filtered, last} {
+		h.plugins = append(h.plugins, hosted{instance: &plugins.Instance{Section: p.name}, plugin: plugins.Supervise(p, plugins.Supervision{})})
+	}
+	h.plugins[1].filter, _ = plugins.Filter{Speakers: []string{"Kitchen"}}.Compile()
+
+	speaker := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: "Office"}}
+	h.Execute(hostName, soundtouch.Update{Value: soundtouch.Volume{}}, speaker)
+	// executes the queued updates
+	h.shutdown(time.Second)
+
+	if first.executed != 1 || last.executed != 1 {
+		t.Errorf("Execute() executed first %d, last %d times, want 1", first.executed, last.executed)
+	}
+	if filtered.executed != 0 {
+		t.Errorf("Execute() executed plugin whose filter doesn't match")
+	}
+
+	var b strings.Builder
+	metrics.Write(&b)
+	for _, want := range []string{
+		`soundtouch_updates_total{speaker="Office",type="Volume"} 1`,
+		`soundtouch_plugin_executions_total{plugin="first"} 1`,
+		`soundtouch_plugin_executions_total{plugin="last"} 1`,
+		`soundtouch_plugin_panics_total{plugin="first"} 1`,
+		`soundtouch_plugin_execution_seconds_count{plugin="last"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("metrics missing %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestHost_Disable(t *testing.T) {
+	h := newHost(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			h.Disable()
+			h.Enable()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		h.IsEnabled()
+	}
+	<-done
+	if !h.IsEnabled() {
+		t.Errorf("IsEnabled() = false after Enable()")
+	}
+}
@@ -1,24 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/influxdata/toml"
 	"github.com/jpillora/opts"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/theovassiliou/soundtouch-automation/plugins/autooff"
-	"github.com/theovassiliou/soundtouch-automation/plugins/auxjoin"
-	"github.com/theovassiliou/soundtouch-automation/plugins/episodecollector"
-	"github.com/theovassiliou/soundtouch-automation/plugins/influxconnector"
-	"github.com/theovassiliou/soundtouch-automation/plugins/logger"
-	"github.com/theovassiliou/soundtouch-automation/plugins/magiczone"
-	"github.com/theovassiliou/soundtouch-automation/plugins/telegram"
-	"github.com/theovassiliou/soundtouch-automation/plugins/volumebutler"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/all"
 	"github.com/theovassiliou/soundtouch-golang"
 )
 
@@ -33,10 +30,44 @@ const header = `
 #
 # Plugins must be declared in here to be active.
 # To deactivate a plugin, comment out the name and any variables.
+# A plugin section given as array of tables, e.g. [[logger]], creates one plugin per table.
+# The optional key alias="name" tells these plugins apart.
+#
+# Every plugin runs on its own queue of updates. The optional sub-table supervisor of a plugin
+# section configures it, e.g. for [volumeButler]:
+#   [volumeButler.supervisor]
+#   queue = 16          # updates waiting for the plugin
+#   drop = "oldest"     # if the queue is full drop the "oldest" or "newest" update, or "block"
+#   timeout = "30s"     # time a single execution may take
+#   max_failures = 3    # consecutive panics or timeouts after which the plugin is disabled
+#
+# The optional sub-table filter of a plugin section selects the updates the plugin is executed
+# with. All criteria given have to match, an empty list matches everything, e.g.
+#   [logger.filter]
+#   speakers = ["Office", "Kitchen"]
+#   exclude_speakers = ["Bathroom"]
+#   types = ["Volume", "NowPlaying"]
+#   sources = ["TUNEIN", "SPOTIFY"]     # what the speaker plays, also for Volume updates
+#   artists = ["John Sinclair"]
+#   play_status = ["PLAY_STATE"]
+#   time = ["07:00-09:00", "22:00-02:00"]
+#   expression = 'speaker == "Office" && type == "Volume" && volume > 40'
+# Expressions can use speaker, device_id, type, source, artist, album, track, station,
+# play_status, stream_type, volume, actual_volume, muted, hour and weekday.
+#
+# Plugin sections are reloaded on SIGHUP and whenever this file is modified. Changes of
+# the global section require a restart.
 #
 # Where parameters can be set in the config file, environemnt variables or via command-line flags
 # the order of precedence is as follows: 
 #     defaults < config file < environment variables < command-line flags. 
+#
+# Every value can be overridden by an environment variable named SOUNDTOUCH_<SECTION>_<KEY>,
+# e.g. SOUNDTOUCH_GLOBAL_INTERFACE="eth0" or SOUNDTOUCH_INFLUXDB_INFLUXURL="http://influxdb:8086".
+# Lists are given comma separated. Use --print-effective-config to see the resolved values.
+#
+# Run "masteringsoundtouch validate" to check this file for unknown keys, message types and,
+# with --discover, speaker names. It exits with status 1 if problems have been found.
 
 # Global section contains global, plugin independent parameters
 [global]
@@ -53,46 +84,71 @@ no_of_soundtouch_systems=7
 
 type config struct {
 	global
-	LogLevel     log.Level `help:"Log level, one of panic, fatal, error, warn or warning, info, debug, trace"`
-	SampleConfig bool      `opts:"group=Configuration" help:"If set creates a sample config file that can be used later"`
-	PidFile      []string  `opts:"group=Configuration" help:"Write a PID file, if set"`
-	Config       string    `opts:"group=Soundtouch" help:"configuration file to load"`
+	Interface             stringFlag `opts:"mode=flag,group=Soundtouch" help:"network interface to listen"`
+	NoOfSoundtouchSystems intFlag    `opts:"mode=flag,group=Soundtouch" help:"Number of Soundtouch systems to scan for."`
+	StaticSpeakers        []string   `opts:"group=Soundtouch" help:"A static list of IPs of speakers to handle. Superseeds NoOfSoundtouchSystems if set."`
+	LogLevel              log.Level  `help:"Log level, one of panic, fatal, error, warn or warning, info, debug, trace"`
+	SampleConfig          bool       `opts:"group=Configuration" help:"If set creates a sample config file that can be used later"`
+	PrintEffectiveConfig  bool       `opts:"group=Configuration" help:"If set prints the effective configuration and where each value has been taken from"`
+	PidFile               []string   `opts:"group=Configuration" help:"Write a PID file, if set"`
+	Config                string     `opts:"group=Soundtouch" help:"configuration file to load"`
 }
 
+// global contains the plugin independent parameters of the [global] section
 type global struct {
-	Interface             string   `opts:"group=Soundtouch" help:"network interface to listen"`
-	NoOfSoundtouchSystems int      `opts:"group=Soundtouch" help:"Number of Soundtouch systems to scan for."`
-	StaticSpeakers        []string `opts:"group=Soundtouch" help:"A static list of IPs of speakers to handle. Superseeds NoOfSoundtouchSystems if set."`
+	Interface             string   `toml:"interface"`
+	NoOfSoundtouchSystems int      `toml:"no_of_soundtouch_systems"`
+	StaticSpeakers        []string `toml:"static_speakers"`
 }
+
+// defaultGlobal contains the defaults of the [global] section
+var defaultGlobal = global{
+	Interface:             "en0",
+	NoOfSoundtouchSystems: -1,
+}
+
+// tomlConfig contains the [global] section and every configured plugin section in the order of
+// the config file. Plugin sections are decoded by the plugins registry.
 type tomlConfig struct {
-	Global           global
-	Logger           *logger.Config           `toml:"logger"`
-	EpisodeCollector *episodecollector.Config `toml:"episodeCollector"`
-	MagicZone        *magiczone.Config        `toml:"magicZone"`
-	InfluxDB         *influxconnector.Config  `toml:"influxDB"`
-	VolumeButler     *volumebutler.Config     `toml:"volumeButler"`
-	AutoOff          *autooff.Config          `toml:"autoOff"`
-	Telegram         *telegram.Config         `toml:"telegram"`
-	AuxJoin          *auxjoin.Config          `toml:"auxjoin"`
+	Global  global
+	Plugins []*plugins.Instance
 }
 
 func main() {
 	defer tearDown()
 
-	var tConfig tomlConfig
 	conf = config{
-		global: global{
-			Interface:             "en0",
-			NoOfSoundtouchSystems: -1,
-		},
-		SampleConfig: false,
-		LogLevel:     log.InfoLevel,
-		Config:       "config.toml",
+		Interface:             stringFlag{value: defaultGlobal.Interface},
+		NoOfSoundtouchSystems: intFlag{value: defaultGlobal.NoOfSoundtouchSystems},
+		SampleConfig:          false,
+		LogLevel:              log.InfoLevel,
+		Config:                "config.toml",
 	}
 
 	//parse config
-	opts.New(&conf).
+	po := opts.New(&conf).
 		Version(FormatFullVersion("masteringsoundtouch", version, branch, commit, build)).
+		AddCommand(opts.New(&validateCmd{DiscoveryTimeout: 10 * time.Second}).
+			Name("validate").
+			Summary("Checks the config file and exits with status 1 if it contains problems")).
+		AddCommand(opts.New(&replayCmd{Speed: 1}).
+			Name("replay").
+			Summary("Feeds a recording of the recorder plugin through the configured plugins")).
+		AddCommand(opts.New(&simulateCmd{}).
+			Name("simulate").
+			Summary("Simulates SoundTouch speakers on the local machine")).
+		AddCommand(opts.New(&scheduleCmd{}).
+			Name("schedule").
+			Summary("Lists the jobs of the scheduler and skips their next runs")).
+		AddCommand(opts.New(&sceneCmd{DiscoveryTimeout: 10 * time.Second}).
+			Name("scene").
+			Summary("Lists, captures, restores and deletes scenes of all speakers")).
+		AddCommand(opts.New(&presetsCmd{DiscoveryTimeout: 10 * time.Second}).
+			Name("presets").
+			Summary("Compares, backs up and pushes the presets of all speakers")).
+		AddCommand(opts.New(&historyCmd{}).
+			Name("history").
+			Summary("Lists the listening sessions recorded by the history plugin")).
 		Parse()
 
 	log.SetFormatter(&log.TextFormatter{
@@ -101,59 +157,72 @@ func main() {
 	})
 	log.SetLevel(conf.LogLevel)
 
+	if po.IsRunnable() {
+		if err := po.Run(); err != nil {
+			log.Errorln(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if conf.SampleConfig {
-		printSampleConfig(initPlugins(tConfig, true))
+		printSampleConfig()
 		log.Infoln("Dumped sample config file")
 		os.Exit(0)
 	}
 
-	f, err := os.Open(conf.Config)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	buf, err := io.ReadAll(f)
+	tConfig, prov, err := readConfig(conf.Config)
 	if err != nil {
 		panic(err)
 	}
+	conf.global = tConfig.Global
 
-	if err := toml.Unmarshal(buf, &tConfig); err != nil {
-		panic(err)
+	if conf.PrintEffectiveConfig {
+		printEffectiveConfig(os.Stdout, &tConfig, prov)
+		os.Exit(0)
 	}
 
-	conf.global.NoOfSoundtouchSystems = tConfig.Global.NoOfSoundtouchSystems
-	conf.global.Interface = tConfig.Global.Interface
-	conf.global.StaticSpeakers = tConfig.Global.StaticSpeakers
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	pl := initPlugins(tConfig, false)
+	h := newHost(ctx)
+	h.apply(tConfig.Plugins)
 
 	nConf := soundtouch.NetworkConfig{
 		InterfaceName:     conf.global.Interface,
 		NoOfSystems:       conf.global.NoOfSoundtouchSystems,
 		StaticIPAddresses: conf.global.StaticSpeakers,
-		Plugins:           pl,
+		Plugins:           []soundtouch.Plugin{h},
 	}
 
+	go newReloader(conf.Config, h, conf.global).watch(ctx)
+
 	if conf.PidFile != nil {
 		createPIDFile(conf.PidFile)
 	}
 
 	// SearchDevices does not closes the channel
 	speakerCh := soundtouch.SearchDevices(nConf)
-	for speaker := range speakerCh {
-		log.Infof("Found device %s-%s with IP %s\n", speaker.Name(), speaker.DeviceID(), speaker.IP)
-	}
-
+	go func() {
+		for speaker := range speakerCh {
+			log.Infof("Found device %s-%s with IP %s\n", speaker.Name(), speaker.DeviceID(), speaker.IP)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Infoln("Received termination signal. Shutting down.")
+	h.shutdown(stopTimeout)
 }
 
-func printSampleConfig(pl []soundtouch.Plugin) bool {
+func printSampleConfig() bool {
 	var sampleConfig strings.Builder
 
 	fHeader := fmt.Sprintf(header, FormatFullVersion("masteringsoundtouch", version, branch, commit, build))
 	sampleConfig.WriteString(fHeader)
 
-	for _, aPlugin := range pl {
-		sampleConfig.WriteString(aPlugin.SampleConfig())
+	for _, section := range plugins.Sections() {
+		creator, _ := plugins.Get(section)
+		sampleConfig.WriteString(creator.SampleConfig)
 	}
 
 	fmt.Println(sampleConfig.String())
@@ -185,41 +254,26 @@ func createPIDFile(pidFile []string) {
 	log.Debugf("PID-file %s successfully created", pidFile[0])
 }
 
-func initPlugins(tConfig tomlConfig, mock bool) []soundtouch.Plugin {
-	pl := []soundtouch.Plugin{}
-
-	if tConfig.Logger != nil {
-		pl = append(pl, logger.NewLogger(*tConfig.Logger))
-	}
-
-	if tConfig.EpisodeCollector != nil {
-		pl = append(pl, episodecollector.NewCollector(*tConfig.EpisodeCollector))
-	}
-	if tConfig.MagicZone != nil {
-		pl = append(pl, magiczone.NewCollector(*tConfig.MagicZone))
-	}
-
-	if tConfig.InfluxDB != nil {
-		pl = append(pl, influxconnector.NewLogger(*tConfig.InfluxDB))
-	}
-
-	if tConfig.VolumeButler != nil {
-		pl = append(pl, volumebutler.NewVolumeButler(*tConfig.VolumeButler))
-	}
+// readConfig reads the config file at path and resolves all configuration layers
+func readConfig(path string) (tomlConfig, provenance, error) {
+	tConfig := tomlConfig{Global: defaultGlobal}
 
-	if tConfig.AutoOff != nil {
-		pl = append(pl, autooff.NewObserver(*tConfig.AutoOff))
+	f, err := os.Open(path)
+	if err != nil {
+		return tConfig, nil, err
 	}
-
-	if tConfig.Telegram != nil {
-		pl = append(pl, telegram.NewTelegramLogger(*tConfig.Telegram))
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return tConfig, nil, err
 	}
 
-	if tConfig.AuxJoin != nil {
-		pl = append(pl, auxjoin.NewAuxJoin(*tConfig.AuxJoin))
+	prov, err := loadConfig(buf, &tConfig)
+	if err != nil {
+		return tConfig, prov, err
 	}
-
-	return pl
+	applyFlags(conf, &tConfig.Global, prov)
+	return tConfig, prov, nil
 }
 
 func tearDown() {
@@ -0,0 +1,206 @@
+// Package metrics collects counters and gauges about the automation and writes them in the
+// Prometheus text format. Collecting is disabled until Enable is called. While disabled every
+// recording function returns immediately, so that instrumented code costs nothing unless the
+// metrics are actually served.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var enabled atomic.Bool
+
+// Enable starts collecting metrics
+func Enable() { enabled.Store(true) }
+
+// Disable stops collecting metrics and forgets all collected values
+func Disable() {
+	enabled.Store(false)
+	for _, f := range families {
+		f.reset()
+	}
+}
+
+// Enabled returns true if metrics are collected. Use it to skip preparing values, e.g. taking
+// the time, that would be recorded only.
+func Enabled() bool { return enabled.Load() }
+
+// The metrics of the automation
+var (
+	Updates             = newFamily("soundtouch_updates_total", "Updates received from the speakers.", "counter", "speaker", "type")
+	PluginExecutions    = newFamily("soundtouch_plugin_executions_total", "Executions of a plugin.", "counter", "plugin")
+	PluginDuration      = newFamily("soundtouch_plugin_execution_seconds", "Time spent executing a plugin.", "summary", "plugin")
+	PluginPanics        = newFamily("soundtouch_plugin_panics_total", "Executions of a plugin that panicked.", "counter", "plugin")
+	PluginTimeouts      = newFamily("soundtouch_plugin_timeouts_total", "Executions of a plugin that exceeded the timeout.", "counter", "plugin")
+	Dropped             = newFamily("soundtouch_plugin_dropped_updates_total", "Updates dropped because the queue of a plugin was full.", "counter", "plugin")
+	PluginEnabled       = newFamily("soundtouch_plugin_enabled", "1 if the plugin is enabled, 0 if it is suspended.", "gauge", "plugin")
+	Actions             = newFamily("soundtouch_plugin_actions_total", "Commands a plugin sent to the speakers.", "counter", "plugin", "action")
+	SpeakerAlive        = newFamily("soundtouch_speaker_alive", "1 if the speaker is alive.", "gauge", "speaker")
+	SpeakerPoweredOn    = newFamily("soundtouch_speaker_powered_on", "1 if the speaker is powered on.", "gauge", "speaker")
+	ZoneMembers         = newFamily("soundtouch_zone_members", "Number of speakers in the zone of a master.", "gauge", "master")
+	InfluxWriteFailures = newFamily("soundtouch_influxdb_write_failures", "Consecutive failed writes to InfluxDB.", "gauge", "plugin")
+)
+
+var families []*Family
+
+// Family is a metric with a value per combination of label values
+type Family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a family for one combination of label values. Summaries use sum and
+// count only.
+type series struct {
+	labelValues []string
+	value       float64
+	sum         float64
+	count       uint64
+}
+
+func newFamily(name, help, kind string, labels ...string) *Family {
+	f := &Family{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	families = append(families, f)
+	return f
+}
+
+// Inc increments the counter for the label values by one
+func (f *Family) Inc(labelValues ...string) { f.Add(1, labelValues...) }
+
+// Add adds v to the counter for the label values
+func (f *Family) Add(v float64, labelValues ...string) {
+	if !enabled.Load() {
+		return
+	}
+	f.with(func(s *series) { s.value += v }, labelValues)
+}
+
+// Set sets the gauge for the label values to v
+func (f *Family) Set(v float64, labelValues ...string) {
+	if !enabled.Load() {
+		return
+	}
+	f.with(func(s *series) { s.value = v }, labelValues)
+}
+
+// SetBool sets the gauge for the label values to 1 if b is true, 0 otherwise
+func (f *Family) SetBool(b bool, labelValues ...string) {
+	v := 0.0
+	if b {
+		v = 1
+	}
+	f.Set(v, labelValues...)
+}
+
+// Observe adds the observation v to the summary for the label values
+func (f *Family) Observe(v float64, labelValues ...string) {
+	if !enabled.Load() {
+		return
+	}
+	f.with(func(s *series) {
+		s.sum += v
+		s.count++
+	}, labelValues)
+}
+
+// Reset forgets all values of the family. Gauges that are collected anew on every scrape
+// are reset first, so that vanished speakers and zones disappear.
+func (f *Family) Reset() { f.reset() }
+
+func (f *Family) reset() {
+	f.mu.Lock()
+	f.series = map[string]*series{}
+	f.mu.Unlock()
+}
+
+func (f *Family) with(fn func(*series), labelValues []string) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Write writes all metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *Family) write(b *strings.Builder) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		cp := *s
+		all = append(all, &cp)
+	}
+	f.mu.Unlock()
+
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range all {
+		labels := f.formatLabels(s.labelValues)
+		if f.kind == "summary" {
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels, formatValue(s.sum))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels, s.count)
+			continue
+		}
+		fmt.Fprintf(b, "%s%s %s\n", f.name, labels, formatValue(s.value))
+	}
+}
+
+func (f *Family) formatLabels(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = f.labels[i] + `="` + escape(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string { return escaper.Replace(v) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
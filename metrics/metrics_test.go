@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	Enable()
+	defer Disable()
+
+	Updates.Inc("Küche", "Volume")
+	Updates.Inc("Küche", "Volume")
+	Updates.Inc("Office \"2\"", "NowPlaying")
+	PluginDuration.Observe(0.25, "Logger")
+	PluginDuration.Observe(0.5, "Logger")
+	SpeakerAlive.SetBool(true, "Office")
+
+	var b strings.Builder
+	if err := Write(&b); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	want := `# HELP soundtouch_updates_total Updates received from the speakers.
+# TYPE soundtouch_updates_total counter
+soundtouch_updates_total{speaker="Küche",type="Volume"} 2
+soundtouch_updates_total{speaker="Office \"2\"",type="NowPlaying"} 1
+# HELP soundtouch_plugin_execution_seconds Time spent executing a plugin.
+# TYPE soundtouch_plugin_execution_seconds summary
+soundtouch_plugin_execution_seconds_sum{plugin="Logger"} 0.75
+soundtouch_plugin_execution_seconds_count{plugin="Logger"} 2
+# HELP soundtouch_speaker_alive 1 if the speaker is alive.
+# TYPE soundtouch_speaker_alive gauge
+soundtouch_speaker_alive{speaker="Office"} 1
+`
+	if b.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	Updates.Inc("Office", "Volume")
+	PluginDuration.Observe(1, "Logger")
+
+	var b strings.Builder
+	Write(&b)
+	if b.String() != "" {
+		t.Errorf("Write() while disabled =\n%s", b.String())
+	}
+}
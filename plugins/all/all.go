@@ -0,0 +1,25 @@
+// Package all registers all plugins shipped with masteringsoundtouch
+package all
+
+import (
+	// Blank imports for plugins to register themselves
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/api"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/autooff"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/auxjoin"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/episodecollector"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/history"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/influxconnector"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/logger"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/magiczone"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/presets"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/prometheus"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/recorder"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/rules"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/scenes"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/scheduler"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/scrobbler"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/sleeptimer"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/telegram"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/volumebutler"
+	_ "github.com/theovassiliou/soundtouch-automation/plugins/volumepolicy"
+)
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "API"
+
+const description = "Serves a REST API to control speakers, zones and plugins"
+
+const sampleConfig = `
+## Enabling the REST API
+# [api]
+
+## address the server listens on. Listen on ":8080" to serve other hosts as well.
+# listen = "127.0.0.1:8080"
+
+## token clients have to present as "Authorization: Bearer <token>" header, or as
+## query parameter token for /updates. No authentication if empty.
+# token = ""
+
+## number of updates buffered for each subscriber of /updates. Subscribers
+## falling further behind are dropped.
+# feed_buffer = 64
+
+`
+
+func init() {
+	plugins.Add("api", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewAPI(*config.(*Config)) },
+	})
+}
+
+// Config contains the configuration of the plugin
+// Listen the address the server listens on, 127.0.0.1:8080 if empty
+// Token the token clients have to present, no authentication if empty
+// FeedBuffer the number of updates buffered for each subscriber, 64 if not set
+type Config struct {
+	Listen     string `toml:"listen"`
+	Token      string `toml:"token"`
+	FeedBuffer int    `toml:"feed_buffer"`
+}
+
+// API describes the plugin. It has a
+// Config to store the configuration
+// host to access the hosted plugins
+// speakers the speakers controlled
+// server serving the api
+// feed rebroadcasting the updates
+// suspended indicates that the plugin is temporarely suspended
+type API struct {
+	Config
+	host      plugins.Host
+	speakers  plugins.Speakers
+	server    *http.Server
+	feed      *feed
+	suspended atomic.Bool
+}
+
+// NewAPI creates a new API plugin with the configuration
+func NewAPI(config Config) (d *API) {
+	d = &API{speakers: plugins.Discovered{}}
+	d.Config = config
+	if d.Listen == "" {
+		d.Listen = "127.0.0.1:8080"
+	}
+	if d.FeedBuffer <= 0 {
+		d.FeedBuffer = 64
+	}
+	d.feed = newFeed(d.FeedBuffer)
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	mLogger.Debugf("Initialised\n")
+
+	return d
+}
+
+// Name returns the plugin name
+func (d *API) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *API) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *API) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *API) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *API) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *API) Enable() { d.suspended.Store(false) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *API) IsEnabled() bool { return !d.suspended.Load() }
+
+// Execute runs the plugin with the given parameter
+func (d *API) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	d.feed.publish(update, speaker)
+}
+
+// SetHost gives the api access to the hosted plugins
+func (d *API) SetHost(h plugins.Host) { d.host = h }
+
+// Start starts serving the api
+func (d *API) Start(ctx context.Context) error {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	l, err := net.Listen("tcp", d.Listen)
+	if err != nil {
+		return err
+	}
+	d.server = &http.Server{Handler: d.router()}
+	if d.Token == "" && !isLoopback(l.Addr()) {
+		mLogger.Warnf("Serving %s without token. Anyone on the network may control the speakers\n", l.Addr())
+	}
+
+	go func() {
+		mLogger.Infof("Listening on %s\n", l.Addr())
+		if err := d.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			mLogger.Errorf("Serving failed. %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// Stop finishes the pending requests, drops all subscribers and stops serving the api
+func (d *API) Stop(ctx context.Context) error {
+	d.feed.close()
+	if d.server == nil {
+		return nil
+	}
+	return d.server.Shutdown(ctx)
+}
+
+// router returns the routes of the api
+func (d *API) router() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery(), logRequests, d.guard)
+
+	r.GET("/devices", d.listDevices)
+	r.GET("/devices/:speaker", d.withSpeaker(d.getDevice))
+	r.GET("/devices/:speaker/now_playing", d.withSpeaker(d.getNowPlaying))
+	r.GET("/devices/:speaker/volume", d.withSpeaker(d.getVolume))
+	r.PUT("/devices/:speaker/volume", d.withSpeaker(d.setVolume))
+	r.GET("/devices/:speaker/zone", d.withSpeaker(d.getZone))
+	r.POST("/devices/:speaker/power_on", d.withSpeaker(d.powerOn))
+	r.POST("/devices/:speaker/power_off", d.withSpeaker(d.powerOff))
+
+	r.POST("/zones", d.createZone)
+	r.DELETE("/zones/:speaker", d.withSpeaker(d.dissolveZone))
+
+	r.GET("/updates", d.serveUpdates)
+
+	r.GET("/plugins", d.listPlugins)
+	r.POST("/plugins/:plugin/enable", d.withPlugin(d.enablePlugin))
+	r.POST("/plugins/:plugin/disable", d.withPlugin(d.disablePlugin))
+	return r
+}
+
+// guard rejects requests without the configured token and changes a browser could send from
+// any website without preflight, i.e. those not declaring a JSON body
+func (d *API) guard(c *gin.Context) {
+	if d.Token != "" && !d.authorized(c) {
+		abort(c, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type")); mt != "application/json" {
+		abort(c, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+	}
+}
+
+// authorized returns true if the request presents the token as bearer token. Websocket clients
+// can't set headers, so /updates takes the query parameter token as well.
+func (d *API) authorized(c *gin.Context) bool {
+	given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok && c.FullPath() == "/updates" {
+		given = c.Query("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(d.Token)) == 1
+}
+
+// isLoopback returns true if addr is only reachable from this host
+func isLoopback(addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	return ok && a.IP.IsLoopback()
+}
+
+// logRequests logs every request with its status and duration
+func logRequests(c *gin.Context) {
+	started := time.Now()
+	c.Next()
+	log.WithFields(log.Fields{
+		"Plugin": name,
+	}).Debugf("%s %s %d %v\n", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), time.Since(started))
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/logger"
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+type fakeHost []soundtouch.Plugin
+
+func (h fakeHost) Plugins() []soundtouch.Plugin { return h }
+
+func serve(d *API, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	d.router().ServeHTTP(w, req)
+	return w
+}
+
+func TestAPI_plugins(t *testing.T) {
+	l := logger.NewLogger(logger.Config{})
+	d := NewAPI(Config{})
+	d.SetHost(fakeHost{l, d})
+
+	w := serve(d, http.MethodPost, "/plugins/Logger/disable", "")
+	if w.Code != http.StatusOK || l.IsEnabled() {
+		t.Fatalf("POST /plugins/Logger/disable = %d, enabled %v", w.Code, l.IsEnabled())
+	}
+
+	w = serve(d, http.MethodGet, "/plugins", "")
+	var got []plugin
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /plugins returned %q: %v", w.Body.String(), err)
+	}
+	want := []plugin{
+		{Name: "Logger", Description: l.Description(), Enabled: false},
+		{Name: "API", Description: description, Enabled: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /plugins = %v, want %v", got, want)
+	}
+
+	w = serve(d, http.MethodPost, "/plugins/Logger/enable", "")
+	if w.Code != http.StatusOK || !l.IsEnabled() {
+		t.Errorf("POST /plugins/Logger/enable = %d, enabled %v", w.Code, l.IsEnabled())
+	}
+}
+
+func TestAPI_notFound(t *testing.T) {
+	d := NewAPI(Config{})
+	d.SetHost(fakeHost{})
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/plugins/Unknown/enable", "", http.StatusNotFound},
+		{http.MethodGet, "/devices/Unknown/now_playing", "", http.StatusNotFound},
+		{http.MethodPut, "/devices/Unknown/volume", `{"volume": 20}`, http.StatusNotFound},
+		{http.MethodPost, "/zones", `{"master": "Unknown", "slaves": ["Kitchen"]}`, http.StatusNotFound},
+		{http.MethodPost, "/zones", `{"slaves": ["Kitchen"]}`, http.StatusBadRequest},
+		{http.MethodDelete, "/zones/Unknown", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if w := serve(d, tt.method, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPI_devices(t *testing.T) {
+	n := simulatortest.Simulate(t, "Office", "Kitchen")
+	office, kitchen := n.Device("Office"), n.Device("Kitchen")
+	d := NewAPI(Config{})
+	d.speakers = n
+
+	w := serve(d, http.MethodGet, "/devices", "")
+	var devices []device
+	if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil {
+		t.Fatalf("GET /devices returned %q: %v", w.Body.String(), err)
+	}
+	var names []string
+	for _, dev := range devices {
+		names = append(names, dev.Name)
+	}
+	if want := []string{"Kitchen", "Office"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("GET /devices = %v, want %v", names, want)
+	}
+
+	w = serve(d, http.MethodGet, "/devices/"+office.DeviceID, "")
+	var got device
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Name != "Office" {
+		t.Errorf("GET /devices/<device ID of Office> = %d %q, want Office", w.Code, w.Body.String())
+	}
+
+	if w := serve(d, http.MethodPut, "/devices/Office/volume", `{"volume": 120}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /devices/Office/volume 120 = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serve(d, http.MethodPut, "/devices/Office/volume", `{"volume": 35}`); w.Code != http.StatusNoContent {
+		t.Errorf("PUT /devices/Office/volume = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if v := office.Volume().TargetVolume; v != 35 {
+		t.Errorf("volume of Office %d, want 35", v)
+	}
+
+	if w := serve(d, http.MethodPost, "/devices/Kitchen/power_on", ""); w.Code != http.StatusNoContent || !kitchen.IsPoweredOn() {
+		t.Errorf("POST /devices/Kitchen/power_on = %d, powered on %v", w.Code, kitchen.IsPoweredOn())
+	}
+	if w := serve(d, http.MethodPost, "/devices/Kitchen/power_off", ""); w.Code != http.StatusNoContent || kitchen.IsPoweredOn() {
+		t.Errorf("POST /devices/Kitchen/power_off = %d, powered on %v", w.Code, kitchen.IsPoweredOn())
+	}
+}
+
+func TestAPI_zones(t *testing.T) {
+	n := simulatortest.Simulate(t, "Office", "Kitchen")
+	office, kitchen := n.Device("Office"), n.Device("Kitchen")
+	office.Play(simulator.NowPlaying{Source: "TUNEIN"})
+	d := NewAPI(Config{})
+	d.speakers = n
+
+	if w := serve(d, http.MethodDelete, "/zones/Office", ""); w.Code != http.StatusConflict {
+		t.Errorf("DELETE /zones/Office without zone = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serve(d, http.MethodPost, "/zones", `{"master": "Office", "slaves": ["Kitchen"]}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST /zones = %d %q, want %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if z := kitchen.Zone(); z.Master != office.DeviceID {
+		t.Errorf("master of the zone of Kitchen %q, want Office %q", z.Master, office.DeviceID)
+	}
+
+	w := serve(d, http.MethodGet, "/devices/Office/zone", "")
+	var zone soundtouch.Zone
+	if err := json.Unmarshal(w.Body.Bytes(), &zone); err != nil || zone.Master != office.DeviceID || len(zone.Members) == 0 {
+		t.Errorf("GET /devices/Office/zone = %d %q, want the zone of Office", w.Code, w.Body.String())
+	}
+
+	if w := serve(d, http.MethodDelete, "/zones/Kitchen", ""); w.Code != http.StatusConflict {
+		t.Errorf("DELETE /zones/Kitchen of a slave = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serve(d, http.MethodDelete, "/zones/Office", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /zones/Office = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if z := kitchen.Zone(); len(z.Members) > 0 {
+		t.Errorf("zone of Kitchen %v after dissolving it, want none", z)
+	}
+}
+
+func TestAPI_guard(t *testing.T) {
+	d := NewAPI(Config{Token: "secret"})
+	d.SetHost(fakeHost{d})
+
+	tests := []struct {
+		name, method, path, contentType, auth string
+		want                                  int
+	}{
+		{"no token", http.MethodGet, "/plugins", "", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/plugins", "", "Bearer guess", http.StatusUnauthorized},
+		{"token", http.MethodGet, "/plugins", "", "Bearer secret", http.StatusOK},
+		{"query token", http.MethodGet, "/plugins?token=secret", "", "", http.StatusUnauthorized},
+		{"feed query token", http.MethodGet, "/updates?token=secret", "", "", http.StatusBadRequest}, // no websocket handshake
+		{"bodyless post", http.MethodPost, "/plugins/API/enable", "", "Bearer secret", http.StatusUnsupportedMediaType},
+		{"form post", http.MethodPost, "/plugins/API/enable", "application/x-www-form-urlencoded", "Bearer secret", http.StatusUnsupportedMediaType},
+		{"text post", http.MethodPost, "/plugins/API/enable", "text/plain", "Bearer secret", http.StatusUnsupportedMediaType},
+		{"json post", http.MethodPost, "/plugins/API/enable", "application/json; charset=utf-8", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			d.router().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
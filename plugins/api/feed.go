@@ -0,0 +1,168 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// writeTimeout is the time a subscriber is given to receive a single message
+const writeTimeout = 10 * time.Second
+
+// message is an update as sent to the subscribers
+type message struct {
+	Speaker  string      `json:"speaker"`
+	DeviceID string      `json:"deviceID"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value"`
+}
+
+// subscriber receives the updates of the speakers and types it is interested in. All if empty.
+type subscriber struct {
+	speakers []string
+	types    []string
+	ch       chan message
+}
+
+func (s *subscriber) wants(m message) bool {
+	return (len(s.speakers) == 0 || slices.Contains(s.speakers, m.Speaker) || slices.Contains(s.speakers, m.DeviceID)) &&
+		(len(s.types) == 0 || slices.Contains(s.types, m.Type))
+}
+
+// feed rebroadcasts updates to any number of subscribers. Every subscriber has a buffer of
+// size messages. A subscriber that lets its buffer overflow is dropped, so that slow
+// subscribers never block the plugins.
+type feed struct {
+	size        int
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+func newFeed(size int) *feed {
+	return &feed{size: size, subscribers: map[*subscriber]bool{}}
+}
+
+// subscribe adds a subscriber for speakers and types
+func (f *feed) subscribe(speakers, types []string) *subscriber {
+	s := &subscriber{speakers: speakers, types: types, ch: make(chan message, f.size)}
+	f.mu.Lock()
+	f.subscribers[s] = true
+	f.mu.Unlock()
+	return s
+}
+
+// unsubscribe removes s and closes its channel, if not already done
+func (f *feed) unsubscribe(s *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop(s)
+}
+
+// drop expects f.mu to be locked
+func (f *feed) drop(s *subscriber) {
+	if f.subscribers[s] {
+		delete(f.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// publish sends the update to every interested subscriber without blocking
+func (f *feed) publish(update soundtouch.Update, speaker soundtouch.Speaker) {
+	m := message{
+		Speaker:  speaker.Name(),
+		DeviceID: speaker.DeviceID(),
+		Value:    update.Value,
+	}
+	if update.Value != nil {
+		m.Type = reflect.TypeOf(update.Value).Name()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subscribers {
+		if !s.wants(m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			log.WithFields(log.Fields{
+				"Plugin": name,
+			}).Warnf("Subscriber too slow. Dropping after %d pending updates.\n", f.size)
+			f.drop(s)
+		}
+	}
+}
+
+// close drops all subscribers
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subscribers {
+		f.drop(s)
+	}
+}
+
+// checkOrigin accepts websocket handshakes of pages served by the host of the api. Otherwise any
+// website could read the updates through the browser of the user. As guard checked the token
+// already, dashboards served from anywhere are accepted if a token is configured. Clients other
+// than browsers send no Origin.
+func (d *API) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || d.Token != "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// serveUpdates streams the updates to a websocket client. The query parameters speaker and
+// type, both repeatable, restrict the updates sent.
+func (d *API) serveUpdates(c *gin.Context) {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	upgrader := websocket.Upgrader{CheckOrigin: d.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		mLogger.Errorf("Upgrading to websocket failed. %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	s := d.feed.subscribe(c.QueryArray("speaker"), c.QueryArray("type"))
+	defer d.feed.unsubscribe(s)
+	mLogger.Infof("%s subscribed to updates of speakers %v, types %v\n", c.ClientIP(), s.speakers, s.types)
+
+	// the client is not expected to send anything. Reading detects when it is gone.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				d.feed.unsubscribe(s)
+				return
+			}
+		}
+	}()
+
+	for m := range s.ch {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := conn.WriteJSON(m); err != nil {
+			mLogger.Debugf("Writing to %s failed. %v\n", c.ClientIP(), err)
+			return
+		}
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "unsubscribed"),
+		time.Now().Add(writeTimeout))
+	mLogger.Infof("%s unsubscribed\n", c.ClientIP())
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func speaker(name string) soundtouch.Speaker {
+	return soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: name, DeviceID: "ID-" + name}}
+}
+
+// subscribers returns the number of subscribers once it equals n or after a second
+func subscribers(f *feed, n int) int {
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		got := len(f.subscribers)
+		f.mu.Unlock()
+		if got == n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAPI_serveUpdates(t *testing.T) {
+	d := NewAPI(Config{})
+	ts := httptest.NewServer(d.router())
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/updates?speaker=Office&type=Volume"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if got := subscribers(d.feed, 1); got != 1 {
+		t.Fatalf("subscribers = %d, want 1", got)
+	}
+
+	d.Execute("API", soundtouch.Update{Value: soundtouch.NowPlaying{Artist: "Artist"}}, speaker("Office"))
+	d.Execute("API", soundtouch.Update{Value: soundtouch.Volume{ActualVolume: 10}}, speaker("Kitchen"))
+	d.Execute("API", soundtouch.Update{Value: soundtouch.Volume{ActualVolume: 20}}, speaker("Office"))
+
+	var got struct {
+		Speaker  string `json:"speaker"`
+		DeviceID string `json:"deviceID"`
+		Type     string `json:"type"`
+		Value    struct {
+			ActualVolume int
+		} `json:"value"`
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&got); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if got.Speaker != "Office" || got.DeviceID != "ID-Office" || got.Type != "Volume" || got.Value.ActualVolume != 20 {
+		t.Errorf("ReadJSON() = %+v, want Volume 20 of Office", got)
+	}
+
+	d.Stop(context.Background())
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("ReadMessage() after Stop error = %v, want close", err)
+	}
+}
+
+func TestFeed_dropsSlowSubscriber(t *testing.T) {
+	f := newFeed(2)
+	slow := f.subscribe(nil, nil)
+	other := f.subscribe([]string{"Kitchen"}, nil)
+
+	for i := 0; i < 3; i++ {
+		f.publish(soundtouch.Update{Value: soundtouch.Volume{ActualVolume: i}}, speaker("Office"))
+	}
+
+	if got := subscribers(f, 1); got != 1 {
+		t.Fatalf("subscribers = %d, want 1", got)
+	}
+	if len(slow.ch) != 2 {
+		t.Errorf("slow subscriber received %d updates, want 2", len(slow.ch))
+	}
+	<-slow.ch
+	<-slow.ch
+	if _, open := <-slow.ch; open {
+		t.Errorf("channel of slow subscriber not closed")
+	}
+	if len(other.ch) != 0 {
+		t.Errorf("filtered subscriber received %d updates, want 0", len(other.ch))
+	}
+	f.unsubscribe(slow)
+}
+
+func TestAPI_checkOrigin(t *testing.T) {
+	tests := []struct {
+		name, token, origin string
+		want                bool
+	}{
+		{"no browser", "", "", true},
+		{"same host", "", "http://automator:8080", true},
+		{"other site", "", "https://example.com", false},
+		{"other site with token", "secret", "https://example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://automator:8080/updates", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := NewAPI(Config{Token: tt.token}).checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin() of %q = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// device is the summary of a speaker as returned by the api
+type device struct {
+	Name      string `json:"name"`
+	DeviceID  string `json:"deviceID"`
+	IP        string `json:"ip"`
+	Alive     bool   `json:"alive"`
+	PoweredOn bool   `json:"poweredOn"`
+}
+
+// plugin is the state of a hosted plugin as returned by the api
+type plugin struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// volumeRequest is the body of a request setting the volume
+type volumeRequest struct {
+	Volume *int `json:"volume" binding:"required"`
+}
+
+// zoneRequest is the body of a request creating a zone
+type zoneRequest struct {
+	Master string   `json:"master" binding:"required"`
+	Slaves []string `json:"slaves" binding:"required"`
+}
+
+func newDevice(s *soundtouch.Speaker) device {
+	return device{
+		Name:      s.Name(),
+		DeviceID:  s.DeviceID(),
+		IP:        s.IP.String(),
+		Alive:     s.IsAlive(),
+		PoweredOn: s.IsPoweredOn(),
+	}
+}
+
+// abort ends the request with status and err as message
+func abort(c *gin.Context, status int, err error) {
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// lookupSpeaker returns the known speaker with the name or device id
+func (d *API) lookupSpeaker(nameOrID string) *soundtouch.Speaker {
+	for _, s := range d.speakers.Known() {
+		if s.Name() == nameOrID || s.DeviceID() == nameOrID {
+			return s
+		}
+	}
+	return nil
+}
+
+// withSpeaker resolves the path parameter speaker and passes the speaker to handler
+func (d *API) withSpeaker(handler func(c *gin.Context, s *soundtouch.Speaker)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := d.lookupSpeaker(c.Param("speaker"))
+		if s == nil {
+			abort(c, http.StatusNotFound, fmt.Errorf("unknown speaker %s", c.Param("speaker")))
+			return
+		}
+		handler(c, s)
+	}
+}
+
+// withPlugin resolves the path parameter plugin and passes the plugin to handler
+func (d *API) withPlugin(handler func(c *gin.Context, p soundtouch.Plugin)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d.host != nil {
+			for _, p := range d.host.Plugins() {
+				if p.Name() == c.Param("plugin") {
+					handler(c, p)
+					return
+				}
+			}
+		}
+		abort(c, http.StatusNotFound, fmt.Errorf("unknown plugin %s", c.Param("plugin")))
+	}
+}
+
+func (d *API) listDevices(c *gin.Context) {
+	devices := []device{}
+	for _, s := range d.speakers.Known() {
+		devices = append(devices, newDevice(s))
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	c.JSON(http.StatusOK, devices)
+}
+
+func (d *API) getDevice(c *gin.Context, s *soundtouch.Speaker) {
+	c.JSON(http.StatusOK, newDevice(s))
+}
+
+func (d *API) getNowPlaying(c *gin.Context, s *soundtouch.Speaker) {
+	np, err := s.NowPlaying()
+	if err != nil {
+		abort(c, http.StatusBadGateway, err)
+		return
+	}
+	c.JSON(http.StatusOK, np)
+}
+
+func (d *API) getVolume(c *gin.Context, s *soundtouch.Speaker) {
+	v, err := s.Volume()
+	if err != nil {
+		abort(c, http.StatusBadGateway, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+func (d *API) setVolume(c *gin.Context, s *soundtouch.Speaker) {
+	var req volumeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, http.StatusBadRequest, err)
+		return
+	}
+	if *req.Volume < 0 || *req.Volume > 100 {
+		abort(c, http.StatusBadRequest, fmt.Errorf("volume %d not within 0..100", *req.Volume))
+		return
+	}
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Name(),
+	}).Infof("Setting volume to %d\n", *req.Volume)
+	s.SetVolume(*req.Volume)
+	metrics.Actions.Inc(name, "SetVolume")
+	c.Status(http.StatusNoContent)
+}
+
+func (d *API) getZone(c *gin.Context, s *soundtouch.Speaker) {
+	z, err := s.GetZone()
+	if err != nil {
+		abort(c, http.StatusBadGateway, err)
+		return
+	}
+	c.JSON(http.StatusOK, z)
+}
+
+func (d *API) powerOn(c *gin.Context, s *soundtouch.Speaker) {
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Name(),
+	}).Infof("Powering on\n")
+	s.PowerOn()
+	metrics.Actions.Inc(name, "PowerOn")
+	c.Status(http.StatusNoContent)
+}
+
+func (d *API) powerOff(c *gin.Context, s *soundtouch.Speaker) {
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Name(),
+	}).Infof("Powering off\n")
+	s.PowerOff()
+	metrics.Actions.Inc(name, "PowerOff")
+	c.Status(http.StatusNoContent)
+}
+
+func (d *API) createZone(c *gin.Context) {
+	var req zoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, http.StatusBadRequest, err)
+		return
+	}
+	master := d.lookupSpeaker(req.Master)
+	if master == nil {
+		abort(c, http.StatusNotFound, fmt.Errorf("unknown speaker %s", req.Master))
+		return
+	}
+	slaves := make([]soundtouch.Speaker, 0, len(req.Slaves))
+	for _, n := range req.Slaves {
+		s := d.lookupSpeaker(n)
+		if s == nil {
+			abort(c, http.StatusNotFound, fmt.Errorf("unknown speaker %s", n))
+			return
+		}
+		slaves = append(slaves, *s)
+	}
+
+	zone := soundtouch.NewZone(*master, slaves...)
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": master.Name(),
+	}).Infof("Creating new zone with %v as master.\n", zone.Master)
+	master.SetZone(zone)
+	metrics.Actions.Inc(name, "SetZone")
+	c.JSON(http.StatusCreated, zone)
+}
+
+func (d *API) dissolveZone(c *gin.Context, s *soundtouch.Speaker) {
+	zone, err := s.GetZone()
+	if err != nil {
+		abort(c, http.StatusBadGateway, err)
+		return
+	}
+	if zone.Master != s.DeviceID() {
+		abort(c, http.StatusConflict, fmt.Errorf("%s is no zone master", s.Name()))
+		return
+	}
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Name(),
+	}).Infof("Dissolving zone\n")
+	s.RemoveZoneSlave(zone)
+	metrics.Actions.Inc(name, "RemoveZoneSlave")
+	c.Status(http.StatusNoContent)
+}
+
+func (d *API) listPlugins(c *gin.Context) {
+	pl := []plugin{}
+	if d.host != nil {
+		for _, p := range d.host.Plugins() {
+			pl = append(pl, plugin{Name: p.Name(), Description: p.Description(), Enabled: p.IsEnabled()})
+		}
+	}
+	c.JSON(http.StatusOK, pl)
+}
+
+func (d *API) enablePlugin(c *gin.Context, p soundtouch.Plugin) {
+	log.WithFields(log.Fields{
+		"Plugin": name,
+	}).Infof("Enabling %s\n", p.Name())
+	p.Enable()
+	c.JSON(http.StatusOK, plugin{Name: p.Name(), Description: p.Description(), Enabled: p.IsEnabled()})
+}
+
+func (d *API) disablePlugin(c *gin.Context, p soundtouch.Plugin) {
+	log.WithFields(log.Fields{
+		"Plugin": name,
+	}).Infof("Disabling %s\n", p.Name())
+	p.Disable()
+	c.JSON(http.StatusOK, plugin{Name: p.Name(), Description: p.Description(), Enabled: p.IsEnabled()})
+}
@@ -2,8 +2,12 @@ package autooff
 
 import (
 	"reflect"
+	"sort"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 )
 
@@ -23,25 +27,51 @@ const sampleConfig = `
 
 `
 
+func init() {
+	plugins.Add("autoOff", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewObserver(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Groups list of Actions.
 type Config map[string]struct {
 	ThenOff []string `toml:"thenOff"`
 }
 
+// References returns the observed speakers and the speakers they switch off
+func (c *Config) References() plugins.References {
+	observed := make([]string, 0, len(*c))
+	for speaker := range *c {
+		observed = append(observed, speaker)
+	}
+	sort.Strings(observed)
+
+	var r plugins.References
+	for _, speaker := range observed {
+		r.Speakers = append(r.Speakers, speaker)
+		r.Speakers = append(r.Speakers, (*c)[speaker].ThenOff...)
+	}
+	return r
+}
+
 // AutoOff describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
 // suspended indicates that the plugin is temporarely suspended
+// speakers looks up the speakers to switch off
 type AutoOff struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
+	speakers  plugins.Speakers
 }
 
 // NewObserver creates a new Collector plugin with the configuration
 func NewObserver(config Config) (d *AutoOff) {
-	d = &AutoOff{}
+	d = &AutoOff{speakers: plugins.Discovered{}}
 	d.Config = config
 
 	mLogger := log.WithFields(log.Fields{
@@ -68,13 +98,13 @@ func (d *AutoOff) SampleConfig() string { return sampleConfig }
 func (d *AutoOff) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *AutoOff) Disable() { d.suspended = true }
+func (d *AutoOff) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *AutoOff) Enable() { d.suspended = false }
+func (d *AutoOff) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *AutoOff) IsEnabled() bool { return !d.suspended }
+func (d *AutoOff) IsEnabled() bool { return !d.suspended.Load() }
 
 // Execute runs the plugin with the given parameter
 func (d *AutoOff) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
@@ -93,9 +123,10 @@ func (d *AutoOff) Execute(pluginName string, update soundtouch.Update, speaker s
 			// If speaker is playing and is playing from TV
 			if speaker.IsAlive() && update.ContentItem().Source == "PRODUCT" {
 				for _, offSpeaker := range thenOff.ThenOff {
-					s := soundtouch.GetSpeakerByName(offSpeaker)
+					s := d.speakers.ByName(offSpeaker)
 					if s != nil {
 						s.PowerOff()
+						metrics.Actions.Inc(name, "PowerOff")
 					} else {
 						mLogger.Errorf("Configured speaker %s not present in soundtouch network. Please check config file.\n", offSpeaker)
 					}
@@ -2,37 +2,19 @@ package autooff
 
 import (
 	"io/ioutil"
-	"net"
-	"net/url"
 	"testing"
 
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
 	"github.com/theovassiliou/soundtouch-golang"
 )
 
 func TestCollector_Execute(t *testing.T) {
-	wohnzimmer := soundtouch.Speaker{
-		IP:   net.IP{},
-		Port: -1,
-		BaseHTTPURL: url.URL{
-			Scheme: "http",
-			Host:   "192.168.178.52:8090",
-		},
-		WebSocketURL: url.URL{},
-		DeviceInfo: soundtouch.Info{
-			DeviceID: "aabbccspeaker1",
-			Name:     "Wohnzimmer",
-			Type:     "",
-			Raw:      nil,
-		},
-		WebSocketCh: make(chan *soundtouch.Update),
-		Plugins:     nil,
-	}
+	n := simulatortest.Simulate(t, "Wohnzimmer", "Schrank", "Küche")
 
-	c1 := map[string]struct {
-		ThenOff []string "toml:\"thenOff\""
-	}{
-		"Wohmzimmer": {
-			ThenOff: []string{"Schrank", "Küche}"},
+	c1 := Config{
+		"Wohnzimmer": {
+			ThenOff: []string{"Schrank", "Küche", "Bad"},
 		},
 	}
 
@@ -46,15 +28,30 @@ func TestCollector_Execute(t *testing.T) {
 	type args struct {
 		pluginName string
 		update     soundtouch.Update
-		speaker    soundtouch.Speaker
+		speaker    string
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
+		name    string
+		fields  fields
+		args    args
+		wantOff bool
 	}{
 		{
-			name: "first test",
+			name: "TV on observed speaker",
+			fields: fields{
+				Config:    c1,
+				Plugin:    func(string, soundtouch.Update, soundtouch.Speaker) { panic("not implemented") },
+				suspended: false,
+			},
+			args: args{
+				pluginName: "",
+				update:     *u1,
+				speaker:    "Wohnzimmer",
+			},
+			wantOff: true,
+		},
+		{
+			name: "TV on other speaker",
 			fields: fields{
 				Config:    c1,
 				Plugin:    func(string, soundtouch.Update, soundtouch.Speaker) { panic("not implemented") },
@@ -63,19 +60,35 @@ func TestCollector_Execute(t *testing.T) {
 			args: args{
 				pluginName: "",
 				update:     *u1,
-				speaker:    wohnzimmer,
+				speaker:    "Schrank",
 			},
+			wantOff: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			n.Device("Wohnzimmer").Play(simulator.NowPlaying{Source: "PRODUCT", SourceAccount: "TV"})
+			for _, name := range []string{"Schrank", "Küche"} {
+				n.Device(name).Play(simulator.NowPlaying{Source: "TUNEIN", StationName: "SWR3"})
+			}
+
 			d := &AutoOff{
-				Config:    tt.fields.Config,
-				Plugin:    tt.fields.Plugin,
-				suspended: tt.fields.suspended,
+				Config:   tt.fields.Config,
+				Plugin:   tt.fields.Plugin,
+				speakers: n,
+			}
+			d.suspended.Store(tt.fields.suspended)
+			d.Execute(tt.args.pluginName, tt.args.update, *n.Device(tt.args.speaker).Speaker())
+
+			for _, name := range []string{"Schrank", "Küche"} {
+				if off := !n.Device(name).IsPoweredOn(); off != tt.wantOff {
+					t.Errorf("%s switched off = %v, want %v", name, off, tt.wantOff)
+				}
+			}
+			if !n.Device("Wohnzimmer").IsPoweredOn() {
+				t.Errorf("observed speaker switched off")
 			}
-			d.Execute(tt.args.pluginName, tt.args.update, tt.args.speaker)
 		})
 	}
 }
@@ -2,8 +2,11 @@ package auxjoin
 
 import (
 	"reflect"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -21,10 +24,23 @@ const sampleConfig = `
 
 `
 
+func init() {
+	plugins.Add("auxjoin", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewAuxJoin(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 type Config struct {
-	Speakers []string `toml:"-"`
+	Speakers []string `toml:"speakers"`
+}
+
+// References returns the speakers the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers}
 }
 
 // AuxJoin describes the plugin. It has a
@@ -34,7 +50,7 @@ type Config struct {
 type AuxJoin struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
 }
 
 // NewAuxJoin creates a new Collector plugin with the configuration
@@ -66,13 +82,13 @@ func (d *AuxJoin) SampleConfig() string { return sampleConfig }
 func (d *AuxJoin) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *AuxJoin) Disable() { d.suspended = true }
+func (d *AuxJoin) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *AuxJoin) Enable() { d.suspended = false }
+func (d *AuxJoin) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *AuxJoin) IsEnabled() bool { return !d.suspended }
+func (d *AuxJoin) IsEnabled() bool { return !d.suspended.Load() }
 
 // Execute runs the plugin with the given parameter
 // AuxJoin adds the auxed speaker to an existing stream, according to the following rules
@@ -113,6 +129,7 @@ func (d *AuxJoin) Execute(pluginName string, update soundtouch.Update, speaker s
 		if aKnownDevice.IsMaster() {
 			newZone := soundtouch.NewZone(*aKnownDevice, speaker)
 			aKnownDevice.AddZoneSlave(newZone)
+			metrics.Actions.Inc(name, "AddZoneSlave")
 			mLogger.Debugf("added %v to master %v\n", speaker.Name(), aKnownDevice.Name())
 			return
 		}
@@ -130,6 +147,7 @@ func (d *AuxJoin) Execute(pluginName string, update soundtouch.Update, speaker s
 			newZone := soundtouch.NewZone(*aKnownDevice, speaker)
 			mLogger.Debugf("Creating new zone with %v as master.\n", newZone.Master)
 			aKnownDevice.SetZone(newZone)
+			metrics.Actions.Inc(name, "SetZone")
 			return
 		}
 	}
@@ -1,10 +1,14 @@
 package episodecollector
 
 import (
+	"context"
 	"reflect"
+	"sync"
+	"sync/atomic"
 
 	scribble "github.com/nanobox-io/golang-scribble"
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -29,6 +33,14 @@ const sampleConfig = `
 
 `
 
+func init() {
+	plugins.Add("episodeCollector", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewCollector(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 // Artists a list of artists for which episodes should be collected
@@ -38,6 +50,11 @@ type Config struct {
 	Database string   `toml:"database"`
 }
 
+// References returns the speakers the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers}
+}
+
 // Collector describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
@@ -45,8 +62,9 @@ type Config struct {
 type Collector struct {
 	Config
 	Plugin     soundtouch.PluginFunc
-	suspended  bool
+	suspended  atomic.Bool
 	scribbleDb *scribble.Driver
+	executing  sync.WaitGroup
 }
 
 // NewCollector creates a new Collector plugin with the configuration
@@ -85,16 +103,25 @@ func (d *Collector) SampleConfig() string { return sampleConfig }
 func (d *Collector) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *Collector) Disable() { d.suspended = true }
+func (d *Collector) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *Collector) Enable() { d.suspended = false }
+func (d *Collector) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *Collector) IsEnabled() bool { return !d.suspended }
+func (d *Collector) IsEnabled() bool { return !d.suspended.Load() }
+
+// Stop suspends the plugin and waits for pending database writes
+func (d *Collector) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	return plugins.Wait(ctx, &d.executing)
+}
 
 // Execute runs the plugin with the given parameter
 func (d *Collector) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	d.executing.Add(1)
+	defer d.executing.Done()
+
 	if !(update.Is("NowPlaying") || update.Is("Volume")) {
 		// UpdateMessageType not needed. Ignoring.
 		return
@@ -41,9 +41,9 @@ func TestCollector_Name(t *testing.T) {
 			d := &Collector{
 				Config:     tt.fields.Config,
 				Plugin:     tt.fields.Plugin,
-				suspended:  tt.fields.suspended,
 				scribbleDb: tt.fields.scribbleDb,
 			}
+			d.suspended.Store(tt.fields.suspended)
 			if got := d.Name(); got != tt.want {
 				t.Errorf("Collector.Name() = %v, want %v", got, tt.want)
 			}
@@ -96,9 +96,9 @@ func TestCollector_Terminate(t *testing.T) {
 			d := &Collector{
 				Config:     tt.fields.Config,
 				Plugin:     tt.fields.Plugin,
-				suspended:  tt.fields.suspended,
 				scribbleDb: tt.fields.scribbleDb,
 			}
+			d.suspended.Store(tt.fields.suspended)
 			if got := d.Terminate(); got != tt.want {
 				t.Errorf("Collector.Terminate() = %v, want %v", got, tt.want)
 			}
@@ -188,9 +188,9 @@ func TestCollector_Execute(t *testing.T) {
 			d := &Collector{
 				Config:     tt.fields.Config,
 				Plugin:     tt.fields.Plugin,
-				suspended:  tt.fields.suspended,
 				scribbleDb: tt.fields.scribbleDb,
 			}
+			d.suspended.Store(tt.fields.suspended)
 			d.Execute(tt.args.pluginName, tt.args.update, tt.args.speaker)
 		})
 	}
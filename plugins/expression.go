@@ -0,0 +1,308 @@
+package plugins
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expression is a compiled boolean expression of a filter, e.g.
+//
+//	speaker == "Office" && type == "Volume" && volume > 40
+//
+// It supports the comparisons == != < <= > >=, the operators && || ! and parentheses.
+// Operands are the values of an update (see Values), strings in double quotes, numbers and
+// true or false.
+type expression interface {
+	eval(v map[string]interface{}) interface{}
+}
+
+type literal struct{ value interface{} }
+
+func (l literal) eval(map[string]interface{}) interface{} { return l.value }
+
+type variable struct{ name string }
+
+func (r variable) eval(v map[string]interface{}) interface{} { return v[r.name] }
+
+type not struct{ x expression }
+
+func (n not) eval(v map[string]interface{}) interface{} { return !truth(n.x.eval(v)) }
+
+type binary struct {
+	op   string
+	x, y expression
+}
+
+func (b binary) eval(v map[string]interface{}) interface{} {
+	switch b.op {
+	case "&&":
+		return truth(b.x.eval(v)) && truth(b.y.eval(v))
+	case "||":
+		return truth(b.x.eval(v)) || truth(b.y.eval(v))
+	}
+	return compare(b.op, b.x.eval(v), b.y.eval(v))
+}
+
+// truth returns true for true and every value that is neither false, zero nor empty
+func truth(x interface{}) bool {
+	switch x := x.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	return false
+}
+
+// compare compares values of the same type. Values of different types are unequal.
+func compare(op string, x, y interface{}) bool {
+	switch x := x.(type) {
+	case float64:
+		y, ok := y.(float64)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+	case string:
+		y, ok := y.(string)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+	case bool:
+		y, ok := y.(bool)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		}
+	}
+	return false
+}
+
+// parseExpression compiles s. Only the names in variables may be referenced.
+func parseExpression(s string, variables []string) (expression, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, variables: variables}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokOp tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i+1)
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", i+1)
+			}
+			tokens = append(tokens, token{tokString, text})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '-' || c == '.':
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i+1)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// parser is a recursive descent parser with the precedence ! > comparisons > && > ||
+type parser struct {
+	tokens    []token
+	pos       int
+	variables []string
+}
+
+func (p *parser) peek(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokOp && p.tokens[p.pos].text == op
+}
+
+func (p *parser) or() (expression, error) {
+	x, err := p.and()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var y expression
+		if y, err = p.and(); err == nil {
+			x = binary{op: "||", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *parser) and() (expression, error) {
+	x, err := p.comparison()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var y expression
+		if y, err = p.comparison(); err == nil {
+			x = binary{op: "&&", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *parser) comparison() (expression, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.peek(op) {
+			p.pos++
+			y, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return binary{op: op, x: x, y: y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *parser) unary() (expression, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokString:
+		return literal{t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.text)
+		}
+		return literal{f}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		}
+		for _, v := range p.variables {
+			if v == t.text {
+				return variable{t.text}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown value %s, expected one of %s", t.text, strings.Join(p.variables, ", "))
+	}
+
+	switch t.text {
+	case "!":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{x}, nil
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
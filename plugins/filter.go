@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// Filter selects the updates a plugin is executed with. It is given by the optional sub-table
+// filter of every plugin section, e.g. [logger.filter], and evaluated by the host. Every
+// criterion given has to match, empty criteria match all updates.
+// Speakers names of the speakers
+// ExcludeSpeakers names of the speakers never matching
+// Types message types, e.g. "Volume"
+// Sources sources the speaker is playing from, e.g. "TUNEIN"
+// Artists artists the speaker is playing
+// PlayStatus play states of the speaker, e.g. "PLAY_STATE"
+// Time local times of the day in the form "07:00-09:30". Windows may span midnight.
+// Expression a boolean expression on the values of the update, see Values
+//
+// Sources, artists and play states are taken from the latest NowPlaying of the speaker, so that
+// e.g. Volume updates can be selected by what the speaker is playing.
+type Filter struct {
+	Speakers        []string `toml:"speakers"`
+	ExcludeSpeakers []string `toml:"exclude_speakers"`
+	Types           []string `toml:"types"`
+	Sources         []string `toml:"sources"`
+	Artists         []string `toml:"artists"`
+	PlayStatus      []string `toml:"play_status"`
+	Time            []string `toml:"time"`
+	Expression      string   `toml:"expression"`
+}
+
+// IsEmpty returns true if the filter matches all updates
+func (f Filter) IsEmpty() bool {
+	return reflect.DeepEqual(f, Filter{})
+}
+
+// References returns the speakers and message types the filter refers to
+func (f Filter) References() References {
+	var speakers []string
+	speakers = append(speakers, f.Speakers...)
+	speakers = append(speakers, f.ExcludeSpeakers...)
+	return References{Speakers: speakers, MessageTypes: f.Types}
+}
+
+// Values are the properties of an update a filter is evaluated on. In expressions they are
+// referenced by the names given in the tags.
+type Values struct {
+	Speaker      string    `expr:"speaker"`
+	DeviceID     string    `expr:"device_id"`
+	Type         string    `expr:"type"`
+	Source       string    `expr:"source"`
+	Artist       string    `expr:"artist"`
+	Album        string    `expr:"album"`
+	Track        string    `expr:"track"`
+	Station      string    `expr:"station"`
+	PlayStatus   string    `expr:"play_status"`
+	StreamType   string    `expr:"stream_type"`
+	Volume       int       `expr:"volume"`
+	ActualVolume int       `expr:"actual_volume"`
+	Muted        bool      `expr:"muted"`
+	Hour         int       `expr:"hour"`
+	Weekday      string    `expr:"weekday"`
+	Time         time.Time `expr:"-"`
+}
+
+// variables are the names of Values usable in expressions
+var variables = func() []string {
+	var names []string
+	t := reflect.TypeOf(Values{})
+	for i := 0; i < t.NumField(); i++ {
+		if n := t.Field(i).Tag.Get("expr"); n != "-" {
+			names = append(names, n)
+		}
+	}
+	return names
+}()
+
+// NewValues returns the values of update. nowPlaying and volume are the latest known state of
+// the speaker, if any. They are superseded by update.
+func NewValues(update soundtouch.Update, speaker soundtouch.Speaker, nowPlaying *soundtouch.NowPlaying, volume *soundtouch.Volume, now time.Time) Values {
+	v := Values{
+		Speaker:  speaker.Name(),
+		DeviceID: speaker.DeviceID(),
+		Hour:     now.Hour(),
+		Weekday:  now.Weekday().String(),
+		Time:     now,
+	}
+	if update.Value != nil {
+		v.Type = reflect.TypeOf(update.Value).Name()
+	}
+
+	switch u := update.Value.(type) {
+	case soundtouch.NowPlaying:
+		nowPlaying = &u
+	case soundtouch.Volume:
+		volume = &u
+	}
+	if nowPlaying != nil {
+		v.Source = string(nowPlaying.Source)
+		v.Artist = nowPlaying.Artist
+		v.Album = nowPlaying.Album
+		v.Track = nowPlaying.Track
+		v.Station = nowPlaying.StationName
+		v.PlayStatus = string(nowPlaying.PlayStatus)
+		v.StreamType = string(nowPlaying.StreamType)
+	}
+	if volume != nil {
+		v.Volume = volume.TargetVolume
+		v.ActualVolume = volume.ActualVolume
+		v.Muted = volume.MuteEnabled
+	}
+	return v
+}
+
+func (v Values) asMap() map[string]interface{} {
+	m := map[string]interface{}{}
+	rv := reflect.ValueOf(v)
+	for i := 0; i < rv.NumField(); i++ {
+		n := rv.Type().Field(i).Tag.Get("expr")
+		if n == "-" {
+			continue
+		}
+		switch f := rv.Field(i); f.Kind() {
+		case reflect.Int:
+			m[n] = float64(f.Int())
+		default:
+			m[n] = f.Interface()
+		}
+	}
+	return m
+}
+
+// window is a time of day window in minutes since midnight
+type window struct{ from, to int }
+
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return m >= w.from && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("time %q is not of the form 07:00-09:30", s)
+	}
+	var w window
+	for i, hm := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(hm))
+		if err != nil {
+			return window{}, fmt.Errorf("time %q is not of the form 07:00-09:30", s)
+		}
+		if i == 0 {
+			w.from = t.Hour()*60 + t.Minute()
+		} else {
+			w.to = t.Hour()*60 + t.Minute()
+		}
+	}
+	return w, nil
+}
+
+// Matcher is a compiled Filter
+type Matcher struct {
+	filter  Filter
+	windows []window
+	expr    expression
+}
+
+// Compile checks the time windows and the expression of f
+func (f Filter) Compile() (*Matcher, error) {
+	m := &Matcher{filter: f}
+	for _, s := range f.Time {
+		w, err := parseWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		m.windows = append(m.windows, w)
+	}
+	if strings.TrimSpace(f.Expression) != "" {
+		e, err := parseExpression(f.Expression, variables)
+		if err != nil {
+			return nil, fmt.Errorf("expression: %v", err)
+		}
+		m.expr = e
+	}
+	return m, nil
+}
+
+// Match returns true if v passes all criteria of the filter. A nil Matcher matches everything.
+func (m *Matcher) Match(v Values) bool {
+	if m == nil {
+		return true
+	}
+	f := m.filter
+	if len(f.Speakers) > 0 && !slices.Contains(f.Speakers, v.Speaker) {
+		return false
+	}
+	if slices.Contains(f.ExcludeSpeakers, v.Speaker) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, v.Type) {
+		return false
+	}
+	if len(f.Sources) > 0 && !slices.Contains(f.Sources, v.Source) {
+		return false
+	}
+	if len(f.Artists) > 0 && !slices.Contains(f.Artists, v.Artist) {
+		return false
+	}
+	if len(f.PlayStatus) > 0 && !slices.Contains(f.PlayStatus, v.PlayStatus) {
+		return false
+	}
+	if len(m.windows) > 0 {
+		in := false
+		for _, w := range m.windows {
+			in = in || w.contains(v.Time)
+		}
+		if !in {
+			return false
+		}
+	}
+	return m.expr == nil || truth(m.expr.eval(v.asMap()))
+}
@@ -0,0 +1,69 @@
+package plugins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	office := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: "Office", DeviceID: "AA01"}}
+	kitchen := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: "Kitchen", DeviceID: "AA02"}}
+	playing := &soundtouch.NowPlaying{Source: "TUNEIN", StationName: "SWR3", PlayStatus: "PLAY_STATE", Artist: "Die drei ???"}
+	morning := time.Date(2026, 10, 19, 7, 30, 0, 0, time.Local)
+	night := time.Date(2026, 10, 19, 23, 30, 0, 0, time.Local)
+
+	volume := func(s soundtouch.Speaker, v int, now time.Time) Values {
+		return NewValues(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: v, ActualVolume: v}}, s, playing, nil, now)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		values Values
+		want   bool
+	}{
+		{"empty", Filter{}, volume(office, 30, morning), true},
+		{"speaker", Filter{Speakers: []string{"Office"}}, volume(kitchen, 30, morning), false},
+		{"excluded speaker", Filter{ExcludeSpeakers: []string{"Office"}}, volume(office, 30, morning), false},
+		{"type", Filter{Types: []string{"NowPlaying"}}, volume(office, 30, morning), false},
+		{"source of latest NowPlaying", Filter{Sources: []string{"TUNEIN"}}, volume(office, 30, morning), true},
+		{"artist", Filter{Artists: []string{"John Sinclair"}}, volume(office, 30, morning), false},
+		{"play status", Filter{PlayStatus: []string{"PLAY_STATE"}}, volume(office, 30, morning), true},
+		{"inside time window", Filter{Time: []string{"07:00-09:00"}}, volume(office, 30, morning), true},
+		{"outside time window", Filter{Time: []string{"07:00-09:00"}}, volume(office, 30, night), false},
+		{"time window over midnight", Filter{Time: []string{"22:00-06:00"}}, volume(office, 30, night), true},
+		{"expression", Filter{Expression: `speaker == "Office" && type == "Volume" && volume > 40`}, volume(office, 45, morning), true},
+		{"expression on low volume", Filter{Expression: `speaker == "Office" && type == "Volume" && volume > 40`}, volume(office, 30, morning), false},
+		{"expression with or and not", Filter{Expression: `!(station == "SWR3") || hour >= 7`}, volume(office, 30, morning), true},
+		{"expression comparing different types", Filter{Expression: `volume == "30"`}, volume(office, 30, morning), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := tt.filter.Compile()
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			if got := m.Match(tt.values); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter_Compile(t *testing.T) {
+	for _, f := range []Filter{
+		{Time: []string{"7-9"}},
+		{Time: []string{"07:00-25:00"}},
+		{Expression: `speaker = "Office"`},
+		{Expression: `loudness > 40`},
+		{Expression: `(volume > 40`},
+		{Expression: `volume >`},
+		{Expression: `speaker == "Office`},
+	} {
+		if _, err := f.Compile(); err == nil {
+			t.Errorf("Compile(%+v) expected error", f)
+		}
+	}
+}
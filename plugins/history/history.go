@@ -0,0 +1,383 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "History"
+
+const description = "Records when speakers played what as listening sessions"
+
+const sampleConfig = `
+## Enabling the history plugin. Sessions are queried with /history in telegram or
+## "masteringsoundtouch history"
+# [history]
+
+## file the sessions are stored in
+# file = "history.jsonl"
+
+## sessions playing shorter are not stored
+# min_duration = "30s"
+
+## time without updates after which a speaker not answering is considered gone
+# check = "2m"
+`
+
+func init() {
+	plugins.Add("history", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewHistory(*config.(*Config)) },
+	})
+}
+
+// Defaults if not configured otherwise
+const (
+	DefaultFile        = "history.jsonl"
+	DefaultMinDuration = 30 * time.Second
+	DefaultCheck       = 2 * time.Minute
+)
+
+// Config contains the configuration of the plugin
+// File the file the sessions are stored in
+// MinDuration sessions playing shorter are not stored, e.g. "30s"
+// Check time without updates after which a speaker not answering is considered gone, e.g. "2m"
+type Config struct {
+	File        string `toml:"file"`
+	MinDuration string `toml:"min_duration"`
+	Check       string `toml:"check"`
+}
+
+// Validate checks the durations
+func (c *Config) Validate() error {
+	_, _, err := c.durations()
+	return err
+}
+
+// file returns the configured file or the DefaultFile
+func (c Config) file() string {
+	if c.File == "" {
+		return DefaultFile
+	}
+	return c.File
+}
+
+func (c Config) durations() (minDuration, check time.Duration, err error) {
+	minDuration, check = DefaultMinDuration, DefaultCheck
+	if c.MinDuration != "" {
+		if minDuration, err = time.ParseDuration(c.MinDuration); err != nil || minDuration < 0 {
+			return 0, 0, fmt.Errorf("min_duration %q is no duration", c.MinDuration)
+		}
+	}
+	if c.Check != "" {
+		if check, err = time.ParseDuration(c.Check); err != nil || check <= 0 {
+			return 0, 0, fmt.Errorf("check %q is no positive duration", c.Check)
+		}
+	}
+	return minDuration, check, nil
+}
+
+// open is a session still running
+// speaker the speaker playing
+// playingSince the time the speaker started playing, zero while paused
+// lastSeen the time of the last update of the speaker
+type open struct {
+	Session
+	speaker      soundtouch.Speaker
+	playingSince time.Time
+	lastSeen     time.Time
+}
+
+// History describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// minDuration, check the parsed configuration. check is 0 if the configuration is invalid.
+// open the running session per device ID
+// volumes the last volume per device ID
+// speakers looks up the speakers queries may name
+type History struct {
+	Config
+	Plugin      soundtouch.PluginFunc
+	suspended   atomic.Bool
+	minDuration time.Duration
+	check       time.Duration
+	mu          sync.Mutex
+	open        map[string]*open
+	volumes     map[string]int
+	ctx         context.Context
+	cancel      context.CancelFunc
+	running     sync.WaitGroup
+	speakers    plugins.Speakers
+}
+
+// NewHistory creates a new History plugin with the configuration
+func NewHistory(config Config) (d *History) {
+	d = &History{Config: config, open: map[string]*open{}, volumes: map[string]int{}, speakers: plugins.Discovered{}}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	minDuration, check, err := config.durations()
+	if err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.minDuration, d.check = minDuration, check
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *History) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *History) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *History) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *History) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *History) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *History) Enable() { d.suspended.Store(d.check == 0) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *History) IsEnabled() bool { return !d.suspended.Load() }
+
+// Start watches for speakers disappearing until ctx is done
+func (d *History) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.check == 0 {
+		return nil
+	}
+	d.running.Add(1)
+	go d.watch()
+	return nil
+}
+
+// Stop ends the running sessions and stores them
+func (d *History) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	d.cancel()
+	err := plugins.Wait(ctx, &d.running)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for id := range d.open {
+		d.close(id, Shutdown, now)
+	}
+	return err
+}
+
+// Execute runs the plugin with the given parameter
+func (d *History) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if !d.IsEnabled() || update.Value == nil {
+		return
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+	mLogger.Traceln("Executing", pluginName)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	id := speaker.DeviceID()
+	o := d.open[id]
+	if o != nil {
+		o.lastSeen = now
+	}
+
+	switch u := update.Value.(type) {
+	case soundtouch.Volume:
+		d.volumes[id] = u.TargetVolume
+		if o != nil {
+			o.PeakVolume = max(o.PeakVolume, u.TargetVolume)
+		}
+	case soundtouch.NowPlaying:
+		d.nowPlaying(mLogger, speaker, u, now)
+	}
+}
+
+// nowPlaying ends the session of speaker if np switches it off or changes the content, and
+// starts a new one for the content played. On radio only a change of station changes the
+// content, the artist and album change with every song and are kept of the last one.
+func (d *History) nowPlaying(mLogger *log.Entry, speaker soundtouch.Speaker, np soundtouch.NowPlaying, now time.Time) {
+	id := speaker.DeviceID()
+	if o := d.open[id]; o != nil {
+		switch {
+		case np.Source == "STANDBY":
+			d.close(id, PowerOff, now)
+		case string(np.Source) != o.Source:
+			d.close(id, SourceChange, now)
+		case np.StationName != o.Station:
+			d.close(id, ContentChange, now)
+		case np.StationName == "" && (np.Artist != o.Artist || np.Album != o.Album):
+			d.close(id, ContentChange, now)
+		}
+	}
+	if np.Source == "STANDBY" || np.Source == "" {
+		return
+	}
+
+	o := d.open[id]
+	if o == nil {
+		o = &open{
+			Session: Session{
+				Speaker:    speaker.Name(),
+				DeviceID:   id,
+				Source:     string(np.Source),
+				Artist:     np.Artist,
+				Album:      np.Album,
+				Station:    np.StationName,
+				Start:      now,
+				PeakVolume: d.volumes[id],
+			},
+			speaker: speaker,
+		}
+		d.open[id] = o
+		mLogger.Debugf("Session started\n")
+	}
+	o.lastSeen = now
+	if np.Track != "" {
+		o.Track = np.Track
+	}
+	if np.StationName != "" && np.Artist != "" {
+		o.Artist, o.Album = np.Artist, np.Album
+	}
+
+	playing := np.PlayStatus == "PLAY_STATE" || np.PlayStatus == "BUFFERING_STATE"
+	switch {
+	case playing && o.playingSince.IsZero():
+		o.playingSince = now
+	case !playing && !o.playingSince.IsZero():
+		o.Duration += now.Sub(o.playingSince)
+		o.playingSince = time.Time{}
+	}
+}
+
+// close ends the session of the speaker with device ID id at end and stores it, unless it is
+// too short
+func (d *History) close(id, reason string, end time.Time) {
+	o := d.open[id]
+	if o == nil {
+		return
+	}
+	delete(d.open, id)
+	s := o.Session
+	if !o.playingSince.IsZero() && end.After(o.playingSince) {
+		s.Duration += end.Sub(o.playingSince)
+	}
+	s.End, s.Reason = end, reason
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Speaker,
+	})
+	if s.Duration < d.minDuration {
+		mLogger.Debugf("Session of %v ended by %s too short\n", s.Duration, reason)
+		return
+	}
+	if err := Append(d.file(), s); err != nil {
+		mLogger.Errorf("Storing session failed: %v\n", err)
+		return
+	}
+	mLogger.Infof("Session of %v ended by %s\n", s.Duration.Round(time.Second), reason)
+}
+
+// watch ends the sessions of speakers no longer answering
+func (d *History) watch() {
+	defer d.running.Done()
+	ticker := time.NewTicker(d.check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		d.mu.Lock()
+		quiet := map[string]open{}
+		for id, o := range d.open {
+			if time.Since(o.lastSeen) >= d.check {
+				quiet[id] = *o
+			}
+		}
+		d.mu.Unlock()
+
+		for id, o := range quiet {
+			if o.speaker.IsAlive() {
+				continue
+			}
+			d.mu.Lock()
+			// the speaker may have come back meanwhile
+			if cur := d.open[id]; cur != nil && cur.lastSeen.Equal(o.lastSeen) {
+				d.close(id, Disappeared, o.lastSeen)
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// Sessions returns the stored and running sessions matching q, oldest first. Running sessions
+// end now and have no reason.
+func (d *History) Sessions(q Query) ([]Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sessions, err := Read(d.file(), q)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var running []Session
+	for _, o := range d.open {
+		s := o.Session
+		s.End = now
+		if !o.playingSince.IsZero() {
+			s.Duration += now.Sub(o.playingSince)
+		}
+		if q.Match(s) {
+			running = append(running, s)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Start.Before(running[j].Start) })
+	return append(sessions, running...), nil
+}
+
+// Speakers returns the names of the known speakers
+func (d *History) Speakers() []string {
+	var names []string
+	for _, s := range d.speakers.Known() {
+		names = append(names, s.Name())
+	}
+	sort.Strings(names)
+	return names
+}
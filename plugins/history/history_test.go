@@ -0,0 +1,170 @@
+package history
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func playing(source, artist, album, track string) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{
+		Source: soundtouch.Source(source), Artist: artist, Album: album, Track: track, PlayStatus: "PLAY_STATE",
+	}}
+}
+
+func status(source string, status soundtouch.PlayStatus) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{Source: soundtouch.Source(source), PlayStatus: status}}
+}
+
+func volume(v int) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.Volume{TargetVolume: v, ActualVolume: v}}
+}
+
+func TestHistory_Sessions(t *testing.T) {
+	speaker := *simulatortest.Simulate(t, "Prinzessinen").Device("Prinzessinen").Speaker()
+	file := filepath.Join(t.TempDir(), "history.jsonl")
+	d := NewHistory(Config{File: file, MinDuration: "0s"})
+
+	d.Execute("", volume(20), speaker)
+	d.Execute("", playing("STORED_MUSIC", "Die drei ???", "Folge 1", "Kapitel 1"), speaker)
+	d.Execute("", volume(35), speaker)
+	d.Execute("", playing("STORED_MUSIC", "Die drei ???", "Folge 1", "Kapitel 2"), speaker)
+	d.Execute("", playing("STORED_MUSIC", "Die drei ???", "Folge 2", "Kapitel 1"), speaker)
+	d.Execute("", playing("TUNEIN", "", "", ""), speaker)
+	d.Execute("", status("TUNEIN", "PAUSE_STATE"), speaker)
+	d.Execute("", status("STANDBY", ""), speaker)
+	d.Execute("", playing("AUX", "", "", ""), speaker)
+
+	sessions, err := d.Sessions(Query{})
+	if err != nil {
+		t.Fatalf("Sessions() error = %v", err)
+	}
+	var got [][]string
+	for _, s := range sessions {
+		got = append(got, []string{s.Source, s.Album, s.Track, s.Reason})
+	}
+	want := [][]string{
+		{"STORED_MUSIC", "Folge 1", "Kapitel 2", ContentChange},
+		{"STORED_MUSIC", "Folge 2", "Kapitel 1", SourceChange},
+		{"TUNEIN", "", "", PowerOff},
+		{"AUX", "", "", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sessions() = %v, want %v", got, want)
+	}
+	if sessions[0].PeakVolume != 35 || sessions[1].PeakVolume != 35 {
+		t.Errorf("Sessions() peak volumes %d, %d, want 35", sessions[0].PeakVolume, sessions[1].PeakVolume)
+	}
+
+	if err := d.Stop(context.Background()); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+	stored, _ := Read(file, Query{Speaker: "prinzessinen", Artist: "drei"})
+	if len(stored) != 2 {
+		t.Errorf("Read() of Die drei ??? = %d sessions, want 2", len(stored))
+	}
+	stored, _ = Read(file, Query{})
+	if len(stored) != 4 || stored[3].Reason != Shutdown {
+		t.Errorf("Read() = %v, want the AUX session ended by shutdown", stored)
+	}
+}
+
+func TestHistory_Radio(t *testing.T) {
+	speaker := *simulatortest.Simulate(t, "Prinzessinen").Device("Prinzessinen").Speaker()
+	d := NewHistory(Config{File: filepath.Join(t.TempDir(), "history.jsonl"), MinDuration: "0s"})
+	radio := func(station, artist, track string) soundtouch.Update {
+		return soundtouch.Update{Value: soundtouch.NowPlaying{
+			Source: "TUNEIN", StationName: station, Artist: artist, Track: track, PlayStatus: "PLAY_STATE",
+		}}
+	}
+
+	d.Execute("", radio("SWR3", "Queen", "Radio Ga Ga"), speaker)
+	d.Execute("", radio("SWR3", "", ""), speaker) // news
+	d.Execute("", radio("SWR3", "ABBA", "Waterloo"), speaker)
+	d.Execute("", radio("SWR3", "Bonnie Tyler", "Holding Out for a Hero"), speaker)
+	d.Execute("", radio("SWR1", "Nena", "99 Luftballons"), speaker)
+	d.Execute("", status("STANDBY", ""), speaker)
+
+	sessions, err := d.Sessions(Query{})
+	if err != nil {
+		t.Fatalf("Sessions() error = %v", err)
+	}
+	var got [][]string
+	for _, s := range sessions {
+		got = append(got, []string{s.Station, s.Artist, s.Track, s.Reason})
+	}
+	want := [][]string{
+		{"SWR3", "Bonnie Tyler", "Holding Out for a Hero", ContentChange},
+		{"SWR1", "Nena", "99 Luftballons", PowerOff},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sessions() = %v, want %v", got, want)
+	}
+}
+
+func TestHistory_MinDuration(t *testing.T) {
+	speaker := *simulatortest.Simulate(t, "Prinzessinen").Device("Prinzessinen").Speaker()
+	d := NewHistory(Config{File: filepath.Join(t.TempDir(), "history.jsonl"), MinDuration: "1h"})
+
+	d.Execute("", playing("TUNEIN", "", "", ""), speaker)
+	d.Execute("", status("STANDBY", ""), speaker)
+	if sessions, _ := d.Sessions(Query{}); len(sessions) != 0 {
+		t.Errorf("Sessions() = %v, want the short session dropped", sessions)
+	}
+}
+
+func TestHistory_Disappeared(t *testing.T) {
+	n := simulatortest.Simulate(t, "Prinzessinen")
+	speaker := *n.Device("Prinzessinen").Speaker()
+	d := NewHistory(Config{File: filepath.Join(t.TempDir(), "history.jsonl"), MinDuration: "0s", Check: "20ms"})
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer d.Stop(context.Background())
+
+	d.Execute("", playing("TUNEIN", "", "", ""), speaker)
+	n.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stored, _ := Read(d.file(), Query{})
+		if len(stored) == 1 {
+			if stored[0].Reason != Disappeared {
+				t.Errorf("session ended by %s, want %s", stored[0].Reason, Disappeared)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("session of the disappeared speaker not ended")
+}
+
+func TestParseQuery(t *testing.T) {
+	day := func(s string) time.Time { d, _ := ParseDate(s); return d }
+	tests := []struct {
+		words   []string
+		want    Query
+		wantErr bool
+	}{
+		{nil, Query{}, false},
+		{[]string{"kitchen", "Die", "drei", "???"}, Query{Speaker: "Kitchen", Artist: "Die drei ???"}, false},
+		{[]string{"2024-03-01"}, Query{From: day("2024-03-01"), To: day("2024-03-02")}, false},
+		{[]string{"Office", "2024-03-01", "2024-03-07"}, Query{Speaker: "Office", From: day("2024-03-01"), To: day("2024-03-08")}, false},
+		{[]string{"2024-03-01", "2024-03-02", "2024-03-03"}, Query{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.words, []string{"Kitchen", "Office"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseQuery(%v) error = %v", tt.words, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%v) = %+v, want %+v", tt.words, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The reasons a session ends
+const (
+	PowerOff      = "power off"
+	SourceChange  = "source change"
+	ContentChange = "content change"
+	Disappeared   = "disappeared"
+	Shutdown      = "shutdown"
+)
+
+// Session is the time a speaker played the same content, from being switched on or the content
+// changing until being switched off or the content changing. Pauses are part of the session but
+// not of its duration.
+// Track the last track played
+// Station the radio station played
+// Duration the time the speaker has been playing
+// PeakVolume the highest volume during the session
+// Reason why the session ended, e.g. "power off"
+type Session struct {
+	Speaker    string        `json:"speaker"`
+	DeviceID   string        `json:"device_id"`
+	Source     string        `json:"source"`
+	Artist     string        `json:"artist,omitempty"`
+	Album      string        `json:"album,omitempty"`
+	Track      string        `json:"track,omitempty"`
+	Station    string        `json:"station,omitempty"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Duration   time.Duration `json:"duration"`
+	PeakVolume int           `json:"peak_volume"`
+	Reason     string        `json:"reason"`
+}
+
+// String describes the session in one line
+func (s Session) String() string {
+	what := s.Source
+	switch {
+	case s.Station != "":
+		what = s.Station
+	case s.Artist != "" && s.Album != "":
+		what = s.Artist + " - " + s.Album
+	case s.Artist != "":
+		what = s.Artist
+	}
+	return fmt.Sprintf("%s %s %s %s (volume %d)", s.Start.Format("Mon 02.01. 15:04"), s.Speaker,
+		s.Duration.Round(time.Minute), what, s.PeakVolume)
+}
+
+// Query selects sessions. Empty criteria match all sessions.
+// Speaker name of the speaker, case is ignored
+// Artist part of the artist, case is ignored
+// From sessions ending after From
+// To sessions starting before To
+type Query struct {
+	Speaker string
+	Artist  string
+	From    time.Time
+	To      time.Time
+}
+
+// Match returns true if s meets all criteria of q
+func (q Query) Match(s Session) bool {
+	if q.Speaker != "" && !strings.EqualFold(q.Speaker, s.Speaker) {
+		return false
+	}
+	if q.Artist != "" && !strings.Contains(strings.ToLower(s.Artist), strings.ToLower(q.Artist)) {
+		return false
+	}
+	if !q.From.IsZero() && s.End.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !s.Start.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// dateLayout is the layout of dates in queries
+const dateLayout = "2006-01-02"
+
+// ParseDate returns the start of day date in the form 2024-03-01, in the local time zone
+func ParseDate(date string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, date, time.Local)
+}
+
+// ParseQuery reads a query from words. Up to two dates in the form 2024-03-01 give the first
+// and the last day. A word that is one of speakers selects the speaker, the remaining words
+// the artist.
+func ParseQuery(words []string, speakers []string) (Query, error) {
+	var q Query
+	var dates []time.Time
+	var artist []string
+	for _, w := range words {
+		if d, err := ParseDate(w); err == nil {
+			dates = append(dates, d)
+			continue
+		}
+		if q.Speaker == "" {
+			found := false
+			for _, s := range speakers {
+				if strings.EqualFold(s, w) {
+					q.Speaker, found = s, true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+		artist = append(artist, w)
+	}
+	switch len(dates) {
+	case 0:
+	case 1:
+		q.From, q.To = dates[0], dates[0].AddDate(0, 0, 1)
+	case 2:
+		q.From, q.To = dates[0], dates[1].AddDate(0, 0, 1)
+	default:
+		return q, fmt.Errorf("at most two dates expected")
+	}
+	q.Artist = strings.Join(artist, " ")
+	return q, nil
+}
+
+// Append adds the session to the file, one JSON object per line
+func Append(file string, s Session) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns the sessions stored in file matching q, oldest first. A missing file contains
+// no sessions.
+func Read(file string, q Query) ([]Session, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sessions []Session
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var s Session
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if q.Match(s) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, scanner.Err()
+}
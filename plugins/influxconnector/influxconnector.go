@@ -1,11 +1,16 @@
 package influxconnector
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"reflect"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -36,6 +41,14 @@ const sampleConfig = `
 ## 
 `
 
+func init() {
+	plugins.Add("influxDB", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewLogger(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 // IgnoreMessages a list of message types to be ignored
@@ -47,6 +60,11 @@ type Config struct {
 	DryRun      bool     `toml:"dry_run"`
 }
 
+// References returns the speakers and message types the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers, MessageTypes: c.LogMessages}
+}
+
 // InfluxDB describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
@@ -54,8 +72,9 @@ type Config struct {
 type InfluxDB struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
 	noOfFails int
+	writing   sync.Mutex
 }
 
 var influxDB = soundtouch.InfluxDB{
@@ -77,7 +96,7 @@ func NewLogger(config Config) (d *InfluxDB) {
 		"Plugin": name,
 	})
 	if config.InfluxURL == "" {
-		d.suspended = true
+		d.suspended.Store(true)
 		return d
 	}
 
@@ -85,7 +104,7 @@ func NewLogger(config Config) (d *InfluxDB) {
 	if err != nil {
 		mLogger.Infof("Not a valid URL: %v", config.InfluxURL)
 		mLogger.Infof("Suspending plugin")
-		d.suspended = true
+		d.suspended.Store(true)
 		return d
 	}
 
@@ -111,17 +130,36 @@ func (d *InfluxDB) SampleConfig() string { return sampleConfig }
 func (d *InfluxDB) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *InfluxDB) Disable() { d.suspended = true }
+func (d *InfluxDB) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *InfluxDB) Enable() { d.suspended = false }
+func (d *InfluxDB) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *InfluxDB) IsEnabled() bool { return !d.suspended }
+func (d *InfluxDB) IsEnabled() bool { return !d.suspended.Load() }
+
+// Stop suspends the plugin and waits for a pending write to complete
+func (d *InfluxDB) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+
+	written := make(chan struct{})
+	go func() {
+		d.writing.Lock()
+		d.writing.Unlock()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
 // Execute runs the plugin with the given parameter
 func (d *InfluxDB) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
-	if d.suspended {
+	if d.suspended.Load() {
 		return
 	}
 
@@ -141,19 +179,24 @@ func (d *InfluxDB) Execute(pluginName string, update soundtouch.Update, speaker
 
 	v, _ := update.Lineproto(influxDB, &update)
 
+	d.writing.Lock()
+	defer d.writing.Unlock()
+
 	if !(d.Config.DryRun) && v != "" {
 		result, err := influxDB.SetData("write", []byte(v))
 		if err != nil {
 			if d.noOfFails >= maxNoOfFails {
-				d.suspended = true
+				d.suspended.Store(true)
 				mLogger.Errorf("Failed %v times to connect. Disabling plugin.", d.noOfFails)
 			} else {
 				d.noOfFails = d.noOfFails + 1
+				metrics.InfluxWriteFailures.Set(float64(d.noOfFails), name)
 				mLogger.Errorf("failed. No of fails %v", d.noOfFails)
 				return
 			}
 		}
 		d.noOfFails = 0
+		metrics.InfluxWriteFailures.Set(0, name)
 		mLogger.Debugf("succeeded: %v", string(result))
 
 	} else if v != "" {
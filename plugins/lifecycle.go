@@ -0,0 +1,113 @@
+package plugins
+
+import (
+	"context"
+	"sync"
+
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Starter is implemented by plugins that run in the background. Start is called once the
+// plugin is hosted. ctx is cancelled when the daemon shuts down.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by plugins that have to release resources or flush pending work
+// before they are discarded. Stop should return before the deadline of ctx.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// Unwrap returns the plugin wrapped by p, e.g. by an alias, or p itself
+func Unwrap(p soundtouch.Plugin) soundtouch.Plugin {
+	for {
+		w, ok := p.(interface{ Unwrap() soundtouch.Plugin })
+		if !ok {
+			return p
+		}
+		p = w.Unwrap()
+	}
+}
+
+// Start calls Start of p, if the plugin implements Starter
+func Start(ctx context.Context, p soundtouch.Plugin) error {
+	if s, ok := Unwrap(p).(Starter); ok {
+		return s.Start(ctx)
+	}
+	return nil
+}
+
+// Stop calls Stop of p, if the plugin implements Stopper
+func Stop(ctx context.Context, p soundtouch.Plugin) error {
+	if s, ok := Unwrap(p).(Stopper); ok {
+		return s.Stop(ctx)
+	}
+	return nil
+}
+
+// Wait waits for wg until ctx is done
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Host gives plugins access to all hosted plugins
+type Host interface {
+	Plugins() []soundtouch.Plugin
+}
+
+// HostAware is implemented by plugins that act on other plugins. SetHost is called before Start.
+type HostAware interface {
+	SetHost(h Host)
+}
+
+// SetHost calls SetHost of p, if the plugin implements HostAware
+func SetHost(p soundtouch.Plugin, h Host) {
+	if s, ok := Unwrap(p).(HostAware); ok {
+		s.SetHost(h)
+	}
+}
+
+// BusAware is implemented by plugins that observe updates beyond the one they are executed
+// with. SetBus is called before Start.
+type BusAware interface {
+	SetBus(b *bus.Bus)
+}
+
+// SetBus calls SetBus of p, if the plugin implements BusAware
+func SetBus(p soundtouch.Plugin, b *bus.Bus) {
+	if s, ok := Unwrap(p).(BusAware); ok {
+		s.SetBus(b)
+	}
+}
+
+// Notifier is implemented by plugins that deliver messages to people, e.g. via telegram
+type Notifier interface {
+	Notify(msg string) error
+}
+
+// Notifiers returns the enabled plugins of h that implement Notifier
+func Notifiers(h Host) []Notifier {
+	if h == nil {
+		return nil
+	}
+	var n []Notifier
+	for _, p := range h.Plugins() {
+		if nf, ok := Unwrap(p).(Notifier); ok && p.IsEnabled() {
+			n = append(n, nf)
+		}
+	}
+	return n
+}
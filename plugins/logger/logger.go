@@ -2,8 +2,10 @@ package logger
 
 import (
 	"reflect"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -26,6 +28,14 @@ const sampleConfig = `
 
 const description = "Logs update messages"
 
+func init() {
+	plugins.Add("logger", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewLogger(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 // IgnoreMessages a list of message types to be ignored
@@ -34,6 +44,11 @@ type Config struct {
 	IgnoreMessages []string `toml:"ignore_messages"`
 }
 
+// References returns the speakers and message types the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers, MessageTypes: c.IgnoreMessages}
+}
+
 // Logger describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
@@ -41,7 +56,7 @@ type Config struct {
 type Logger struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
 }
 
 // NewLogger creates a new Logger plugin with the configuration
@@ -73,13 +88,13 @@ func (d *Logger) SampleConfig() string { return sampleConfig }
 func (d *Logger) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *Logger) Disable() { d.suspended = true }
+func (d *Logger) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *Logger) Enable() { d.suspended = false }
+func (d *Logger) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *Logger) IsEnabled() bool { return !d.suspended }
+func (d *Logger) IsEnabled() bool { return !d.suspended.Load() }
 
 // Execute runs the plugin with the given parameter
 func (d *Logger) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
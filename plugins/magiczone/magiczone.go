@@ -2,8 +2,11 @@ package magiczone
 
 import (
 	"reflect"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -21,10 +24,23 @@ const sampleConfig = `
 
 `
 
+func init() {
+	plugins.Add("magicZone", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewCollector(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 type Config struct {
-	Speakers []string `toml:"-"`
+	Speakers []string `toml:"speakers"`
+}
+
+// References returns the speakers the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers}
 }
 
 // MagicZone describes the plugin. It has a
@@ -34,7 +50,7 @@ type Config struct {
 type MagicZone struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
 }
 
 // NewCollector creates a new Collector plugin with the configuration
@@ -66,13 +82,13 @@ func (d *MagicZone) SampleConfig() string { return sampleConfig }
 func (d *MagicZone) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *MagicZone) Disable() { d.suspended = true }
+func (d *MagicZone) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *MagicZone) Enable() { d.suspended = false }
+func (d *MagicZone) Enable() { d.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *MagicZone) IsEnabled() bool { return !d.suspended }
+func (d *MagicZone) IsEnabled() bool { return !d.suspended.Load() }
 
 // Execute runs the plugin with the given parameter
 func (d *MagicZone) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
@@ -136,6 +152,7 @@ func (d *MagicZone) Execute(pluginName string, update soundtouch.Update, speaker
 					mLogger.Infof("Adding myself to master %v zone.\n", zone.Master)
 					newZone := soundtouch.NewZone(c, speaker)
 					c.AddZoneSlave(newZone)
+					metrics.Actions.Inc(name, "AddZoneSlave")
 					soundtouch.DumpZones(mLogger, c)
 					mLogger.Debugln("Done!")
 					return
@@ -149,6 +166,7 @@ func (d *MagicZone) Execute(pluginName string, update soundtouch.Update, speaker
 		newZone := soundtouch.NewZone(choosenAsNewMaster, speaker)
 		mLogger.Infof("Creating new zone with %v as master.\n", newZone.Master)
 		choosenAsNewMaster.SetZone(newZone)
+		metrics.Actions.Inc(name, "SetZone")
 		soundtouch.DumpZones(mLogger, choosenAsNewMaster)
 		return
 	}
@@ -0,0 +1,266 @@
+package presets
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Slots is the number of presets of a speaker
+const Slots = 6
+
+// FileFormat is the format of the files backups are stored in
+const FileFormat = 1
+
+// ContentItem is the content stored in a preset, as exchanged with /presets and /storePreset
+type ContentItem struct {
+	XMLName       xml.Name `xml:"ContentItem" json:"-"`
+	Source        string   `xml:"source,attr" json:"source"`
+	Type          string   `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Location      string   `xml:"location,attr,omitempty" json:"location,omitempty"`
+	SourceAccount string   `xml:"sourceAccount,attr,omitempty" json:"source_account,omitempty"`
+	IsPresetable  bool     `xml:"isPresetable,attr" json:"is_presetable"`
+	Name          string   `xml:"itemName,omitempty" json:"name,omitempty"`
+	ContainerArt  string   `xml:"containerArt,omitempty" json:"container_art,omitempty"`
+}
+
+// Same returns true if c and o play the same content. Names and art are not compared.
+func (c *ContentItem) Same(o *ContentItem) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	return c.Source == o.Source && c.Type == o.Type && c.Location == o.Location && c.SourceAccount == o.SourceAccount
+}
+
+// String returns the name of the content, or its source and location if unnamed
+func (c *ContentItem) String() string {
+	switch {
+	case c == nil:
+		return "-"
+	case c.Name != "":
+		return c.Name
+	case c.Location != "":
+		return c.Source + " " + c.Location
+	}
+	return c.Source
+}
+
+// Preset is the content stored in the slot ID 1..6 of a speaker
+type Preset struct {
+	XMLName     xml.Name     `xml:"preset" json:"-"`
+	ID          int          `xml:"id,attr" json:"id"`
+	ContentItem *ContentItem `xml:"ContentItem" json:"content_item"`
+}
+
+// SpeakerPresets are the presets of a speaker, ordered by ID
+type SpeakerPresets struct {
+	Name     string   `json:"name"`
+	DeviceID string   `json:"device_id"`
+	Presets  []Preset `json:"presets"`
+}
+
+// Slot returns the content of preset id, nil if none is stored
+func (sp SpeakerPresets) Slot(id int) *ContentItem {
+	for _, p := range sp.Presets {
+		if p.ID == id {
+			return p.ContentItem
+		}
+	}
+	return nil
+}
+
+// Read returns the presets of the speaker
+func Read(s *soundtouch.Speaker) (SpeakerPresets, error) {
+	sp := SpeakerPresets{Name: s.Name(), DeviceID: s.DeviceID()}
+	body, err := s.GetData("presets")
+	if err != nil {
+		return sp, err
+	}
+	var presets struct {
+		XMLName xml.Name `xml:"presets"`
+		Presets []Preset `xml:"preset"`
+	}
+	if err := xml.Unmarshal(body, &presets); err != nil {
+		return sp, fmt.Errorf("reading presets of %s: %v", s.Name(), err)
+	}
+	sp.Presets = presets.Presets
+	for i, p := range sp.Presets {
+		// as stored in a file, so that unchanged presets compare equal
+		sp.Presets[i].XMLName = xml.Name{}
+		if p.ContentItem != nil {
+			p.ContentItem.XMLName = xml.Name{}
+		}
+	}
+	sort.Slice(sp.Presets, func(i, j int) bool { return sp.Presets[i].ID < sp.Presets[j].ID })
+	return sp, nil
+}
+
+// Push stores the presets of sp on the speaker. Presets the speaker has but sp has not are
+// removed, presets already stored are left alone. Push returns the number of presets changed.
+func Push(s *soundtouch.Speaker, sp SpeakerPresets) (int, error) {
+	current, err := Read(s)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for id := 1; id <= Slots; id++ {
+		want, have := sp.Slot(id), current.Slot(id)
+		if want.Same(have) {
+			continue
+		}
+		action, p := "storePreset", Preset{ID: id, ContentItem: want}
+		if want == nil {
+			action, p = "removePreset", Preset{ID: id}
+		}
+		body, _ := xml.Marshal(p)
+		reply, err := s.SetData(action, body)
+		if err == nil && bytes.Contains(reply, []byte("<errors")) {
+			err = fmt.Errorf("%s", reply)
+		}
+		if err != nil {
+			return changed, fmt.Errorf("%s of preset %d on %s: %v", action, id, s.Name(), err)
+		}
+		metrics.Actions.Inc(name, action)
+		changed++
+	}
+	return changed, nil
+}
+
+// Differences returns the IDs of the presets not the same on all speakers
+func Differences(speakers []SpeakerPresets) []int {
+	var ids []int
+	for id := 1; id <= Slots; id++ {
+		for _, sp := range speakers[min(1, len(speakers)):] {
+			if !sp.Slot(id).Same(speakers[0].Slot(id)) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Backup are the presets of the speakers at a point in time
+// Version numbers the backups of a file, starting with 1
+// Taken the time the presets have been read
+// Speakers the presets of every speaker, ordered by name
+type Backup struct {
+	Version  int              `json:"version"`
+	Taken    time.Time        `json:"taken"`
+	Speakers []SpeakerPresets `json:"speakers"`
+}
+
+// Speaker returns the presets of the speaker given by name or device ID
+func (b Backup) Speaker(nameOrID string) (SpeakerPresets, bool) {
+	for _, sp := range b.Speakers {
+		if sp.Name == nameOrID || sp.DeviceID == nameOrID {
+			return sp, true
+		}
+	}
+	return SpeakerPresets{}, false
+}
+
+// File is the content of a backup file
+// Format the FileFormat the file is written in
+// Backups the backups, oldest first
+type File struct {
+	Format  int      `json:"format"`
+	Backups []Backup `json:"backups"`
+}
+
+// Add appends the presets of speakers as a new version, unless they are those of the latest
+// version. Speakers of the latest version missing in speakers are carried over, so that a
+// speaker not reachable keeps its presets. Only the newest keep versions are kept. Add returns
+// the version and whether it has been added.
+func (f *File) Add(speakers []SpeakerPresets, taken time.Time, keep int) (Backup, bool) {
+	b := Backup{Taken: taken, Speakers: append([]SpeakerPresets(nil), speakers...)}
+	latest, ok := f.Version(0)
+	if ok {
+		for _, sp := range latest.Speakers {
+			if _, found := b.Speaker(sp.DeviceID); !found {
+				b.Speakers = append(b.Speakers, sp)
+			}
+		}
+	}
+	sort.Slice(b.Speakers, func(i, j int) bool { return b.Speakers[i].Name < b.Speakers[j].Name })
+	if ok && reflect.DeepEqual(normalized(b.Speakers), normalized(latest.Speakers)) {
+		return latest, false
+	}
+
+	b.Version = latest.Version + 1
+	f.Backups = append(f.Backups, b)
+	if keep > 0 && len(f.Backups) > keep {
+		f.Backups = f.Backups[len(f.Backups)-keep:]
+	}
+	return b, true
+}
+
+// normalized returns speakers without empty preset lists, so that nil and empty compare equal
+func normalized(speakers []SpeakerPresets) []SpeakerPresets {
+	n := make([]SpeakerPresets, len(speakers))
+	for i, sp := range speakers {
+		n[i] = sp
+		if len(sp.Presets) == 0 {
+			n[i].Presets = nil
+		}
+	}
+	return n
+}
+
+// Version returns the backup with version, the latest if version is 0
+func (f *File) Version(version int) (Backup, bool) {
+	if len(f.Backups) == 0 {
+		return Backup{}, false
+	}
+	if version == 0 {
+		return f.Backups[len(f.Backups)-1], true
+	}
+	for _, b := range f.Backups {
+		if b.Version == version {
+			return b, true
+		}
+	}
+	return Backup{}, false
+}
+
+// Load reads the backups stored in file. A missing file contains no backups.
+func Load(file string) (*File, error) {
+	f := &File{Format: FileFormat}
+	buf, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, f); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if f.Format > FileFormat {
+		return nil, fmt.Errorf("%s: format %d is newer than %d", file, f.Format, FileFormat)
+	}
+	f.Format = FileFormat
+	return f, nil
+}
+
+// Save writes the backups to file
+func (f *File) Save(file string) error {
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,322 @@
+package presets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "Presets"
+
+const description = "Backs up the presets of all speakers and pushes them back"
+
+const sampleConfig = `
+## Enabling the presets plugin. The presets of all speakers are backed up periodically and
+## compared, backed up and pushed with "masteringsoundtouch presets"
+# [presets]
+
+## file the backups are stored in
+# file = "presets.json"
+
+## time between two backups
+# interval = "24h"
+
+## number of backups kept
+# keep = 10
+`
+
+func init() {
+	plugins.Add("presets", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewPresets(*config.(*Config)) },
+	})
+}
+
+// Defaults if not configured otherwise
+const (
+	DefaultFile     = "presets.json"
+	DefaultInterval = 24 * time.Hour
+	DefaultKeep     = 10
+)
+
+// Config contains the configuration of the plugin
+// File the file the backups are stored in
+// Interval time between two backups, e.g. "24h"
+// Keep number of backups kept
+type Config struct {
+	File     string `toml:"file"`
+	Interval string `toml:"interval"`
+	Keep     int    `toml:"keep"`
+}
+
+// Validate checks the interval
+func (c *Config) Validate() error {
+	_, err := c.interval()
+	return err
+}
+
+// file returns the configured file or the DefaultFile
+func (c Config) file() string {
+	if c.File == "" {
+		return DefaultFile
+	}
+	return c.File
+}
+
+// keep returns the configured number of backups kept or DefaultKeep
+func (c Config) keep() int {
+	if c.Keep <= 0 {
+		return DefaultKeep
+	}
+	return c.Keep
+}
+
+func (c Config) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return DefaultInterval, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("interval %q is no positive duration", c.Interval)
+	}
+	return d, nil
+}
+
+// Presets describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// interval the time between two backups, 0 if the configuration is invalid
+// speakers looks up the speakers whose presets are backed up
+type Presets struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	interval  time.Duration
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+	speakers  plugins.Speakers
+}
+
+// firstBackup is the time after start the first backup is taken, giving discovery time to
+// find the speakers
+var firstBackup = time.Minute
+
+// NewPresets creates a new Presets plugin with the configuration
+func NewPresets(config Config) (d *Presets) {
+	d = &Presets{Config: config, speakers: plugins.Discovered{}}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	interval, err := config.interval()
+	if err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.interval = interval
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *Presets) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Presets) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Presets) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Presets) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Presets) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Presets) Enable() { d.suspended.Store(d.interval == 0) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Presets) IsEnabled() bool { return !d.suspended.Load() }
+
+// Start takes backups periodically until ctx is done
+func (d *Presets) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.interval == 0 {
+		return nil
+	}
+	d.running.Add(1)
+	go d.backupPeriodically()
+	return nil
+}
+
+// Stop ends the periodic backups and waits for a running backup
+func (d *Presets) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	d.cancel()
+	return plugins.Wait(ctx, &d.running)
+}
+
+// Execute does nothing. Backups are taken periodically.
+func (d *Presets) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+}
+
+func (d *Presets) backupPeriodically() {
+	defer d.running.Done()
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	wait := firstBackup
+	for {
+		select {
+		case <-time.After(wait):
+		case <-d.ctx.Done():
+			return
+		}
+		wait = d.interval
+		if !d.IsEnabled() {
+			continue
+		}
+		if _, _, err := d.Backup(); err != nil {
+			mLogger.Errorf("Backup failed: %v\n", err)
+		}
+	}
+}
+
+// knownSpeakers returns the known speakers ordered by name
+func (d *Presets) knownSpeakers() []*soundtouch.Speaker {
+	var speakers []*soundtouch.Speaker
+	for _, s := range d.speakers.Known() {
+		speakers = append(speakers, s)
+	}
+	sort.Slice(speakers, func(i, j int) bool { return speakers[i].Name() < speakers[j].Name() })
+	return speakers
+}
+
+// Current reads the presets of all known speakers. Speakers whose presets can't be read are
+// logged and left out.
+func (d *Presets) Current() []SpeakerPresets {
+	var current []SpeakerPresets
+	for _, s := range d.knownSpeakers() {
+		sp, err := Read(s)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Plugin":  name,
+				"Speaker": s.Name(),
+			}).Errorf("Reading presets failed: %v\n", err)
+			continue
+		}
+		current = append(current, sp)
+	}
+	return current
+}
+
+// Backup reads the presets of all known speakers and stores them as a new version, unless they
+// are unchanged. It returns the latest version and whether it has been added.
+func (d *Presets) Backup() (Backup, bool, error) {
+	current := d.Current()
+	if len(current) == 0 {
+		return Backup{}, false, fmt.Errorf("no presets read")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := Load(d.file())
+	if err != nil {
+		return Backup{}, false, err
+	}
+	b, added := f.Add(current, time.Now(), d.keep())
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Version": b.Version,
+	})
+	if !added {
+		mLogger.Debugf("Presets unchanged\n")
+		return b, false, nil
+	}
+	if err := f.Save(d.file()); err != nil {
+		return Backup{}, false, err
+	}
+	mLogger.Infof("Backed up the presets of %d speakers\n", len(b.Speakers))
+	return b, true, nil
+}
+
+// Backups returns the stored backups, oldest first
+func (d *Presets) Backups() ([]Backup, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := Load(d.file())
+	if err != nil {
+		return nil, err
+	}
+	return f.Backups, nil
+}
+
+// Push stores the presets of the speaker from, as backed up in version, on the speakers to.
+// The latest version is used if version is 0. If from is empty every speaker gets its own
+// presets back. Push returns the number of presets changed per speaker.
+func (d *Presets) Push(to []string, from string, version int) (map[string]int, error) {
+	d.mu.Lock()
+	f, err := Load(d.file())
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := f.Version(version)
+	if !ok {
+		return nil, fmt.Errorf("no backup with version %d", version)
+	}
+	var source SpeakerPresets
+	if from != "" {
+		if source, ok = b.Speaker(from); !ok {
+			return nil, fmt.Errorf("no presets of %s in version %d", from, b.Version)
+		}
+	}
+
+	known := map[string]*soundtouch.Speaker{}
+	for _, s := range d.knownSpeakers() {
+		known[s.Name()] = s
+	}
+	changed := map[string]int{}
+	for _, n := range to {
+		s, ok := known[n]
+		if !ok {
+			return changed, fmt.Errorf("unknown speaker %s", n)
+		}
+		sp := source
+		if from == "" {
+			if sp, ok = b.Speaker(s.DeviceID()); !ok {
+				return changed, fmt.Errorf("no presets of %s in version %d", n, b.Version)
+			}
+		}
+		c, err := Push(s, sp)
+		changed[n] = c
+		if err != nil {
+			return changed, err
+		}
+		log.WithFields(log.Fields{
+			"Plugin":  name,
+			"Speaker": n,
+			"Version": b.Version,
+		}).Infof("Pushed presets of %s, %d changed\n", sp.Name, c)
+	}
+	return changed, nil
+}
@@ -0,0 +1,144 @@
+package presets
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+)
+
+var (
+	swr3 = &simulator.ContentItem{Source: "TUNEIN", Type: "stationurl", Location: "/v1/playback/station/s24896", IsPresetable: true, ItemName: "SWR3"}
+	dlf  = &simulator.ContentItem{Source: "TUNEIN", Type: "stationurl", Location: "/v1/playback/station/s42828", IsPresetable: true, ItemName: "Deutschlandfunk"}
+	aux  = &simulator.ContentItem{Source: "AUX", SourceAccount: "AUX", IsPresetable: true}
+)
+
+// simulate starts the simulated speakers Kitchen, with SWR3 and AUX as presets 1 and 2, and
+// Office, with SWR3 and Deutschlandfunk as presets 1 and 3
+func simulate(t *testing.T) (n *simulator.Network, kitchen, office *simulator.Device) {
+	n = simulatortest.Simulate(t, "Kitchen", "Office")
+	kitchen, office = n.Device("Kitchen"), n.Device("Office")
+	kitchen.StorePreset(1, swr3)
+	kitchen.StorePreset(2, aux)
+	office.StorePreset(1, swr3)
+	office.StorePreset(3, dlf)
+	return n, kitchen, office
+}
+
+// slots returns the names of the presets stored on dev by ID
+func slots(dev *simulator.Device) map[int]string {
+	m := map[int]string{}
+	for _, p := range dev.Presets() {
+		m[p.ID] = p.ContentItem.Source + " " + p.ContentItem.ItemName
+	}
+	return m
+}
+
+func TestPresets_Backup(t *testing.T) {
+	n, kitchen, _ := simulate(t)
+	file := filepath.Join(t.TempDir(), "presets.json")
+	d := NewPresets(Config{File: file, Keep: 2})
+	d.speakers = n
+
+	current := d.Current()
+	if len(current) != 2 || current[0].Name != "Kitchen" || current[0].Slot(1).Name != "SWR3" {
+		t.Fatalf("Current() = %+v, want the presets of Kitchen and Office", current)
+	}
+	if got := Differences(current); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("Differences() = %v, want [2 3]", got)
+	}
+
+	b, added, err := d.Backup()
+	if err != nil || !added || b.Version != 1 {
+		t.Fatalf("Backup() = %v, %v, %v, want version 1 added", b.Version, added, err)
+	}
+	if b, added, _ = d.Backup(); added || b.Version != 1 {
+		t.Errorf("Backup() of unchanged presets = %v, %v, want version 1 not added", b.Version, added)
+	}
+	kitchen.StorePreset(4, dlf)
+	d.Backup()
+	kitchen.StorePreset(5, dlf)
+	d.Backup()
+
+	backups, err := d.Backups()
+	if err != nil {
+		t.Fatalf("Backups() error = %v", err)
+	}
+	if len(backups) != 2 || backups[0].Version != 2 || backups[1].Version != 3 {
+		t.Errorf("Backups() kept %d, want versions 2 and 3", len(backups))
+	}
+}
+
+func TestPresets_Push(t *testing.T) {
+	n, kitchen, office := simulate(t)
+	file := filepath.Join(t.TempDir(), "presets.json")
+	d := NewPresets(Config{File: file})
+	d.speakers = n
+	if _, _, err := d.Backup(); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+
+	changed, err := d.Push([]string{"Office"}, "Kitchen", 0)
+	if err != nil || changed["Office"] != 2 {
+		t.Errorf("Push(Office, Kitchen) = %v, %v, want 2 changed", changed, err)
+	}
+	want := map[int]string{1: "TUNEIN SWR3", 2: "AUX "}
+	if got := slots(office); !reflect.DeepEqual(got, want) {
+		t.Errorf("Office presets = %v, want %v", got, want)
+	}
+	if got := office.Received("/storePreset"); len(got) != 1 {
+		t.Errorf("Office received %d /storePreset, want 1 leaving SWR3 alone", len(got))
+	}
+
+	// a factory reset speaker gets its own presets back
+	for id := 1; id <= Slots; id++ {
+		kitchen.StorePreset(id, nil)
+	}
+	if _, err := d.Push([]string{"Kitchen"}, "", 1); err != nil {
+		t.Errorf("Push(Kitchen) error = %v", err)
+	}
+	if got := slots(kitchen); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kitchen presets = %v, want %v", got, want)
+	}
+
+	if _, err := d.Push([]string{"Bathroom"}, "Kitchen", 0); err == nil {
+		t.Errorf("Push(Bathroom) expected error")
+	}
+	if _, err := d.Push([]string{"Office"}, "Kitchen", 7); err == nil {
+		t.Errorf("Push() of version 7 expected error")
+	}
+}
+
+func TestFile_Add(t *testing.T) {
+	f := &File{Format: FileFormat}
+	taken := time.Date(2024, 3, 1, 3, 0, 0, 0, time.UTC)
+	kitchen := SpeakerPresets{Name: "Kitchen", DeviceID: "K", Presets: []Preset{{ID: 1, ContentItem: &ContentItem{Source: "AUX"}}}}
+	office := SpeakerPresets{Name: "Office", DeviceID: "O"}
+
+	f.Add([]SpeakerPresets{office, kitchen}, taken, 0)
+	b, added := f.Add([]SpeakerPresets{kitchen}, taken.Add(time.Hour), 0)
+	if added {
+		t.Errorf("Add() without Office added version %d, want Office carried over", b.Version)
+	}
+	if len(b.Speakers) != 2 || b.Speakers[0].Name != "Kitchen" {
+		t.Errorf("Add() speakers = %+v, want Kitchen and Office", b.Speakers)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Load(filepath.Join(dir, "presets.json"))
+	if err != nil || len(f.Backups) != 0 {
+		t.Errorf("Load() of a missing file = %v, %v, want no backups", f, err)
+	}
+
+	file := filepath.Join(dir, "newer.json")
+	os.WriteFile(file, []byte(`{"format": 2, "backups": []}`), 0644)
+	if _, err := Load(file); err == nil {
+		t.Errorf("Load() of format 2 expected error")
+	}
+}
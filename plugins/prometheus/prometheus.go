@@ -0,0 +1,240 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "Prometheus"
+
+const description = "Serves metrics about speakers and plugins to Prometheus"
+
+const sampleConfig = `
+## Enabling the metrics endpoint. Metrics are collected only if this section is present.
+# [prometheus]
+
+## address the server listens on. Listen on ":2112" to be scraped from other hosts.
+# listen = "127.0.0.1:2112"
+
+## path the metrics are served at
+# path = "/metrics"
+
+`
+
+func init() {
+	plugins.Add("prometheus", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewPrometheus(*config.(*Config)) },
+	})
+}
+
+// Config contains the configuration of the plugin
+// Listen the address the server listens on, 127.0.0.1:2112 if empty
+// Path the path the metrics are served at, /metrics if empty
+type Config struct {
+	Listen string `toml:"listen"`
+	Path   string `toml:"path"`
+}
+
+// refreshInterval is the interval the state of the speakers is queried in
+const refreshInterval = 30 * time.Second
+
+// Prometheus describes the plugin. It has a
+// Config to store the configuration
+// host to access the hosted plugins
+// server serving the metrics
+// suspended indicates that the plugin is temporarely suspended
+// speakers looks up the speakers whose state is reported
+// mu guards the gauges of the speakers while they are refreshed or written
+// cancel and running stop the refresh of the speakers
+type Prometheus struct {
+	Config
+	host      plugins.Host
+	server    *http.Server
+	suspended atomic.Bool
+	speakers  plugins.Speakers
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+}
+
+// NewPrometheus creates a new Prometheus plugin with the configuration
+func NewPrometheus(config Config) (d *Prometheus) {
+	d = &Prometheus{speakers: plugins.Discovered{}}
+	d.Config = config
+	if d.Listen == "" {
+		d.Listen = "127.0.0.1:2112"
+	}
+	if d.Path == "" {
+		d.Path = "/metrics"
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	mLogger.Debugf("Initialised\n")
+
+	return d
+}
+
+// Name returns the plugin name
+func (d *Prometheus) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Prometheus) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Prometheus) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Prometheus) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Prometheus) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Prometheus) Enable() { d.suspended.Store(false) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Prometheus) IsEnabled() bool { return !d.suspended.Load() }
+
+// Execute does nothing. Updates and plugin executions are counted by the host.
+func (d *Prometheus) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+}
+
+// SetHost gives the plugin access to the hosted plugins
+func (d *Prometheus) SetHost(h plugins.Host) { d.host = h }
+
+// Start starts collecting metrics, refreshing the state of the speakers and serving them
+func (d *Prometheus) Start(ctx context.Context) error {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	l, err := net.Listen("tcp", d.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(d.Path, d.serveMetrics)
+	d.server = &http.Server{Handler: mux}
+	metrics.Enable()
+
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		d.refreshSpeakers(ctx)
+	}()
+
+	go func() {
+		mLogger.Infof("Serving metrics on %s%s\n", l.Addr(), d.Path)
+		if err := d.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			mLogger.Errorf("Serving failed. %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving the metrics. They are still collected, so that the counters do not start
+// over when the plugin is restarted on a reload.
+func (d *Prometheus) Stop(ctx context.Context) error {
+	if d.server == nil {
+		return nil
+	}
+	d.cancel()
+	if err := plugins.Wait(ctx, &d.running); err != nil {
+		return err
+	}
+	return d.server.Shutdown(ctx)
+}
+
+// serveMetrics collects the state of the plugins and writes all metrics. The state of the speakers
+// is the one of the last refresh, so that a scrape never waits for a speaker.
+func (d *Prometheus) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if d.suspended.Load() {
+		http.Error(w, "metrics are suspended", http.StatusServiceUnavailable)
+		return
+	}
+	d.collectPlugins()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := metrics.Write(w); err != nil {
+		log.WithFields(log.Fields{
+			"Plugin": name,
+		}).Errorf("Writing metrics failed. %v\n", err)
+	}
+}
+
+// collectPlugins sets the gauges describing the current state of the plugins
+func (d *Prometheus) collectPlugins() {
+	metrics.PluginEnabled.Reset()
+	if d.host != nil {
+		for _, p := range d.host.Plugins() {
+			metrics.PluginEnabled.SetBool(p.IsEnabled(), p.Name())
+		}
+	}
+}
+
+// refreshSpeakers collects the state of the speakers every refreshInterval until ctx is done
+func (d *Prometheus) refreshSpeakers(ctx context.Context) {
+	d.collectSpeakers()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.collectSpeakers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// speakerState is the state of a speaker as reported by the gauges
+type speakerState struct {
+	name             string
+	alive, poweredOn bool
+	zoneMembers      int
+}
+
+// collectSpeakers queries the state of the speakers and sets the gauges describing it. The
+// speakers are queried before the gauges are locked, so that a scrape never waits for them.
+func (d *Prometheus) collectSpeakers() {
+	var states []speakerState
+	for _, s := range d.speakers.Known() {
+		st := speakerState{name: s.Name(), alive: s.IsAlive(), poweredOn: s.IsPoweredOn()}
+		if z, err := s.GetZone(); err == nil && z.Master == s.DeviceID() {
+			st.zoneMembers = len(z.Members)
+		}
+		states = append(states, st)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	metrics.SpeakerAlive.Reset()
+	metrics.SpeakerPoweredOn.Reset()
+	metrics.ZoneMembers.Reset()
+	for _, st := range states {
+		metrics.SpeakerAlive.SetBool(st.alive, st.name)
+		metrics.SpeakerPoweredOn.SetBool(st.poweredOn, st.name)
+		if st.zoneMembers > 0 {
+			metrics.ZoneMembers.Set(float64(st.zoneMembers), st.name)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins/logger"
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+type fakeHost []soundtouch.Plugin
+
+func (h fakeHost) Plugins() []soundtouch.Plugin { return h }
+
+func TestPrometheus(t *testing.T) {
+	n := simulatortest.Simulate(t, "Office", "Kitchen")
+	n.Device("Office").Play(simulator.NowPlaying{Source: "TUNEIN", StationName: "SWR3"})
+
+	l := logger.NewLogger(logger.Config{})
+	l.Disable()
+	d := NewPrometheus(Config{Listen: "127.0.0.1:0"})
+	d.speakers = n
+	d.SetHost(fakeHost{l, d})
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(metrics.Disable)
+	metrics.Actions.Inc("AutoOff", "PowerOff")
+	d.collectSpeakers()
+
+	body := scrape(d)
+	for _, want := range []string{
+		`soundtouch_plugin_actions_total{plugin="AutoOff",action="PowerOff"} 1`,
+		`soundtouch_plugin_enabled{plugin="Logger"} 0`,
+		`soundtouch_plugin_enabled{plugin="Prometheus"} 1`,
+		`soundtouch_speaker_alive{speaker="Kitchen"} 0`,
+		`soundtouch_speaker_alive{speaker="Office"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %s in\n%s", want, body)
+		}
+	}
+
+	// a scrape reports the state of the last refresh without asking the speakers
+	n.Device("Office").PowerOff()
+	want := `soundtouch_speaker_powered_on{speaker="Office"} 1`
+	if body := scrape(d); !strings.Contains(body, want+"\n") {
+		t.Errorf("metrics missing %s before the refresh in\n%s", want, body)
+	}
+	d.collectSpeakers()
+	want = `soundtouch_speaker_powered_on{speaker="Office"} 0`
+	if body := scrape(d); !strings.Contains(body, want+"\n") {
+		t.Errorf("metrics missing %s after the refresh in\n%s", want, body)
+	}
+
+	// a reload restarts the plugin, the counters go on
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	metrics.Actions.Inc("AutoOff", "PowerOff")
+	d = NewPrometheus(Config{Listen: "127.0.0.1:0"})
+	d.speakers = n
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start() after Stop() error = %v", err)
+	}
+	defer d.Stop(context.Background())
+	want = `soundtouch_plugin_actions_total{plugin="AutoOff",action="PowerOff"} 2`
+	if body := scrape(d); !strings.Contains(body, want+"\n") {
+		t.Errorf("metrics missing %s after restart in\n%s", want, body)
+	}
+}
+
+// scrape returns the metrics served by d
+func scrape(d *Prometheus) string {
+	w := httptest.NewRecorder()
+	d.serveMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestNewPrometheus(t *testing.T) {
+	if d := NewPrometheus(Config{}); d.Listen != "127.0.0.1:2112" || d.Path != "/metrics" {
+		t.Errorf("NewPrometheus() listens on %s%s, want 127.0.0.1:2112/metrics", d.Listen, d.Path)
+	}
+}
@@ -0,0 +1,220 @@
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+var name = "Recorder"
+
+const description = "Records update messages for later replay"
+
+const sampleConfig = `
+## Enabling the recorder plugin
+# [recorder]
+
+## file the updates are appended to, one JSON object per line.
+## Replay with "masteringsoundtouch replay <file>"
+# file = "updates.jsonl"
+
+## speakers for which updates should be recorded. If empty, all
+# speakers = ["Office", "Kitchen"]
+
+`
+
+func init() {
+	plugins.Add("recorder", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewRecorder(*config.(*Config)) },
+	})
+}
+
+// Config contains the configuration of the plugin
+// File the recording is appended to, updates.jsonl if empty
+// Speakers list of SpeakerNames the handler is added. All if empty
+type Config struct {
+	File     string   `toml:"file"`
+	Speakers []string `toml:"speakers"`
+}
+
+// References returns the speakers the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers}
+}
+
+// Record is a recorded update
+// Time the update has been received
+// DeviceID of the speaker sending the update
+// Speaker the name of the speaker
+// Type the message type of the update
+// Raw the update as sent by the speaker
+type Record struct {
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"deviceID"`
+	Speaker  string    `json:"speaker"`
+	Type     string    `json:"type"`
+	Raw      string    `json:"raw"`
+}
+
+// Recorder describes the plugin. It has a
+// Config to store the configuration
+// file the recording is written to
+// suspended indicates that the plugin is temporarely suspended
+type Recorder struct {
+	Config
+	mu        sync.Mutex
+	file      *os.File
+	enc       *json.Encoder
+	suspended atomic.Bool
+}
+
+// NewRecorder creates a new Recorder plugin with the configuration
+func NewRecorder(config Config) (d *Recorder) {
+	d = &Recorder{}
+	d.Config = config
+	if d.File == "" {
+		d.File = "updates.jsonl"
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	mLogger.Debugf("Initialised\n")
+
+	return d
+}
+
+// Name returns the plugin name
+func (d *Recorder) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Recorder) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Recorder) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Recorder) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Recorder) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Recorder) Enable() { d.suspended.Store(false) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Recorder) IsEnabled() bool { return !d.suspended.Load() }
+
+// Start opens the recording for appending
+func (d *Recorder) Start(ctx context.Context) error {
+	f, err := os.OpenFile(d.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.file = f
+	d.enc = json.NewEncoder(f)
+	return nil
+}
+
+// Stop closes the recording
+func (d *Recorder) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file, d.enc = nil, nil
+	return err
+}
+
+// Execute runs the plugin with the given parameter
+func (d *Recorder) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if len(d.Speakers) > 0 && !slices.Contains(d.Speakers, speaker.Name()) {
+		return
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+
+	raw, ok := rawOf(update)
+	if !ok {
+		mLogger.Debugln("Update carries no raw message. Not recorded.")
+		return
+	}
+	rec := Record{
+		Time:     time.Now(),
+		DeviceID: speaker.DeviceID(),
+		Speaker:  speaker.Name(),
+		Type:     reflect.TypeOf(update.Value).Name(),
+		Raw:      string(raw),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.enc == nil {
+		return
+	}
+	if err := d.enc.Encode(rec); err != nil {
+		mLogger.Errorf("Recording to %s failed. %v\n", d.File, err)
+	}
+}
+
+// rawOf returns the message the update has been decoded from
+func rawOf(update soundtouch.Update) ([]byte, bool) {
+	if update.Value == nil {
+		return nil, false
+	}
+	v := reflect.ValueOf(update.Value)
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+	f := v.FieldByName("Raw")
+	if !f.IsValid() || f.Type() != reflect.TypeOf([]byte(nil)) || f.Len() == 0 {
+		return nil, false
+	}
+	return f.Bytes(), true
+}
+
+// Read calls fn for every record of a recording in order. Reading stops at the first error
+// returned by fn.
+func Read(r io.Reader, fn func(rec Record) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,86 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func TestRecorder_Execute(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "updates.jsonl")
+	d := NewRecorder(Config{File: file, Speakers: []string{"Office"}})
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	office := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: "Office", DeviceID: "A0F6FD4E8B31"}}
+	kitchen := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: "Kitchen", DeviceID: "689E19B8BB8A"}}
+	d.Execute(name, soundtouch.Update{Value: soundtouch.Volume{Raw: []byte("<volume/>")}}, office)
+	d.Execute(name, soundtouch.Update{Value: soundtouch.Volume{Raw: []byte("<volume/>")}}, kitchen)
+	d.Execute(name, soundtouch.Update{Value: soundtouch.NowPlaying{}}, office)
+	d.Execute(name, soundtouch.Update{Value: soundtouch.NowPlaying{Raw: []byte("<nowPlaying/>")}}, office)
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []string
+	err = Read(f, func(rec Record) error {
+		if rec.Time.IsZero() || rec.DeviceID != "A0F6FD4E8B31" {
+			t.Errorf("Read() record %+v misses time or device ID", rec)
+		}
+		got = append(got, rec.Speaker+" "+rec.Type+" "+rec.Raw)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	want := []string{"Office Volume <volume/>", "Office NowPlaying <nowPlaying/>"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read() = %v, want %v", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	stop := errors.New("stop")
+	tests := []struct {
+		name      string
+		recording string
+		want      int
+		wantErr   bool
+	}{
+		{"empty", "", 0, false},
+		{"blank lines", "{\"speaker\":\"Office\"}\n\n{\"speaker\":\"Kitchen\"}\n", 2, false},
+		{"invalid", "{\"speaker\":\"Office\"}\nnot json\n", 1, true},
+		{"stopped", "{\"speaker\":\"Office\"}\n{\"speaker\":\"stop\"}\n{\"speaker\":\"Kitchen\"}\n", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n int
+			err := Read(strings.NewReader(tt.recording), func(rec Record) error {
+				if rec.Speaker == "stop" {
+					return stop
+				}
+				n++
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != tt.want {
+				t.Errorf("Read() records = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package plugins
+
+import (
+	"reflect"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// MessageTypes lists the names of the update message types plugins can filter on
+var MessageTypes = []string{
+	reflect.TypeOf(soundtouch.ConnectionStateUpdated{}).Name(),
+	reflect.TypeOf(soundtouch.NowPlaying{}).Name(),
+	reflect.TypeOf(soundtouch.Volume{}).Name(),
+}
+
+// References lists the names a plugin configuration refers to
+// Speakers names of speakers
+// MessageTypes names of update message types
+type References struct {
+	Speakers     []string
+	MessageTypes []string
+}
+
+// Referrer is implemented by plugin configurations that refer to speakers or message types by
+// name. This allows to check them before the plugin runs.
+type Referrer interface {
+	References() References
+}
@@ -0,0 +1,188 @@
+package plugins
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Creator describes how a plugin is configured and instantiated.
+// SampleConfig text explaining how the plugin should be configured
+// NewConfig returns a pointer to an empty configuration a section is decoded into
+// New creates the plugin with the decoded configuration
+type Creator struct {
+	SampleConfig string
+	NewConfig    func() interface{}
+	New          func(config interface{}) soundtouch.Plugin
+}
+
+var registry = map[string]Creator{}
+
+// Validator is implemented by configurations that check their values beyond what the toml
+// decoder does, e.g. durations given as strings. Instance.Validate rejects a section that is not
+// valid, once the environment variables have been applied.
+type Validator interface {
+	Validate() error
+}
+
+// Add registers a plugin under the name of its toml section. It is intended to be called
+// from the init function of the plugin package.
+func Add(section string, creator Creator) {
+	if _, exists := registry[section]; exists {
+		panic(fmt.Sprintf("plugin section %s registered twice", section))
+	}
+	registry[section] = creator
+}
+
+// Get returns the Creator registered for section
+func Get(section string) (Creator, bool) {
+	c, ok := registry[section]
+	return c, ok
+}
+
+// Sections returns the sorted names of all registered sections
+func Sections() []string {
+	s := make([]string, 0, len(registry))
+	for section := range registry {
+		s = append(s, section)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// Instance is a configured plugin section. A section given as array of tables, e.g. [[logger]],
+// results in one Instance per table.
+// Section the name of the toml section
+// Alias optional name distinguishing several instances of the same section
+// Config the decoded configuration
+// Supervision how the plugin is run, given by the optional sub-table supervisor
+// Filter the updates the plugin is executed with, given by the optional sub-table filter
+// Table the section as read from the config file
+// Line the line of the section in the config file
+type Instance struct {
+	Section     string
+	Alias       string
+	Config      interface{}
+	Supervision Supervision
+	Filter      Filter
+	Table       *ast.Table
+	Line        int
+}
+
+// ID identifies the instance in the form section or section.alias
+func (i *Instance) ID() string {
+	if i.Alias == "" {
+		return i.Section
+	}
+	return i.Section + "." + i.Alias
+}
+
+// Validate checks the configuration of the instance if it is a Validator
+func (i *Instance) Validate() error {
+	if v, ok := i.Config.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("line %d: [%s] %v", i.Line, i.ID(), err)
+		}
+	}
+	return nil
+}
+
+// Create instantiates the plugin configured by the instance
+func (i *Instance) Create() soundtouch.Plugin {
+	p := registry[i.Section].New(i.Config)
+	if i.Alias == "" {
+		return p
+	}
+	return &aliased{Plugin: p, alias: i.Alias}
+}
+
+// Decode decodes the table of a registered section into Instances. The optional key alias names
+// the instance, the optional sub-tables supervisor and filter configure how it is run and
+// which updates it is executed with.
+func Decode(section string, field interface{}) ([]*Instance, error) {
+	creator, ok := registry[section]
+	if !ok {
+		return nil, fmt.Errorf("unknown section [%s]", section)
+	}
+
+	var tables []*ast.Table
+	switch t := field.(type) {
+	case *ast.Table:
+		tables = []*ast.Table{t}
+	case []*ast.Table:
+		tables = t
+	default:
+		return nil, fmt.Errorf("%s is not a section", section)
+	}
+
+	instances := make([]*Instance, 0, len(tables))
+	for _, tbl := range tables {
+		inst := &Instance{Section: section, Table: tbl, Line: tbl.Line}
+
+		if kv, ok := tbl.Fields["alias"].(*ast.KeyValue); ok {
+			s, ok := kv.Value.(*ast.String)
+			if !ok {
+				return nil, fmt.Errorf("line %d: alias of [%s] must be a string", kv.Line, section)
+			}
+			inst.Alias = s.Value
+			delete(tbl.Fields, "alias")
+		}
+
+		if st, ok := tbl.Fields["supervisor"].(*ast.Table); ok {
+			if err := toml.UnmarshalTable(st, &inst.Supervision); err != nil {
+				return nil, fmt.Errorf("[%s.supervisor]: %v", section, err)
+			}
+			if err := inst.Supervision.validate(); err != nil {
+				return nil, fmt.Errorf("line %d: [%s.supervisor] %v", st.Line, section, err)
+			}
+			delete(tbl.Fields, "supervisor")
+		}
+
+		if st, ok := tbl.Fields["filter"].(*ast.Table); ok {
+			if err := toml.UnmarshalTable(st, &inst.Filter); err != nil {
+				return nil, fmt.Errorf("[%s.filter]: %v", section, err)
+			}
+			if _, err := inst.Filter.Compile(); err != nil {
+				return nil, fmt.Errorf("line %d: [%s.filter] %v", st.Line, section, err)
+			}
+			delete(tbl.Fields, "filter")
+		}
+
+		inst.Config = creator.NewConfig()
+		if err := toml.UnmarshalTable(tbl, inst.Config); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", inst.ID(), err)
+		}
+		instances = append(instances, inst)
+	}
+
+	if len(instances) > 1 {
+		seen := map[string]bool{}
+		for n, inst := range instances {
+			if inst.Alias == "" {
+				inst.Alias = fmt.Sprint(n + 1)
+			}
+			if seen[inst.Alias] {
+				return nil, fmt.Errorf("line %d: alias %s of [[%s]] used twice", inst.Line, inst.Alias, section)
+			}
+			seen[inst.Alias] = true
+		}
+	}
+	return instances, nil
+}
+
+// aliased renames a plugin so that several instances of it can be told apart
+type aliased struct {
+	soundtouch.Plugin
+	alias string
+}
+
+// Name returns the plugin name followed by the alias of the instance
+func (a *aliased) Name() string {
+	return fmt.Sprintf("%s[%s]", a.Plugin.Name(), a.alias)
+}
+
+// Unwrap returns the renamed plugin
+func (a *aliased) Unwrap() soundtouch.Plugin { return a.Plugin }
@@ -0,0 +1,636 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-automation/plugins/scenes"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+var name = "Rules"
+
+const description = "Runs actions when updates match configured rules"
+
+const sampleConfig = `
+## Enabling the rules plugin. Every [[rules]] table is one rule.
+# [[rules]]
+# alias = "tv-off"
+## optional time that has to pass before the rule fires again
+# cooldown = "1m"
+
+## when the rule is triggered. Every criterion given has to match.
+#	[rules.when]
+#		speakers = ["Wohnzimmer"]
+#		types = ["NowPlaying"]
+#		sources = ["PRODUCT"]
+## transitions: the play status or source before the NowPlaying update
+#		# from_play_status = ["PLAY_STATE"]
+#		# play_status = ["STOP_STATE", "PAUSE_STATE"]
+#		# from_sources = ["STANDBY"]
+#		# artists = ["Die drei ???"]
+#		# time = ["07:00-09:30"]
+#		# expression = 'volume > 40'
+
+## conditions on the state of other speakers, all have to hold
+#	[[rules.if]]
+#		speaker = "Küche"
+#		powered_on = true
+#		# sources = ["TUNEIN"]
+#		# play_status = ["PLAY_STATE"]
+#		# expression = 'volume < 30'
+
+## actions: power_on, power_off, set_volume, preset, join_zone, leave_zone, notify,
+## capture_scene, restore_scene
+## speakers default to the speaker that triggered the rule
+#	[[rules.then]]
+#		do = "power_off"
+#		speakers = ["Küche", "Schrank"]
+#	[[rules.then]]
+#		do = "notify"
+#		message = "{{.Speaker}} is playing TV"
+#		after = "10s"
+`
+
+func init() {
+	plugins.Add("rules", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewRules(*config.(*Config)) },
+	})
+}
+
+// The actions a rule can run
+const (
+	PowerOn   = "power_on"
+	PowerOff  = "power_off"
+	SetVolume = "set_volume"
+	Preset    = "preset"
+	JoinZone  = "join_zone"
+	LeaveZone = "leave_zone"
+	Notify    = "notify"
+	Capture   = "capture_scene"
+	Restore   = "restore_scene"
+)
+
+var actions = []string{PowerOn, PowerOff, SetVolume, Preset, JoinZone, LeaveZone, Notify, Capture, Restore}
+
+var presets = []soundtouch.Key{
+	soundtouch.PRESET_1, soundtouch.PRESET_2, soundtouch.PRESET_3,
+	soundtouch.PRESET_4, soundtouch.PRESET_5, soundtouch.PRESET_6,
+}
+
+// Config contains one rule
+// When the updates triggering the rule
+// Conditions on the state of speakers that have to hold when the rule is triggered
+// Actions run if the rule fires
+// Cooldown time the rule doesn't fire again after it fired, e.g. "1m"
+type Config struct {
+	When       Trigger     `toml:"when"`
+	Conditions []Condition `toml:"if"`
+	Actions    []Action    `toml:"then"`
+	Cooldown   string      `toml:"cooldown"`
+}
+
+// Trigger selects the updates firing a rule. Every criterion given has to match. Sources,
+// artists and play states are those of the speaker after the update.
+// Speakers names of the speakers
+// Types message types, e.g. "NowPlaying"
+// Sources sources the speaker is playing from, e.g. "PRODUCT"
+// Artists artists the speaker is playing
+// PlayStatus play states of the speaker, e.g. "PLAY_STATE"
+// FromPlayStatus play states of the speaker before a NowPlaying update changing it
+// FromSources sources of the speaker before a NowPlaying update changing it
+// Time local times of the day in the form "07:00-09:30"
+// Expression a boolean expression on the values of the update, see plugins.Values
+type Trigger struct {
+	Speakers       []string `toml:"speakers"`
+	Types          []string `toml:"types"`
+	Sources        []string `toml:"sources"`
+	Artists        []string `toml:"artists"`
+	PlayStatus     []string `toml:"play_status"`
+	FromPlayStatus []string `toml:"from_play_status"`
+	FromSources    []string `toml:"from_sources"`
+	Time           []string `toml:"time"`
+	Expression     string   `toml:"expression"`
+}
+
+func (t Trigger) filter() plugins.Filter {
+	return plugins.Filter{
+		Speakers:   t.Speakers,
+		Types:      t.Types,
+		Sources:    t.Sources,
+		Artists:    t.Artists,
+		PlayStatus: t.PlayStatus,
+		Time:       t.Time,
+		Expression: t.Expression,
+	}
+}
+
+// isTransition returns true if the trigger requires a change of play status or source
+func (t Trigger) isTransition() bool {
+	return len(t.FromPlayStatus) > 0 || len(t.FromSources) > 0
+}
+
+// Condition is a requirement on the state of a speaker
+// Speaker name of the speaker, the triggering speaker if empty
+// PoweredOn whether the speaker has to be on or in standby
+// Sources sources the speaker has to play from
+// PlayStatus play states the speaker has to be in
+// Expression a boolean expression on the state of the speaker, see plugins.Values
+type Condition struct {
+	Speaker    string   `toml:"speaker"`
+	PoweredOn  *bool    `toml:"powered_on"`
+	Sources    []string `toml:"sources"`
+	PlayStatus []string `toml:"play_status"`
+	Expression string   `toml:"expression"`
+}
+
+func (c Condition) filter() plugins.Filter {
+	return plugins.Filter{Sources: c.Sources, PlayStatus: c.PlayStatus, Expression: c.Expression}
+}
+
+// Action is run when a rule fires
+// Do the action, one of power_on, power_off, set_volume, preset, join_zone, leave_zone, notify,
+// capture_scene, restore_scene
+// Speakers names of the speakers the action is run on, the triggering speaker if empty
+// Volume the volume set by set_volume
+// Preset the preset 1-6 selected by preset
+// Master name of the zone master for join_zone, the triggering speaker if empty
+// Message the text sent by notify. It is a text/template on plugins.Values, e.g. "{{.Speaker}}"
+// Scene the name of the scene captured or restored
+// After delay before the action is run, e.g. "30s"
+type Action struct {
+	Do       string   `toml:"do"`
+	Speakers []string `toml:"speakers"`
+	Volume   int      `toml:"volume"`
+	Preset   int      `toml:"preset"`
+	Master   string   `toml:"master"`
+	Message  string   `toml:"message"`
+	Scene    string   `toml:"scene"`
+	After    string   `toml:"after"`
+}
+
+// References returns the speakers and message types the rule refers to
+func (c *Config) References() plugins.References {
+	r := plugins.References{MessageTypes: c.When.Types}
+	r.Speakers = append(r.Speakers, c.When.Speakers...)
+	for _, cond := range c.Conditions {
+		if cond.Speaker != "" {
+			r.Speakers = append(r.Speakers, cond.Speaker)
+		}
+	}
+	for _, a := range c.Actions {
+		r.Speakers = append(r.Speakers, a.Speakers...)
+		if a.Master != "" {
+			r.Speakers = append(r.Speakers, a.Master)
+		}
+	}
+	return r
+}
+
+// Validate checks the trigger, the conditions and the actions of the rule
+func (c *Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+// rule is a compiled Config
+type rule struct {
+	trigger    *plugins.Matcher
+	conditions []*plugins.Matcher
+	messages   []*template.Template
+	delays     []time.Duration
+	cooldown   time.Duration
+}
+
+func (c *Config) compile() (*rule, error) {
+	r := &rule{}
+	var err error
+	if r.trigger, err = c.When.filter().Compile(); err != nil {
+		return nil, fmt.Errorf("when: %v", err)
+	}
+	if c.Cooldown != "" {
+		if r.cooldown, err = time.ParseDuration(c.Cooldown); err != nil {
+			return nil, fmt.Errorf("cooldown: %v", err)
+		}
+	}
+	for i, cond := range c.Conditions {
+		m, err := cond.filter().Compile()
+		if err != nil {
+			return nil, fmt.Errorf("if %d: %v", i+1, err)
+		}
+		r.conditions = append(r.conditions, m)
+	}
+	if len(c.Actions) == 0 {
+		return nil, fmt.Errorf("no actions given in then")
+	}
+	for i, a := range c.Actions {
+		if !slices.Contains(actions, a.Do) {
+			return nil, fmt.Errorf("then %d: unknown action %q, expected one of %s", i+1, a.Do, strings.Join(actions, ", "))
+		}
+		if a.Do == Preset && (a.Preset < 1 || a.Preset > len(presets)) {
+			return nil, fmt.Errorf("then %d: preset %d not in 1-%d", i+1, a.Preset, len(presets))
+		}
+		if (a.Do == Capture || a.Do == Restore) && a.Scene == "" {
+			return nil, fmt.Errorf("then %d: no scene given", i+1)
+		}
+		if a.Do == SetVolume && (a.Volume < 0 || a.Volume > 100) {
+			return nil, fmt.Errorf("then %d: volume %d not in 0-100", i+1, a.Volume)
+		}
+		var delay time.Duration
+		if a.After != "" {
+			if delay, err = time.ParseDuration(a.After); err != nil {
+				return nil, fmt.Errorf("then %d: after: %v", i+1, err)
+			}
+		}
+		r.delays = append(r.delays, delay)
+		msg, err := template.New("message").Parse(a.Message)
+		if err != nil {
+			return nil, fmt.Errorf("then %d: message: %v", i+1, err)
+		}
+		r.messages = append(r.messages, msg)
+	}
+	return r, nil
+}
+
+// Rules describes the plugin. It has a
+// Config to store the rule
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// rule the compiled rule, nil if the configuration is invalid
+// previous the last NowPlaying per device ID, to detect transitions
+// fired the time the rule fired last
+// speakers looks up the speakers the rule acts on
+type Rules struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	rule      *rule
+	previous  map[string]soundtouch.NowPlaying
+	fired     time.Time
+	bus       *bus.Bus
+	host      plugins.Host
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pending   sync.WaitGroup
+	speakers  plugins.Speakers
+}
+
+// NewRules creates a new Rules plugin with the configuration
+func NewRules(config Config) (d *Rules) {
+	d = &Rules{Config: config, previous: map[string]soundtouch.NowPlaying{}, speakers: plugins.Discovered{}}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	r, err := config.compile()
+	if err != nil {
+		mLogger.Errorf("Invalid rule: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.rule = r
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *Rules) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Rules) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Rules) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Rules) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Rules) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Rules) Enable() { d.suspended.Store(d.rule == nil) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Rules) IsEnabled() bool { return !d.suspended.Load() }
+
+// SetBus gives the plugin access to the state of the speakers the conditions refer to
+func (d *Rules) SetBus(b *bus.Bus) { d.bus = b }
+
+// SetHost gives the plugin access to the plugins delivering notifications
+func (d *Rules) SetHost(h plugins.Host) { d.host = h }
+
+// Start binds delayed actions to ctx
+func (d *Rules) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	return nil
+}
+
+// Stop drops delayed actions that are not yet due and waits for running ones
+func (d *Rules) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	d.cancel()
+	return plugins.Wait(ctx, &d.pending)
+}
+
+// Execute runs the plugin with the given parameter
+func (d *Rules) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if !d.IsEnabled() || update.Value == nil {
+		return
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+	mLogger.Traceln("Executing", pluginName)
+
+	previous, hadPrevious := d.previous[speaker.DeviceID()]
+	if np, ok := update.Value.(soundtouch.NowPlaying); ok {
+		d.previous[speaker.DeviceID()] = np
+	}
+
+	now := time.Now()
+	np, vol := d.state(speaker.DeviceID())
+	values := plugins.NewValues(update, speaker, np, vol, now)
+	if !d.rule.trigger.Match(values) {
+		return
+	}
+	if d.When.isTransition() && !d.isTransition(update, previous, hadPrevious) {
+		return
+	}
+	if d.rule.cooldown > 0 && now.Sub(d.fired) < d.rule.cooldown {
+		mLogger.Debugf("Triggered during cooldown. Ignoring.\n")
+		return
+	}
+	for i, cond := range d.Conditions {
+		if !d.holds(cond, d.rule.conditions[i], speaker, now) {
+			mLogger.Debugf("Condition %d does not hold. Not firing.\n", i+1)
+			return
+		}
+	}
+
+	mLogger.Infof("Rule fired\n")
+	d.fired = now
+	for i, a := range d.Actions {
+		if d.rule.delays[i] == 0 {
+			d.run(mLogger, i, a, speaker, values)
+			continue
+		}
+		d.pending.Add(1)
+		go func(i int, a Action) {
+			defer d.pending.Done()
+			select {
+			case <-time.After(d.rule.delays[i]):
+				d.run(mLogger, i, a, speaker, values)
+			case <-d.ctx.Done():
+			}
+		}(i, a)
+	}
+}
+
+// isTransition returns true if update changed the play status or source of the speaker from
+// one given by the trigger
+func (d *Rules) isTransition(update soundtouch.Update, previous soundtouch.NowPlaying, hadPrevious bool) bool {
+	np, ok := update.Value.(soundtouch.NowPlaying)
+	if !ok || !hadPrevious {
+		return false
+	}
+	if len(d.When.FromPlayStatus) > 0 {
+		if np.PlayStatus == previous.PlayStatus || !slices.Contains(d.When.FromPlayStatus, string(previous.PlayStatus)) {
+			return false
+		}
+	}
+	if len(d.When.FromSources) > 0 {
+		if np.Source == previous.Source || !slices.Contains(d.When.FromSources, string(previous.Source)) {
+			return false
+		}
+	}
+	return true
+}
+
+// state returns the latest known NowPlaying and Volume of the speaker given by name or device ID
+func (d *Rules) state(speaker string) (*soundtouch.NowPlaying, *soundtouch.Volume) {
+	if d.bus == nil {
+		return nil, nil
+	}
+	var np *soundtouch.NowPlaying
+	var vol *soundtouch.Volume
+	if e, ok := d.bus.Last(speaker, "NowPlaying"); ok {
+		v := e.Update.Value.(soundtouch.NowPlaying)
+		np = &v
+	}
+	if e, ok := d.bus.Last(speaker, "Volume"); ok {
+		v := e.Update.Value.(soundtouch.Volume)
+		vol = &v
+	}
+	return np, vol
+}
+
+// holds returns true if the condition holds. The state of the speaker is taken from the bus and
+// asked from the speaker if the bus doesn't know it.
+func (d *Rules) holds(cond Condition, m *plugins.Matcher, trigger soundtouch.Speaker, now time.Time) bool {
+	speaker := trigger
+	if cond.Speaker != "" && cond.Speaker != trigger.Name() {
+		s := d.speakers.ByName(cond.Speaker)
+		if s == nil {
+			return false
+		}
+		speaker = *s
+	}
+
+	np, vol := d.state(speaker.DeviceID())
+	if np == nil {
+		v, err := speaker.NowPlaying()
+		if err != nil {
+			return false
+		}
+		np = &v
+	}
+	if vol == nil && strings.TrimSpace(cond.Expression) != "" {
+		if v, err := speaker.Volume(); err == nil {
+			vol = &v
+		}
+	}
+
+	if cond.PoweredOn != nil && *cond.PoweredOn != (np.Source != "" && np.Source != "STANDBY") {
+		return false
+	}
+	return m.Match(plugins.NewValues(soundtouch.Update{}, speaker, np, vol, now))
+}
+
+// targets returns the speakers the action is run on
+func (d *Rules) targets(mLogger *log.Entry, a Action, trigger soundtouch.Speaker) []*soundtouch.Speaker {
+	if len(a.Speakers) == 0 {
+		return []*soundtouch.Speaker{&trigger}
+	}
+	var sp []*soundtouch.Speaker
+	for _, n := range a.Speakers {
+		s := d.speakers.ByName(n)
+		if s == nil {
+			mLogger.Errorf("Configured speaker %s not present in soundtouch network. Please check config file.\n", n)
+			continue
+		}
+		sp = append(sp, s)
+	}
+	return sp
+}
+
+// run runs the i-th action of the rule
+func (d *Rules) run(mLogger *log.Entry, i int, a Action, trigger soundtouch.Speaker, values plugins.Values) {
+	targets := d.targets(mLogger, a, trigger)
+	switch a.Do {
+	case PowerOn:
+		for _, s := range targets {
+			mLogger.Infof("Powering on %s\n", s.Name())
+			s.PowerOn()
+			metrics.Actions.Inc(name, "PowerOn")
+		}
+	case PowerOff:
+		for _, s := range targets {
+			mLogger.Infof("Powering off %s\n", s.Name())
+			s.PowerOff()
+			metrics.Actions.Inc(name, "PowerOff")
+		}
+	case SetVolume:
+		for _, s := range targets {
+			mLogger.Infof("Setting volume of %s to %d\n", s.Name(), a.Volume)
+			s.SetVolume(a.Volume)
+			metrics.Actions.Inc(name, "SetVolume")
+		}
+	case Preset:
+		for _, s := range targets {
+			mLogger.Infof("Selecting preset %d on %s\n", a.Preset, s.Name())
+			if err := s.PressKey(presets[a.Preset-1]); err != nil {
+				mLogger.Errorf("Selecting preset on %s failed: %v\n", s.Name(), err)
+				continue
+			}
+			metrics.Actions.Inc(name, "Preset")
+		}
+	case JoinZone:
+		d.joinZone(mLogger, a, trigger, targets)
+	case LeaveZone:
+		d.leaveZone(mLogger, targets)
+	case Notify:
+		var b strings.Builder
+		if err := d.rule.messages[i].Execute(&b, values); err != nil {
+			mLogger.Errorf("Rendering message failed: %v\n", err)
+			return
+		}
+		notifiers := plugins.Notifiers(d.host)
+		if len(notifiers) == 0 {
+			mLogger.Warnf("No plugin delivering notifications. Dropping %q\n", b.String())
+			return
+		}
+		for _, n := range notifiers {
+			if err := n.Notify(b.String()); err != nil {
+				mLogger.Errorf("Sending notification failed: %v\n", err)
+				continue
+			}
+			metrics.Actions.Inc(name, "Notify")
+		}
+	case Capture, Restore:
+		sc := d.scenes()
+		if sc == nil {
+			mLogger.Errorf("No scenes plugin configured. Can't %s %s\n", a.Do, a.Scene)
+			return
+		}
+		if a.Do == Capture {
+			if _, err := sc.Capture(a.Scene); err != nil {
+				mLogger.Errorf("Capturing scene %s failed: %v\n", a.Scene, err)
+			}
+			return
+		}
+		mLogger.Infof("Restoring scene %s\n", a.Scene)
+		if err := sc.Restore(a.Scene); err != nil {
+			mLogger.Errorf("Restoring scene %s failed: %v\n", a.Scene, err)
+		}
+	}
+}
+
+// scenes returns the hosted scenes plugin, nil if none is configured
+func (d *Rules) scenes() *scenes.Scenes {
+	if d.host == nil {
+		return nil
+	}
+	for _, p := range d.host.Plugins() {
+		if sc, ok := plugins.Unwrap(p).(*scenes.Scenes); ok && p.IsEnabled() {
+			return sc
+		}
+	}
+	return nil
+}
+
+// joinZone adds the targets to the zone of the master, creating the zone if the master has none
+func (d *Rules) joinZone(mLogger *log.Entry, a Action, trigger soundtouch.Speaker, targets []*soundtouch.Speaker) {
+	master := &trigger
+	if a.Master != "" {
+		if master = d.speakers.ByName(a.Master); master == nil {
+			mLogger.Errorf("Configured master %s not present in soundtouch network. Please check config file.\n", a.Master)
+			return
+		}
+	}
+	var slaves []soundtouch.Speaker
+	for _, s := range targets {
+		if s.DeviceID() != master.DeviceID() {
+			slaves = append(slaves, *s)
+		}
+	}
+	if len(slaves) == 0 {
+		return
+	}
+
+	zone := soundtouch.NewZone(*master, slaves...)
+	if master.HasZone() && master.IsMaster() {
+		mLogger.Infof("Adding %d speakers to zone of %s\n", len(slaves), master.Name())
+		master.AddZoneSlave(zone)
+		metrics.Actions.Inc(name, "AddZoneSlave")
+		return
+	}
+	mLogger.Infof("Creating new zone with %s as master\n", master.Name())
+	master.SetZone(zone)
+	metrics.Actions.Inc(name, "SetZone")
+}
+
+// leaveZone removes the targets from their zones. A target being zone master dissolves its zone.
+func (d *Rules) leaveZone(mLogger *log.Entry, targets []*soundtouch.Speaker) {
+	for _, s := range targets {
+		zone, err := s.GetZone()
+		if err != nil || zone.Master == "" {
+			continue
+		}
+		if zone.Master == s.DeviceID() {
+			mLogger.Infof("Dissolving zone of %s\n", s.Name())
+			s.RemoveZoneSlave(zone)
+			metrics.Actions.Inc(name, "RemoveZoneSlave")
+			continue
+		}
+		master := d.speakers.ByDeviceID(zone.Master)
+		if master == nil {
+			mLogger.Errorf("Master %s of %s not present in soundtouch network\n", zone.Master, s.Name())
+			continue
+		}
+		mLogger.Infof("Removing %s from zone of %s\n", s.Name(), master.Name())
+		master.RemoveZoneSlave(soundtouch.NewZone(*master, *s))
+		metrics.Actions.Inc(name, "RemoveZoneSlave")
+	}
+}
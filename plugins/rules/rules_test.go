@@ -0,0 +1,219 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// simulate starts the simulated speakers Wohnzimmer, Schrank and Küche playing the radio
+func simulate(t *testing.T) *simulator.Network {
+	net := simulatortest.Simulate(t, "Wohnzimmer", "Schrank", "Küche")
+	for _, d := range net.Devices() {
+		d.Play(simulator.NowPlaying{Source: "TUNEIN", StationName: "SWR3", PlayStatus: "PLAY_STATE"})
+	}
+	return net
+}
+
+func nowPlaying(source, playStatus string) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{Source: soundtouch.Source(source), PlayStatus: soundtouch.PlayStatus(playStatus)}}
+}
+
+// autoOff is the AutoOff configuration [autoOff.Wohnzimmer] thenOff = ["Schrank", "Küche"]
+var autoOff = Config{
+	When:    Trigger{Speakers: []string{"Wohnzimmer"}, Types: []string{"NowPlaying"}, Sources: []string{"PRODUCT"}},
+	Actions: []Action{{Do: PowerOff, Speakers: []string{"Schrank", "Küche"}}},
+}
+
+func TestRules_AutoOff(t *testing.T) {
+	tests := []struct {
+		name    string
+		speaker string
+		update  soundtouch.Update
+		wantOff bool
+	}{
+		{"TV on observed speaker", "Wohnzimmer", nowPlaying("PRODUCT", ""), true},
+		{"TV on other speaker", "Schrank", nowPlaying("PRODUCT", ""), false},
+		{"radio on observed speaker", "Wohnzimmer", nowPlaying("TUNEIN", "PLAY_STATE"), false},
+		{"volume on observed speaker", "Wohnzimmer", soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			net := simulate(t)
+			d := NewRules(autoOff)
+			d.speakers = net
+			d.Execute("", tt.update, *net.Device(tt.speaker).Speaker())
+
+			for _, name := range []string{"Schrank", "Küche"} {
+				if name == tt.speaker {
+					continue
+				}
+				if off := !net.Device(name).IsPoweredOn(); off != tt.wantOff {
+					t.Errorf("%s switched off = %v, want %v", name, off, tt.wantOff)
+				}
+			}
+			if !net.Device("Wohnzimmer").IsPoweredOn() {
+				t.Errorf("observed speaker switched off")
+			}
+		})
+	}
+}
+
+func TestRules_Conditions(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name      string
+		condition Condition
+		want      bool
+	}{
+		{"speaker powered on", Condition{Speaker: "Küche", PoweredOn: &on}, true},
+		{"speaker not in standby", Condition{Speaker: "Küche", PoweredOn: &off}, false},
+		{"source", Condition{Speaker: "Küche", Sources: []string{"TUNEIN"}}, true},
+		{"other source", Condition{Speaker: "Küche", Sources: []string{"SPOTIFY"}}, false},
+		{"expression", Condition{Speaker: "Küche", Expression: `volume < 30`}, true},
+		{"triggering speaker", Condition{PlayStatus: []string{"PAUSE_STATE"}}, false},
+		{"unknown speaker", Condition{Speaker: "Bad"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			net := simulate(t)
+			b := bus.New(0)
+			b.Publish(nowPlaying("TUNEIN", "PLAY_STATE"), *net.Device("Küche").Speaker())
+			b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20, ActualVolume: 20}}, *net.Device("Küche").Speaker())
+
+			d := NewRules(Config{
+				When:       Trigger{Speakers: []string{"Wohnzimmer"}},
+				Conditions: []Condition{tt.condition},
+				Actions:    []Action{{Do: SetVolume, Volume: 15}},
+			})
+			d.speakers = net
+			d.SetBus(b)
+			u := nowPlaying("TUNEIN", "PLAY_STATE")
+			b.Publish(u, *net.Device("Wohnzimmer").Speaker())
+			d.Execute("", u, *net.Device("Wohnzimmer").Speaker())
+
+			if got := len(net.Device("Wohnzimmer").Received("/volume")) > 0; got != tt.want {
+				t.Errorf("fired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules_Transition(t *testing.T) {
+	net := simulate(t)
+	wohnzimmer := *net.Device("Wohnzimmer").Speaker()
+	d := NewRules(Config{
+		When: Trigger{
+			Speakers:       []string{"Wohnzimmer"},
+			FromPlayStatus: []string{"PLAY_STATE"},
+			PlayStatus:     []string{"STOP_STATE", "PAUSE_STATE"},
+		},
+		Actions: []Action{{Do: Preset, Preset: 2}},
+	})
+	d.speakers = net
+
+	for _, status := range []string{"STOP_STATE", "PLAY_STATE", "PLAY_STATE", "PAUSE_STATE", "STOP_STATE"} {
+		d.Execute("", nowPlaying("TUNEIN", status), wohnzimmer)
+	}
+
+	// only PLAY_STATE -> PAUSE_STATE is a transition, the first STOP_STATE has no predecessor
+	var presses int
+	for _, body := range net.Device("Wohnzimmer").Received("/key") {
+		if strings.Contains(body, "PRESET_2") && strings.Contains(body, "release") {
+			presses++
+		}
+	}
+	if presses != 1 {
+		t.Errorf("preset selected %d times, want 1", presses)
+	}
+}
+
+func TestRules_CooldownAndDelay(t *testing.T) {
+	net := simulate(t)
+	wohnzimmer := *net.Device("Wohnzimmer").Speaker()
+	d := NewRules(Config{
+		When:     Trigger{Speakers: []string{"Wohnzimmer"}, Sources: []string{"PRODUCT"}},
+		Actions:  []Action{{Do: PowerOff, Speakers: []string{"Küche"}, After: "20ms"}},
+		Cooldown: "1h",
+	})
+	d.speakers = net
+
+	d.Execute("", nowPlaying("PRODUCT", ""), wohnzimmer)
+	if !net.Device("Küche").IsPoweredOn() {
+		t.Fatalf("delayed action run immediately")
+	}
+	d.pending.Wait()
+	if net.Device("Küche").IsPoweredOn() {
+		t.Fatalf("delayed action not run")
+	}
+
+	net.Device("Küche").PowerOn()
+	d.Execute("", nowPlaying("PRODUCT", ""), wohnzimmer)
+	d.pending.Wait()
+	if !net.Device("Küche").IsPoweredOn() {
+		t.Errorf("rule fired during cooldown")
+	}
+}
+
+type notifier struct{ messages []string }
+
+func (n *notifier) Notify(msg string) error {
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+// host hosts a notifying plugin
+type host struct{ n *notifier }
+
+func (h host) Plugins() []soundtouch.Plugin {
+	return []soundtouch.Plugin{struct {
+		*Rules
+		*notifier
+	}{NewRules(autoOff), h.n}}
+}
+
+func TestRules_Notify(t *testing.T) {
+	net := simulate(t)
+	n := &notifier{}
+	d := NewRules(Config{
+		When:    Trigger{Sources: []string{"PRODUCT"}},
+		Actions: []Action{{Do: Notify, Message: "{{.Speaker}} plays {{.Source}}"}},
+	})
+	d.speakers = net
+	d.SetHost(host{n})
+	d.Execute("", nowPlaying("PRODUCT", ""), *net.Device("Schrank").Speaker())
+
+	if len(n.messages) != 1 || n.messages[0] != "Schrank plays PRODUCT" {
+		t.Errorf("notified %q, want [Schrank plays PRODUCT]", n.messages)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{Actions: []Action{{Do: "reboot"}}},
+		{Actions: []Action{{Do: Preset, Preset: 7}}},
+		{Actions: []Action{{Do: SetVolume, Volume: 120}}},
+		{Actions: []Action{{Do: PowerOff, After: "soon"}}},
+		{Actions: []Action{{Do: Notify, Message: "{{.Speaker"}}},
+		{Actions: []Action{{Do: PowerOff}}, Cooldown: "1 hour"},
+		{When: Trigger{Time: []string{"7-9"}}, Actions: []Action{{Do: PowerOff}}},
+		{Conditions: []Condition{{Expression: "loudness > 3"}}, Actions: []Action{{Do: PowerOff}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) expected error", c)
+		}
+	}
+
+	d := NewRules(Config{Actions: []Action{{Do: "reboot"}}})
+	if d.IsEnabled() {
+		t.Errorf("plugin with invalid rule enabled")
+	}
+	if err := autoOff.Validate(); err != nil {
+		t.Errorf("Validate(autoOff) = %v", err)
+	}
+}
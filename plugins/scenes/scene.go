@@ -0,0 +1,295 @@
+package scenes
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Scene is the state of all speakers at a point in time
+// Name identifies the scene, e.g. "Party"
+// Captured the time the scene has been captured
+// Speakers the state of every speaker known at that time
+type Scene struct {
+	Name     string         `json:"name"`
+	Captured time.Time      `json:"captured"`
+	Speakers []SpeakerState `json:"speakers"`
+}
+
+// SpeakerState is the state of a speaker in a scene
+// PoweredOn the speaker is not in standby
+// ContentItem what the speaker plays, nil if powered off
+// Volume the volume of the speaker
+// ZoneMaster device ID of the master of the zone the speaker is member of. Empty if in no zone.
+// A master has its own device ID.
+type SpeakerState struct {
+	Name        string       `json:"name"`
+	DeviceID    string       `json:"device_id"`
+	PoweredOn   bool         `json:"powered_on"`
+	ContentItem *ContentItem `json:"content_item,omitempty"`
+	Volume      int          `json:"volume"`
+	ZoneMaster  string       `json:"zone_master,omitempty"`
+}
+
+// ContentItem is the content a speaker plays, as sent to /select of a speaker
+type ContentItem struct {
+	XMLName       xml.Name `xml:"ContentItem" json:"-"`
+	Source        string   `xml:"source,attr" json:"source"`
+	Type          string   `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Location      string   `xml:"location,attr,omitempty" json:"location,omitempty"`
+	SourceAccount string   `xml:"sourceAccount,attr,omitempty" json:"source_account,omitempty"`
+	IsPresetable  bool     `xml:"isPresetable,attr" json:"is_presetable"`
+	Name          string   `xml:"itemName,omitempty" json:"name,omitempty"`
+}
+
+// isMaster returns true if the speaker is master of a zone
+func (s SpeakerState) isMaster() bool { return s.ZoneMaster != "" && s.ZoneMaster == s.DeviceID }
+
+// isSlave returns true if the speaker is member of a zone but not its master
+func (s SpeakerState) isSlave() bool { return s.ZoneMaster != "" && s.ZoneMaster != s.DeviceID }
+
+// slaveOf returns true if the speaker with device ID id is slave of master in the scene
+func (sc Scene) slaveOf(id, master string) bool {
+	for _, s := range sc.Speakers {
+		if s.DeviceID == id {
+			return s.isSlave() && s.ZoneMaster == master
+		}
+	}
+	return false
+}
+
+// String describes the scene in one line per speaker
+func (sc Scene) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (captured %s)\n", sc.Name, sc.Captured.Format("2006-01-02 15:04"))
+	names := map[string]string{}
+	for _, s := range sc.Speakers {
+		names[s.DeviceID] = s.Name
+	}
+	for _, s := range sc.Speakers {
+		switch {
+		case !s.PoweredOn:
+			fmt.Fprintf(&b, "  %s: off\n", s.Name)
+		case s.isSlave():
+			fmt.Fprintf(&b, "  %s: in zone of %s, volume %d\n", s.Name, names[s.ZoneMaster], s.Volume)
+		default:
+			what := ""
+			if s.ContentItem != nil {
+				what = strings.TrimSpace(s.ContentItem.Source + " " + s.ContentItem.Name)
+			}
+			fmt.Fprintf(&b, "  %s: %s, volume %d\n", s.Name, what, s.Volume)
+		}
+	}
+	return b.String()
+}
+
+// Capture returns the state of the speakers as scene name
+func Capture(name string, speakers []*soundtouch.Speaker) Scene {
+	sc := Scene{Name: name, Captured: time.Now()}
+	for _, s := range speakers {
+		state := SpeakerState{Name: s.Name(), DeviceID: s.DeviceID()}
+		if np, err := s.NowPlaying(); err == nil && np.Source != "STANDBY" && np.Source != "" {
+			state.PoweredOn = true
+			c := np.Content
+			state.ContentItem = &ContentItem{
+				Source:        string(c.Source),
+				Type:          c.Type,
+				Location:      c.Location,
+				SourceAccount: c.SourceAccount,
+				IsPresetable:  c.IsPresetable,
+				Name:          c.Name,
+			}
+			if state.ContentItem.Source == "" {
+				state.ContentItem.Source = string(np.Source)
+			}
+		}
+		if v, err := s.Volume(); err == nil {
+			state.Volume = v.TargetVolume
+		}
+		if zone, err := s.GetZone(); err == nil && len(zone.Members) > 0 {
+			state.ZoneMaster = zone.Master
+		}
+		sc.Speakers = append(sc.Speakers, state)
+	}
+	sort.Slice(sc.Speakers, func(i, j int) bool { return sc.Speakers[i].Name < sc.Speakers[j].Name })
+	return sc
+}
+
+// Restore brings the speakers into the state of the scene. Zones not part of the scene are
+// dissolved first, slaves not in the zone of their master in the scene are removed from it.
+// Then masters and speakers playing on their own are switched on and select their content,
+// before the zones are created and their slaves get their volume. Speakers off in the scene are
+// switched off last. Restore returns an error naming the speakers of the scene not found.
+func Restore(sc Scene, speakers []*soundtouch.Speaker) error {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+		"Scene":  sc.Name,
+	})
+
+	byID := map[string]*soundtouch.Speaker{}
+	for _, s := range speakers {
+		byID[s.DeviceID()] = s
+	}
+	var missing []string
+	var states []SpeakerState
+	for _, st := range sc.Speakers {
+		if byID[st.DeviceID] == nil {
+			missing = append(missing, st.Name)
+			continue
+		}
+		states = append(states, st)
+	}
+
+	// 1. dissolve zones whose master is not master in the scene, remove the slaves not in the
+	// zone of the scene from the others
+	for _, st := range states {
+		s := byID[st.DeviceID]
+		zone, err := s.GetZone()
+		if err != nil || len(zone.Members) == 0 || zone.Master != s.DeviceID() {
+			continue
+		}
+		if !st.isMaster() {
+			mLogger.Infof("Dissolving zone of %s\n", s.Name())
+			s.RemoveZoneSlave(zone)
+			metrics.Actions.Inc(name, "RemoveZoneSlave")
+			continue
+		}
+		extra := soundtouch.Zone{Master: zone.Master, SenderIPAddress: zone.SenderIPAddress, SenderIsMaster: zone.SenderIsMaster}
+		for _, m := range zone.Members {
+			if m.DeviceID != s.DeviceID() && !sc.slaveOf(m.DeviceID, s.DeviceID()) {
+				extra.Members = append(extra.Members, m)
+			}
+		}
+		if len(extra.Members) > 0 {
+			mLogger.Infof("Removing %d speakers from zone of %s\n", len(extra.Members), s.Name())
+			s.RemoveZoneSlave(extra)
+			metrics.Actions.Inc(name, "RemoveZoneSlave")
+		}
+	}
+
+	// 2. masters and speakers on their own
+	for _, st := range states {
+		if st.PoweredOn && !st.isSlave() {
+			play(mLogger, byID[st.DeviceID], st)
+		}
+	}
+
+	// 3. zones, masters before slaves
+	for _, master := range states {
+		if !master.isMaster() || !master.PoweredOn {
+			continue
+		}
+		m := byID[master.DeviceID]
+		var slaves []soundtouch.Speaker
+		for _, st := range states {
+			if st.isSlave() && st.ZoneMaster == master.DeviceID {
+				slaves = append(slaves, *byID[st.DeviceID])
+			}
+		}
+		if len(slaves) == 0 {
+			continue
+		}
+		zone, err := m.GetZone()
+		if err == nil && zone.Master == m.DeviceID() && len(zone.Members) > 0 {
+			var missing []soundtouch.Speaker
+			for _, s := range slaves {
+				if !s.IsSpeakerMember(zone.Members) {
+					missing = append(missing, s)
+				}
+			}
+			if len(missing) > 0 {
+				mLogger.Infof("Adding %d speakers to zone of %s\n", len(missing), m.Name())
+				m.AddZoneSlave(soundtouch.NewZone(*m, missing...))
+				metrics.Actions.Inc(name, "AddZoneSlave")
+			}
+		} else {
+			mLogger.Infof("Creating zone with %s as master\n", m.Name())
+			m.SetZone(soundtouch.NewZone(*m, slaves...))
+			metrics.Actions.Inc(name, "SetZone")
+		}
+	}
+	for _, st := range states {
+		if st.isSlave() {
+			byID[st.DeviceID].SetVolume(st.Volume)
+			metrics.Actions.Inc(name, "SetVolume")
+		}
+	}
+
+	// 4. speakers off
+	for _, st := range states {
+		if st.PoweredOn {
+			continue
+		}
+		s := byID[st.DeviceID]
+		if s.IsPoweredOn() {
+			mLogger.Infof("Powering off %s\n", s.Name())
+			s.PowerOff()
+			metrics.Actions.Inc(name, "PowerOff")
+		}
+		s.SetVolume(st.Volume)
+		metrics.Actions.Inc(name, "SetVolume")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("speakers %s not found", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// play switches s on, selects the content of the state and sets its volume
+func play(mLogger *log.Entry, s *soundtouch.Speaker, st SpeakerState) {
+	if !s.IsPoweredOn() {
+		mLogger.Infof("Powering on %s\n", s.Name())
+		s.PowerOn()
+		metrics.Actions.Inc(name, "PowerOn")
+	}
+	if st.ContentItem != nil {
+		mLogger.Infof("Selecting %s %s on %s\n", st.ContentItem.Source, st.ContentItem.Name, s.Name())
+		body, _ := xml.Marshal(st.ContentItem)
+		if _, err := s.SetData("select", body); err != nil {
+			mLogger.Errorf("Selecting content on %s failed: %v\n", s.Name(), err)
+		} else {
+			metrics.Actions.Inc(name, "Select")
+		}
+	}
+	s.SetVolume(st.Volume)
+	metrics.Actions.Inc(name, "SetVolume")
+}
+
+// Load reads the scenes stored in file. A missing file contains no scenes.
+func Load(file string) (map[string]Scene, error) {
+	scenes := map[string]Scene{}
+	buf, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return scenes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &scenes); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return scenes, nil
+}
+
+// Save writes the scenes to file
+func Save(file string, scenes map[string]Scene) error {
+	buf, err := json.MarshalIndent(scenes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
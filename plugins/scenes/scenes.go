@@ -0,0 +1,186 @@
+package scenes
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "Scenes"
+
+const description = "Captures and restores the state of all speakers as named scenes"
+
+const sampleConfig = `
+## Enabling the scenes plugin. Scenes are captured and restored with /scene in telegram or
+## "masteringsoundtouch scene"
+# [scenes]
+
+## file the scenes are stored in
+# file = "scenes.json"
+`
+
+func init() {
+	plugins.Add("scenes", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewScenes(*config.(*Config)) },
+	})
+}
+
+// DefaultFile is the file scenes are stored in if not configured otherwise
+const DefaultFile = "scenes.json"
+
+// Config contains the configuration of the plugin
+// File the file the scenes are stored in
+type Config struct {
+	File string `toml:"file"`
+}
+
+// file returns the configured file or the DefaultFile
+func (c Config) file() string {
+	if c.File == "" {
+		return DefaultFile
+	}
+	return c.File
+}
+
+// Scenes describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// speakers looks up the speakers scenes are captured from and restored to
+type Scenes struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	mu        sync.Mutex
+	speakers  plugins.Speakers
+}
+
+// NewScenes creates a new Scenes plugin with the configuration
+func NewScenes(config Config) (d *Scenes) {
+	d = &Scenes{Config: config, speakers: plugins.Discovered{}}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *Scenes) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Scenes) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Scenes) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Scenes) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Scenes) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Scenes) Enable() { d.suspended.Store(false) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Scenes) IsEnabled() bool { return !d.suspended.Load() }
+
+// Execute does nothing. Scenes are captured and restored on request.
+func (d *Scenes) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+}
+
+// knownSpeakers returns the known speakers ordered by name
+func (d *Scenes) knownSpeakers() []*soundtouch.Speaker {
+	var speakers []*soundtouch.Speaker
+	for _, s := range d.speakers.Known() {
+		speakers = append(speakers, s)
+	}
+	sort.Slice(speakers, func(i, j int) bool { return speakers[i].Name() < speakers[j].Name() })
+	return speakers
+}
+
+// Capture captures the state of all known speakers as scene sceneName and stores it, replacing
+// a scene of the same name
+func (d *Scenes) Capture(sceneName string) (Scene, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	speakers := d.knownSpeakers()
+	if len(speakers) == 0 {
+		return Scene{}, fmt.Errorf("no speakers known")
+	}
+	scenes, err := Load(d.file())
+	if err != nil {
+		return Scene{}, err
+	}
+	sc := Capture(sceneName, speakers)
+	scenes[sceneName] = sc
+	if err := Save(d.file(), scenes); err != nil {
+		return Scene{}, err
+	}
+	log.WithFields(log.Fields{
+		"Plugin": name,
+		"Scene":  sceneName,
+	}).Infof("Captured %d speakers\n", len(sc.Speakers))
+	return sc, nil
+}
+
+// Restore restores the stored scene sceneName
+func (d *Scenes) Restore(sceneName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	scenes, err := Load(d.file())
+	if err != nil {
+		return err
+	}
+	sc, ok := scenes[sceneName]
+	if !ok {
+		return fmt.Errorf("unknown scene %s", sceneName)
+	}
+	return Restore(sc, d.knownSpeakers())
+}
+
+// Delete removes the stored scene sceneName
+func (d *Scenes) Delete(sceneName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	scenes, err := Load(d.file())
+	if err != nil {
+		return err
+	}
+	if _, ok := scenes[sceneName]; !ok {
+		return fmt.Errorf("unknown scene %s", sceneName)
+	}
+	delete(scenes, sceneName)
+	return Save(d.file(), scenes)
+}
+
+// Scenes returns the stored scenes ordered by name
+func (d *Scenes) Scenes() ([]Scene, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	scenes, err := Load(d.file())
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Scene, 0, len(scenes))
+	for _, sc := range scenes {
+		list = append(list, sc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
@@ -0,0 +1,150 @@
+package scenes
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// simulate starts the simulated speakers Kitchen, playing the radio, and Office, in standby
+func simulate(t *testing.T) (n *simulator.Network, kitchen, office *simulator.Device) {
+	n = simulatortest.Simulate(t, "Kitchen", "Office")
+	kitchen, office = n.Device("Kitchen"), n.Device("Office")
+	kitchen.Play(simulator.NowPlaying{Source: "TUNEIN"})
+	kitchen.ResetCommands()
+	office.ResetCommands()
+	return n, kitchen, office
+}
+
+func dinner(kitchen, office *simulator.Device) Scene {
+	return Scene{Name: "Dinner", Captured: time.Now(), Speakers: []SpeakerState{
+		{Name: "Kitchen", DeviceID: kitchen.DeviceID, Volume: 10},
+		{Name: "Office", DeviceID: office.DeviceID, PoweredOn: true, Volume: 25, ContentItem: &ContentItem{
+			Source: "TUNEIN", Type: "stationurl", Location: "/v1/playback/station/s24896", IsPresetable: true, Name: "SWR3",
+		}},
+		{Name: "Bathroom", DeviceID: "0000DEADBEEF", Volume: 30},
+	}}
+}
+
+func TestRestore(t *testing.T) {
+	n, kitchen, office := simulate(t)
+	d := NewScenes(Config{})
+	d.speakers = n
+
+	err := Restore(dinner(kitchen, office), d.knownSpeakers())
+	if err == nil || err.Error() != "speakers Bathroom not found" {
+		t.Errorf("Restore() error = %v, want speakers Bathroom not found", err)
+	}
+
+	if !office.IsPoweredOn() {
+		t.Errorf("Office not switched on")
+	}
+	selected := office.Received("/select")
+	if len(selected) != 1 || !strings.Contains(selected[0], `location="/v1/playback/station/s24896"`) ||
+		!strings.Contains(selected[0], "<itemName>SWR3</itemName>") {
+		t.Errorf("Office selected %v, want SWR3", selected)
+	}
+	if v := office.Received("/volume"); len(v) != 1 || v[0] != "<volume>25</volume>" {
+		t.Errorf("Office volumes %v, want 25", v)
+	}
+
+	if kitchen.IsPoweredOn() {
+		t.Errorf("Kitchen not switched off")
+	}
+	if v := kitchen.Received("/volume"); len(v) != 1 || v[0] != "<volume>10</volume>" {
+		t.Errorf("Kitchen volumes %v, want 10", v)
+	}
+}
+
+func TestRestore_Zone(t *testing.T) {
+	n := simulatortest.Simulate(t, "Bathroom", "Kitchen", "Office")
+	bathroom, kitchen, office := n.Device("Bathroom"), n.Device("Kitchen"), n.Device("Office")
+	office.Play(simulator.NowPlaying{Source: "TUNEIN"})
+	master := office.Speaker()
+	master.SetZone(soundtouch.NewZone(*master, *kitchen.Speaker(), *bathroom.Speaker()))
+
+	// Office stays master, but Bathroom does not belong to its zone
+	sc := Scene{Name: "Cooking", Speakers: []SpeakerState{
+		{Name: "Bathroom", DeviceID: bathroom.DeviceID, Volume: 5},
+		{Name: "Kitchen", DeviceID: kitchen.DeviceID, PoweredOn: true, Volume: 30, ZoneMaster: office.DeviceID},
+		{Name: "Office", DeviceID: office.DeviceID, PoweredOn: true, Volume: 20, ZoneMaster: office.DeviceID},
+	}}
+	d := NewScenes(Config{})
+	d.speakers = n
+	if err := Restore(sc, d.knownSpeakers()); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	var members []string
+	for _, m := range office.Zone().Members {
+		members = append(members, n.Device(m.DeviceID).Name)
+	}
+	if strings.Join(members, ", ") != "Office, Kitchen" {
+		t.Errorf("zone of Office %v, want Office, Kitchen", members)
+	}
+	if z := bathroom.Zone(); len(z.Members) != 0 {
+		t.Errorf("Bathroom still in zone %+v", z)
+	}
+	if bathroom.IsPoweredOn() {
+		t.Errorf("Bathroom not switched off")
+	}
+}
+
+func TestScenes(t *testing.T) {
+	n, kitchen, office := simulate(t)
+	file := filepath.Join(t.TempDir(), "scenes.json")
+	if err := Save(file, map[string]Scene{"Dinner": dinner(kitchen, office)}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	d := NewScenes(Config{File: file})
+	d.speakers = n
+	if _, err := d.Capture("Party"); err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+	list, err := d.Scenes()
+	if err != nil {
+		t.Fatalf("Scenes() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "Dinner" || list[1].Name != "Party" {
+		t.Fatalf("Scenes() = %v, want Dinner and Party", list)
+	}
+	if p := list[1].Speakers; len(p) != 2 || p[0].Name != "Kitchen" || p[1].Name != "Office" {
+		t.Errorf("Party speakers = %v, want Kitchen and Office", p)
+	}
+	if d := list[0].Speakers[1].ContentItem; d == nil || d.Name != "SWR3" {
+		t.Errorf("Dinner content of Office = %v after Load, want SWR3", d)
+	}
+
+	if err := d.Restore("Dinner"); err == nil {
+		t.Errorf("Restore(Dinner) expected error on missing Bathroom")
+	}
+	if !office.IsPoweredOn() {
+		t.Errorf("Office not switched on by Restore(Dinner)")
+	}
+	if err := d.Restore("Brunch"); err == nil || err.Error() != "unknown scene Brunch" {
+		t.Errorf("Restore(Brunch) error = %v, want unknown scene Brunch", err)
+	}
+
+	if err := d.Delete("Party"); err != nil {
+		t.Errorf("Delete(Party) error = %v", err)
+	}
+	if err := d.Delete("Party"); err == nil {
+		t.Errorf("Delete(Party) twice expected error")
+	}
+	if list, _ := d.Scenes(); len(list) != 1 {
+		t.Errorf("Scenes() = %v after Delete, want Dinner", list)
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	scenes, err := Load(filepath.Join(t.TempDir(), "scenes.json"))
+	if err != nil || len(scenes) != 0 {
+		t.Errorf("Load() = %v, %v, want no scenes", scenes, err)
+	}
+}
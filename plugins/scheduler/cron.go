@@ -0,0 +1,209 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression with the five fields minute, hour, day of month, month and
+// day of week, e.g. "45 6 * * 1-5" for weekdays at 06:45. Fields are lists of values, ranges
+// and steps like "0-30/10,45". Months and days of week may be given by their English
+// abbreviations, e.g. "MON-FRI". Sunday is 0 or 7. The descriptors @yearly, @monthly, @weekly,
+// @daily and @hourly are accepted as well.
+//
+// Like cron, a day matches if the day of month or the day of week matches, if both are
+// restricted.
+type Cron struct {
+	expr                         string
+	minute, hour, dom, month     uint64
+	dow                          uint64
+	domRestricted, dowRestricted bool
+	// timeRestricted is true if neither minute nor hour start with *, e.g. "30 2"
+	timeRestricted bool
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var months = []string{"", "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+var weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// field describes the values allowed in a field of a cron expression
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var fields = []field{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, months},
+	{"day of week", 0, 7, weekdays},
+}
+
+// ParseCron parses a cron expression
+func ParseCron(expr string) (*Cron, error) {
+	s := strings.TrimSpace(expr)
+	if d, ok := descriptors[strings.ToLower(s)]; ok {
+		s = d
+	}
+	parts := strings.Fields(s)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron %q must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	var sets [5]uint64
+	for i, p := range parts {
+		set, err := fields[i].parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %s: %v", expr, fields[i].name, err)
+		}
+		sets[i] = set
+	}
+	c := &Cron{
+		expr:           strings.TrimSpace(expr),
+		minute:         sets[0],
+		hour:           sets[1],
+		dom:            sets[2],
+		month:          sets[3],
+		dow:            sets[4],
+		domRestricted:  parts[2] != "*",
+		dowRestricted:  parts[4] != "*",
+		timeRestricted: !strings.HasPrefix(parts[0], "*") && !strings.HasPrefix(parts[1], "*"),
+	}
+	// Sunday is 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parse returns the set of values given by s as bit set
+func (f field) parse(s string) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		from, to := f.min, f.max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = f.value(a); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = f.value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = f.max
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (f field) value(s string) (int, error) {
+	for i, n := range f.names {
+		if n != "" && strings.EqualFold(n, s) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%q not in %d-%d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// String returns the expression as given
+func (c *Cron) String() string { return c.expr }
+
+func has(set uint64, v int) bool { return set&(1<<uint(v)) != 0 }
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time after t matching the expression, in the location of t. It returns
+// the zero time if there is none within the next five years, e.g. for "0 0 30 2 *". Like cron, an
+// expression of a fixed time skipped when daylight saving time starts matches the first minute
+// after the skipped hour, e.g. "30 2 * * *" matches 03:00.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	limit := t.AddDate(5, 0, 0)
+	prev := t.Truncate(time.Minute)
+	t = prev.Add(time.Minute)
+
+	for t.Before(limit) {
+		if c.skipped(prev, t) {
+			return t
+		}
+		prev = t
+		switch {
+		case !has(c.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !has(c.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !has(c.minute, t.Minute()):
+			// minutes are added to make progress in the hour repeated when daylight saving ends
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// skipped returns true if the expression is of a fixed time and matches a local time between prev
+// and t that doesn't exist, because the clocks have been put forward
+func (c *Cron) skipped(prev, t time.Time) bool {
+	if !c.timeRestricted {
+		return false
+	}
+	gap := wall(t).Sub(wall(prev)) - t.Sub(prev)
+	for w := wall(t).Add(-gap); w.Before(wall(t)); w = w.Add(time.Minute) {
+		if has(c.month, int(w.Month())) && c.dayMatches(w) && has(c.hour, w.Hour()) && has(c.minute, w.Minute()) {
+			return true
+		}
+	}
+	return false
+}
+
+// wall returns the local time of t as if it was UTC, so that subtracting two wall times ignores
+// changes of daylight saving time
+func wall(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
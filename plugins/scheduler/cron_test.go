@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron_Next(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// Sunday, 18 October 2026
+	sunday := time.Date(2026, 10, 18, 12, 0, 0, 0, berlin)
+
+	tests := []struct {
+		cron string
+		from time.Time
+		want time.Time
+	}{
+		{"45 6 * * 1-5", sunday, time.Date(2026, 10, 19, 6, 45, 0, 0, berlin)},
+		{"45 6 * * MON-FRI", time.Date(2026, 10, 19, 6, 45, 0, 0, berlin), time.Date(2026, 10, 20, 6, 45, 0, 0, berlin)},
+		{"*/15 * * * *", time.Date(2026, 10, 18, 12, 7, 30, 0, berlin), time.Date(2026, 10, 18, 12, 15, 0, 0, berlin)},
+		{"0 18 * * SAT", sunday, time.Date(2026, 10, 24, 18, 0, 0, 0, berlin)},
+		{"0 9 * * 7", sunday, time.Date(2026, 10, 25, 9, 0, 0, 0, berlin)},
+		{"0 0 1 jan *", sunday, time.Date(2027, 1, 1, 0, 0, 0, 0, berlin)},
+		{"@daily", sunday, time.Date(2026, 10, 19, 0, 0, 0, 0, berlin)},
+		{"0,30 8-9 * * *", time.Date(2026, 10, 18, 8, 30, 0, 0, berlin), time.Date(2026, 10, 18, 9, 0, 0, 0, berlin)},
+		// day of month or day of week if both are restricted
+		{"0 12 1 * FRI", sunday, time.Date(2026, 10, 23, 12, 0, 0, 0, berlin)},
+		{"0 0 29 2 *", sunday, time.Date(2028, 2, 29, 0, 0, 0, 0, berlin)},
+		{"0 0 30 2 *", sunday, time.Time{}},
+		// daylight saving time ends on 25 October 2026, 03:00 CEST becomes 02:00 CET
+		{"0 3 * * *", time.Date(2026, 10, 24, 12, 0, 0, 0, berlin), time.Date(2026, 10, 25, 3, 0, 0, 0, berlin)},
+		// and starts on 29 March 2026, 02:30 doesn't exist and runs at 03:00 like with cron
+		{"30 2 * * *", time.Date(2026, 3, 28, 12, 0, 0, 0, berlin), time.Date(2026, 3, 29, 3, 0, 0, 0, berlin)},
+		{"30 2 * * *", time.Date(2026, 3, 29, 1, 59, 30, 0, berlin), time.Date(2026, 3, 29, 3, 0, 0, 0, berlin)},
+		{"30 2 * * *", time.Date(2026, 3, 29, 3, 0, 0, 0, berlin), time.Date(2026, 3, 30, 2, 30, 0, 0, berlin)},
+		{"30 2 * * 1", time.Date(2026, 3, 28, 12, 0, 0, 0, berlin), time.Date(2026, 3, 30, 2, 30, 0, 0, berlin)},
+		// expressions not of a fixed time don't run for the skipped hour
+		{"30 * * * *", time.Date(2026, 3, 29, 1, 45, 0, 0, berlin), time.Date(2026, 3, 29, 3, 30, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cron, func(t *testing.T) {
+			c, err := ParseCron(tt.cron)
+			if err != nil {
+				t.Fatalf("ParseCron() error = %v", err)
+			}
+			if got := c.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"30-10 * * * *",
+		"* * * * MONDAY",
+		"@sometimes",
+	} {
+		if _, err := ParseCron(s); err == nil {
+			t.Errorf("ParseCron(%q) expected error", s)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "Scheduler"
+
+const description = "Runs time-based actions like alarms and wake-ups"
+
+const sampleConfig = `
+## Enabling the scheduler plugin
+# [scheduler]
+
+## time zone of the cron expressions, the local time zone if empty
+# timezone = "Europe/Berlin"
+
+## dates jobs with skip_holidays = true don't run on. Ranges are given by "from..to"
+# holidays = ["2026-12-24..2026-12-26", "2027-01-01"]
+
+## file remembering the runs to skip once. Needed to skip runs with "masteringsoundtouch schedule --skip"
+# state = "scheduler.json"
+
+## a job, fields of cron: minute hour day-of-month month day-of-week
+#	[[scheduler.job]]
+#		name = "wakeup"
+#		cron = "45 6 * * MON-FRI"
+#		speakers = ["Schlafzimmer"]
+#		preset = 3
+## ramps the volume from ramp_from to volume over ramp
+#		ramp_from = 5
+#		volume = 25
+#		ramp = "10m"
+#		skip_holidays = true
+## dates the job doesn't run on
+#		# except = ["2026-10-23"]
+
+#	[[scheduler.job]]
+#		name = "radio"
+#		cron = "0 18 * * SAT"
+#		timezone = "Europe/Athens"
+#		speakers = ["Kueche"]
+#		volume = 30
+#		[scheduler.job.content_item]
+#			source = "TUNEIN"
+#			type = "stationurl"
+#			location = "/v1/playback/station/s24896"
+#			name = "SWR3"
+
+#	[[scheduler.job]]
+#		name = "night"
+#		cron = "30 23 * * *"
+#		speakers = ["Kueche", "Wohnzimmer"]
+#		power_off = true
+`
+
+func init() {
+	plugins.Add("scheduler", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewScheduler(*config.(*Config)) },
+	})
+}
+
+// Config contains the configuration of the plugin
+// TimeZone the IANA time zone of the cron expressions, e.g. "Europe/Berlin". Local if empty
+// Holidays dates in the form 2006-01-02 or ranges 2006-01-02..2006-01-06
+// State file the runs to skip once are kept in. Kept in memory if empty
+// Jobs the scheduled jobs
+type Config struct {
+	TimeZone string   `toml:"timezone"`
+	Holidays []string `toml:"holidays"`
+	State    string   `toml:"state"`
+	Jobs     []Job    `toml:"job"`
+}
+
+// Job is a scheduled action
+// Name identifies the job, e.g. to skip it once
+// Cron when the job runs, see Cron
+// TimeZone overrides the time zone of the plugin
+// Speakers names of the speakers the job acts on
+// Preset the preset 1-6 to select
+// ContentItem the content to play, if no preset is given
+// Volume the volume to set
+// RampFrom the volume a ramp starts with
+// Ramp the duration the volume is ramped from RampFrom to Volume, e.g. "10m"
+// PowerOff switches the speakers off instead of on
+// SkipHolidays the job doesn't run on holidays
+// Except dates the job doesn't run on
+type Job struct {
+	Name         string       `toml:"name"`
+	Cron         string       `toml:"cron"`
+	TimeZone     string       `toml:"timezone"`
+	Speakers     []string     `toml:"speakers"`
+	Preset       int          `toml:"preset"`
+	ContentItem  *ContentItem `toml:"content_item"`
+	Volume       *int         `toml:"volume"`
+	RampFrom     *int         `toml:"ramp_from"`
+	Ramp         string       `toml:"ramp"`
+	PowerOff     bool         `toml:"power_off"`
+	SkipHolidays bool         `toml:"skip_holidays"`
+	Except       []string     `toml:"except"`
+}
+
+// ContentItem is the content a job selects, as sent to /select of a speaker
+type ContentItem struct {
+	XMLName       xml.Name `xml:"ContentItem" toml:"-"`
+	Source        string   `xml:"source,attr" toml:"source"`
+	Type          string   `xml:"type,attr,omitempty" toml:"type"`
+	Location      string   `xml:"location,attr,omitempty" toml:"location"`
+	SourceAccount string   `xml:"sourceAccount,attr,omitempty" toml:"source_account"`
+	Name          string   `xml:"itemName,omitempty" toml:"name"`
+}
+
+// References returns the speakers the jobs act on
+func (c *Config) References() plugins.References {
+	var r plugins.References
+	for _, j := range c.Jobs {
+		r.Speakers = append(r.Speakers, j.Speakers...)
+	}
+	return r
+}
+
+// Validate checks the time zones, cron expressions, dates and actions of the jobs
+func (c *Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+var presets = []soundtouch.Key{
+	soundtouch.PRESET_1, soundtouch.PRESET_2, soundtouch.PRESET_3,
+	soundtouch.PRESET_4, soundtouch.PRESET_5, soundtouch.PRESET_6,
+}
+
+// job is a compiled Job
+type job struct {
+	Job
+	cron   *Cron
+	loc    *time.Location
+	ramp   time.Duration
+	except dates
+}
+
+func (c *Config) compile() ([]*job, error) {
+	loc, err := location(c.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	holidays, err := parseDates(c.Holidays)
+	if err != nil {
+		return nil, fmt.Errorf("holidays: %v", err)
+	}
+
+	var jobs []*job
+	seen := map[string]bool{}
+	for i, jc := range c.Jobs {
+		if jc.Name == "" {
+			return nil, fmt.Errorf("job %d: no name given", i+1)
+		}
+		if seen[jc.Name] {
+			return nil, fmt.Errorf("job %s: name used twice", jc.Name)
+		}
+		seen[jc.Name] = true
+
+		j, err := jc.compile(loc, holidays)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", jc.Name, err)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (jc Job) compile(loc *time.Location, holidays dates) (*job, error) {
+	j := &job{Job: jc, loc: loc}
+	var err error
+	if j.cron, err = ParseCron(jc.Cron); err != nil {
+		return nil, err
+	}
+	if jc.TimeZone != "" {
+		if j.loc, err = location(jc.TimeZone); err != nil {
+			return nil, err
+		}
+	}
+	if j.except, err = parseDates(jc.Except); err != nil {
+		return nil, fmt.Errorf("except: %v", err)
+	}
+	if jc.SkipHolidays {
+		j.except = append(j.except, holidays...)
+	}
+
+	if len(jc.Speakers) == 0 {
+		return nil, fmt.Errorf("no speakers given")
+	}
+	if jc.Preset != 0 && (jc.Preset < 1 || jc.Preset > len(presets)) {
+		return nil, fmt.Errorf("preset %d not in 1-%d", jc.Preset, len(presets))
+	}
+	for _, v := range []*int{jc.Volume, jc.RampFrom} {
+		if v != nil && (*v < 0 || *v > 100) {
+			return nil, fmt.Errorf("volume %d not in 0-100", *v)
+		}
+	}
+	if jc.Ramp != "" {
+		if j.ramp, err = time.ParseDuration(jc.Ramp); err != nil {
+			return nil, fmt.Errorf("ramp: %v", err)
+		}
+		if jc.Volume == nil || jc.RampFrom == nil {
+			return nil, fmt.Errorf("ramp needs volume and ramp_from")
+		}
+	}
+	if jc.PowerOff && (jc.Preset != 0 || jc.ContentItem != nil || jc.Volume != nil) {
+		return nil, fmt.Errorf("power_off can't be combined with preset, content_item or volume")
+	}
+	return j, nil
+}
+
+func location(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("timezone %q: %v", tz, err)
+	}
+	return loc, nil
+}
+
+// next returns the first run of the job after t that is no exception, the zero time if there
+// is none
+func (j *job) next(t time.Time) time.Time {
+	t = t.In(j.loc)
+	for i := 0; i < 1000; i++ {
+		if t = j.cron.Next(t); t.IsZero() || !j.except.contains(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// following returns the first run of the job after prev that is not before now, and the runs
+// after prev missed because they passed before now, e.g. during a long ramp
+func (j *job) following(prev, now time.Time) (next time.Time, missed []time.Time) {
+	for next = j.next(prev); !next.IsZero() && next.Before(now); next = j.next(next) {
+		missed = append(missed, next)
+	}
+	return next, missed
+}
+
+// Scheduler describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// jobs the compiled jobs, nil if the configuration is invalid
+// state the runs to skip once, if no state file is configured
+// speakers looks up the speakers of the jobs
+type Scheduler struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	jobs      []*job
+	mu        sync.Mutex
+	state     State
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+	speakers  plugins.Speakers
+}
+
+// NewScheduler creates a new Scheduler plugin with the configuration
+func NewScheduler(config Config) (d *Scheduler) {
+	d = &Scheduler{Config: config, state: State{Skip: map[string]time.Time{}}, speakers: plugins.Discovered{}}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	jobs, err := config.compile()
+	if err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.jobs = jobs
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *Scheduler) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Scheduler) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Scheduler) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Scheduler) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin. Jobs due while disabled are not run.
+func (d *Scheduler) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Scheduler) Enable() { d.suspended.Store(d.jobs == nil) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Scheduler) IsEnabled() bool { return !d.suspended.Load() }
+
+// Execute does nothing. Jobs are run by time, not by updates.
+func (d *Scheduler) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+}
+
+// Start schedules every job
+func (d *Scheduler) Start(ctx context.Context) error {
+	ctx, d.cancel = context.WithCancel(ctx)
+	for _, j := range d.jobs {
+		d.running.Add(1)
+		go func(j *job) {
+			defer d.running.Done()
+			d.schedule(ctx, j)
+		}(j)
+	}
+	return nil
+}
+
+// Stop ends the schedules and waits for running jobs, e.g. volume ramps, to be aborted
+func (d *Scheduler) Stop(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+	d.cancel()
+	return plugins.Wait(ctx, &d.running)
+}
+
+// schedule runs j at its times until ctx is done. Each run follows the one before, runs passed
+// meanwhile are logged as missed.
+func (d *Scheduler) schedule(ctx context.Context, j *job) {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+		"Job":    j.Name,
+	})
+
+	next := j.next(time.Now())
+	for {
+		if next.IsZero() {
+			mLogger.Warnf("Job %s never runs again\n", j.Name)
+			return
+		}
+		mLogger.Infof("Next run of %s at %s\n", j.Name, next.Format(time.RFC1123))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+
+		switch {
+		case !d.IsEnabled():
+			mLogger.Infof("Plugin disabled. Not running %s\n", j.Name)
+		case d.skip(mLogger, j.Name, next):
+			mLogger.Infof("Skipping %s once\n", j.Name)
+		default:
+			d.run(ctx, mLogger, j)
+		}
+
+		var missed []time.Time
+		next, missed = j.following(next, time.Now())
+		for _, m := range missed {
+			mLogger.Warnf("Missed run of %s at %s\n", j.Name, m.Format(time.RFC1123))
+		}
+	}
+}
+
+// skip returns true if the run at t is to be skipped. The skip is consumed.
+func (d *Scheduler) skip(mLogger *log.Entry, job string, t time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := d.state
+	if d.State != "" {
+		var err error
+		if state, err = ReadState(d.State); err != nil {
+			mLogger.Errorf("Reading state failed: %v\n", err)
+			return false
+		}
+	}
+	skip, ok := state.Skip[job]
+	if !ok || skip.After(t) {
+		return false
+	}
+	delete(state.Skip, job)
+	if d.State != "" {
+		if err := state.Write(d.State); err != nil {
+			mLogger.Errorf("Writing state failed: %v\n", err)
+		}
+	}
+	// a skip of an earlier run missed, e.g. because the daemon was down, is not applied
+	return skip.Equal(t)
+}
+
+// run runs j on all its speakers
+func (d *Scheduler) run(ctx context.Context, mLogger *log.Entry, j *job) {
+	mLogger.Infof("Running %s\n", j.Name)
+	var wg sync.WaitGroup
+	for _, n := range j.Speakers {
+		s := d.speakers.ByName(n)
+		if s == nil {
+			mLogger.Errorf("Configured speaker %s not present in soundtouch network. Please check config file.\n", n)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.runOn(ctx, mLogger.WithField("Speaker", s.Name()), s)
+		}()
+	}
+	wg.Wait()
+}
+
+// runOn runs the job on speaker s
+func (j *job) runOn(ctx context.Context, mLogger *log.Entry, s *soundtouch.Speaker) {
+	if j.PowerOff {
+		mLogger.Infof("Powering off\n")
+		s.PowerOff()
+		metrics.Actions.Inc(name, "PowerOff")
+		return
+	}
+
+	if !s.IsPoweredOn() {
+		mLogger.Infof("Powering on\n")
+		s.PowerOn()
+		metrics.Actions.Inc(name, "PowerOn")
+	}
+	if j.RampFrom != nil {
+		s.SetVolume(*j.RampFrom)
+		metrics.Actions.Inc(name, "SetVolume")
+	}
+
+	switch {
+	case j.Preset > 0:
+		mLogger.Infof("Selecting preset %d\n", j.Preset)
+		if err := s.PressKey(presets[j.Preset-1]); err != nil {
+			mLogger.Errorf("Selecting preset failed: %v\n", err)
+		} else {
+			metrics.Actions.Inc(name, "Preset")
+		}
+	case j.ContentItem != nil:
+		mLogger.Infof("Selecting %s %s\n", j.ContentItem.Source, j.ContentItem.Name)
+		body, _ := xml.Marshal(j.ContentItem)
+		if _, err := s.SetData("select", body); err != nil {
+			mLogger.Errorf("Selecting content failed: %v\n", err)
+		} else {
+			metrics.Actions.Inc(name, "Select")
+		}
+	}
+
+	switch {
+	case j.ramp > 0:
+		mLogger.Infof("Ramping volume from %d to %d over %v\n", *j.RampFrom, *j.Volume, j.ramp)
+		ramp(ctx, s, *j.RampFrom, *j.Volume, j.ramp)
+	case j.Volume != nil:
+		s.SetVolume(*j.Volume)
+		metrics.Actions.Inc(name, "SetVolume")
+	}
+}
+
+// minRampStep is the shortest interval between two volume changes of a ramp
+const minRampStep = 100 * time.Millisecond
+
+// ramp changes the volume of s step by step from from to to over d. A ramp too short for a step
+// per minRampStep changes the volume by more than one per step. It returns early when ctx is done.
+func ramp(ctx context.Context, s *soundtouch.Speaker, from, to int, d time.Duration) {
+	steps := to - from
+	if steps < 0 {
+		steps = -steps
+	}
+	if steps == 0 {
+		return
+	}
+	if d/time.Duration(steps) < minRampStep {
+		steps = int(d / minRampStep)
+		if steps < 1 {
+			steps = 1
+		}
+	}
+	interval := d / time.Duration(steps)
+	if interval < minRampStep {
+		interval = minRampStep
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-ticker.C:
+			s.SetVolume(from + (to-from)*i/steps)
+			metrics.Actions.Inc(name, "SetVolume")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Schedules returns the jobs and their next runs after now
+func (d *Scheduler) Schedules(now time.Time) ([]Schedule, error) {
+	d.mu.Lock()
+	state := d.state
+	d.mu.Unlock()
+	return schedules(d.jobs, d.State, state, now)
+}
+
+// SkipOnce skips the next run of the job after now and returns its time
+func (d *Scheduler) SkipOnce(job string, now time.Time) (time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return skipOnce(d.jobs, d.State, &d.state, job, now)
+}
@@ -0,0 +1,226 @@
+package scheduler
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+)
+
+func intp(v int) *int { return &v }
+
+// wakeup is the job of the sample configuration
+var wakeup = Job{
+	Name:         "wakeup",
+	Cron:         "45 6 * * MON-FRI",
+	Speakers:     []string{"Schlafzimmer"},
+	Preset:       3,
+	RampFrom:     intp(5),
+	Volume:       intp(25),
+	Ramp:         "10m",
+	SkipHolidays: true,
+}
+
+func TestConfig_Schedules(t *testing.T) {
+	c := Config{
+		TimeZone: "Europe/Berlin",
+		Holidays: []string{"2026-10-20..2026-10-21"},
+		State:    filepath.Join(t.TempDir(), "scheduler.json"),
+		Jobs: []Job{
+			wakeup,
+			{Name: "night", Cron: "30 23 * * *", Speakers: []string{"Küche"}, PowerOff: true, Except: []string{"2026-10-18"}},
+		},
+	}
+	berlin, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// Monday, 19 October 2026
+	now := time.Date(2026, 10, 19, 7, 0, 0, 0, berlin)
+
+	s, err := c.Schedules(now)
+	if err != nil {
+		t.Fatalf("Schedules() error = %v", err)
+	}
+	if len(s) != 2 || s[0].Job != "night" || s[1].Job != "wakeup" {
+		t.Fatalf("Schedules() = %+v, want night before wakeup", s)
+	}
+	if want := time.Date(2026, 10, 19, 23, 30, 0, 0, berlin); !s[0].Next.Equal(want) {
+		t.Errorf("next night = %v, want %v", s[0].Next, want)
+	}
+	// Tuesday and Wednesday are holidays
+	if want := time.Date(2026, 10, 22, 6, 45, 0, 0, berlin); !s[1].Next.Equal(want) {
+		t.Errorf("next wakeup = %v, want %v", s[1].Next, want)
+	}
+	if s[1].Action != "preset 3, volume 5→25 over 10m0s on Schlafzimmer" {
+		t.Errorf("wakeup action = %q", s[1].Action)
+	}
+
+	skipped, err := c.SkipOnce("wakeup", now)
+	if err != nil {
+		t.Fatalf("SkipOnce() error = %v", err)
+	}
+	if s, _ := c.Schedules(now); !s[1].Skipped || s[0].Skipped {
+		t.Errorf("Schedules() after skipping = %+v, want wakeup skipped", s)
+	}
+	if _, err := c.SkipOnce("breakfast", now); err == nil {
+		t.Errorf("SkipOnce(breakfast) expected error")
+	}
+
+	// the daemon consumes the skip
+	d := NewScheduler(c)
+	mLogger := log.WithField("Plugin", name)
+	if !d.skip(mLogger, "wakeup", skipped) {
+		t.Errorf("skipped run not skipped")
+	}
+	if d.skip(mLogger, "wakeup", skipped) {
+		t.Errorf("run skipped twice")
+	}
+}
+
+func TestScheduler_SkipOnce(t *testing.T) {
+	d := NewScheduler(Config{Jobs: []Job{wakeup}})
+	now := time.Now()
+	next, err := d.SkipOnce("wakeup", now)
+	if err != nil {
+		t.Fatalf("SkipOnce() error = %v", err)
+	}
+	if s, _ := d.Schedules(now); !s[0].Skipped {
+		t.Errorf("Schedules() = %+v, want wakeup skipped", s)
+	}
+	mLogger := log.WithField("Plugin", name)
+	if d.skip(mLogger, "wakeup", next.Add(-24*time.Hour)) {
+		t.Errorf("earlier run skipped")
+	}
+	if !d.skip(mLogger, "wakeup", next) {
+		t.Errorf("skipped run not skipped")
+	}
+}
+
+func TestJob_following(t *testing.T) {
+	jobs, err := (&Config{Jobs: []Job{{Name: "hourly", Cron: "0 * * * *", Speakers: []string{"Küche"}, PowerOff: true}}}).compile()
+	if err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	j := jobs[0]
+	prev := time.Date(2026, 10, 19, 7, 0, 0, 0, j.loc)
+
+	// a timer firing a moment early does not run the job twice
+	if next, missed := j.following(prev, prev.Add(-time.Millisecond)); !next.Equal(prev.Add(time.Hour)) || len(missed) != 0 {
+		t.Errorf("following() = %v, %v, want 08:00 and nothing missed", next, missed)
+	}
+	// a run lasting beyond 09:00 misses 08:00 and 09:00
+	next, missed := j.following(prev, prev.Add(2*time.Hour+time.Minute))
+	if !next.Equal(prev.Add(3*time.Hour)) || len(missed) != 2 || !missed[1].Equal(prev.Add(2*time.Hour)) {
+		t.Errorf("following() = %v, %v, want 10:00 and 08:00, 09:00 missed", next, missed)
+	}
+}
+
+func TestJob_runOn(t *testing.T) {
+	n := simulatortest.Simulate(t, "Schlafzimmer")
+	dev := n.Device("Schlafzimmer")
+
+	tests := []struct {
+		name       string
+		job        Job
+		wantOn     bool
+		wantVolume []string
+		wantKey    string
+		wantSelect string
+	}{
+		{
+			name:       "ramp",
+			job:        Job{Name: "wakeup", Cron: "@daily", Speakers: []string{"Schlafzimmer"}, Preset: 3, RampFrom: intp(5), Volume: intp(8), Ramp: "300ms"},
+			wantOn:     true,
+			wantVolume: []string{"5", "6", "7", "8"},
+			wantKey:    "PRESET_3",
+		},
+		{
+			name:       "ramp shorter than its steps",
+			job:        Job{Name: "wakeup", Cron: "@daily", Speakers: []string{"Schlafzimmer"}, RampFrom: intp(5), Volume: intp(100), Ramp: "250ms"},
+			wantOn:     true,
+			wantVolume: []string{"5", "52", "100"},
+		},
+		{
+			name:       "ramp of nanoseconds",
+			job:        Job{Name: "wakeup", Cron: "@daily", Speakers: []string{"Schlafzimmer"}, RampFrom: intp(5), Volume: intp(100), Ramp: "50ns"},
+			wantOn:     true,
+			wantVolume: []string{"5", "100"},
+		},
+		{
+			name: "content item",
+			job: Job{Name: "radio", Cron: "@daily", Speakers: []string{"Schlafzimmer"}, Volume: intp(30),
+				ContentItem: &ContentItem{Source: "TUNEIN", Type: "stationurl", Location: "/v1/playback/station/s24896", Name: "SWR3"}},
+			wantOn:     true,
+			wantVolume: []string{"30"},
+			wantSelect: `<ContentItem source="TUNEIN" type="stationurl" location="/v1/playback/station/s24896"><itemName>SWR3</itemName></ContentItem>`,
+		},
+		{
+			name:   "power off",
+			job:    Job{Name: "night", Cron: "@daily", Speakers: []string{"Schlafzimmer"}, PowerOff: true},
+			wantOn: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev.PowerOff()
+			if tt.name == "power off" {
+				dev.PowerOn()
+			}
+			dev.ResetCommands()
+
+			d := NewScheduler(Config{Jobs: []Job{tt.job}})
+			if !d.IsEnabled() {
+				t.Fatalf("invalid job")
+			}
+			d.speakers = n
+			d.run(context.Background(), log.WithField("Plugin", name), d.jobs[0])
+
+			if dev.IsPoweredOn() != tt.wantOn {
+				t.Errorf("powered on = %v, want %v", dev.IsPoweredOn(), tt.wantOn)
+			}
+			var volumes []string
+			for _, body := range dev.Received("/volume") {
+				volumes = append(volumes, strings.TrimSuffix(strings.TrimPrefix(body, "<volume>"), "</volume>"))
+			}
+			if strings.Join(volumes, ",") != strings.Join(tt.wantVolume, ",") {
+				t.Errorf("volumes set %v, want %v", volumes, tt.wantVolume)
+			}
+			keys := strings.Join(dev.Received("/key"), "")
+			if tt.wantKey != "" && !strings.Contains(keys, tt.wantKey) {
+				t.Errorf("keys pressed %s, want %s", keys, tt.wantKey)
+			}
+			if sel := strings.Join(dev.Received("/select"), ""); sel != tt.wantSelect {
+				t.Errorf("selected %s, want %s", sel, tt.wantSelect)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func(change func(j *Job)) *Config {
+		j := wakeup
+		change(&j)
+		return &Config{Jobs: []Job{j}}
+	}
+	simulatortest.CheckValidate(t, []simulatortest.ConfigTest{
+		{Name: "valid", Config: &Config{Jobs: []Job{wakeup}}},
+		{Name: "time zone", Config: &Config{TimeZone: "Europe/Atlantis", Jobs: []Job{wakeup}}, Want: `timezone "Europe/Atlantis": unknown time zone Europe/Atlantis`},
+		{Name: "holiday", Config: &Config{Holidays: []string{"24.12.2026"}, Jobs: []Job{wakeup}}, Want: `holidays: date "24.12.2026" is not of the form 2006-01-02 or 2006-01-02..2006-01-06`},
+		{Name: "name twice", Config: &Config{Jobs: []Job{wakeup, wakeup}}, Want: "job wakeup: name used twice"},
+		{Name: "no name", Config: valid(func(j *Job) { j.Name = "" }), Want: "job 1: no name given"},
+		{Name: "cron", Config: valid(func(j *Job) { j.Cron = "45 6 * *" }), Want: `job wakeup: cron "45 6 * *" must have 5 fields: minute hour day-of-month month day-of-week`},
+		{Name: "job time zone", Config: valid(func(j *Job) { j.TimeZone = "Mars" }), Want: `job wakeup: timezone "Mars": unknown time zone Mars`},
+		{Name: "no speakers", Config: valid(func(j *Job) { j.Speakers = nil }), Want: "job wakeup: no speakers given"},
+		{Name: "preset", Config: valid(func(j *Job) { j.Preset = 7 }), Want: "job wakeup: preset 7 not in 1-6"},
+		{Name: "volume", Config: valid(func(j *Job) { j.Volume = intp(101) }), Want: "job wakeup: volume 101 not in 0-100"},
+		{Name: "ramp", Config: valid(func(j *Job) { j.Ramp = "ten minutes" }), Want: `job wakeup: ramp: time: invalid duration "ten minutes"`},
+		{Name: "ramp without end", Config: valid(func(j *Job) { j.Volume = nil }), Want: "job wakeup: ramp needs volume and ramp_from"},
+		{Name: "power off", Config: valid(func(j *Job) { j.PowerOff = true }), Want: "job wakeup: power_off can't be combined with preset, content_item or volume"},
+		{Name: "except", Config: valid(func(j *Job) { j.Except = []string{"2026-10-19..tomorrow"} }), Want: `job wakeup: except: date "2026-10-19..tomorrow" is not of the form 2006-01-02 or 2006-01-02..2006-01-06`},
+	})
+}
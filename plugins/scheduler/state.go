@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateFormat is the format of holidays and exceptions
+const dateFormat = "2006-01-02"
+
+// dates are days given as ranges of dates
+type dates []struct{ from, to string }
+
+// parseDates parses dates in the form 2006-01-02 and ranges in the form 2006-01-02..2006-01-06
+func parseDates(ds []string) (dates, error) {
+	var d dates
+	for _, s := range ds {
+		from, to, isRange := strings.Cut(s, "..")
+		if !isRange {
+			to = from
+		}
+		for _, x := range []string{from, to} {
+			if _, err := time.Parse(dateFormat, strings.TrimSpace(x)); err != nil {
+				return nil, fmt.Errorf("date %q is not of the form 2006-01-02 or 2006-01-02..2006-01-06", s)
+			}
+		}
+		d = append(d, struct{ from, to string }{strings.TrimSpace(from), strings.TrimSpace(to)})
+	}
+	return d, nil
+}
+
+// contains returns true if the day of t is one of the dates. Dates in the form 2006-01-02
+// compare like the days they denote.
+func (d dates) contains(t time.Time) bool {
+	day := t.Format(dateFormat)
+	for _, r := range d {
+		if day >= r.from && day <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// State contains the runs to skip once. It is kept in the state file of the plugin, so that
+// runs can be skipped while the daemon is running.
+// Skip the time of the run to skip by job name
+type State struct {
+	Skip map[string]time.Time `json:"skip"`
+}
+
+// ReadState reads the state file. A missing file is an empty state.
+func ReadState(file string) (State, error) {
+	s := State{Skip: map[string]time.Time{}}
+	buf, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return s, fmt.Errorf("%s: %v", file, err)
+	}
+	if s.Skip == nil {
+		s.Skip = map[string]time.Time{}
+	}
+	return s, nil
+}
+
+// Write writes the state to file
+func (s State) Write(file string) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Schedule describes a job and its next run
+// Next the next run, zero if the job never runs again
+// Skipped the next run is skipped once
+type Schedule struct {
+	Job     string
+	Cron    string
+	Zone    string
+	Next    time.Time
+	Skipped bool
+	Action  string
+}
+
+// action describes what the job does
+func (j *job) action() string {
+	var a []string
+	switch {
+	case j.PowerOff:
+		a = append(a, "power off")
+	case j.Preset > 0:
+		a = append(a, fmt.Sprintf("preset %d", j.Preset))
+	case j.ContentItem != nil:
+		a = append(a, fmt.Sprintf("play %s %s", j.ContentItem.Source, j.ContentItem.Name))
+	default:
+		a = append(a, "power on")
+	}
+	switch {
+	case j.ramp > 0:
+		a = append(a, fmt.Sprintf("volume %d→%d over %v", *j.RampFrom, *j.Volume, j.ramp))
+	case j.Volume != nil:
+		a = append(a, fmt.Sprintf("volume %d", *j.Volume))
+	}
+	return fmt.Sprintf("%s on %s", strings.Join(a, ", "), strings.Join(j.Speakers, ", "))
+}
+
+func schedules(jobs []*job, file string, state State, now time.Time) ([]Schedule, error) {
+	if file != "" {
+		var err error
+		if state, err = ReadState(file); err != nil {
+			return nil, err
+		}
+	}
+	var s []Schedule
+	for _, j := range jobs {
+		next := j.next(now)
+		skip, ok := state.Skip[j.Name]
+		s = append(s, Schedule{
+			Job:     j.Name,
+			Cron:    j.cron.String(),
+			Zone:    j.loc.String(),
+			Next:    next,
+			Skipped: ok && skip.Equal(next),
+			Action:  j.action(),
+		})
+	}
+	sort.SliceStable(s, func(a, b int) bool {
+		if s[a].Next.IsZero() != s[b].Next.IsZero() {
+			return s[b].Next.IsZero()
+		}
+		return s[a].Next.Before(s[b].Next)
+	})
+	return s, nil
+}
+
+func skipOnce(jobs []*job, file string, state *State, name string, now time.Time) (time.Time, error) {
+	for _, j := range jobs {
+		if j.Name != name {
+			continue
+		}
+		next := j.next(now)
+		if next.IsZero() {
+			return next, fmt.Errorf("job %s never runs again", name)
+		}
+		if file != "" {
+			s, err := ReadState(file)
+			if err != nil {
+				return next, err
+			}
+			s.Skip[name] = next
+			return next, s.Write(file)
+		}
+		state.Skip[name] = next
+		return next, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown job %s", name)
+}
+
+// Schedules returns the jobs configured and their next runs after now. Skips are read from the
+// state file.
+func (c *Config) Schedules(now time.Time) ([]Schedule, error) {
+	jobs, err := c.compile()
+	if err != nil {
+		return nil, err
+	}
+	return schedules(jobs, c.State, State{}, now)
+}
+
+// SkipOnce records in the state file that the next run of the job after now is skipped and
+// returns its time
+func (c *Config) SkipOnce(job string, now time.Time) (time.Time, error) {
+	if c.State == "" {
+		return time.Time{}, fmt.Errorf("no state file configured")
+	}
+	jobs, err := c.compile()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return skipOnce(jobs, c.State, nil, job, now)
+}
@@ -0,0 +1,113 @@
+package scrobbler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The listen types of the ListenBrainz API
+const (
+	Single     = "single"
+	PlayingNow = "playing_now"
+)
+
+// Listen is a track listened to, or playing now, as submitted to the ListenBrainz API
+type Listen struct {
+	ListenedAt    int64         `json:"listened_at,omitempty"`
+	TrackMetadata TrackMetadata `json:"track_metadata"`
+}
+
+// TrackMetadata describes a track
+type TrackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name,omitempty"`
+	AdditionalInfo AdditionalInfo `json:"additional_info"`
+}
+
+// AdditionalInfo are optional details of a track
+type AdditionalInfo struct {
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+	MediaPlayer      string `json:"media_player,omitempty"`
+	SubmissionClient string `json:"submission_client,omitempty"`
+	MusicService     string `json:"music_service_name,omitempty"`
+}
+
+// submission is the body of /1/submit-listens
+type submission struct {
+	ListenType string   `json:"listen_type"`
+	Payload    []Listen `json:"payload"`
+}
+
+// apiError is a failed submission. Temporary errors are worth retrying.
+type apiError struct {
+	status    int
+	message   string
+	temporary bool
+}
+
+func (e *apiError) Error() string {
+	if e.status == 0 {
+		return e.message
+	}
+	return fmt.Sprintf("%d %s", e.status, e.message)
+}
+
+// isTemporary returns true if err is worth retrying later
+func isTemporary(err error) bool {
+	e, ok := err.(*apiError)
+	return !ok || e.temporary
+}
+
+// client submits listens to a ListenBrainz compatible API at baseURL
+type client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newClient(baseURL string) *client {
+	return &client{baseURL: strings.TrimRight(baseURL, "/"), http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// submit sends the listen of listenType with the user token. Network failures, rate limits and
+// server errors are temporary.
+func (c *client) submit(token, listenType string, l Listen) error {
+	body, err := json.Marshal(submission{ListenType: listenType, Payload: []Listen{l}})
+	if err != nil {
+		return &apiError{message: err.Error()}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return &apiError{message: err.Error()}
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &apiError{message: err.Error(), temporary: true}
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(reply))
+	if json.Unmarshal(reply, &e) == nil && e.Error != "" {
+		msg = e.Error
+	}
+	return &apiError{
+		status:    resp.StatusCode,
+		message:   msg,
+		temporary: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+}
@@ -0,0 +1,106 @@
+package scrobbler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// entry is a listen waiting to be submitted with the token of a user
+type entry struct {
+	Token  string `json:"token"`
+	Listen Listen `json:"listen"`
+}
+
+// queue holds the listens not yet submitted, oldest first. It is kept in file, one JSON object
+// per line, so that no listen is lost while the API is unreachable or the plugin is restarted.
+type queue struct {
+	file    string
+	mu      sync.Mutex
+	entries []entry
+}
+
+// loadQueue reads the listens queued in file. A missing file holds no listens.
+func loadQueue(file string) (*queue, error) {
+	q := &queue{file: file}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return q, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		q.entries = append(q.entries, e)
+	}
+	return q, scanner.Err()
+}
+
+// push appends the entries and writes the queue
+func (q *queue) push(entries ...entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, entries...)
+	return q.write()
+}
+
+// peek returns the oldest entry, false if the queue is empty
+func (q *queue) peek() (entry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return entry{}, false
+	}
+	return q.entries[0], true
+}
+
+// pop removes the oldest entry and writes the queue
+func (q *queue) pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) > 0 {
+		q.entries = q.entries[1:]
+	}
+	return q.write()
+}
+
+// len returns the number of entries queued
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *queue) write() error {
+	tmp := q.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range q.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.file)
+}
@@ -0,0 +1,491 @@
+package scrobbler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+var name = "Scrobbler"
+
+const description = "Submits the tracks played to ListenBrainz"
+
+const sampleConfig = `
+## Enabling the scrobbler plugin. Tracks played are submitted to ListenBrainz.
+# [scrobbler]
+
+## base URL of a ListenBrainz compatible API
+# url = "https://api.listenbrainz.org"
+
+## file listens are queued in while the API is unreachable
+# queue = "scrobbler.jsonl"
+
+## time between two attempts to submit queued listens
+# retry = "1m"
+
+## sources never submitted
+# ignore_sources = ["AUX", "PRODUCT"]
+
+## the user token of every user and the speakers the user listens on, all if empty
+#	[[scrobbler.user]]
+#		token = "00000000-0000-0000-0000-000000000000"
+#		speakers = ["Office", "Kitchen"]
+`
+
+func init() {
+	plugins.Add("scrobbler", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewScrobbler(*config.(*Config)) },
+	})
+}
+
+// Defaults if not configured otherwise
+const (
+	DefaultURL   = "https://api.listenbrainz.org"
+	DefaultQueue = "scrobbler.jsonl"
+	DefaultRetry = time.Minute
+)
+
+// DefaultIgnoreSources are the sources not submitted if not configured otherwise
+var DefaultIgnoreSources = []string{"AUX", "PRODUCT"}
+
+// Config contains the configuration of the plugin
+// URL base URL of a ListenBrainz compatible API
+// Queue file listens are queued in while the API is unreachable
+// Retry time between two attempts to submit queued listens, e.g. "1m"
+// IgnoreSources sources never submitted
+// Users the users listens are submitted for
+type Config struct {
+	URL           string   `toml:"url"`
+	Queue         string   `toml:"queue"`
+	Retry         string   `toml:"retry"`
+	IgnoreSources []string `toml:"ignore_sources"`
+	Users         []User   `toml:"user"`
+}
+
+// User is a ListenBrainz user
+// Token the user token, see https://listenbrainz.org/settings/
+// Speakers names of the speakers the user listens on, all if empty
+type User struct {
+	Token    string   `toml:"token"`
+	Speakers []string `toml:"speakers"`
+}
+
+// References returns the speakers the users listen on
+func (c *Config) References() plugins.References {
+	var r plugins.References
+	for _, u := range c.Users {
+		r.Speakers = append(r.Speakers, u.Speakers...)
+	}
+	return r
+}
+
+// Validate checks the URL, the retry interval and the users
+func (c *Config) Validate() error {
+	_, err := c.retry()
+	if err != nil {
+		return err
+	}
+	if u, err := url.Parse(c.url()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q is no http(s) URL", c.URL)
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no user configured")
+	}
+	for i, u := range c.Users {
+		if u.Token == "" {
+			return fmt.Errorf("user %d: no token", i+1)
+		}
+	}
+	return nil
+}
+
+func (c Config) url() string {
+	if c.URL == "" {
+		return DefaultURL
+	}
+	return c.URL
+}
+
+func (c Config) queue() string {
+	if c.Queue == "" {
+		return DefaultQueue
+	}
+	return c.Queue
+}
+
+func (c Config) retry() (time.Duration, error) {
+	if c.Retry == "" {
+		return DefaultRetry, nil
+	}
+	d, err := time.ParseDuration(c.Retry)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("retry %q is no positive duration", c.Retry)
+	}
+	return d, nil
+}
+
+// tokens returns the tokens of the users listening on speaker
+func (c Config) tokens(speaker string) []string {
+	var tokens []string
+	for _, u := range c.Users {
+		if len(u.Speakers) == 0 || slices.Contains(u.Speakers, speaker) {
+			tokens = append(tokens, u.Token)
+		}
+	}
+	return tokens
+}
+
+// The rule when a track counts as listened: after half its duration or four minutes, whichever
+// comes first. Tracks shorter than minTrack never count. Tracks of unknown duration count after
+// four minutes.
+const (
+	maxListen = 4 * time.Minute
+	minTrack  = 30 * time.Second
+)
+
+// track is a track played by a speaker
+// duration the length of the track, 0 if unknown
+// played the time played before playingSince
+// playingSince the time the speaker started playing, zero while paused
+type track struct {
+	speaker      string
+	artist       string
+	title        string
+	album        string
+	source       string
+	duration     time.Duration
+	start        time.Time
+	played       time.Duration
+	playingSince time.Time
+}
+
+// listened returns true if the track counts as listened when it ends at end
+func (t *track) listened(end time.Time) bool {
+	played := t.played
+	if !t.playingSince.IsZero() {
+		played += end.Sub(t.playingSince)
+	}
+	if t.duration == 0 {
+		return played >= maxListen
+	}
+	if t.duration < minTrack {
+		return false
+	}
+	return played >= min(t.duration/2, maxListen)
+}
+
+// listen returns the track as Listen. Listens being played now have no time.
+func (t *track) listen(playingNow bool) Listen {
+	l := Listen{TrackMetadata: TrackMetadata{
+		ArtistName:  t.artist,
+		TrackName:   t.title,
+		ReleaseName: t.album,
+		AdditionalInfo: AdditionalInfo{
+			DurationMs:       t.duration.Milliseconds(),
+			MediaPlayer:      "SoundTouch",
+			SubmissionClient: "masteringsoundtouch",
+			MusicService:     t.source,
+		},
+	}}
+	if !playingNow {
+		l.ListenedAt = t.start.Unix()
+	}
+	return l
+}
+
+// Scrobbler describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// retry the time between two attempts, 0 if the configuration is invalid
+// tracks the track played per device ID
+// queue the listens not yet submitted
+// playingNow the latest listen playing now per token, not yet submitted
+// wake tells the sender that listens are waiting
+// clock returns the current time
+type Scrobbler struct {
+	Config
+	Plugin     soundtouch.PluginFunc
+	suspended  atomic.Bool
+	retry      time.Duration
+	client     *client
+	mu         sync.Mutex
+	tracks     map[string]*track
+	queue      *queue
+	playingNow map[string]Listen
+	wake       chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	running    sync.WaitGroup
+	clock      func() time.Time
+}
+
+// NewScrobbler creates a new Scrobbler plugin with the configuration
+func NewScrobbler(config Config) (d *Scrobbler) {
+	d = &Scrobbler{
+		Config:     config,
+		tracks:     map[string]*track{},
+		playingNow: map[string]Listen{},
+		wake:       make(chan struct{}, 1),
+		clock:      time.Now,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if d.IgnoreSources == nil {
+		d.IgnoreSources = DefaultIgnoreSources
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	retry, err := config.retry()
+	if err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	q, err := loadQueue(config.queue())
+	if err != nil {
+		mLogger.Errorf("Reading queue failed: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.queue = q
+	d.retry = retry
+	d.client = newClient(config.url())
+
+	mLogger.Debugf("Initialised with %d queued listens\n", q.len())
+	return d
+}
+
+// Name returns the plugin name
+func (d *Scrobbler) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *Scrobbler) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *Scrobbler) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *Scrobbler) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *Scrobbler) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *Scrobbler) Enable() { d.suspended.Store(d.retry == 0) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *Scrobbler) IsEnabled() bool { return !d.suspended.Load() }
+
+// Start submits listens until ctx is done, beginning with those queued
+func (d *Scrobbler) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.retry == 0 {
+		return nil
+	}
+	d.running.Add(1)
+	go d.send()
+	d.signal()
+	return nil
+}
+
+// Stop ends the submissions. Tracks played long enough are queued, to be submitted after the
+// next start.
+func (d *Scrobbler) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	d.cancel()
+	err := plugins.Wait(ctx, &d.running)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock()
+	for id, t := range d.tracks {
+		d.finish(t, now)
+		delete(d.tracks, id)
+	}
+	return err
+}
+
+// Execute runs the plugin with the given parameter
+func (d *Scrobbler) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if !d.IsEnabled() || update.Value == nil {
+		return
+	}
+	np, ok := update.Value.(soundtouch.NowPlaying)
+	if !ok {
+		return
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+	mLogger.Traceln("Executing", pluginName)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock()
+	id := speaker.DeviceID()
+	ignored := np.Source == "STANDBY" || slices.Contains(d.IgnoreSources, string(np.Source)) ||
+		np.Artist == "" || np.Track == ""
+	t := d.tracks[id]
+	if t != nil && (ignored || t.artist != np.Artist || t.title != np.Track || t.album != np.Album) {
+		d.finish(t, now)
+		delete(d.tracks, id)
+		t = nil
+	}
+	if ignored {
+		return
+	}
+
+	if t == nil {
+		t = &track{
+			speaker:  speaker.Name(),
+			artist:   np.Artist,
+			title:    np.Track,
+			album:    np.Album,
+			source:   string(np.Source),
+			duration: duration(np),
+			start:    now,
+		}
+		d.tracks[id] = t
+		mLogger.Debugf("Playing %s - %s\n", t.artist, t.title)
+		for _, token := range d.tokens(t.speaker) {
+			d.playingNow[token] = t.listen(true)
+		}
+		d.signal()
+	}
+
+	playing := np.PlayStatus == "PLAY_STATE" || np.PlayStatus == "BUFFERING_STATE"
+	switch {
+	case playing && t.playingSince.IsZero():
+		t.playingSince = now
+	case !playing && !t.playingSince.IsZero():
+		t.played += now.Sub(t.playingSince)
+		t.playingSince = time.Time{}
+	}
+}
+
+// timeTotal is the length of a track in the NowPlaying message
+var timeTotal = regexp.MustCompile(`<time[^>]*\stotal="(\d+)"`)
+
+// duration returns the length of the track played, 0 if unknown
+func duration(np soundtouch.NowPlaying) time.Duration {
+	m := timeTotal.FindSubmatch(np.Raw)
+	if m == nil {
+		return 0
+	}
+	s, _ := strconv.Atoi(string(m[1]))
+	return time.Duration(s) * time.Second
+}
+
+// finish queues the track ending at end for all users of its speaker if it counts as listened
+func (d *Scrobbler) finish(t *track, end time.Time) {
+	if !t.listened(end) {
+		return
+	}
+	var entries []entry
+	for _, token := range d.tokens(t.speaker) {
+		entries = append(entries, entry{Token: token, Listen: t.listen(false)})
+	}
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": t.speaker,
+	})
+	if err := d.queue.push(entries...); err != nil {
+		mLogger.Errorf("Queueing listen failed: %v\n", err)
+	}
+	mLogger.Infof("Listened to %s - %s\n", t.artist, t.title)
+	d.signal()
+}
+
+// signal wakes the sender
+func (d *Scrobbler) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send submits what is playing now and the queued listens when woken and every retry
+func (d *Scrobbler) send() {
+	defer d.running.Done()
+	ticker := time.NewTicker(d.retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		d.sendPlayingNow()
+		d.flush()
+	}
+}
+
+// sendPlayingNow submits the tracks playing now. They are not retried, as they are outdated soon.
+func (d *Scrobbler) sendPlayingNow() {
+	d.mu.Lock()
+	pending := d.playingNow
+	d.playingNow = map[string]Listen{}
+	d.mu.Unlock()
+
+	for token, l := range pending {
+		if err := d.client.submit(token, PlayingNow, l); err != nil {
+			log.WithFields(log.Fields{
+				"Plugin": name,
+			}).Debugf("Submitting playing now failed: %v\n", err)
+			continue
+		}
+		metrics.Actions.Inc(name, "PlayingNow")
+	}
+}
+
+// flush submits the queued listens, oldest first, until the queue is empty or the API is
+// unreachable. Listens the API rejects are dropped.
+func (d *Scrobbler) flush() {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+	for d.ctx.Err() == nil {
+		e, ok := d.queue.peek()
+		if !ok {
+			return
+		}
+		err := d.client.submit(e.Token, Single, e.Listen)
+		if err != nil && isTemporary(err) {
+			mLogger.Warnf("Submitting failed: %v. %d listens queued.\n", err, d.queue.len())
+			return
+		}
+		if err != nil {
+			mLogger.Errorf("Listen of %s - %s rejected: %v. Dropping it.\n",
+				e.Listen.TrackMetadata.ArtistName, e.Listen.TrackMetadata.TrackName, err)
+		} else {
+			metrics.Actions.Inc(name, "Listen")
+		}
+		if err := d.queue.pop(); err != nil {
+			mLogger.Errorf("Writing queue failed: %v\n", err)
+		}
+	}
+}
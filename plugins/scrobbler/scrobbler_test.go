@@ -0,0 +1,222 @@
+package scrobbler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// received is a submission the stand-in received
+type received struct {
+	token      string
+	listenType string
+	listens    []Listen
+}
+
+// standIn is a local stand-in for the ListenBrainz API. It answers with status, recording the
+// submissions accepted.
+type standIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	received []received
+}
+
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/1/submit-listens" {
+			http.NotFound(w, r)
+			return
+		}
+		var sub submission
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 400, "error": "invalid JSON"}`))
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+		if token == "invalid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code": 401, "error": "Invalid authorization token."}`))
+			return
+		}
+		w.WriteHeader(s.status)
+		if s.status == http.StatusOK {
+			s.received = append(s.received, received{token: token, listenType: sub.ListenType, listens: sub.Payload})
+			w.Write([]byte(`{"status": "ok"}`))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// listens returns the listens received of listenType as "token: artist - track"
+func (s *standIn) listens(listenType string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []string
+	for _, r := range s.received {
+		if r.listenType != listenType {
+			continue
+		}
+		for _, listen := range r.listens {
+			l = append(l, r.token+": "+listen.TrackMetadata.ArtistName+" - "+listen.TrackMetadata.TrackName)
+		}
+	}
+	return l
+}
+
+// await waits until the stand-in received n listens of listenType
+func (s *standIn) await(t *testing.T, listenType string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if l := s.listens(listenType); len(l) >= n {
+			return l
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("received %v, want %d %s listens", s.listens(listenType), n, listenType)
+	return nil
+}
+
+func speaker(name string) soundtouch.Speaker {
+	return soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: name, DeviceID: strings.ToUpper(name)}}
+}
+
+func playing(source, artist, track string, total int) soundtouch.Update {
+	raw := ""
+	if total > 0 {
+		raw = fmt.Sprintf(`<nowPlaying><time total="%d">0</time></nowPlaying>`, total)
+	}
+	return soundtouch.Update{Value: soundtouch.NowPlaying{
+		Source: soundtouch.Source(source), Artist: artist, Track: track, PlayStatus: "PLAY_STATE", Raw: []byte(raw),
+	}}
+}
+
+func standby() soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{Source: "STANDBY"}}
+}
+
+func TestScrobbler(t *testing.T) {
+	api := newStandIn(t)
+	clock := simulatortest.NewClock(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC))
+	d := NewScrobbler(Config{
+		URL:   api.URL,
+		Queue: filepath.Join(t.TempDir(), "queue.jsonl"),
+		Users: []User{{Token: "alice"}, {Token: "bob", Speakers: []string{"Kitchen"}}},
+	})
+	d.clock = clock.Now
+	if !d.IsEnabled() {
+		t.Fatalf("plugin suspended")
+	}
+	d.Start(context.Background())
+	defer d.Stop(context.Background())
+	office, kitchen := speaker("Office"), speaker("Kitchen")
+
+	d.Execute("", playing("SPOTIFY", "Queen", "Bohemian Rhapsody", 354), office)
+	if got := api.await(t, PlayingNow, 1); got[0] != "alice: Queen - Bohemian Rhapsody" {
+		t.Errorf("playing now %v, want alice: Queen - Bohemian Rhapsody", got)
+	}
+	clock.Advance(3 * time.Minute) // more than half
+	d.Execute("", playing("SPOTIFY", "Queen", "Radio Ga Ga", 0), office)
+	clock.Advance(3 * time.Minute) // less than four minutes of unknown duration
+	d.Execute("", playing("SPOTIFY", "Queen", "Jealousy", 30*60), office)
+	clock.Advance(5 * time.Minute) // four minutes of a long track
+	d.Execute("", standby(), office)
+
+	d.Execute("", playing("AUX", "Unknown", "Line in", 0), kitchen)
+	clock.Advance(5 * time.Minute)
+	d.Execute("", playing("TUNEIN", "Die Ärzte", "Westerland", 220), kitchen)
+	clock.Advance(time.Minute) // less than half
+	d.Execute("", standby(), kitchen)
+
+	got := api.await(t, Single, 2)
+	want := []string{"alice: Queen - Bohemian Rhapsody", "alice: Queen - Jealousy"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("listens %v, want %v", got, want)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !slices.Contains(api.listens(PlayingNow), "bob: Die Ärzte - Westerland") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got = api.listens(PlayingNow)
+	if !slices.Contains(got, "bob: Die Ärzte - Westerland") || slices.Contains(got, "alice: Unknown - Line in") {
+		t.Errorf("playing now %v, want Westerland for alice and bob, no AUX", got)
+	}
+}
+
+func TestScrobbler_Queue(t *testing.T) {
+	api := newStandIn(t)
+	api.setStatus(http.StatusServiceUnavailable)
+	clock := simulatortest.NewClock(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC))
+	config := Config{
+		URL:   api.URL,
+		Queue: filepath.Join(t.TempDir(), "queue.jsonl"),
+		Retry: "10ms",
+		Users: []User{{Token: "alice"}, {Token: "invalid"}},
+	}
+	d := NewScrobbler(config)
+	d.clock = clock.Now
+	office := speaker("Office")
+
+	d.Execute("", playing("STORED_MUSIC", "Queen", "Bohemian Rhapsody", 354), office)
+	clock.Advance(4 * time.Minute)
+	d.Execute("", standby(), office)
+	if n := d.queue.len(); n != 2 {
+		t.Fatalf("queued %d listens, want 2", n)
+	}
+
+	// a restarted plugin submits the listens queued on disk once the API is back
+	d = NewScrobbler(config)
+	if n := d.queue.len(); n != 2 {
+		t.Fatalf("queue read %d listens, want 2", n)
+	}
+	d.Start(context.Background())
+	defer d.Stop(context.Background())
+	time.Sleep(30 * time.Millisecond)
+	if n := d.queue.len(); n != 2 {
+		t.Errorf("queue holds %d listens while the API is unavailable, want 2", n)
+	}
+	api.setStatus(http.StatusOK)
+	if got := api.await(t, Single, 1); got[0] != "alice: Queen - Bohemian Rhapsody" {
+		t.Errorf("listens %v, want the queued listen of alice", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for d.queue.len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d.queue.len(); n != 0 {
+		t.Errorf("queue holds %d listens, want the rejected listen dropped", n)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	simulatortest.CheckValidate(t, []simulatortest.ConfigTest{
+		{Name: "valid", Config: &Config{Users: []User{{Token: "alice"}}}, Want: ""},
+		{Name: "no user", Config: &Config{}, Want: "no user configured"},
+		{Name: "no token", Config: &Config{Users: []User{{Speakers: []string{"Office"}}}}, Want: "user 1: no token"},
+		{Name: "url", Config: &Config{URL: "api.listenbrainz.org", Users: []User{{Token: "alice"}}}, Want: `url "api.listenbrainz.org" is no http(s) URL`},
+		{Name: "retry", Config: &Config{Retry: "often", Users: []User{{Token: "alice"}}}, Want: `retry "often" is no positive duration`},
+	})
+}
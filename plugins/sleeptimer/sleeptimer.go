@@ -0,0 +1,492 @@
+package sleeptimer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+var name = "SleepTimer"
+
+const description = "Fades out and switches off speakers after a while"
+
+const sampleConfig = `
+## Enabling the sleep timer plugin. Timers are started with /sleep in telegram.
+# [sleeptimer]
+
+## length of a timer if none is given
+# duration = "30m"
+
+## the volume is faded out over the last fade of a timer
+# fade = "5m"
+
+## timers started automatically if one of the artists starts playing after a time of day
+#	[[sleeptimer.auto_arm]]
+#		speakers = ["Prinzessinen"]
+#		artists = ["Die drei ???", "Benjamin Blümchen"]
+#		after = "19:00"
+#		duration = "45m"
+`
+
+func init() {
+	plugins.Add("sleeptimer", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewSleepTimer(*config.(*Config)) },
+	})
+}
+
+// Defaults of the configuration
+const (
+	DefaultDuration = 30 * time.Minute
+	DefaultFade     = 5 * time.Minute
+)
+
+// Config contains the configuration of the plugin
+// Duration the length of a timer if none is given, e.g. "30m"
+// Fade the time before the end of a timer the volume is faded out, e.g. "5m"
+// AutoArm starts timers when configured artists start playing
+type Config struct {
+	Duration string    `toml:"duration"`
+	Fade     string    `toml:"fade"`
+	AutoArm  []AutoArm `toml:"auto_arm"`
+}
+
+// AutoArm starts a timer when one of the artists starts playing on one of the speakers after
+// a time of day. A timer cancelled is not armed again until the speaker has been switched off.
+// Speakers names of the speakers. All if empty
+// Artists the artists
+// After local time of the day in the form 19:00. Till midnight.
+// Duration the length of the timer, the Duration of the plugin if empty
+type AutoArm struct {
+	Speakers []string `toml:"speakers"`
+	Artists  []string `toml:"artists"`
+	After    string   `toml:"after"`
+	Duration string   `toml:"duration"`
+}
+
+// References returns the speakers timers are armed on automatically
+func (c *Config) References() plugins.References {
+	var r plugins.References
+	for _, a := range c.AutoArm {
+		r.Speakers = append(r.Speakers, a.Speakers...)
+	}
+	return r
+}
+
+// Validate checks the durations and times of the configuration
+func (c *Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+// settings is a compiled Config
+type settings struct {
+	duration, fade time.Duration
+	autoArm        []autoArm
+}
+
+type autoArm struct {
+	AutoArm
+	after    int
+	duration time.Duration
+}
+
+func (c *Config) compile() (*settings, error) {
+	s := &settings{duration: DefaultDuration, fade: DefaultFade}
+	var err error
+	if c.Duration != "" {
+		if s.duration, err = time.ParseDuration(c.Duration); err != nil {
+			return nil, fmt.Errorf("duration: %v", err)
+		}
+	}
+	if c.Fade != "" {
+		if s.fade, err = time.ParseDuration(c.Fade); err != nil {
+			return nil, fmt.Errorf("fade: %v", err)
+		}
+	}
+	for i, a := range c.AutoArm {
+		aa := autoArm{AutoArm: a, duration: s.duration}
+		if len(a.Artists) == 0 {
+			return nil, fmt.Errorf("auto_arm %d: no artists given", i+1)
+		}
+		if a.After != "" {
+			t, err := time.Parse("15:04", a.After)
+			if err != nil {
+				return nil, fmt.Errorf("auto_arm %d: after %q is not of the form 19:00", i+1, a.After)
+			}
+			aa.after = t.Hour()*60 + t.Minute()
+		}
+		if a.Duration != "" {
+			if aa.duration, err = time.ParseDuration(a.Duration); err != nil {
+				return nil, fmt.Errorf("auto_arm %d: duration: %v", i+1, err)
+			}
+		}
+		s.autoArm = append(s.autoArm, aa)
+	}
+	return s, nil
+}
+
+// matches returns true if the timer is to be armed for speaker playing artist at now
+func (a autoArm) matches(speaker, artist string, now time.Time) bool {
+	if len(a.Speakers) > 0 && !slices.Contains(a.Speakers, speaker) {
+		return false
+	}
+	return slices.Contains(a.Artists, artist) && now.Hour()*60+now.Minute() >= a.after
+}
+
+// Timer is an armed sleep timer
+// Speaker the speaker the timer has been armed for
+// Speakers the speakers switched off, the members of the zone of Speaker
+// Ends the time the speakers are switched off
+// Fading the volume is being faded out
+type Timer struct {
+	Speaker  string
+	Speakers []string
+	Ends     time.Time
+	Fading   bool
+}
+
+type timer struct {
+	Timer
+	cancel context.CancelFunc
+}
+
+// SleepTimer describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// timers the armed timers by speaker name
+// disarmed speakers whose timer has been cancelled, they are not armed automatically
+// speakers looks up the speakers timers act on
+type SleepTimer struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	settings  *settings
+	bus       *bus.Bus
+	host      plugins.Host
+	ctx       context.Context
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+	speakers  plugins.Speakers
+
+	mu       sync.Mutex
+	timers   map[string]*timer
+	disarmed map[string]bool
+}
+
+// NewSleepTimer creates a new SleepTimer plugin with the configuration
+func NewSleepTimer(config Config) (d *SleepTimer) {
+	d = &SleepTimer{Config: config, timers: map[string]*timer{}, disarmed: map[string]bool{}, speakers: plugins.Discovered{}}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	s, err := config.compile()
+	if err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.settings = s
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *SleepTimer) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *SleepTimer) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *SleepTimer) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *SleepTimer) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *SleepTimer) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *SleepTimer) Enable() { d.suspended.Store(d.settings == nil) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *SleepTimer) IsEnabled() bool { return !d.suspended.Load() }
+
+// SetBus gives the plugin access to the volumes of the speakers
+func (d *SleepTimer) SetBus(b *bus.Bus) { d.bus = b }
+
+// SetHost gives the plugin access to the plugins delivering notifications
+func (d *SleepTimer) SetHost(h plugins.Host) { d.host = h }
+
+// Start binds the timers to ctx
+func (d *SleepTimer) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	return nil
+}
+
+// Stop cancels all timers. Volumes being faded out are restored.
+func (d *SleepTimer) Stop(ctx context.Context) error {
+	d.suspended.Store(true)
+	d.cancel()
+	return plugins.Wait(ctx, &d.running)
+}
+
+// Execute arms timers automatically and drops the timers of speakers switched off by hand
+func (d *SleepTimer) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if !d.IsEnabled() {
+		return
+	}
+	np, ok := update.Value.(soundtouch.NowPlaying)
+	if !ok {
+		return
+	}
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+
+	if np.Source == "STANDBY" {
+		d.mu.Lock()
+		delete(d.disarmed, speaker.Name())
+		t := d.timers[speaker.Name()]
+		byHand := t != nil && !t.Fading
+		d.mu.Unlock()
+		if byHand {
+			mLogger.Infof("Switched off. Cancelling sleep timer.\n")
+			d.Cancel(speaker.Name())
+			d.mu.Lock()
+			delete(d.disarmed, speaker.Name())
+			d.mu.Unlock()
+		}
+		return
+	}
+
+	if np.PlayStatus != soundtouch.PlayState {
+		return
+	}
+	d.mu.Lock()
+	_, armed := d.timers[speaker.Name()]
+	disarmed := d.disarmed[speaker.Name()]
+	d.mu.Unlock()
+	if armed || disarmed {
+		return
+	}
+	for _, a := range d.settings.autoArm {
+		if !a.matches(speaker.Name(), np.Artist, time.Now()) {
+			continue
+		}
+		t, err := d.Arm(speaker.Name(), a.duration)
+		if err != nil {
+			mLogger.Errorf("Arming sleep timer failed: %v\n", err)
+			return
+		}
+		msg := fmt.Sprintf("%s plays %s. Sleep timer armed, switching off at %s.", speaker.Name(), np.Artist, t.Ends.Format("15:04"))
+		mLogger.Infoln(msg)
+		for _, n := range plugins.Notifiers(d.host) {
+			if err := n.Notify(msg); err != nil {
+				mLogger.Errorf("Sending notification failed: %v\n", err)
+			}
+		}
+		return
+	}
+}
+
+// Arm starts a timer switching off the speaker after duration, the configured duration if not
+// positive. If the speaker is member of a zone, all members are switched off. A timer already
+// armed for the speaker is replaced.
+func (d *SleepTimer) Arm(speaker string, duration time.Duration) (Timer, error) {
+	if d.settings == nil {
+		return Timer{}, fmt.Errorf("sleep timer not configured")
+	}
+	s := d.speakers.ByName(speaker)
+	if s == nil {
+		return Timer{}, fmt.Errorf("unknown speaker %s", speaker)
+	}
+	if duration <= 0 {
+		duration = d.settings.duration
+	}
+
+	members := d.zoneMembers(s)
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Name()
+	}
+
+	d.Cancel(speaker)
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	t := &timer{
+		Timer:  Timer{Speaker: speaker, Speakers: names, Ends: time.Now().Add(duration)},
+		cancel: cancel,
+	}
+	d.mu.Lock()
+	d.timers[speaker] = t
+	delete(d.disarmed, speaker)
+	d.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": speaker,
+	}).Infof("Sleep timer for %v ends at %s\n", names, t.Ends.Format("15:04:05"))
+	metrics.Actions.Inc(name, "Arm")
+
+	armed := t.Timer
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		d.run(ctx, t, members)
+	}()
+	return armed, nil
+}
+
+// Cancel cancels the timer of the speaker and returns true if one was armed. Volumes being faded
+// out are restored.
+func (d *SleepTimer) Cancel(speaker string) bool {
+	d.mu.Lock()
+	t, ok := d.timers[speaker]
+	delete(d.timers, speaker)
+	if ok {
+		d.disarmed[speaker] = true
+	}
+	d.mu.Unlock()
+	if ok {
+		t.cancel()
+	}
+	return ok
+}
+
+// Timers returns the armed timers ordered by their end
+func (d *SleepTimer) Timers() []Timer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	timers := make([]Timer, 0, len(d.timers))
+	for _, t := range d.timers {
+		timers = append(timers, t.Timer)
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i].Ends.Before(timers[j].Ends) })
+	return timers
+}
+
+// zoneMembers returns the speakers of the zone of s, s alone if it is member of no zone
+func (d *SleepTimer) zoneMembers(s *soundtouch.Speaker) []*soundtouch.Speaker {
+	zone, err := s.GetZone()
+	if err != nil || len(zone.Members) == 0 {
+		return []*soundtouch.Speaker{s}
+	}
+	var members []*soundtouch.Speaker
+	if m := d.speakers.ByDeviceID(zone.Master); m != nil {
+		members = append(members, m)
+	}
+	for _, member := range zone.Members {
+		if member.DeviceID == zone.Master {
+			continue
+		}
+		if m := d.speakers.ByDeviceID(member.DeviceID); m != nil {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		return []*soundtouch.Speaker{s}
+	}
+	return members
+}
+
+// volume returns the volume of s, as last seen on the bus or asked from the speaker
+func (d *SleepTimer) volume(s *soundtouch.Speaker) int {
+	if d.bus != nil {
+		if e, ok := d.bus.Last(s.DeviceID(), "Volume"); ok {
+			return e.Update.Value.(soundtouch.Volume).TargetVolume
+		}
+	}
+	v, _ := s.Volume()
+	return v.TargetVolume
+}
+
+// run waits for the fade of t, fades the volume of the members out, switches them off and
+// restores their volume
+func (d *SleepTimer) run(ctx context.Context, t *timer, members []*soundtouch.Speaker) {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": t.Speaker,
+	})
+	defer func() {
+		d.mu.Lock()
+		if d.timers[t.Speaker] == t {
+			delete(d.timers, t.Speaker)
+		}
+		d.mu.Unlock()
+	}()
+
+	fade := d.settings.fade
+	if remaining := time.Until(t.Ends); fade > remaining {
+		fade = remaining
+	}
+	select {
+	case <-time.After(time.Until(t.Ends) - fade):
+	case <-ctx.Done():
+		mLogger.Infof("Sleep timer cancelled\n")
+		return
+	}
+
+	d.mu.Lock()
+	t.Fading = true
+	d.mu.Unlock()
+
+	original := make([]int, len(members))
+	loudest := 1
+	for i, m := range members {
+		original[i] = d.volume(m)
+		loudest = max(loudest, original[i])
+	}
+	restore := func() {
+		for i, m := range members {
+			m.SetVolume(original[i])
+			metrics.Actions.Inc(name, "SetVolume")
+		}
+	}
+
+	mLogger.Infof("Fading out %v over %v\n", t.Speakers, fade)
+	ticker := time.NewTicker(max(fade/time.Duration(loudest), time.Millisecond))
+	defer ticker.Stop()
+	for step := 1; step <= loudest; step++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			mLogger.Infof("Sleep timer cancelled. Restoring volume.\n")
+			restore()
+			return
+		}
+		for i, m := range members {
+			m.SetVolume(original[i] * (loudest - step) / loudest)
+			metrics.Actions.Inc(name, "SetVolume")
+		}
+	}
+
+	for _, m := range members {
+		mLogger.Infof("Powering off %s\n", m.Name())
+		m.PowerOff()
+		metrics.Actions.Inc(name, "PowerOff")
+	}
+	// the volume is kept in standby, so that the speaker starts with it next time
+	restore()
+}
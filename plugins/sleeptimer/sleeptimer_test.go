@@ -0,0 +1,175 @@
+package sleeptimer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// simulate starts the simulated speaker Prinzessinen playing an audiobook at volume 20
+func simulate(t *testing.T) (*simulator.Network, *simulator.Device, *bus.Bus) {
+	n := simulatortest.Simulate(t, "Prinzessinen")
+	dev := n.Device("Prinzessinen")
+	dev.Play(simulator.NowPlaying{Source: "STORED_MUSIC", Artist: "Die drei ???"})
+	dev.SetVolume(20)
+	dev.ResetCommands()
+
+	b := bus.New(0)
+	b.Publish(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20, ActualVolume: 20}}, *dev.Speaker())
+	return n, dev, b
+}
+
+// volumes returns the volumes set on dev
+func volumes(dev *simulator.Device) []string {
+	var v []string
+	for _, body := range dev.Received("/volume") {
+		v = append(v, strings.TrimSuffix(strings.TrimPrefix(body, "<volume>"), "</volume>"))
+	}
+	return v
+}
+
+func TestSleepTimer_Arm(t *testing.T) {
+	n, dev, b := simulate(t)
+	d := NewSleepTimer(Config{Fade: "40ms"})
+	d.speakers = n
+	d.SetBus(b)
+
+	timer, err := d.Arm("Prinzessinen", 60*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Arm() error = %v", err)
+	}
+	if len(timer.Speakers) != 1 || timer.Speakers[0] != "Prinzessinen" {
+		t.Errorf("Arm() speakers = %v, want [Prinzessinen]", timer.Speakers)
+	}
+	if len(d.Timers()) != 1 {
+		t.Errorf("Timers() = %v, want the armed timer", d.Timers())
+	}
+	d.running.Wait()
+
+	if dev.IsPoweredOn() {
+		t.Errorf("speaker not switched off")
+	}
+	v := volumes(dev)
+	if len(v) != 21 || v[0] != "19" || v[19] != "0" || v[20] != "20" {
+		t.Errorf("volumes set %v, want 19 down to 0, then 20 restored", v)
+	}
+	if len(d.Timers()) != 0 {
+		t.Errorf("Timers() = %v after the timer ended", d.Timers())
+	}
+
+	if _, err := d.Arm("Bad", time.Minute); err == nil {
+		t.Errorf("Arm(Bad) expected error")
+	}
+}
+
+func TestSleepTimer_Cancel(t *testing.T) {
+	n, dev, b := simulate(t)
+	d := NewSleepTimer(Config{Fade: "2s"})
+	d.speakers = n
+	d.SetBus(b)
+
+	if _, err := d.Arm("Prinzessinen", time.Hour); err != nil {
+		t.Fatalf("Arm() error = %v", err)
+	}
+	if !d.Cancel("Prinzessinen") || d.Cancel("Prinzessinen") {
+		t.Errorf("Cancel() didn't cancel the timer once")
+	}
+	d.running.Wait()
+	if !dev.IsPoweredOn() || len(volumes(dev)) != 0 {
+		t.Errorf("cancelled timer acted on speaker")
+	}
+
+	// cancelled while fading
+	if _, err := d.Arm("Prinzessinen", 2*time.Second); err != nil {
+		t.Fatalf("Arm() error = %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	d.Cancel("Prinzessinen")
+	d.running.Wait()
+	v := volumes(dev)
+	if !dev.IsPoweredOn() || len(v) < 2 || v[len(v)-1] != "20" {
+		t.Errorf("volumes set %v, want fading restored to 20", v)
+	}
+}
+
+func TestSleepTimer_Execute(t *testing.T) {
+	n, dev, b := simulate(t)
+	d := NewSleepTimer(Config{AutoArm: []AutoArm{{Speakers: []string{"Prinzessinen"}, Artists: []string{"Die drei ???"}}}})
+	d.speakers = n
+	d.SetBus(b)
+	speaker := *dev.Speaker()
+	playing := soundtouch.Update{Value: soundtouch.NowPlaying{Source: "STORED_MUSIC", Artist: "Die drei ???", PlayStatus: soundtouch.PlayState}}
+	standby := soundtouch.Update{Value: soundtouch.NowPlaying{Source: "STANDBY"}}
+
+	d.Execute("", playing, speaker)
+	if len(d.Timers()) != 1 {
+		t.Fatalf("timer not armed automatically")
+	}
+
+	// switching off by hand cancels the timer
+	d.Execute("", standby, speaker)
+	if len(d.Timers()) != 0 {
+		t.Fatalf("timer not cancelled by switching off")
+	}
+
+	// a timer cancelled by the user is not armed again until the speaker is switched off
+	d.Execute("", playing, speaker)
+	d.Cancel("Prinzessinen")
+	d.Execute("", playing, speaker)
+	if len(d.Timers()) != 0 {
+		t.Errorf("cancelled timer armed again")
+	}
+	d.Execute("", standby, speaker)
+	d.Execute("", playing, speaker)
+	if len(d.Timers()) != 1 {
+		t.Errorf("timer not armed after switching off")
+	}
+	d.Cancel("Prinzessinen")
+	d.running.Wait()
+}
+
+func TestAutoArm_matches(t *testing.T) {
+	evening := time.Date(2026, 10, 18, 19, 30, 0, 0, time.Local)
+	afternoon := time.Date(2026, 10, 18, 16, 0, 0, 0, time.Local)
+	c := Config{AutoArm: []AutoArm{{Speakers: []string{"Prinzessinen"}, Artists: []string{"Die drei ???"}, After: "19:00"}}}
+	s, err := c.compile()
+	if err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	a := s.autoArm[0]
+
+	tests := []struct {
+		speaker, artist string
+		now             time.Time
+		want            bool
+	}{
+		{"Prinzessinen", "Die drei ???", evening, true},
+		{"Prinzessinen", "Die drei ???", afternoon, false},
+		{"Prinzessinen", "Metallica", evening, false},
+		{"Wohnzimmer", "Die drei ???", evening, false},
+	}
+	for _, tt := range tests {
+		if got := a.matches(tt.speaker, tt.artist, tt.now); got != tt.want {
+			t.Errorf("matches(%s, %s, %v) = %v, want %v", tt.speaker, tt.artist, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, c := range []Config{
+		{Duration: "half an hour"},
+		{Fade: "5"},
+		{AutoArm: []AutoArm{{Speakers: []string{"Prinzessinen"}}}},
+		{AutoArm: []AutoArm{{Artists: []string{"Die drei ???"}, After: "7pm"}}},
+		{AutoArm: []AutoArm{{Artists: []string{"Die drei ???"}, Duration: "long"}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) expected error", c)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package plugins
+
+import (
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Speakers looks up the speakers a plugin acts on. Plugins are handed the Discovered speakers by
+// their constructor, tests hand them a simulator.Network instead.
+// Known returns the speakers by device ID
+// ByName and ByDeviceID return the speaker with the name or device ID, nil if unknown
+type Speakers interface {
+	Known() map[string]*soundtouch.Speaker
+	ByName(name string) *soundtouch.Speaker
+	ByDeviceID(deviceID string) *soundtouch.Speaker
+}
+
+// Discovered are the speakers discovered on the network
+type Discovered struct{}
+
+// Known returns the discovered speakers by device ID
+func (Discovered) Known() map[string]*soundtouch.Speaker { return soundtouch.GetKnownDevices() }
+
+// ByName returns the discovered speaker with the name, nil if unknown
+func (Discovered) ByName(name string) *soundtouch.Speaker { return soundtouch.GetSpeakerByName(name) }
+
+// ByDeviceID returns the discovered speaker with the device ID, nil if unknown
+func (Discovered) ByDeviceID(deviceID string) *soundtouch.Speaker {
+	return soundtouch.GetSpeakerByDeviceId(deviceID)
+}
@@ -0,0 +1,260 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// What a supervisor does with an update if the queue of its plugin is full
+const (
+	DropOldest = "oldest"
+	DropNewest = "newest"
+	Block      = "block"
+)
+
+// Supervision configures how a plugin is run by its supervisor. It is given by the optional
+// sub-table supervisor of every plugin section, e.g. [volumeButler.supervisor].
+// Queue the number of updates waiting for the plugin, 16 if not set
+// Drop what to do with an update if the queue is full: "oldest" (default) drops the longest
+// waiting update, "newest" the arriving one, "block" waits for the plugin
+// Timeout the time a single execution may take before it counts as failure, e.g. "10s", 30s if
+// not set. The updates arriving until a longer execution finishes are dropped.
+// MaxFailures the number of consecutive panics or timeouts after which the plugin is disabled,
+// 3 if not set. Negative values never disable the plugin.
+type Supervision struct {
+	Queue       int    `toml:"queue"`
+	Drop        string `toml:"drop"`
+	Timeout     string `toml:"timeout"`
+	MaxFailures int    `toml:"max_failures"`
+}
+
+// DefaultSupervision is used for plugin sections without supervisor sub-table
+var DefaultSupervision = Supervision{Queue: 16, Drop: DropOldest, Timeout: "30s", MaxFailures: 3}
+
+// withDefaults returns s with every unset value taken from DefaultSupervision
+func (s Supervision) withDefaults() Supervision {
+	if s.Queue <= 0 {
+		s.Queue = DefaultSupervision.Queue
+	}
+	if s.Drop == "" {
+		s.Drop = DefaultSupervision.Drop
+	}
+	if s.Timeout == "" {
+		s.Timeout = DefaultSupervision.Timeout
+	}
+	if s.MaxFailures == 0 {
+		s.MaxFailures = DefaultSupervision.MaxFailures
+	}
+	return s
+}
+
+// validate checks the values that can't be checked by decoding
+func (s Supervision) validate() error {
+	switch s.Drop {
+	case "", DropOldest, DropNewest, Block:
+	default:
+		return fmt.Errorf("drop must be one of %s, %s or %s", DropOldest, DropNewest, Block)
+	}
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("timeout %q is no positive duration", s.Timeout)
+		}
+	}
+	return nil
+}
+
+// job is an update waiting to be executed by the plugin
+type job struct {
+	update  soundtouch.Update
+	speaker soundtouch.Speaker
+}
+
+// Supervisor runs a plugin on its own goroutine. Updates are queued, so that a slow plugin
+// doesn't delay the other plugins. A panic or an execution exceeding the timeout is logged and
+// counted. The plugin is disabled after too many consecutive failures. closing is closed when
+// Close is called, so that an update waiting for the queue in Block mode gives up.
+type Supervisor struct {
+	soundtouch.Plugin
+	config  Supervision
+	timeout time.Duration
+
+	mu        sync.RWMutex
+	queue     chan job
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+	failures  int
+	done      chan struct{}
+}
+
+// Supervise starts running p as configured by config
+func Supervise(p soundtouch.Plugin, config Supervision) *Supervisor {
+	config = config.withDefaults()
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout, _ = time.ParseDuration(DefaultSupervision.Timeout)
+	}
+
+	s := &Supervisor{
+		Plugin:  p,
+		config:  config,
+		timeout: timeout,
+		queue:   make(chan job, config.Queue),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Unwrap returns the supervised plugin
+func (s *Supervisor) Unwrap() soundtouch.Plugin { return s.Plugin }
+
+// Execute queues the update for the plugin
+func (s *Supervisor) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	j := job{update: update, speaker: speaker}
+	if s.config.Drop == Block {
+		select {
+		case s.queue <- j:
+		case <-s.closing:
+		}
+		return
+	}
+	select {
+	case s.queue <- j:
+		return
+	default:
+	}
+
+	if s.config.Drop == DropOldest {
+		select {
+		case <-s.queue:
+		default:
+		}
+		select {
+		case s.queue <- j:
+		default:
+		}
+	}
+	metrics.Dropped.Inc(s.Name())
+	s.logger(speaker).Warnf("Queue of %d updates full. Dropped the %s update.\n", s.config.Queue, s.config.Drop)
+}
+
+// Close stops accepting updates and waits until the queued updates have been executed or ctx
+// is done. An execution exceeding the timeout is not waited for.
+func (s *Supervisor) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run executes the queued updates one after another. While an execution exceeding the timeout
+// hasn't finished, the updates are dropped, so that the plugin never executes two updates at once
+// and its queue doesn't stall.
+func (s *Supervisor) run() {
+	defer close(s.done)
+	var late <-chan bool
+	var current job
+	var started time.Time
+	for {
+		select {
+		case <-late:
+			late = nil
+			s.logger(current.speaker).Warnf("Finished after %v.\n", time.Since(started).Round(time.Millisecond))
+		case j, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			if late != nil {
+				metrics.Dropped.Inc(s.Name())
+				continue
+			}
+			if !s.Plugin.IsEnabled() {
+				continue
+			}
+			current, started = j, time.Now()
+			late = s.execute(j)
+		}
+	}
+}
+
+// execute runs the plugin with the update. An execution exceeding the timeout is counted as
+// failure at once and left running. execute then returns the channel it reports its end on.
+func (s *Supervisor) execute(j job) <-chan bool {
+	mLogger := s.logger(j.speaker)
+
+	started := time.Now()
+	finished := make(chan bool, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				metrics.PluginPanics.Inc(s.Name())
+				mLogger.Errorf("Panicked. %v\n%s\n", r, debug.Stack())
+				finished <- false
+			}
+		}()
+		s.Plugin.Execute(s.Name(), j.update, j.speaker)
+		finished <- true
+	}()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	var ok bool
+	var late <-chan bool
+	select {
+	case ok = <-finished:
+	case <-timer.C:
+		metrics.PluginTimeouts.Inc(s.Name())
+		mLogger.Errorf("Not finished within %v. Dropping the updates until it finishes.\n", s.timeout)
+		late = finished
+	}
+
+	if metrics.Enabled() {
+		metrics.PluginExecutions.Inc(s.Name())
+		metrics.PluginDuration.Observe(time.Since(started).Seconds(), s.Name())
+	}
+
+	if ok {
+		s.failures = 0
+		return nil
+	}
+	s.failures++
+	if s.config.MaxFailures > 0 && s.failures >= s.config.MaxFailures {
+		mLogger.Errorf("Failed %d times in a row. Disabling plugin.\n", s.failures)
+		s.Plugin.Disable()
+		s.failures = 0
+	}
+	return late
+}
+
+func (s *Supervisor) logger(speaker soundtouch.Speaker) *log.Entry {
+	return log.WithFields(log.Fields{
+		"Plugin":  s.Name(),
+		"Speaker": speaker.Name(),
+	})
+}
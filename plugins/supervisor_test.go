@@ -0,0 +1,225 @@
+package plugins
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// fake is a plugin that hands every update to fn
+type fake struct {
+	fn        func(update soundtouch.Update)
+	mu        sync.Mutex
+	n         int
+	suspended bool
+}
+
+func (f *fake) Name() string         { return "fake" }
+func (f *fake) Description() string  { return "" }
+func (f *fake) SampleConfig() string { return "" }
+func (f *fake) Terminate() bool      { return false }
+
+func (f *fake) Disable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.suspended = true
+}
+
+func (f *fake) Enable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.suspended = false
+}
+
+func (f *fake) IsEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.suspended
+}
+
+func (f *fake) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	f.mu.Lock()
+	f.n++
+	f.mu.Unlock()
+	f.fn(update)
+}
+
+func (f *fake) executions() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+func executeN(s *Supervisor, from, to int) {
+	for i := from; i <= to; i++ {
+		s.Execute("fake", soundtouch.Update{Value: i}, soundtouch.Speaker{})
+	}
+}
+
+func closeSupervisor(t *testing.T, s *Supervisor) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func TestSupervisor_Panics(t *testing.T) {
+	f := &fake{fn: func(update soundtouch.Update) {
+		if update.Value.(int) <= 3 {
+			panic("boom")
+		}
+	}}
+	s := Supervise(f, Supervision{MaxFailures: 3})
+	executeN(s, 1, 5)
+	closeSupervisor(t, s)
+
+	if f.executions() != 3 {
+		t.Errorf("executions = %d, want 3", f.executions())
+	}
+	if f.IsEnabled() {
+		t.Errorf("plugin not disabled after 3 panics")
+	}
+}
+
+func TestSupervisor_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var executed []int
+	running, overlapping := 0, false
+	f := &fake{fn: func(update soundtouch.Update) {
+		mu.Lock()
+		running++
+		overlapping = overlapping || running > 1
+		mu.Unlock()
+		if update.Value.(int) == 1 {
+			<-release
+		}
+		mu.Lock()
+		running--
+		executed = append(executed, update.Value.(int))
+		mu.Unlock()
+	}}
+	s := Supervise(f, Supervision{Timeout: "10ms", MaxFailures: 2})
+	executeN(s, 1, 1)
+	time.Sleep(50 * time.Millisecond)
+	// the first hangs, the second is dropped instead of waiting for it
+	executeN(s, 2, 2)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	executeN(s, 3, 3)
+	closeSupervisor(t, s)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(executed, []int{1, 3}) || overlapping {
+		t.Errorf("executed %v, overlapping %v, want [1 3] one after another", executed, overlapping)
+	}
+	if !f.IsEnabled() {
+		t.Errorf("plugin disabled after a single timeout")
+	}
+}
+
+func TestSupervisor_Hangs(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	f := &fake{fn: func(update soundtouch.Update) { <-release }}
+	s := Supervise(f, Supervision{Timeout: "10ms", MaxFailures: 1})
+	executeN(s, 1, 1)
+	time.Sleep(50 * time.Millisecond)
+	if f.IsEnabled() {
+		t.Errorf("plugin not disabled while hanging")
+	}
+	// Close doesn't wait for the execution hanging
+	closeSupervisor(t, s)
+}
+
+func TestSupervisor_CloseBlocked(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	f := &fake{fn: func(update soundtouch.Update) {
+		if update.Value.(int) == 1 {
+			close(started)
+		}
+		<-release
+	}}
+	s := Supervise(f, Supervision{Queue: 1, Drop: Block, Timeout: "1h"})
+	executeN(s, 1, 1)
+	<-started
+	executeN(s, 2, 2)
+	sent := make(chan struct{})
+	go func() {
+		executeN(s, 3, 3) // waits for the queue
+		close(sent)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closed := make(chan error)
+	go func() { closed <- s.Close(ctx) }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close() blocked by an update waiting for the queue")
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Errorf("Execute() still waiting for the queue after Close()")
+	}
+}
+
+func TestSupervisor_Drop(t *testing.T) {
+	tests := []struct {
+		drop string
+		want []int
+	}{
+		{drop: DropOldest, want: []int{1, 4, 5}},
+		{drop: DropNewest, want: []int{1, 2, 3}},
+		{drop: Block, want: []int{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.drop, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var got []int
+			f := &fake{fn: func(update soundtouch.Update) {
+				if update.Value.(int) == 1 {
+					close(started)
+					<-release
+				}
+				got = append(got, update.Value.(int))
+			}}
+			s := Supervise(f, Supervision{Queue: 2, Drop: tt.drop})
+
+			// the plugin is busy with the first update while the others arrive
+			executeN(s, 1, 1)
+			<-started
+			if tt.drop == Block {
+				sent := make(chan struct{})
+				go func() {
+					executeN(s, 2, 5)
+					close(sent)
+				}()
+				close(release)
+				<-sent
+			} else {
+				executeN(s, 2, 5)
+				close(release)
+			}
+			closeSupervisor(t, s)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("executed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-golang"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// remoteUnique routes the presses of all remote control buttons to remoteCallback. The data of a
+// button is the action followed by its arguments, e.g. "vol|<deviceID>|+5".
+const remoteUnique = "remote"
+
+// The actions of the remote control buttons
+const (
+	actList   = "list"
+	actCard   = "card"
+	actKey    = "key"
+	actVolume = "vol"
+	actPreset = "preset"
+	actPower  = "power"
+	actZone   = "zone"
+	actJoin   = "join"
+	actLeave  = "leave"
+)
+
+// actionCommands are the commands whose permission the actions of the buttons need. Switching a
+// speaker on or off needs /on or /off, see actionCommand.
+var actionCommands = map[string]string{
+	actKey:    "pause",
+	actVolume: "volume",
+	actPreset: "preset",
+	actZone:   "zone",
+	actJoin:   "zone",
+	actLeave:  "unzone",
+}
+
+// actionCommand returns the command whose permission action on s needs, empty if none
+func actionCommand(action string, s *soundtouch.Speaker) string {
+	if action != actPower {
+		return actionCommands[action]
+	}
+	if s.IsPoweredOn() {
+		return "off"
+	}
+	return "on"
+}
+
+// cardKeys are the keys the card presses
+var cardKeys = []soundtouch.Key{soundtouch.PLAY_PAUSE, soundtouch.NEXT_TRACK}
+
+// cardState is the latest state of a speaker shown on the cards
+type cardState struct {
+	nowPlaying *soundtouch.NowPlaying
+	volume     *soundtouch.Volume
+}
+
+// openCard is the card shown last in a chat. shown is the content of the card, so that it is
+// only edited if it changes.
+type openCard struct {
+	msg      tb.StoredMessage
+	deviceID string
+	shown    string
+}
+
+// remoteCards are the remote control cards shown, one per chat. They are refreshed by run when the
+// state of their speaker changes. due holds the speakers whose cards are to be refreshed by device
+// ID, so that the updates arriving while refreshing a speaker are refreshed together. wake tells
+// run that speakers are due.
+type remoteCards struct {
+	edit func(msg tb.Editable, text string, kb *tb.ReplyMarkup) error
+	wake chan struct{}
+
+	mu     sync.Mutex
+	states map[string]*cardState
+	open   map[int64]*openCard
+	due    map[string]*soundtouch.Speaker
+}
+
+func newRemoteCards(edit func(msg tb.Editable, text string, kb *tb.ReplyMarkup) error) *remoteCards {
+	return &remoteCards{
+		edit:   edit,
+		wake:   make(chan struct{}, 1),
+		states: map[string]*cardState{},
+		open:   map[int64]*openCard{},
+		due:    map[string]*soundtouch.Speaker{},
+	}
+}
+
+// observe keeps the state of speaker of update. It returns true if a card shows the speaker.
+func (r *remoteCards) observe(update soundtouch.Update, speaker soundtouch.Speaker) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.states[speaker.DeviceID()]
+	if st == nil {
+		st = &cardState{}
+		r.states[speaker.DeviceID()] = st
+	}
+	switch v := update.Value.(type) {
+	case soundtouch.NowPlaying:
+		st.nowPlaying = &v
+	case soundtouch.Volume:
+		st.volume = &v
+	default:
+		return false
+	}
+	for _, c := range r.open {
+		if c.deviceID == speaker.DeviceID() {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule lets run refresh the cards of s, without waiting for it
+func (r *remoteCards) schedule(s *soundtouch.Speaker) {
+	r.mu.Lock()
+	r.due[s.DeviceID()] = s
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the cards of the speakers scheduled until ctx is done
+func (r *remoteCards) run(ctx context.Context) {
+	for {
+		select {
+		case <-r.wake:
+			r.mu.Lock()
+			due := r.due
+			r.due = map[string]*soundtouch.Speaker{}
+			r.mu.Unlock()
+			for _, s := range due {
+				r.refresh(s)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// state returns the latest state of s, asking the speaker for what is unknown
+func (r *remoteCards) state(s *soundtouch.Speaker) cardState {
+	r.mu.Lock()
+	var st cardState
+	if known := r.states[s.DeviceID()]; known != nil {
+		st = *known
+	}
+	r.mu.Unlock()
+
+	if st.nowPlaying == nil {
+		if np, err := s.NowPlaying(); err == nil {
+			st.nowPlaying = &np
+		}
+	}
+	if st.volume == nil {
+		if v, err := s.Volume(); err == nil {
+			st.volume = &v
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	known := r.states[s.DeviceID()]
+	if known == nil {
+		known = &cardState{}
+		r.states[s.DeviceID()] = known
+	}
+	// updates observed meanwhile are newer than the answers of the speaker
+	if known.nowPlaying == nil {
+		known.nowPlaying = st.nowPlaying
+	}
+	if known.volume == nil {
+		known.volume = st.volume
+	}
+	return *known
+}
+
+// show edits msg into the card of s and refreshes it from now on
+func (r *remoteCards) show(msg tb.StoredMessage, s *soundtouch.Speaker) error {
+	r.mu.Lock()
+	c := r.open[msg.ChatID]
+	if c == nil || c.msg != msg || c.deviceID != s.DeviceID() {
+		c = &openCard{msg: msg, deviceID: s.DeviceID()}
+		r.open[msg.ChatID] = c
+	}
+	r.mu.Unlock()
+	return r.render(c, s)
+}
+
+// close stops refreshing the card of the chat
+func (r *remoteCards) close(chatID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.open, chatID)
+}
+
+// refresh renders the cards of s again
+func (r *remoteCards) refresh(s *soundtouch.Speaker) {
+	r.mu.Lock()
+	var cards []*openCard
+	for _, c := range r.open {
+		if c.deviceID == s.DeviceID() {
+			cards = append(cards, c)
+		}
+	}
+	r.mu.Unlock()
+	for _, c := range cards {
+		if err := r.render(c, s); err != nil {
+			log.WithFields(log.Fields{
+				"Plugin":  name,
+				"Speaker": s.Name(),
+			}).Warnf("Refreshing remote control failed: %v\n", err)
+		}
+	}
+}
+
+// render edits card c of s, unless it shows the content already. The speaker and telegram are
+// asked without holding mu, so that observing updates never waits for them.
+func (r *remoteCards) render(c *openCard, s *soundtouch.Speaker) error {
+	zone, _ := s.GetZone()
+	text, kb := card(s, r.state(s), len(zone.Members) > 0)
+	content := text + "\n" + keyboardText(kb)
+	r.mu.Lock()
+	shown := c.shown
+	r.mu.Unlock()
+	if content == shown {
+		return nil
+	}
+	if err := r.edit(c.msg, text, kb); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	c.shown = content
+	r.mu.Unlock()
+	return nil
+}
+
+// keyboardText returns the labels of the buttons of kb
+func keyboardText(kb *tb.ReplyMarkup) string {
+	var rows []string
+	for _, row := range kb.InlineKeyboard {
+		var labels []string
+		for _, b := range row {
+			labels = append(labels, b.Text)
+		}
+		rows = append(rows, strings.Join(labels, " "))
+	}
+	return strings.Join(rows, "\n")
+}
+
+// playIcons shows the play status on the cards
+var playIcons = map[soundtouch.PlayStatus]string{
+	soundtouch.PlayState:      "▶",
+	soundtouch.PauseState:     "⏸",
+	soundtouch.StopState:      "⏹",
+	soundtouch.BufferingState: "⏳",
+}
+
+// card returns the text and the buttons of the card of s in state st
+func card(s *soundtouch.Speaker, st cardState, inZone bool) (string, *tb.ReplyMarkup) {
+	var b strings.Builder
+	b.WriteString("🔊 " + s.Name() + "\n")
+	np := st.nowPlaying
+	on := np == nil || np.Source != soundtouch.Standby
+	switch {
+	case np == nil:
+		b.WriteString("Not known what is playing\n")
+	case !on:
+		b.WriteString("Standby\n")
+	default:
+		var what []string
+		for _, w := range []string{np.StationName, np.Artist, np.Track, np.Album} {
+			if w != "" && !strings.Contains(strings.Join(what, " "), w) {
+				what = append(what, w)
+			}
+		}
+		if len(what) == 0 {
+			what = append(what, string(np.Source))
+		}
+		icon := playIcons[np.PlayStatus]
+		if icon == "" {
+			icon = "▶"
+		}
+		fmt.Fprintf(&b, "%s %s\n", icon, strings.Join(what, " – "))
+		fmt.Fprintf(&b, "Source %s\n", np.Source)
+	}
+	if v := st.volume; v != nil {
+		fmt.Fprintf(&b, "Volume %d", v.TargetVolume)
+		if v.MuteEnabled {
+			b.WriteString(" (muted)")
+		}
+		b.WriteString("\n")
+	}
+
+	id := s.DeviceID()
+	kb := &tb.ReplyMarkup{}
+	btn := func(text, action string, args ...string) tb.Btn {
+		return kb.Data(text, remoteUnique, append([]string{action, id}, args...)...)
+	}
+	var presets tb.Row
+	for i := 1; i <= 6; i++ {
+		presets = append(presets, btn(strconv.Itoa(i), actPreset, strconv.Itoa(i)))
+	}
+	power := btn("⏻ Off", actPower)
+	if !on {
+		power = btn("⏻ On", actPower)
+	}
+	zone := btn("🔗 Join zone", actZone)
+	if inZone {
+		zone = btn("⛓ Leave zone", actLeave)
+	}
+	kb.Inline(
+		kb.Row(btn("⏯", actKey, string(soundtouch.PLAY_PAUSE)), btn("⏭", actKey, string(soundtouch.NEXT_TRACK))),
+		kb.Row(btn("🔉 -5", actVolume, "-5"), btn("🔊 +5", actVolume, "+5")),
+		presets,
+		kb.Row(power, zone),
+		kb.Row(kb.Data("⬅ Speakers", remoteUnique, actList), btn("🔄", actCard)),
+	)
+	return b.String(), kb
+}
+
+// speakerList returns the buttons opening the cards of the speakers, two per row
+func speakerList(known map[string]*soundtouch.Speaker) *tb.ReplyMarkup {
+	byName, names := knownSpeakers(known)
+	kb := &tb.ReplyMarkup{}
+	var rows []tb.Row
+	for i, n := range names {
+		if i%2 == 0 {
+			rows = append(rows, tb.Row{})
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], kb.Data(n, remoteUnique, actCard, byName[n].DeviceID()))
+	}
+	kb.Inline(rows...)
+	return kb
+}
+
+// joinList returns the buttons letting s join the zone of one of the other speakers
+func joinList(s *soundtouch.Speaker, known map[string]*soundtouch.Speaker) *tb.ReplyMarkup {
+	byName, names := knownSpeakers(known)
+	kb := &tb.ReplyMarkup{}
+	var rows []tb.Row
+	for _, n := range names {
+		if m := byName[n]; m.DeviceID() != s.DeviceID() {
+			rows = append(rows, kb.Row(kb.Data("Play with "+n, remoteUnique, actJoin, s.DeviceID(), m.DeviceID())))
+		}
+	}
+	rows = append(rows, kb.Row(kb.Data("⬅ Back", remoteUnique, actCard, s.DeviceID())))
+	kb.Inline(rows...)
+	return kb
+}
+
+// permitted returns the known speakers u may control by device ID
+func (d *Bot) permitted(u User) map[string]*soundtouch.Speaker {
+	known := map[string]*soundtouch.Speaker{}
+	for id, s := range d.speakers.Known() {
+		if u.mayControl(s.Name()) {
+			known[id] = s
+		}
+	}
+	return known
+}
+
+// /remote [speakerName]
+func (d *Bot) remoteControl(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	known := d.permitted(d.sender(m))
+	if len(known) == 0 {
+		d.bot.Send(m.Sender, "No speakers found")
+		return
+	}
+
+	args := strings.Fields(m.Text)[1:]
+	if len(args) == 0 {
+		d.bot.Send(m.Sender, "Choose a speaker", speakerList(known))
+		return
+	}
+	s, err := lookupSpeaker(known, strings.Join(args, " "))
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Choose a speaker", err), speakerList(known))
+		return
+	}
+	msg, err := d.bot.Send(m.Sender, "🔊 "+s.Name())
+	if err != nil {
+		return
+	}
+	if err := d.cards.show(storedMessage(msg), s); err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not show the remote control: %v", err))
+	}
+}
+
+func storedMessage(m *tb.Message) tb.StoredMessage {
+	id, chat := m.MessageSig()
+	return tb.StoredMessage{MessageID: id, ChatID: chat}
+}
+
+// remoteCallback routes the presses of the remote control buttons. The card is edited in place
+// and the outcome of the action is shown as notification.
+func (d *Bot) remoteCallback(c *tb.Callback) {
+	respond := func(text string, alert bool) {
+		d.bot.Respond(c, &tb.CallbackResponse{Text: text, ShowAlert: alert})
+	}
+	u, ok := d.users.get(c.Sender.ID)
+	if !ok || !u.mayUse("remote") || c.Message == nil {
+		respond("You are not permitted to use the remote control", true)
+		return
+	}
+	known := d.permitted(u)
+	msg := storedMessage(c.Message)
+
+	args := strings.Split(c.Data, "|")
+	if args[0] == actList {
+		d.cards.close(msg.ChatID)
+		d.bot.Edit(msg, "Choose a speaker", speakerList(known))
+		respond("", false)
+		return
+	}
+	if len(args) < 2 || known[args[1]] == nil {
+		respond("Unknown speaker", true)
+		return
+	}
+	s := known[args[1]]
+	arg := ""
+	if len(args) > 2 {
+		arg = args[2]
+	}
+	cmd := actionCommand(args[0], s)
+	if cmd != "" && !u.mayUse(cmd) {
+		respond(fmt.Sprintf("You are not permitted to use /%s", cmd), true)
+		return
+	}
+
+	var reply string
+	var err error
+	switch args[0] {
+	case actCard:
+	case actKey:
+		reply, err = pressKey(s, soundtouch.Key(arg))
+	case actVolume:
+		reply, err = setVolume(d.speakers, known, []string{s.Name(), arg})
+	case actPreset:
+		reply, err = playPreset(d.speakers, known, []string{s.Name(), arg})
+	case actPower:
+		if cmd == "off" {
+			reply, err = powerOff(d.speakers, known, []string{s.Name()})
+		} else {
+			reply, err = powerOn(d.speakers, known, []string{s.Name()})
+		}
+	case actLeave:
+		reply, err = dissolveZone(d.speakers, known, []string{s.Name()})
+	case actZone:
+		d.cards.close(msg.ChatID)
+		d.bot.Edit(msg, fmt.Sprintf("Choose the speaker %s plays with", s.Name()), joinList(s, known))
+		respond("", false)
+		return
+	case actJoin:
+		reply, err = joinZone(s, known[arg])
+	default:
+		respond("Unknown button", true)
+		return
+	}
+	if err != nil {
+		respond(fmt.Sprintf("Could not %s: %v", args[0], err), true)
+	} else {
+		respond(reply, false)
+	}
+	if err := d.cards.show(msg, s); err != nil {
+		log.WithFields(log.Fields{
+			"Plugin":  name,
+			"Speaker": s.Name(),
+		}).Warnf("Showing remote control failed: %v\n", err)
+	}
+}
+
+// pressKey presses one of the cardKeys on s
+func pressKey(s *soundtouch.Speaker, key soundtouch.Key) (string, error) {
+	if !containsKey(cardKeys, key) {
+		return "", fmt.Errorf("key %q not supported", key)
+	}
+	remoteLogger(s).Infof("Pressing %s\n", key)
+	if err := s.PressKey(key); err != nil {
+		return "", err
+	}
+	metrics.Actions.Inc(name, "PressKey")
+	return fmt.Sprintf("%s pressed", key), nil
+}
+
+func containsKey(keys []soundtouch.Key, key soundtouch.Key) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// joinZone lets s play with master, adding it to the zone of master if there is one
+func joinZone(s, master *soundtouch.Speaker) (string, error) {
+	if master == nil {
+		return "", fmt.Errorf("unknown speaker")
+	}
+	zone, err := master.GetZone()
+	if err == nil && zone.Master == master.DeviceID() && len(zone.Members) > 0 {
+		remoteLogger(master).Infof("Adding %s to zone\n", s.Name())
+		master.AddZoneSlave(soundtouch.NewZone(*master, *s))
+		metrics.Actions.Inc(name, "AddZoneSlave")
+	} else {
+		remoteLogger(master).Infof("Creating new zone with %s\n", s.Name())
+		master.SetZone(soundtouch.NewZone(*master, *s))
+		metrics.Actions.Inc(name, "SetZone")
+	}
+	return fmt.Sprintf("%s plays with %s", s.Name(), master.Name()), nil
+}
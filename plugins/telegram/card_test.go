@@ -0,0 +1,245 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestCard(t *testing.T) {
+	office := speaker("Office")
+	np := playing("TUNEIN", "SWR3", "Queen", "Radio Ga Ga").Value.(soundtouch.NowPlaying)
+	text, kb := card(&office, cardState{nowPlaying: &np, volume: &soundtouch.Volume{TargetVolume: 35}}, false)
+	want := "🔊 Office\n▶ SWR3 – Queen – Radio Ga Ga\nSource TUNEIN\nVolume 35\n"
+	if text != want {
+		t.Errorf("card() text = %q, want %q", text, want)
+	}
+	wantKeys := "⏯ ⏭\n🔉 -5 🔊 +5\n1 2 3 4 5 6\n⏻ Off 🔗 Join zone\n⬅ Speakers 🔄"
+	if got := keyboardText(kb); got != wantKeys {
+		t.Errorf("card() buttons = %q, want %q", got, wantKeys)
+	}
+	var data []string
+	for _, row := range kb.InlineKeyboard {
+		for _, b := range row {
+			if b.Unique != remoteUnique {
+				t.Errorf("button %q routed to %q", b.Text, b.Unique)
+			}
+			data = append(data, b.Data)
+		}
+	}
+	wantData := []string{
+		"key|Office|PLAY_PAUSE", "key|Office|NEXT_TRACK", "vol|Office|-5", "vol|Office|+5",
+		"preset|Office|1", "preset|Office|2", "preset|Office|3", "preset|Office|4", "preset|Office|5", "preset|Office|6",
+		"power|Office", "zone|Office", "list", "card|Office",
+	}
+	if !reflect.DeepEqual(data, wantData) {
+		t.Errorf("card() data = %q, want %q", data, wantData)
+	}
+
+	sb := standby().Value.(soundtouch.NowPlaying)
+	text, kb = card(&office, cardState{nowPlaying: &sb}, true)
+	if text != "🔊 Office\nStandby\n" {
+		t.Errorf("card() in standby = %q", text)
+	}
+	if got := keyboardText(kb); !strings.Contains(got, "⏻ On ⛓ Leave zone") {
+		t.Errorf("card() buttons in standby = %q", got)
+	}
+}
+
+func TestRemoteCards(t *testing.T) {
+	n := simulatortest.Simulate(t, "Kitchen", "Office")
+	kitchen := n.Device("Kitchen").Speaker()
+	var edits []string
+	r := newRemoteCards(func(msg tb.Editable, text string, kb *tb.ReplyMarkup) error {
+		id, _ := msg.MessageSig()
+		edits = append(edits, id+": "+strings.SplitN(text, "\n", 2)[1])
+		return nil
+	})
+	msg := tb.StoredMessage{MessageID: "7", ChatID: 1}
+
+	if r.observe(playing("TUNEIN", "SWR3", "", ""), *kitchen) {
+		t.Errorf("observe() without a card = true")
+	}
+	r.observe(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 20}}, *kitchen)
+	if err := r.show(msg, kitchen); err != nil {
+		t.Fatalf("show() error = %v", err)
+	}
+	r.show(msg, kitchen) // unchanged, not edited
+	if !r.observe(playing("TUNEIN", "Radio Bob", "", ""), *kitchen) {
+		t.Errorf("observe() of the speaker shown = false")
+	}
+	r.refresh(kitchen)
+	if r.observe(standby(), *n.ByName("Office")) {
+		t.Errorf("observe() of another speaker = true")
+	}
+	r.close(msg.ChatID)
+	r.observe(standby(), *kitchen)
+	r.refresh(kitchen)
+
+	want := []string{"7: ▶ SWR3\nSource TUNEIN\nVolume 20\n", "7: ▶ Radio Bob\nSource TUNEIN\nVolume 20\n"}
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("edits %q, want %q", edits, want)
+	}
+}
+
+func TestRemoteCards_run(t *testing.T) {
+	n := simulatortest.Simulate(t, "Kitchen")
+	kitchen := n.Device("Kitchen").Speaker()
+	edited := make(chan string)
+	release := make(chan struct{}, 2)
+	r := newRemoteCards(func(msg tb.Editable, text string, kb *tb.ReplyMarkup) error {
+		edited <- strings.SplitN(text, "\n", 3)[1]
+		<-release
+		return nil
+	})
+	msg := tb.StoredMessage{MessageID: "7", ChatID: 1}
+	r.observe(playing("TUNEIN", "SWR3", "", ""), *kitchen)
+	release <- struct{}{}
+	go r.show(msg, kitchen)
+	if got := <-edited; got != "▶ SWR3" {
+		t.Errorf("shown %q, want SWR3", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(stopped)
+	}()
+	r.observe(playing("TUNEIN", "Radio Bob", "", ""), *kitchen)
+	r.schedule(kitchen)
+	if got := <-edited; got != "▶ Radio Bob" {
+		t.Errorf("refreshed %q, want Radio Bob", got)
+	}
+	// the edit is pending, observing and scheduling must not wait for it
+	for _, station := range []string{"SWR1", "SWR2", "SWR3"} {
+		r.observe(playing("TUNEIN", station, "", ""), *kitchen)
+		r.schedule(kitchen)
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	if got := <-edited; got != "▶ SWR3" {
+		t.Errorf("refreshed %q, want the latest station SWR3", got)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("run() did not stop")
+	}
+	select {
+	case got := <-edited:
+		t.Errorf("refreshed again %q", got)
+	default:
+	}
+}
+
+func TestJoinList(t *testing.T) {
+	known := simulatortest.Simulate(t, "Kitchen", "Office", "Bathroom").Known()
+	byName, _ := knownSpeakers(known)
+	kb := joinList(byName["Office"], known)
+	want := "Play with Bathroom\nPlay with Kitchen\n⬅ Back"
+	if got := keyboardText(kb); got != want {
+		t.Errorf("joinList() = %q, want %q", got, want)
+	}
+	if got := keyboardText(speakerList(known)); got != "Bathroom Kitchen\nOffice" {
+		t.Errorf("speakerList() = %q", got)
+	}
+}
+
+// telegramAPI records the answers to callbacks and the texts of the messages sent by a bot
+// talking to it
+type telegramAPI struct {
+	mu      sync.Mutex
+	answers []tb.CallbackResponse
+	sent    []string
+}
+
+func (a *telegramAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/answerCallbackQuery"):
+		var resp tb.CallbackResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		a.answers = append(a.answers, resp)
+	case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+		var msg struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&msg)
+		a.sent = append(a.sent, msg.Text)
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+		return
+	}
+	w.Write([]byte(`{"ok":true,"result":true}`))
+}
+
+// newTestBot returns a bot talking to a telegramAPI
+func newTestBot(t *testing.T) (*tb.Bot, *telegramAPI) {
+	api := &telegramAPI{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	bot, err := tb.NewBot(tb.Settings{URL: srv.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatalf("NewBot() error = %v", err)
+	}
+	return bot, api
+}
+
+func TestRemoteCallback_Restricted(t *testing.T) {
+	n := simulatortest.Simulate(t, "Kitchen")
+	kitchen := n.Device("Kitchen")
+	kitchen.Play(simulator.NowPlaying{Source: "TUNEIN"})
+	bot, api := newTestBot(t)
+	u, _ := loadUsers(filepath.Join(t.TempDir(), "users.json"), []int64{2}, nil)
+	u.restrict(2, nil, []string{"remote", "volume"})
+	d := &Bot{bot: bot, users: u, speakers: n, cards: newRemoteCards(func(tb.Editable, string, *tb.ReplyMarkup) error { return nil })}
+
+	id := kitchen.Speaker().DeviceID()
+	press := func(data string) tb.CallbackResponse {
+		t.Helper()
+		api.mu.Lock()
+		api.answers = nil
+		api.mu.Unlock()
+		d.remoteCallback(&tb.Callback{ID: "1", Sender: &tb.User{ID: 2}, Message: &tb.Message{ID: 7, Chat: &tb.Chat{ID: 2}}, Data: data})
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if len(api.answers) != 1 {
+			t.Fatalf("%s answered %d times, want once", data, len(api.answers))
+		}
+		return api.answers[0]
+	}
+
+	for _, data := range []string{"preset|" + id + "|3", "power|" + id, "key|" + id + "|PLAY_PAUSE", "leave|" + id} {
+		if got := press(data); !got.ShowAlert || !strings.Contains(got.Text, "not permitted") {
+			t.Errorf("%s answered %+v, want not permitted", data, got)
+		}
+	}
+	if keys := kitchen.Received("/key"); len(keys) > 0 {
+		t.Errorf("keys received by Kitchen %v, want none", keys)
+	}
+	if !kitchen.IsPoweredOn() {
+		t.Errorf("Kitchen switched off")
+	}
+
+	if got := press("vol|" + id + "|+5"); got.ShowAlert {
+		t.Errorf("volume answered %+v, want permitted", got)
+	}
+	if v := kitchen.Volume().TargetVolume; v == 0 {
+		t.Errorf("volume of Kitchen not changed")
+	}
+}
@@ -4,22 +4,70 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/theovassiliou/soundtouch-golang"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-automation/plugins/history"
+	"github.com/theovassiliou/soundtouch-automation/plugins/scenes"
+	"github.com/theovassiliou/soundtouch-automation/plugins/sleeptimer"
 	"golang.org/x/exp/slices"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
-// assertSender returns false in case user is not authorized
-func (d *Bot) assertSender(sender *tb.User) bool {
-	return slices.Contains(d.Config.AuthorizedSender, strconv.FormatInt(sender.ID, 10))
+// command returns the command of text without slash and bot name, e.g. volume
+func command(text string) string {
+	f := strings.Fields(text)
+	if len(f) == 0 {
+		return ""
+	}
+	c, _, _ := strings.Cut(strings.TrimPrefix(f[0], "/"), "@")
+	return c
+}
+
+// assertSender returns false, replying why, in case the sender of m is not authorized or not
+// permitted to use the command of m
+func (d *Bot) assertSender(m *tb.Message) bool {
+	u, ok := d.users.get(m.Sender.ID)
+	if !ok {
+		log.WithFields(log.Fields{
+			"Plugin": name,
+			"Sender": m.Sender.ID,
+		}).Infof("Refused /%s of unauthorized %s\n", command(m.Text), m.Sender.Username)
+		d.bot.Send(m.Sender, fmt.Sprintf("%s (%v) not authorized. Use /authorize (authKey)", m.Sender.Username, m.Sender.ID))
+		return false
+	}
+	if c := command(m.Text); !u.mayUse(c) {
+		d.bot.Send(m.Sender, fmt.Sprintf("You are not permitted to use /%s", c))
+		return false
+	}
+	return true
+}
+
+// sender returns the authorized sender of m
+func (d *Bot) sender(m *tb.Message) User {
+	u, _ := d.users.get(m.Sender.ID)
+	return u
+}
+
+// userName returns the name u is known by
+func userName(u *tb.User) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+// notifyAdmins sends msg to the admins
+func (d *Bot) notifyAdmins(msg string) {
+	for _, id := range d.users.admins() {
+		d.bot.Send(&tb.User{ID: id}, msg)
+	}
 }
 
 // /status [speakerName]
 func (d *Bot) status(m *tb.Message) {
-	if !d.assertSender(m.Sender) {
-		d.bot.Send(m.Sender, fmt.Sprintf("%s (%v) not authorized. Use /authorize (authKey)", m.Sender.Username, m.Sender.ID))
+	if !d.assertSender(m) {
 		return
 	}
 
@@ -27,18 +75,24 @@ func (d *Bot) status(m *tb.Message) {
 	speakers := strings.Split(text, " ")
 	speakers = speakers[1:]
 
-	gkd := soundtouch.GetKnownDevices()
+	u := d.sender(m)
 	var b strings.Builder
 	if len(speakers) == 0 {
 		b.WriteString("List of Soundtouch Devices\n")
-		for sName := range gkd {
-			speaker := soundtouch.GetSpeakerByDeviceId(sName)
+		for _, speaker := range d.speakers.Known() {
+			if !u.mayControl(speaker.Name()) {
+				continue
+			}
 			fmt.Fprintf(&b, "Device %s-%s with IP %s\n", speaker.Name(), speaker.DeviceID(), speaker.IP)
 
 		}
 	} else {
 		for _, sName := range speakers {
-			speaker := soundtouch.GetSpeakerByName(sName)
+			if !u.mayControl(sName) {
+				fmt.Fprintf(&b, "You are not permitted to control %v\n", sName)
+				continue
+			}
+			speaker := d.speakers.ByName(sName)
 			if speaker != nil {
 				fmt.Fprintf(&b, "Device %s-%s with IP %s\n", speaker.Name(), speaker.DeviceID(), speaker.IP)
 				fmt.Fprintf(&b, " isPoweredOn(): %v\n", speaker.IsPoweredOn())
@@ -70,27 +124,467 @@ func (d *Bot) authorize(m *tb.Message) {
 	mLogger := log.WithFields(log.Fields{
 		"Plugin": "TelegramBot",
 		"Handle": "authorize/",
+		"Sender": m.Sender.ID,
 	})
 
-	mLogger.Debugf("The bot: %v", d)
-	authKey := d.Config.AuthKey
+	if _, ok := d.users.get(m.Sender.ID); ok {
+		d.bot.Send(m.Sender, "Already authorized")
+		return
+	}
+	if d.users.blocked(m.Sender.ID) {
+		mLogger.Warnf("Refused authorization of %s after too many failed attempts\n", userName(m.Sender))
+		d.bot.Send(m.Sender, "Too many failed attempts. Try again later")
+		return
+	}
 
-	if authKey == "" {
+	user := User{ID: m.Sender.ID, Name: userName(m.Sender)}
+	authParam := strings.Fields(m.Text)
+	switch {
+	case len(authParam) >= 2 && d.AuthKey != "":
+		if authParam[1] != d.AuthKey {
+			d.users.fail(m.Sender.ID)
+			mLogger.Warnf("Failed authorization of %s with a wrong key\n", user.Name)
+			d.bot.Send(m.Sender, "Could not authorize with this key")
+			return
+		}
+		if err := d.users.add(user); err != nil {
+			mLogger.Errorf("Storing %s failed: %v\n", user.Name, err)
+		}
+		mLogger.Infof("Authorized %s with the key\n", user.Name)
+		d.bot.Send(m.Sender, "Authorization granted")
+		d.notifyAdmins(fmt.Sprintf("%s (%d) authorized with the key", user.Name, user.ID))
+	case len(d.users.admins()) > 0:
+		if !d.users.request(user) {
+			d.bot.Send(m.Sender, "Authorization already requested. Wait for an admin to approve it")
+			return
+		}
+		mLogger.Infof("%s requests authorization\n", user.Name)
+		d.notifyAdmins(fmt.Sprintf("%s (%d) asks for authorization. Use /approve %d or /deny %d", user.Name, user.ID, user.ID, user.ID))
+		d.bot.Send(m.Sender, "Authorization requested. Wait for an admin to approve it")
+	case d.AuthKey == "":
 		d.bot.Send(m.Sender, "Authorization temporary disabled")
+	default:
+		d.bot.Send(m.Sender, "authorization key mising or wrong")
+	}
+}
+
+// parseUserID returns the user id given as first word following the command of m
+func parseUserID(m *tb.Message) (int64, error) {
+	args := strings.Fields(m.Text)[1:]
+	if len(args) == 0 {
+		return 0, fmt.Errorf("no user id given")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is no user id", args[0])
+	}
+	return id, nil
+}
+
+// /users
+func (d *Bot) listUsers(m *tb.Message) {
+	if !d.assertSender(m) {
 		return
 	}
+	var b strings.Builder
+	b.WriteString("Authorized users\n")
+	for _, u := range d.users.list() {
+		b.WriteString(u.String() + "\n")
+	}
+	if requests := d.users.requests(); len(requests) > 0 {
+		b.WriteString("Waiting for approval\n")
+		for _, u := range requests {
+			fmt.Fprintf(&b, "%s (%d)\n", u.Name, u.ID)
+		}
+	}
+	d.bot.Send(m.Sender, b.String())
+}
 
-	text := m.Text
-	authParam := strings.Split(text, " ")
-	if len(authParam) >= 2 && authKey == authParam[1] {
-		d.Config.AuthorizedSender = append(d.Config.AuthorizedSender, strconv.FormatInt(m.Sender.ID, 10))
-		d.bot.Send(m.Sender, "Authorization granted")
+// /revoke userId
+func (d *Bot) revoke(m *tb.Message) {
+	if !d.assertSender(m) {
 		return
-	} else if len(authParam) < 2 {
-		d.bot.Send(m.Sender, "authorization key mising or wrong")
+	}
+	id, err := parseUserID(m)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Use /revoke userId", err))
 		return
 	}
+	u, err := d.users.revoke(id)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not revoke: %v", err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"Plugin": name,
+		"Sender": m.Sender.ID,
+	}).Infof("Revoked authorization of %s (%d)\n", u.Name, u.ID)
+	d.bot.Send(&tb.User{ID: id}, "Your authorization has been revoked")
+	d.bot.Send(m.Sender, fmt.Sprintf("Authorization of %s (%d) revoked", u.Name, u.ID))
+}
 
-	d.bot.Send(m.Sender, fmt.Sprintf("Could not authorize with key %v", authParam[1]))
+// /approve userId
+func (d *Bot) approve(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	id, err := parseUserID(m)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Use /approve userId", err))
+		return
+	}
+	u, err := d.users.approve(id)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not approve: %v", err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"Plugin": name,
+		"Sender": m.Sender.ID,
+	}).Infof("Approved authorization of %s (%d)\n", u.Name, u.ID)
+	d.bot.Send(&tb.User{ID: id}, "Authorization granted")
+	d.bot.Send(m.Sender, fmt.Sprintf("%s (%d) authorized", u.Name, u.ID))
+}
+
+// /deny userId
+func (d *Bot) deny(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	id, err := parseUserID(m)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Use /deny userId", err))
+		return
+	}
+	u, err := d.users.deny(id)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not deny: %v", err))
+		return
+	}
+	// a denied request counts as failed attempt, keeping users from flooding the admins
+	d.users.fail(id)
+	log.WithFields(log.Fields{
+		"Plugin": name,
+		"Sender": m.Sender.ID,
+	}).Warnf("Denied authorization of %s (%d)\n", u.Name, u.ID)
+	d.bot.Send(&tb.User{ID: id}, "Authorization denied")
+	d.bot.Send(m.Sender, fmt.Sprintf("Authorization of %s (%d) denied", u.Name, u.ID))
+}
 
+// parseRestrictions returns the speakers and commands of words like "speakers Living Room,
+// Kitchen commands volume, on". "none" lifts all restrictions.
+func parseRestrictions(words []string) (speakers, commands []string, err error) {
+	if len(words) == 1 && words[0] == "none" {
+		return nil, nil, nil
+	}
+	lists := map[string][]string{}
+	key := ""
+	for _, w := range words {
+		if w == "speakers" || w == "commands" {
+			key = w
+			lists[key] = append(lists[key], "")
+			continue
+		}
+		if key == "" {
+			return nil, nil, fmt.Errorf("%q is neither speakers nor commands", w)
+		}
+		l := lists[key]
+		l[len(l)-1] = strings.TrimSpace(l[len(l)-1] + " " + w)
+	}
+	split := func(parts []string) []string {
+		var items []string
+		for _, p := range parts {
+			for _, i := range strings.Split(p, ",") {
+				if i = strings.TrimPrefix(strings.TrimSpace(i), "/"); i != "" {
+					items = append(items, i)
+				}
+			}
+		}
+		return items
+	}
+	speakers, commands = split(lists["speakers"]), split(lists["commands"])
+	if len(speakers) == 0 && len(commands) == 0 {
+		return nil, nil, fmt.Errorf("no speakers or commands given")
+	}
+	return speakers, commands, nil
+}
+
+// /restrict userId [speakers name, ...] [commands name, ...] | none
+func (d *Bot) restrict(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	usage := "Use /restrict userId [speakers name, ...] [commands name, ...] | none"
+	id, err := parseUserID(m)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. %s", err, usage))
+		return
+	}
+	speakers, commands, err := parseRestrictions(strings.Fields(m.Text)[2:])
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. %s", err, usage))
+		return
+	}
+	for _, c := range commands {
+		if !isCommand(c) {
+			d.bot.Send(m.Sender, fmt.Sprintf("Unknown command /%s. %s", c, usage))
+			return
+		}
+	}
+	u, err := d.users.restrict(id, speakers, commands)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not restrict: %v", err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"Plugin": name,
+		"Sender": m.Sender.ID,
+	}).Infof("Restricted %s\n", u)
+	d.bot.Send(m.Sender, u.String())
+}
+
+// /subscribe [notificationName...|all] and /unsubscribe notificationName...|all
+func (d *Bot) subscribe(m *tb.Message, subscribe bool) {
+	if !d.assertSender(m) {
+		return
+	}
+	names := d.notifier.names()
+	if len(names) == 0 {
+		d.bot.Send(m.Sender, "No notifications configured. Add [[telegram.notification]] sections.")
+		return
+	}
+
+	args := strings.Fields(m.Text)[1:]
+	if len(args) == 0 {
+		if !subscribe {
+			d.bot.Send(m.Sender, "No notification given. Use /unsubscribe notificationName...|all")
+			return
+		}
+		u := d.sender(m)
+		var b strings.Builder
+		for _, n := range d.notifier.notifications {
+			mark := "  "
+			if slices.Contains(u.Subscriptions, n.Name) {
+				mark = "✓ "
+			}
+			b.WriteString(mark + n.String() + "\n")
+		}
+		b.WriteString("Use /subscribe notificationName...|all")
+		d.bot.Send(m.Sender, b.String())
+		return
+	}
+	if len(args) == 1 && args[0] == "all" {
+		args = names
+	}
+	for _, a := range args {
+		if !slices.Contains(names, a) {
+			d.bot.Send(m.Sender, fmt.Sprintf("Unknown notification %q. Notifications are %s", a, strings.Join(names, ", ")))
+			return
+		}
+	}
+	u, err := d.users.subscribe(m.Sender.ID, args, subscribe)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not change subscriptions: %v", err))
+		return
+	}
+	if len(u.Subscriptions) == 0 {
+		d.bot.Send(m.Sender, "Subscribed to no notifications")
+		return
+	}
+	d.bot.Send(m.Sender, fmt.Sprintf("Subscribed to %s", strings.Join(u.Subscriptions, ", ")))
+}
+
+// sleepTimer returns the hosted sleep timer, nil if none is configured
+func (d *Bot) sleepTimer() *sleeptimer.SleepTimer {
+	if d.host == nil {
+		return nil
+	}
+	for _, p := range d.host.Plugins() {
+		if st, ok := plugins.Unwrap(p).(*sleeptimer.SleepTimer); ok && p.IsEnabled() {
+			return st
+		}
+	}
+	return nil
+}
+
+// /sleep [speakerName [minutes|off]]
+func (d *Bot) sleep(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	st := d.sleepTimer()
+	if st == nil {
+		d.bot.Send(m.Sender, "No sleep timer configured. Add a [sleeptimer] section.")
+		return
+	}
+
+	args := strings.Fields(m.Text)[1:]
+	if len(args) == 0 {
+		timers := st.Timers()
+		if len(timers) == 0 {
+			d.bot.Send(m.Sender, "No sleep timer armed. Use /sleep speakerName [minutes]")
+			return
+		}
+		var b strings.Builder
+		for _, t := range timers {
+			fmt.Fprintf(&b, "%s switches off at %s\n", strings.Join(t.Speakers, ", "), t.Ends.Format("15:04"))
+		}
+		d.bot.Send(m.Sender, b.String())
+		return
+	}
+
+	speaker := args[0]
+	if !d.sender(m).mayControl(speaker) {
+		d.bot.Send(m.Sender, fmt.Sprintf("You are not permitted to control %s", speaker))
+		return
+	}
+	if len(args) > 1 && args[1] == "off" {
+		if st.Cancel(speaker) {
+			d.bot.Send(m.Sender, fmt.Sprintf("Sleep timer of %s cancelled", speaker))
+		} else {
+			d.bot.Send(m.Sender, fmt.Sprintf("No sleep timer armed for %s", speaker))
+		}
+		return
+	}
+
+	var duration time.Duration
+	if len(args) > 1 {
+		minutes, err := strconv.Atoi(args[1])
+		if err != nil || minutes <= 0 {
+			d.bot.Send(m.Sender, fmt.Sprintf("%q are no minutes. Use /sleep speakerName [minutes|off]", args[1]))
+			return
+		}
+		duration = time.Duration(minutes) * time.Minute
+	}
+	t, err := st.Arm(speaker, duration)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not arm sleep timer: %v", err))
+		return
+	}
+	d.bot.Send(m.Sender, fmt.Sprintf("%s switches off at %s", strings.Join(t.Speakers, ", "), t.Ends.Format("15:04")))
+}
+
+// scenes returns the hosted scenes plugin, nil if none is configured
+func (d *Bot) scenes() *scenes.Scenes {
+	if d.host == nil {
+		return nil
+	}
+	for _, p := range d.host.Plugins() {
+		if sc, ok := plugins.Unwrap(p).(*scenes.Scenes); ok && p.IsEnabled() {
+			return sc
+		}
+	}
+	return nil
+}
+
+// /scene [sceneName | save sceneName | delete sceneName]
+func (d *Bot) scene(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	sc := d.scenes()
+	if sc == nil {
+		d.bot.Send(m.Sender, "No scenes configured. Add a [scenes] section.")
+		return
+	}
+
+	args := strings.Fields(m.Text)[1:]
+	switch {
+	case len(args) == 0:
+		list, err := sc.Scenes()
+		if err != nil {
+			d.bot.Send(m.Sender, fmt.Sprintf("Could not read scenes: %v", err))
+			return
+		}
+		if len(list) == 0 {
+			d.bot.Send(m.Sender, "No scenes captured. Use /scene save sceneName")
+			return
+		}
+		var b strings.Builder
+		for _, s := range list {
+			b.WriteString(s.String())
+		}
+		d.bot.Send(m.Sender, b.String())
+	case len(args) == 2 && args[0] == "save":
+		s, err := sc.Capture(args[1])
+		if err != nil {
+			d.bot.Send(m.Sender, fmt.Sprintf("Could not capture scene: %v", err))
+			return
+		}
+		d.bot.Send(m.Sender, s.String())
+	case len(args) == 2 && args[0] == "delete":
+		if err := sc.Delete(args[1]); err != nil {
+			d.bot.Send(m.Sender, fmt.Sprintf("Could not delete scene: %v", err))
+			return
+		}
+		d.bot.Send(m.Sender, fmt.Sprintf("Scene %s deleted", args[1]))
+	default:
+		name := strings.Join(args, " ")
+		if err := sc.Restore(name); err != nil {
+			d.bot.Send(m.Sender, fmt.Sprintf("Could not restore scene %s: %v", name, err))
+			return
+		}
+		d.bot.Send(m.Sender, fmt.Sprintf("Scene %s restored", name))
+	}
+}
+
+// history returns the hosted history plugin, nil if none is configured
+func (d *Bot) history() *history.History {
+	if d.host == nil {
+		return nil
+	}
+	for _, p := range d.host.Plugins() {
+		if h, ok := plugins.Unwrap(p).(*history.History); ok && p.IsEnabled() {
+			return h
+		}
+	}
+	return nil
+}
+
+// maxSessions is the number of sessions /history replies with
+const maxSessions = 20
+
+// /history [speakerName] [artist] [fromDate [toDate]]
+func (d *Bot) listeningHistory(m *tb.Message) {
+	if !d.assertSender(m) {
+		return
+	}
+	h := d.history()
+	if h == nil {
+		d.bot.Send(m.Sender, "No history configured. Add a [history] section.")
+		return
+	}
+
+	q, err := history.ParseQuery(strings.Fields(m.Text)[1:], h.Speakers())
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Use /history [speakerName] [artist] [fromDate [toDate]]", err))
+		return
+	}
+	if q.From.IsZero() && q.To.IsZero() {
+		// the last week unless dates are given
+		q.From = time.Now().AddDate(0, 0, -7)
+	}
+	sessions, err := h.Sessions(q)
+	if err != nil {
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not read history: %v", err))
+		return
+	}
+	if len(sessions) == 0 {
+		d.bot.Send(m.Sender, "No sessions found")
+		return
+	}
+
+	var total time.Duration
+	for _, s := range sessions {
+		total += s.Duration
+	}
+	var b strings.Builder
+	if len(sessions) > maxSessions {
+		fmt.Fprintf(&b, "Latest %d of %d sessions\n", maxSessions, len(sessions))
+	}
+	for _, s := range sessions[max(0, len(sessions)-maxSessions):] {
+		b.WriteString(s.String() + "\n")
+	}
+	fmt.Fprintf(&b, "%v in total", total.Round(time.Minute))
+	d.bot.Send(m.Sender, b.String())
 }
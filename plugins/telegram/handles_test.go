@@ -0,0 +1,51 @@
+package telegram
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestBot_status(t *testing.T) {
+	n := simulatortest.Simulate(t, "Kitchen", "Office")
+	bot, api := newTestBot(t)
+	u, _ := loadUsers(filepath.Join(t.TempDir(), "users.json"), []int64{1, 2}, nil)
+	u.restrict(2, []string{"Kitchen"}, nil)
+	d := &Bot{bot: bot, users: u, speakers: n}
+
+	tests := []struct {
+		sender  int64
+		text    string
+		want    []string
+		notWant []string
+	}{
+		{1, "/status", []string{"Device Kitchen-", "Device Office-"}, nil},
+		{2, "/status", []string{"Device Kitchen-"}, []string{"Office"}},
+		{1, "/status Office", []string{"Device Office-", "isPoweredOn()"}, []string{"Kitchen"}},
+		{2, "/status Office", []string{"You are not permitted to control Office"}, nil},
+		{1, "/status Garage", []string{"Could not find speaker Garage"}, nil},
+	}
+	for _, tt := range tests {
+		api.mu.Lock()
+		api.sent = nil
+		api.mu.Unlock()
+		d.status(&tb.Message{Sender: &tb.User{ID: tt.sender}, Chat: &tb.Chat{ID: tt.sender}, Text: tt.text})
+
+		api.mu.Lock()
+		got := strings.Join(api.sent, "\n")
+		api.mu.Unlock()
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s of %d = %q, want %q", tt.text, tt.sender, got, w)
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(got, w) {
+				t.Errorf("%s of %d = %q, want no %q", tt.text, tt.sender, got, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// The events notifications are sent on
+const (
+	Playing  = "playing"
+	PowerOn  = "power_on"
+	PowerOff = "power_off"
+	Offline  = "offline"
+	Online   = "online"
+)
+
+// defaultMessages are the messages of notifications without message
+var defaultMessages = map[string]string{
+	Playing:  "{{.Speaker}} started playing {{or .Station .Album .Artist .Source}}",
+	PowerOn:  "{{.Speaker}} powered on",
+	PowerOff: "{{.Speaker}} powered off",
+	Offline:  "{{.Speaker}} went offline",
+	Online:   "{{.Speaker}} is back online",
+}
+
+var events = []string{Playing, PowerOn, PowerOff, Offline, Online}
+
+// Defaults of the notification settings
+const (
+	defaultDedup = 10 * time.Minute
+	defaultCheck = time.Minute
+)
+
+// Notification is a message sent to the users subscribed to it when a speaker raises the event.
+// Name the name users subscribe with
+// Event one of playing, power_on, power_off, offline, online. playing is raised when a speaker
+// starts playing another source, station or album, not on every track.
+// Speakers the speakers notified about, all if empty
+// Time local times of the day in the form "23:00-06:00" the notification is sent in, always if empty
+// Message a text/template on plugins.Values, e.g. "{{.Speaker}} plays {{.Station}}"
+type Notification struct {
+	Name     string   `toml:"name"`
+	Event    string   `toml:"event"`
+	Speakers []string `toml:"speakers"`
+	Time     []string `toml:"time"`
+	Message  string   `toml:"message"`
+}
+
+func (n Notification) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s on %s", n.Name, n.Event)
+	if len(n.Speakers) > 0 {
+		fmt.Fprintf(&b, " of %s", strings.Join(n.Speakers, ", "))
+	}
+	if len(n.Time) > 0 {
+		fmt.Fprintf(&b, " at %s", strings.Join(n.Time, ", "))
+	}
+	return b.String()
+}
+
+// notification is a compiled Notification
+type notification struct {
+	Notification
+	matcher *plugins.Matcher
+	message *template.Template
+}
+
+// compileNotifications checks the notifications, the quiet hours and the durations of c
+func (c Config) compileNotifications() ([]notification, *plugins.Matcher, error) {
+	var compiled []notification
+	for i, n := range c.Notifications {
+		if n.Name == "" {
+			return nil, nil, fmt.Errorf("notification %d: no name given", i+1)
+		}
+		if slices.ContainsFunc(compiled, func(o notification) bool { return o.Name == n.Name }) {
+			return nil, nil, fmt.Errorf("notification %s: name given twice", n.Name)
+		}
+		if !slices.Contains(events, n.Event) {
+			return nil, nil, fmt.Errorf("notification %s: event %q is not one of %s", n.Name, n.Event, strings.Join(events, ", "))
+		}
+		m, err := plugins.Filter{Speakers: n.Speakers, Time: n.Time}.Compile()
+		if err != nil {
+			return nil, nil, fmt.Errorf("notification %s: %v", n.Name, err)
+		}
+		msg := n.Message
+		if msg == "" {
+			msg = defaultMessages[n.Event]
+		}
+		t, err := template.New(n.Name).Parse(msg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("notification %s: message: %v", n.Name, err)
+		}
+		compiled = append(compiled, notification{Notification: n, matcher: m, message: t})
+	}
+
+	var quiet *plugins.Matcher
+	if len(c.QuietHours) > 0 {
+		m, err := plugins.Filter{Time: c.QuietHours}.Compile()
+		if err != nil {
+			return nil, nil, fmt.Errorf("quiet_hours: %v", err)
+		}
+		quiet = m
+	}
+	if _, _, _, err := c.notificationDurations(); err != nil {
+		return nil, nil, err
+	}
+	return compiled, quiet, nil
+}
+
+// notificationDurations returns digest, dedup and check of c or their defaults
+func (c Config) notificationDurations() (digest, dedup, check time.Duration, err error) {
+	parse := func(key, s string, def time.Duration) (time.Duration, error) {
+		if s == "" {
+			return def, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%s %q is no positive duration", key, s)
+		}
+		return d, nil
+	}
+	if digest, err = parse("digest", c.Digest, 0); err != nil {
+		return
+	}
+	if dedup, err = parse("dedup", c.Dedup, defaultDedup); err != nil {
+		return
+	}
+	check, err = parse("check", c.Check, defaultCheck)
+	return
+}
+
+// event is a notification raised
+type event struct {
+	notification string
+	speaker      string
+	text         string
+	time         time.Time
+}
+
+// speakerState is what the notifier knows about a speaker
+type speakerState struct {
+	speaker    soundtouch.Speaker
+	known      bool
+	on         bool
+	playing    string
+	offline    bool
+	lastSeen   time.Time
+	nowPlaying *soundtouch.NowPlaying
+	volume     *soundtouch.Volume
+}
+
+// notifier raises the notifications on the updates of the speakers and sends them to the
+// subscribed users. Notifications are held back during quiet hours and in digest mode. The
+// notifications raised are queued and sent by run, so that observing never waits for telegram.
+type notifier struct {
+	notifications []notification
+	quiet         *plugins.Matcher
+	digest        time.Duration
+	dedup         time.Duration
+	check         time.Duration
+	users         *users
+	send          func(id int64, msg string) error
+	clock         func() time.Time
+	queue         chan []event
+
+	mu     sync.Mutex
+	states map[string]*speakerState
+	sent   map[string]time.Time
+	held   []event
+}
+
+// queueSize is the number of notifications waiting to be sent. More are dropped.
+const queueSize = 64
+
+func newNotifier(c Config, u *users, send func(id int64, msg string) error) (*notifier, error) {
+	notifications, quiet, err := c.compileNotifications()
+	if err != nil {
+		return nil, err
+	}
+	digest, dedup, check, _ := c.notificationDurations()
+	return &notifier{
+		notifications: notifications,
+		quiet:         quiet,
+		digest:        digest,
+		dedup:         dedup,
+		check:         check,
+		users:         u,
+		send:          send,
+		clock:         time.Now,
+		queue:         make(chan []event, queueSize),
+		states:        map[string]*speakerState{},
+		sent:          map[string]time.Time{},
+	}, nil
+}
+
+// names returns the names of the notifications
+func (n *notifier) names() []string {
+	var names []string
+	for _, nf := range n.notifications {
+		names = append(names, nf.Name)
+	}
+	return names
+}
+
+// observe raises the notifications on update of speaker
+func (n *notifier) observe(update soundtouch.Update, speaker soundtouch.Speaker) {
+	if len(n.notifications) == 0 {
+		return
+	}
+	now := n.clock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st := n.states[speaker.DeviceID()]
+	if st == nil {
+		st = &speakerState{}
+		n.states[speaker.DeviceID()] = st
+	}
+	st.speaker, st.lastSeen = speaker, now
+	values := func() plugins.Values {
+		return plugins.NewValues(update, speaker, st.nowPlaying, st.volume, now)
+	}
+	if st.offline {
+		st.offline = false
+		n.raise(Online, values(), now)
+	}
+
+	switch v := update.Value.(type) {
+	case soundtouch.NowPlaying:
+		first := !st.known
+		st.nowPlaying = &v
+		on := v.Source != soundtouch.Standby
+		if !first && on != st.on {
+			if on {
+				n.raise(PowerOn, values(), now)
+			} else {
+				n.raise(PowerOff, values(), now)
+			}
+		}
+		st.known, st.on = true, on
+		if !on {
+			st.playing = ""
+			return
+		}
+		if playing := playingOf(v); playing != "" && playing != st.playing {
+			if !first {
+				n.raise(Playing, values(), now)
+			}
+			st.playing = playing
+		}
+	case soundtouch.Volume:
+		st.volume = &v
+	}
+}
+
+// playingOf returns what np plays, empty if it does not play. Tracks are left out, so that
+// playing changes with the source, station or album only.
+func playingOf(np soundtouch.NowPlaying) string {
+	if np.PlayStatus != soundtouch.PlayState && np.PlayStatus != soundtouch.BufferingState {
+		return ""
+	}
+	if np.StationName == "" && np.Album == "" {
+		return string(np.Source) + "|" + np.Artist
+	}
+	return string(np.Source) + "|" + np.StationName + "|" + np.Album
+}
+
+// raise renders the notifications of ev matching values and queues them, unless they were sent
+// within the dedup interval. They are held back in digest mode and during quiet hours. The caller
+// holds mu.
+func (n *notifier) raise(ev string, values plugins.Values, now time.Time) {
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": values.Speaker,
+		"Event":   ev,
+	})
+	for _, nf := range n.notifications {
+		if nf.Event != ev || !nf.matcher.Match(values) {
+			continue
+		}
+		var b strings.Builder
+		if err := nf.message.Execute(&b, values); err != nil {
+			mLogger.Errorf("Rendering notification %s failed: %v\n", nf.Name, err)
+			continue
+		}
+		key := nf.Name + "|" + values.Speaker + "|" + b.String()
+		if last, ok := n.sent[key]; ok && now.Sub(last) < n.dedup {
+			mLogger.Debugf("Dropping repeated notification %q\n", b.String())
+			continue
+		}
+		n.sent[key] = now
+		e := event{notification: nf.Name, speaker: values.Speaker, text: b.String(), time: now}
+		if n.digest > 0 || n.isQuiet(now) {
+			n.held = append(n.held, e)
+			continue
+		}
+		select {
+		case n.queue <- []event{e}:
+		default:
+			mLogger.Errorf("Queue of %d notifications full. Dropping %q\n", queueSize, e.text)
+		}
+	}
+}
+
+// isQuiet returns true if now is within the quiet hours
+func (n *notifier) isQuiet(now time.Time) bool {
+	return n.quiet != nil && n.quiet.Match(plugins.Values{Time: now})
+}
+
+// deliver sends the events to the users subscribed to them and permitted to control the speaker,
+// several events in one message
+func (n *notifier) deliver(events []event) {
+	for _, u := range n.users.list() {
+		var subscribed []event
+		for _, e := range events {
+			if slices.Contains(u.Subscriptions, e.notification) && u.mayControl(e.speaker) {
+				subscribed = append(subscribed, e)
+			}
+		}
+		if len(subscribed) == 0 {
+			continue
+		}
+		msg := subscribed[0].text
+		if len(subscribed) > 1 {
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d notifications", len(subscribed))
+			for _, e := range subscribed {
+				fmt.Fprintf(&b, "\n%s %s", e.time.Format("15:04"), e.text)
+			}
+			msg = b.String()
+		}
+		if err := n.send(u.ID, msg); err != nil {
+			log.WithFields(log.Fields{
+				"Plugin": name,
+			}).Errorf("Sending notification to %d failed: %v\n", u.ID, err)
+			continue
+		}
+		metrics.Actions.Inc(name, "Notify")
+	}
+}
+
+// flush sends the events held back, unless it is quiet hours, and forgets the notifications
+// sent before the dedup interval
+func (n *notifier) flush(now time.Time) {
+	n.mu.Lock()
+	for key, last := range n.sent {
+		if now.Sub(last) >= n.dedup {
+			delete(n.sent, key)
+		}
+	}
+	var held []event
+	if !n.isQuiet(now) {
+		held, n.held = n.held, nil
+	}
+	n.mu.Unlock()
+
+	if len(held) > 0 {
+		n.deliver(held)
+	}
+}
+
+// answers returns true if the speaker answers requests. Unlike IsAlive it is true for speakers in
+// standby.
+func answers(s soundtouch.Speaker) bool {
+	_, err := s.GetData("info")
+	return err == nil
+}
+
+// checkOffline raises offline for the speakers not seen for the check interval and no longer
+// answering
+func (n *notifier) checkOffline(now time.Time) {
+	n.mu.Lock()
+	var quiet []*speakerState
+	for _, st := range n.states {
+		if !st.offline && now.Sub(st.lastSeen) >= n.check {
+			quiet = append(quiet, st)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, st := range quiet {
+		if answers(st.speaker) {
+			continue
+		}
+		n.mu.Lock()
+		// the speaker may have come back meanwhile
+		if !st.offline && now.Sub(st.lastSeen) >= n.check {
+			st.offline = true
+			n.raise(Offline, plugins.NewValues(soundtouch.Update{}, st.speaker, st.nowPlaying, st.volume, now), now)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// run sends the events queued, checks for speakers going offline and sends the events held back
+// until ctx is done. In digest mode they are sent every digest interval, otherwise when quiet
+// hours end.
+func (n *notifier) run(ctx context.Context) {
+	interval := n.digest
+	if interval == 0 {
+		interval = time.Minute
+	}
+	flush := time.NewTicker(interval)
+	defer flush.Stop()
+	check := time.NewTicker(n.check)
+	defer check.Stop()
+	for {
+		select {
+		case events := <-n.queue:
+			n.deliver(events)
+		case <-flush.C:
+			n.flush(n.clock())
+		case <-check.C:
+			n.checkOffline(n.clock())
+		case <-ctx.Done():
+			n.deliverQueued()
+			n.flush(n.clock())
+			return
+		}
+	}
+}
+
+// deliverQueued sends the events queued without waiting for more
+func (n *notifier) deliverQueued() {
+	for {
+		select {
+		case events := <-n.queue:
+			n.deliver(events)
+		default:
+			return
+		}
+	}
+}
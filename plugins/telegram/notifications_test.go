@@ -0,0 +1,230 @@
+package telegram
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// outbox records the messages sent as "id: message"
+type outbox struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (o *outbox) send(id int64, msg string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, fmt.Sprintf("%d: %s", id, msg))
+	return nil
+}
+
+// sent sends the notifications queued by n and returns the messages sent since the last call
+func sent(n *notifier, o *outbox) []string {
+	n.deliverQueued()
+	return o.take()
+}
+
+func (o *outbox) take() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sent := o.sent
+	o.sent = nil
+	return sent
+}
+
+// newTestNotifier returns a notifier of config sending to alice (1), subscribed to all
+// notifications, and bob (2), subscribed to radio and restricted to the Kitchen. Its clock starts
+// at 20:00.
+func newTestNotifier(t *testing.T, config Config) (*notifier, *outbox, *simulatortest.Clock) {
+	u, err := loadUsers(filepath.Join(t.TempDir(), "users.json"), []int64{1, 2}, nil)
+	if err != nil {
+		t.Fatalf("loadUsers() error = %v", err)
+	}
+	o := &outbox{}
+	n, err := newNotifier(config, u, o.send)
+	if err != nil {
+		t.Fatalf("newNotifier() error = %v", err)
+	}
+	clock := simulatortest.NewClock(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC))
+	u.clock, n.clock = clock.Now, clock.Now
+	u.subscribe(1, n.names(), true)
+	u.subscribe(2, []string{"radio"}, true)
+	u.restrict(2, []string{"Kitchen"}, nil)
+	return n, o, clock
+}
+
+func speaker(name string) soundtouch.Speaker {
+	return soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: name, DeviceID: name}}
+}
+
+func playing(source, station, artist, track string) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{
+		Source: soundtouch.Source(source), StationName: station, Artist: artist, Track: track, PlayStatus: soundtouch.PlayState,
+	}}
+}
+
+func standby() soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{Source: soundtouch.Standby}}
+}
+
+var notifications = []Notification{
+	{Name: "radio", Event: Playing, Message: "{{.Speaker}} started playing {{.Station}}"},
+	{Name: "on", Event: PowerOn, Speakers: []string{"Office"}},
+	{Name: "late", Event: PowerOn, Time: []string{"23:00-06:00"}, Message: "{{.Speaker}} powered on after 23:00"},
+}
+
+func TestNotifier(t *testing.T) {
+	n, o, clock := newTestNotifier(t, Config{Notifications: notifications})
+	office, kitchen := speaker("Office"), speaker("Kitchen")
+
+	n.observe(standby(), office)
+	n.observe(playing("TUNEIN", "Radio Bob", "Queen", "Radio Ga Ga"), kitchen) // first update, no news
+	n.observe(playing("TUNEIN", "SWR3", "", ""), office)
+	n.observe(playing("TUNEIN", "SWR3", "Queen", "Jealousy"), office)
+	n.observe(soundtouch.Update{Value: soundtouch.Volume{TargetVolume: 30}}, office)
+	got := sent(n, o)
+	want := []string{"1: Office powered on", "1: Office started playing SWR3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	n.observe(playing("TUNEIN", "Radio Bob", "", ""), kitchen)
+	n.observe(standby(), office)
+	clock.Advance(time.Minute)
+	n.observe(playing("TUNEIN", "SWR3", "", ""), office) // repeated within dedup
+	n.observe(playing("TUNEIN", "SWR1", "", ""), kitchen)
+	got = sent(n, o)
+	want = []string{"1: Kitchen started playing SWR1", "2: Kitchen started playing SWR1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	clock.Advance(3*time.Hour + 10*time.Minute) // 23:11
+	n.observe(standby(), office)
+	n.observe(playing("TUNEIN", "SWR3", "", ""), office)
+	got = sent(n, o)
+	want = []string{"1: Office powered on", "1: Office powered on after 23:00", "1: Office started playing SWR3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestNotifier_flush(t *testing.T) {
+	n, o, clock := newTestNotifier(t, Config{Notifications: notifications})
+	kitchen := speaker("Kitchen")
+	n.observe(standby(), kitchen)
+	n.observe(playing("TUNEIN", "SWR3", "", ""), kitchen)
+	if got := len(sent(n, o)); got != 2 {
+		t.Fatalf("sent %d notifications, want 2", got)
+	}
+	if len(n.sent) == 0 {
+		t.Fatalf("notifications sent not remembered for dedup")
+	}
+	clock.Advance(time.Hour)
+	n.flush(clock.Now())
+	if len(n.sent) != 0 {
+		t.Errorf("remembering %d notifications after the dedup interval, want none", len(n.sent))
+	}
+}
+
+func TestBot_ExecuteNotifies(t *testing.T) {
+	n, o, _ := newTestNotifier(t, Config{Notifications: notifications})
+	d := &Bot{
+		Config:   Config{Speakers: []string{"Office"}, IgnoreMessages: []string{"NowPlaying"}},
+		notifier: n,
+		cards:    newRemoteCards(nil),
+	}
+	kitchen := speaker("Kitchen")
+	d.Execute("", standby(), kitchen)
+	d.Execute("", playing("TUNEIN", "SWR3", "", ""), kitchen)
+	if got := len(sent(n, o)); got != 2 {
+		t.Errorf("sent %d notifications on updates filtered by speakers and ignore_messages, want 2", got)
+	}
+}
+
+func TestNotifier_QuietHours(t *testing.T) {
+	n, o, clock := newTestNotifier(t, Config{Notifications: notifications, QuietHours: []string{"22:00-07:00"}})
+	kitchen := speaker("Kitchen")
+
+	n.observe(standby(), kitchen)
+	n.observe(playing("TUNEIN", "SWR3", "", ""), kitchen)
+	if got := len(sent(n, o)); got != 2 {
+		t.Errorf("sent %d notifications before quiet hours, want 2", got)
+	}
+	clock.Advance(3 * time.Hour) // 23:00
+	n.observe(standby(), kitchen)
+	n.observe(playing("TUNEIN", "Radio Bob", "", ""), kitchen)
+	n.flush(clock.Now())
+	if got := sent(n, o); len(got) != 0 {
+		t.Errorf("sent %q during quiet hours", got)
+	}
+	clock.Advance(8 * time.Hour) // 07:00
+	n.flush(clock.Now())
+	got := sent(n, o)
+	want := []string{
+		"1: 2 notifications\n23:00 Kitchen powered on after 23:00\n23:00 Kitchen started playing Radio Bob",
+		"2: Kitchen started playing Radio Bob",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q after quiet hours, want %q", got, want)
+	}
+}
+
+func TestNotifier_Digest(t *testing.T) {
+	n, o, clock := newTestNotifier(t, Config{Notifications: notifications, Digest: "1h"})
+	office := speaker("Office")
+
+	n.observe(standby(), office)
+	n.observe(playing("TUNEIN", "SWR3", "", ""), office)
+	clock.Advance(10 * time.Minute)
+	n.observe(playing("SPOTIFY", "", "Queen", "Innuendo"), office)
+	if got := sent(n, o); len(got) != 0 {
+		t.Errorf("sent %q before the digest", got)
+	}
+	n.flush(clock.Now())
+	want := []string{"1: 3 notifications\n20:00 Office powered on\n20:00 Office started playing SWR3\n20:10 Office started playing "}
+	if got := sent(n, o); !reflect.DeepEqual(got, want) {
+		t.Errorf("digest %q, want %q", got, want)
+	}
+}
+
+func TestNotifier_Offline(t *testing.T) {
+	n, o, clock := newTestNotifier(t, Config{Notifications: []Notification{{Name: "offline", Event: Offline}, {Name: "online", Event: Online}}})
+	net := simulatortest.Simulate(t, "Kitchen")
+	kitchen := *net.ByName("Kitchen")
+
+	n.observe(standby(), kitchen)
+	clock.Advance(2 * time.Minute)
+	n.checkOffline(clock.Now())
+	if got := sent(n, o); len(got) != 0 {
+		t.Errorf("sent %q while the speaker answers", got)
+	}
+	net.Close()
+	n.checkOffline(clock.Now())
+	n.checkOffline(clock.Now())
+	n.observe(standby(), kitchen)
+	want := []string{"1: Kitchen went offline", "1: Kitchen is back online"}
+	if got := sent(n, o); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	simulatortest.CheckValidate(t, []simulatortest.ConfigTest{
+		{Name: "valid", Config: &Config{AuthorizedSender: []string{"1"}, Notifications: notifications, QuietHours: []string{"22:00-07:00"}}, Want: ""},
+		{Name: "sender", Config: &Config{AuthorizedSender: []string{"alice"}}, Want: `authorizedSenders: "alice" is no user id`},
+		{Name: "no name", Config: &Config{Notifications: []Notification{{Event: Playing}}}, Want: "notification 1: no name given"},
+		{Name: "twice", Config: &Config{Notifications: []Notification{{Name: "a", Event: Playing}, {Name: "a", Event: Online}}}, Want: "notification a: name given twice"},
+		{Name: "event", Config: &Config{Notifications: []Notification{{Name: "a", Event: "volume"}}}, Want: `notification a: event "volume" is not one of playing, power_on, power_off, offline, online`},
+		{Name: "message", Config: &Config{Notifications: []Notification{{Name: "a", Event: Playing, Message: "{{.Speaker"}}}, Want: "notification a: message: template: a:1: unclosed action"},
+		{Name: "quiet", Config: &Config{QuietHours: []string{"late"}}, Want: `quiet_hours: time "late" is not of the form 07:00-09:30`},
+		{Name: "digest", Config: &Config{Digest: "hourly"}, Want: `digest "hourly" is no positive duration`},
+	})
+}
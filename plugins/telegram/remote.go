@@ -0,0 +1,460 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// remoteCommand is a command controlling the speakers. Run receives all speakers, those the sender
+// may control and the words following the command and returns the reply to the sender.
+type remoteCommand struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error)
+}
+
+// remoteCommands are the commands controlling playback, volume, power and zones
+var remoteCommands = []remoteCommand{
+	{"volume", "speakerName [0-100|+5|-5]", "Show, set or change the volume", setVolume},
+	{"on", "speakerName", "Switch a speaker on", powerOn},
+	{"off", "speakerName|all", "Switch a speaker or all speakers off", powerOff},
+	{"pause", "speakerName|all", "Pause a speaker or all speakers", pause},
+	{"preset", "speakerName 1-6", "Play a preset", playPreset},
+	{"zone", "masterName slaveName...", "Let the slaves play with the master", createZone},
+	{"unzone", "speakerName", "Take a speaker out of its zone, dissolving it if it is the master", dissolveZone},
+}
+
+// commands returns the commands offered to the senders while typing
+func commands() []tb.Command {
+	cmds := []tb.Command{
+		{Text: "status", Description: "Status of the speakers"},
+		{Text: "sleep", Description: "List, arm or cancel sleep timers"},
+		{Text: "scene", Description: "List, restore, capture or delete scenes"},
+		{Text: "history", Description: "List the listening sessions"},
+		{Text: "subscribe", Description: "List or subscribe to notifications"},
+		{Text: "unsubscribe", Description: "Unsubscribe from notifications"},
+		{Text: "remote", Description: "Remote control for a speaker"},
+	}
+	for _, c := range remoteCommands {
+		cmds = append(cmds, tb.Command{Text: c.Name, Description: c.Description})
+	}
+	return cmds
+}
+
+// isCommand returns true if c is one of the commands()
+func isCommand(c string) bool {
+	return slices.ContainsFunc(commands(), func(cmd tb.Command) bool { return cmd.Text == c })
+}
+
+// speakerError is a speaker that could not be resolved. Candidates are the names the sender might
+// have meant.
+type speakerError struct {
+	query      string
+	msg        string
+	candidates []string
+}
+
+func (e *speakerError) Error() string { return e.msg }
+
+// usageError is a command given with wrong arguments
+type usageError struct{ msg string }
+
+func (e *usageError) Error() string { return e.msg }
+
+// remote runs the remote command c for the sender of m. A speaker that could not be resolved is
+// answered with a keyboard offering the command for the candidates.
+func (d *Bot) remote(m *tb.Message, c remoteCommand) {
+	if !d.assertSender(m) {
+		return
+	}
+	known := d.permitted(d.sender(m))
+
+	args := strings.Fields(m.Text)[1:]
+	reply, err := c.Run(d.speakers, known, args)
+	var se *speakerError
+	var ue *usageError
+	switch {
+	case errors.As(err, &se):
+		msg := fmt.Sprintf("%v. Use /%s %s", err, c.Name, c.Usage)
+		if len(se.candidates) == 0 {
+			d.bot.Send(m.Sender, msg)
+			return
+		}
+		d.bot.Send(m.Sender, msg, suggestionKeyboard(suggestions(c.Name, args, se.query, se.candidates)))
+	case errors.As(err, &ue):
+		d.bot.Send(m.Sender, fmt.Sprintf("%v. Use /%s %s", err, c.Name, c.Usage))
+	case err != nil:
+		d.bot.Send(m.Sender, fmt.Sprintf("Could not %s: %v", c.Name, err))
+	default:
+		d.bot.Send(m.Sender, reply, &tb.ReplyMarkup{ReplyKeyboardRemove: true})
+	}
+}
+
+// suggestions returns the command lines of cmd with query replaced by each of the candidates. An
+// empty query is a missing speaker, the candidate is put in front of args.
+func suggestions(cmd string, args []string, query string, candidates []string) []string {
+	line := strings.Join(args, " ")
+	var lines []string
+	for _, c := range candidates {
+		var l string
+		if query == "" {
+			l = strings.TrimSpace(c + " " + line)
+		} else {
+			l = strings.Replace(line, query, c, 1)
+		}
+		lines = append(lines, "/"+cmd+" "+l)
+	}
+	return lines
+}
+
+// suggestionKeyboard returns a one time keyboard with a button per line
+func suggestionKeyboard(lines []string) *tb.ReplyMarkup {
+	kb := &tb.ReplyMarkup{ResizeReplyKeyboard: true, OneTimeKeyboard: true}
+	var rows []tb.Row
+	for _, l := range lines {
+		rows = append(rows, kb.Row(kb.Text(l)))
+	}
+	kb.Reply(rows...)
+	return kb
+}
+
+// knownSpeakers returns the known speakers by name and their sorted names
+func knownSpeakers(known map[string]*soundtouch.Speaker) (map[string]*soundtouch.Speaker, []string) {
+	byName := map[string]*soundtouch.Speaker{}
+	var names []string
+	for _, s := range known {
+		byName[s.Name()] = s
+		names = append(names, s.Name())
+	}
+	sort.Strings(names)
+	return byName, names
+}
+
+// lookupSpeaker returns the known speaker query names
+func lookupSpeaker(known map[string]*soundtouch.Speaker, query string) (*soundtouch.Speaker, error) {
+	byName, names := knownSpeakers(known)
+	n, err := matchSpeaker(query, names)
+	if err != nil {
+		return nil, err
+	}
+	return byName[n], nil
+}
+
+// matchSpeaker returns the name of names query refers to. Names match ignoring case, first
+// exactly, then by a unique prefix, then by a unique part and last by a unique name with at most
+// two typos.
+func matchSpeaker(query string, names []string) (string, error) {
+	if query == "" {
+		return "", &speakerError{msg: "No speaker given", candidates: names}
+	}
+	q := strings.ToLower(query)
+	for _, n := range names {
+		if strings.ToLower(n) == q {
+			return n, nil
+		}
+	}
+
+	matchers := []func(n string) bool{
+		func(n string) bool { return strings.HasPrefix(n, q) },
+		func(n string) bool { return strings.Contains(n, q) },
+	}
+	for _, match := range matchers {
+		var found []string
+		for _, n := range names {
+			if match(strings.ToLower(n)) {
+				found = append(found, n)
+			}
+		}
+		if len(found) == 1 {
+			return found[0], nil
+		}
+		if len(found) > 1 {
+			return "", &speakerError{query: query, msg: fmt.Sprintf("%q matches %s", query, strings.Join(found, ", ")), candidates: found}
+		}
+	}
+
+	best, found := 3, []string(nil)
+	for _, n := range names {
+		switch dist := levenshtein(q, strings.ToLower(n)); {
+		case dist < best:
+			best, found = dist, []string{n}
+		case dist == best:
+			found = append(found, n)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	if len(found) > 1 {
+		return "", &speakerError{query: query, msg: fmt.Sprintf("%q matches %s", query, strings.Join(found, ", ")), candidates: found}
+	}
+	return "", &speakerError{query: query, msg: fmt.Sprintf("Unknown speaker %q", query), candidates: names}
+}
+
+// levenshtein returns the number of single character edits turning a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// splitSpeakers splits args into speaker queries. Words are joined to the longest known name
+// they spell, e.g. "Living Room", any other word is a query of its own.
+func splitSpeakers(args []string, names []string) []string {
+	var queries []string
+	for i := 0; i < len(args); {
+		n := 1
+		for j := len(args); j > i+1; j-- {
+			joined := strings.Join(args[i:j], " ")
+			if slices.ContainsFunc(names, func(s string) bool { return strings.EqualFold(s, joined) }) {
+				n = j - i
+				break
+			}
+		}
+		queries = append(queries, strings.Join(args[i:i+n], " "))
+		i += n
+	}
+	return queries
+}
+
+// lastNumber splits args into the speaker query and the last word if it is a number. args
+// naming one of the known names as a whole, e.g. "Room 2", are the query alone.
+func lastNumber(args []string, names []string) (string, string) {
+	if len(args) == 0 {
+		return "", ""
+	}
+	all := strings.Join(args, " ")
+	if slices.ContainsFunc(names, func(s string) bool { return strings.EqualFold(s, all) }) {
+		return all, ""
+	}
+	if _, err := strconv.Atoi(args[len(args)-1]); err != nil {
+		return all, ""
+	}
+	return strings.Join(args[:len(args)-1], " "), args[len(args)-1]
+}
+
+func remoteLogger(s *soundtouch.Speaker) *log.Entry {
+	return log.WithFields(log.Fields{
+		"Plugin":  name,
+		"Speaker": s.Name(),
+	})
+}
+
+// /volume speakerName [0-100|+5|-5]
+func setVolume(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	_, names := knownSpeakers(known)
+	query, level := lastNumber(args, names)
+	s, err := lookupSpeaker(known, query)
+	if err != nil {
+		return "", err
+	}
+	current, err := s.Volume()
+	if err != nil {
+		return "", err
+	}
+	if level == "" {
+		return fmt.Sprintf("%s plays at volume %d", s.Name(), current.TargetVolume), nil
+	}
+
+	v, _ := strconv.Atoi(level)
+	if strings.HasPrefix(level, "+") || strings.HasPrefix(level, "-") {
+		v = min(max(current.TargetVolume+v, 0), 100)
+	} else if v > 100 {
+		return "", &usageError{fmt.Sprintf("Volume %d not within 0..100", v)}
+	}
+	remoteLogger(s).Infof("Setting volume to %d\n", v)
+	s.SetVolume(v)
+	metrics.Actions.Inc(name, "SetVolume")
+	return fmt.Sprintf("%s set to volume %d", s.Name(), v), nil
+}
+
+// /on speakerName
+func powerOn(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	s, err := lookupSpeaker(known, strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	if s.IsPoweredOn() {
+		return fmt.Sprintf("%s is already on", s.Name()), nil
+	}
+	remoteLogger(s).Infof("Powering on\n")
+	s.PowerOn()
+	metrics.Actions.Inc(name, "PowerOn")
+	return fmt.Sprintf("%s switched on", s.Name()), nil
+}
+
+// speakersOn returns the speaker args names, or all speakers powered on for "all"
+func speakersOn(known map[string]*soundtouch.Speaker, args []string) ([]*soundtouch.Speaker, error) {
+	query := strings.Join(args, " ")
+	if strings.EqualFold(query, "all") {
+		byName, names := knownSpeakers(known)
+		var on []*soundtouch.Speaker
+		for _, n := range names {
+			if byName[n].IsPoweredOn() {
+				on = append(on, byName[n])
+			}
+		}
+		return on, nil
+	}
+	s, err := lookupSpeaker(known, query)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsPoweredOn() {
+		return nil, fmt.Errorf("%s is off", s.Name())
+	}
+	return []*soundtouch.Speaker{s}, nil
+}
+
+func speakerNames(speakers []*soundtouch.Speaker) string {
+	var names []string
+	for _, s := range speakers {
+		names = append(names, s.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+// /off speakerName|all
+func powerOff(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	speakers, err := speakersOn(known, args)
+	if err != nil {
+		return "", err
+	}
+	if len(speakers) == 0 {
+		return "All speakers are off", nil
+	}
+	for _, s := range speakers {
+		remoteLogger(s).Infof("Powering off\n")
+		s.PowerOff()
+		metrics.Actions.Inc(name, "PowerOff")
+	}
+	return fmt.Sprintf("%s switched off", speakerNames(speakers)), nil
+}
+
+// /pause speakerName|all
+func pause(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	speakers, err := speakersOn(known, args)
+	if err != nil {
+		return "", err
+	}
+	if len(speakers) == 0 {
+		return "All speakers are off", nil
+	}
+	for _, s := range speakers {
+		remoteLogger(s).Infof("Pausing\n")
+		if err := s.PressKey(soundtouch.PAUSE); err != nil {
+			return "", err
+		}
+		metrics.Actions.Inc(name, "PressKey")
+	}
+	return fmt.Sprintf("%s paused", speakerNames(speakers)), nil
+}
+
+// /preset speakerName 1-6
+func playPreset(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	_, names := knownSpeakers(known)
+	query, preset := lastNumber(args, names)
+	s, err := lookupSpeaker(known, query)
+	if err != nil {
+		return "", err
+	}
+	n, _ := strconv.Atoi(preset)
+	if n < 1 || n > 6 {
+		return "", &usageError{"Preset missing or not within 1..6"}
+	}
+	remoteLogger(s).Infof("Playing preset %d\n", n)
+	if err := s.PressKey(soundtouch.Key(fmt.Sprintf("PRESET_%d", n))); err != nil {
+		return "", err
+	}
+	metrics.Actions.Inc(name, "PressKey")
+	return fmt.Sprintf("%s plays preset %d", s.Name(), n), nil
+}
+
+// /zone masterName slaveName...
+func createZone(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	_, names := knownSpeakers(known)
+	queries := splitSpeakers(args, names)
+	if len(queries) < 2 {
+		return "", &usageError{"A zone needs a master and at least one slave"}
+	}
+	master, err := lookupSpeaker(known, queries[0])
+	if err != nil {
+		return "", err
+	}
+	var slaves []soundtouch.Speaker
+	for _, q := range queries[1:] {
+		s, err := lookupSpeaker(known, q)
+		if err != nil {
+			return "", err
+		}
+		if s.DeviceID() == master.DeviceID() {
+			return "", &usageError{fmt.Sprintf("%s cannot be master and slave", s.Name())}
+		}
+		slaves = append(slaves, *s)
+	}
+
+	zone := soundtouch.NewZone(*master, slaves...)
+	remoteLogger(master).Infof("Creating new zone with %v as master.\n", zone.Master)
+	master.SetZone(zone)
+	metrics.Actions.Inc(name, "SetZone")
+	var sn []string
+	for _, s := range slaves {
+		sn = append(sn, s.Name())
+	}
+	return fmt.Sprintf("%s play with %s", strings.Join(sn, ", "), master.Name()), nil
+}
+
+// /unzone speakerName
+func dissolveZone(all plugins.Speakers, known map[string]*soundtouch.Speaker, args []string) (string, error) {
+	s, err := lookupSpeaker(known, strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	zone, err := s.GetZone()
+	if err != nil {
+		return "", err
+	}
+	if len(zone.Members) == 0 {
+		return "", fmt.Errorf("%s is in no zone", s.Name())
+	}
+	if zone.Master == s.DeviceID() {
+		remoteLogger(s).Infof("Dissolving zone\n")
+		s.RemoveZoneSlave(zone)
+		metrics.Actions.Inc(name, "RemoveZoneSlave")
+		return fmt.Sprintf("Zone of %s dissolved", s.Name()), nil
+	}
+
+	if m := all.ByDeviceID(zone.Master); m != nil {
+		remoteLogger(m).Infof("Removing %s from zone\n", s.Name())
+		m.RemoveZoneSlave(soundtouch.NewZone(*m, *s))
+		metrics.Actions.Inc(name, "RemoveZoneSlave")
+		return fmt.Sprintf("%s no longer plays with %s", s.Name(), m.Name()), nil
+	}
+	return "", fmt.Errorf("master %s of the zone of %s is unknown", zone.Master, s.Name())
+}
@@ -0,0 +1,135 @@
+package telegram
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+func TestMatchSpeaker(t *testing.T) {
+	names := []string{"Bathroom", "Kitchen", "Küche", "Living Room", "Office"}
+	tests := []struct {
+		query      string
+		want       string
+		candidates []string
+	}{
+		{"kitchen", "Kitchen", nil},
+		{"Off", "Office", nil},
+		{"room", "", []string{"Bathroom", "Living Room"}},
+		{"living", "Living Room", nil},
+		{"Kitchne", "Kitchen", nil},
+		{"Kü", "Küche", nil},
+		{"K", "", []string{"Kitchen", "Küche"}},
+		{"Garage", "", names},
+		{"", "", names},
+	}
+	for _, tt := range tests {
+		got, err := matchSpeaker(tt.query, names)
+		if got != tt.want {
+			t.Errorf("matchSpeaker(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+		var se *speakerError
+		if errors.As(err, &se) {
+			if !reflect.DeepEqual(se.candidates, tt.candidates) {
+				t.Errorf("matchSpeaker(%q) candidates %v, want %v", tt.query, se.candidates, tt.candidates)
+			}
+		} else if tt.candidates != nil {
+			t.Errorf("matchSpeaker(%q) error = %v, want candidates %v", tt.query, err, tt.candidates)
+		}
+	}
+}
+
+func TestSplitSpeakers(t *testing.T) {
+	got := splitSpeakers(strings.Fields("living room Kitchen off"), []string{"Kitchen", "Living Room", "Office"})
+	want := []string{"living room", "Kitchen", "off"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitSpeakers() = %q, want %q", got, want)
+	}
+}
+
+func TestLastNumber(t *testing.T) {
+	names := []string{"Kitchen", "Room 2"}
+	tests := []struct {
+		args, query, number string
+	}{
+		{"kitchen 35", "kitchen", "35"},
+		{"kitchen", "kitchen", ""},
+		{"room 2", "room 2", ""},
+		{"Room 2 +5", "Room 2", "+5"},
+		{"Room 3", "Room", "3"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		query, number := lastNumber(strings.Fields(tt.args), names)
+		if query != tt.query || number != tt.number {
+			t.Errorf("lastNumber(%q) = %q, %q, want %q, %q", tt.args, query, number, tt.query, tt.number)
+		}
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	got := suggestions("volume", []string{"room", "+5"}, "room", []string{"Bathroom", "Living Room"})
+	want := []string{"/volume Bathroom +5", "/volume Living Room +5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestions() = %q, want %q", got, want)
+	}
+	got = suggestions("preset", []string{"3"}, "", []string{"Office"})
+	if want := []string{"/preset Office 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestions() of missing speaker = %q, want %q", got, want)
+	}
+}
+
+func TestRemoteCommands(t *testing.T) {
+	n := simulatortest.Simulate(t, "Kitchen", "Office")
+	known := n.Known()
+	kitchen, office := n.Device("Kitchen"), n.Device("Office")
+	kitchen.Play(simulator.NowPlaying{Source: "TUNEIN"})
+	office.Play(simulator.NowPlaying{Source: "SPOTIFY"})
+
+	tests := []struct {
+		cmd     func(plugins.Speakers, map[string]*soundtouch.Speaker, []string) (string, error)
+		args    string
+		want    string
+		wantErr string
+	}{
+		{setVolume, "kitch 35", "Kitchen set to volume 35", ""},
+		{setVolume, "Kitchen 120", "", "Volume 120 not within 0..100"},
+		{setVolume, "35", "", "No speaker given"},
+		{playPreset, "Office 7", "", "Preset missing or not within 1..6"},
+		{playPreset, "Ofice 3", "Office plays preset 3", ""},
+		{pause, "all", "Kitchen, Office paused", ""},
+		{powerOff, "kitchen", "Kitchen switched off", ""},
+		{powerOff, "kitchen", "", "Kitchen is off"},
+		{powerOff, "all", "Office switched off", ""},
+		{powerOff, "all", "All speakers are off", ""},
+		{powerOn, "Office", "Office switched on", ""},
+		{createZone, "Office", "", "A zone needs a master and at least one slave"},
+		{createZone, "Office office", "", "Office cannot be master and slave"},
+	}
+	for _, tt := range tests {
+		got, err := tt.cmd(n, known, strings.Fields(tt.args))
+		gotErr := ""
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if got != tt.want || gotErr != tt.wantErr {
+			t.Errorf("%q = %q, %q, want %q, %q", tt.args, got, gotErr, tt.want, tt.wantErr)
+		}
+	}
+
+	if v := kitchen.Volume().TargetVolume; v != 35 {
+		t.Errorf("volume of Kitchen %d, want 35", v)
+	}
+	if keys := strings.Join(office.Received("/key"), ""); !strings.Contains(keys, "PRESET_3") || !strings.Contains(keys, "PAUSE") {
+		t.Errorf("keys received by Office %v, want PRESET_3 and PAUSE", keys)
+	}
+	if !office.IsPoweredOn() || kitchen.IsPoweredOn() {
+		t.Errorf("Office on %v, Kitchen on %v, want only Office on", office.IsPoweredOn(), kitchen.IsPoweredOn())
+	}
+}
@@ -1,12 +1,15 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 	"reflect"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	"github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 	tb "gopkg.in/tucnak/telebot.v2"
@@ -26,34 +29,136 @@ const sampleConfig = `
 ## all if empty
 # ignore_messages = ["ConnectionStateUpdated"] 
 
+## notifications are raised regardless of speakers and ignore_messages, they select the
+## speakers they are raised for themselves
+
 ## Telegram API Key
 # apiKey ="x:y"
 # authorizedSenders = ["999999", "888888"]
 # authKey = "secrectKey" 
+
+## admins may approve /authorize requests, list, restrict and revoke users
+# admins = ["999999"]
+
+## usersFile the users authorized by /authorize are stored in
+# usersFile = "telegram-users.json"
+
+## notifications are held back during quiet_hours and sent when they end
+# quiet_hours = ["22:30-07:00"]
+
+## digest batches the notifications, sending them once per interval. At once if empty.
+# digest = "1h"
+
+## dedup drops a notification repeating within the interval
+# dedup = "10m"
+
+## check is the interval speakers are checked for having gone offline
+# check = "1m"
+
+## notifications users subscribe to with /subscribe name
+## event one of "playing", "power_on", "power_off", "offline", "online"
+## message a template on the values of the update, e.g. {{.Speaker}}, {{.Station}}, {{.Artist}}
+#	[[telegram.notification]]
+#		name = "radio"
+#		event = "playing"
+#		speakers = ["Office"]
+#		message = "{{.Speaker}} started playing {{.Station}}"
+#	[[telegram.notification]]
+#		name = "late"
+#		event = "power_on"
+#		speakers = ["Schlafzimmer"]
+#		time = ["23:00-06:00"]
+#		message = "{{.Speaker}} powered on after 23:00"
+#	[[telegram.notification]]
+#		name = "offline"
+#		event = "offline"
 `
 
-const description = "Logs all update messages to telegram"
+const description = "Controls the speakers via telegram and notifies about their events"
+
+func init() {
+	plugins.Add("telegram", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewTelegramLogger(*config.(*Config)) },
+	})
+}
 
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 // IgnoreMessages a list of message types to be ignored
 // APIKey for the telegram bot
+// AuthorizedSender the ids of the users authorized without asking
+// AuthKey the key users authorize themselves with, none if empty
+// Admins the ids of the users approving authorization requests and managing the users
+// UsersFile the file the users authorized at runtime are stored in
+// QuietHours local times of the day, e.g. "22:30-07:00", notifications are held back in
+// Digest the interval notifications are batched in, e.g. "1h". Sent at once if empty.
+// Dedup the interval a repeating notification is dropped in, 10m if empty
+// Check the interval speakers are checked for having gone offline, 1m if empty
+// Notifications the notifications users may subscribe to
 type Config struct {
-	Speakers         []string `toml:"speakers"`
-	IgnoreMessages   []string `toml:"ignore_messages"`
-	APIKey           string   `toml:"apiKey"`
-	AuthorizedSender []string `toml:"authorizedSenders"`
-	AuthKey          string   `toml:"authKey"`
+	Speakers         []string       `toml:"speakers"`
+	IgnoreMessages   []string       `toml:"ignore_messages"`
+	APIKey           string         `toml:"apiKey"`
+	AuthorizedSender []string       `toml:"authorizedSenders"`
+	AuthKey          string         `toml:"authKey"`
+	Admins           []string       `toml:"admins"`
+	UsersFile        string         `toml:"usersFile"`
+	QuietHours       []string       `toml:"quiet_hours"`
+	Digest           string         `toml:"digest"`
+	Dedup            string         `toml:"dedup"`
+	Check            string         `toml:"check"`
+	Notifications    []Notification `toml:"notification"`
+}
+
+// usersFile returns the configured users file or the DefaultUsersFile
+func (c Config) usersFile() string {
+	if c.UsersFile == "" {
+		return DefaultUsersFile
+	}
+	return c.UsersFile
+}
+
+// References returns the speakers and message types the configuration refers to
+func (c *Config) References() plugins.References {
+	speakers := append([]string(nil), c.Speakers...)
+	for _, n := range c.Notifications {
+		speakers = append(speakers, n.Speakers...)
+	}
+	return plugins.References{Speakers: speakers, MessageTypes: c.IgnoreMessages}
+}
+
+// Validate checks that authorized senders and admins are user ids and the notifications
+func (c *Config) Validate() error {
+	if _, err := parseIDs("authorizedSenders", c.AuthorizedSender); err != nil {
+		return err
+	}
+	if _, err := parseIDs("admins", c.Admins); err != nil {
+		return err
+	}
+	_, _, err := c.compileNotifications()
+	return err
 }
 
 // Bot describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
+// speakers looks up the speakers controlled remotely
 type Bot struct {
 	Config
 	Plugin    soundtouch.PluginFunc
-	suspended bool
+	suspended atomic.Bool
 	bot       *tb.Bot
+	polling   bool
+	host      plugins.Host
+	users     *users
+	notifier  *notifier
+	cards     *remoteCards
+	ctx       context.Context
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+	speakers  plugins.Speakers
 }
 
 // NewTelegramLogger creates a new Logger plugin with the configuration
@@ -62,15 +167,35 @@ func NewTelegramLogger(config Config) (d *Bot) {
 		"Plugin": name,
 	})
 
-	d = &Bot{}
+	d = &Bot{speakers: plugins.Discovered{}}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
 	if config.APIKey == "" {
 		mLogger.Debug("No APIKey provided. Suspending plugin.")
-		d.suspended = true
+		d.suspended.Store(true)
 		return d
 	}
 
 	d.Config = config
 
+	if err := config.Validate(); err != nil {
+		mLogger.Errorf("Invalid configuration: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	authorized, _ := parseIDs("authorizedSenders", config.AuthorizedSender)
+	admins, _ := parseIDs("admins", config.Admins)
+	u, err := loadUsers(config.usersFile(), authorized, admins)
+	if err != nil {
+		mLogger.Errorf("Reading users failed: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.users = u
+	d.notifier, _ = newNotifier(config, u, func(id int64, msg string) error {
+		_, err := d.bot.Send(&tb.User{ID: id}, msg)
+		return err
+	})
+
 	b, err := tb.NewBot(tb.Settings{
 		// You can also set custom API URL.
 		// If field is empty it equals to "https://api.telegram.org".
@@ -86,50 +211,17 @@ func NewTelegramLogger(config Config) (d *Bot) {
 	}
 	d.bot = b
 
-	var (
-		// Universal markup builders.
-		menu     = &tb.ReplyMarkup{ResizeReplyKeyboard: true}
-		selector = &tb.ReplyMarkup{}
-
-		// Reply buttons.
-		btnHelp     = menu.Text("ℹ Help")
-		btnSettings = menu.Text("⚙ Settings")
-
-		// Inline buttons.
-		//
-		// Pressing it will cause the client to
-		// send the bot a callback.
-		//
-		// Make sure Unique stays unique as per button kind,
-		// as it has to be for callback routing to work.
-		//
-		btnPrev = selector.Data("⬅", "prev", "TEXT btnPrev")
-		btnNext = selector.Data("➡", "next", "TEXT btnNext")
-	)
-
-	menu.Reply(
-		menu.Row(btnHelp),
-		menu.Row(btnSettings),
-	)
-	selector.Inline(
-		selector.Row(btnPrev, btnNext),
-	)
-
-	// On reply button pressed (message)
-	b.Handle(&btnHelp, func(m *tb.Message) {
-		b.Send(m.Sender, fmt.Sprintf("Help %v!", m.Sender.FirstName))
-
-	})
-
-	// On inline button pressed (callback)
-	b.Handle(&btnPrev, func(c *tb.Callback) {
-		b.Respond(c, &tb.CallbackResponse{
-			CallbackID: "",
-			Text:       "testadfad ",
-			ShowAlert:  false,
-			URL:        "",
-		},
-		)
+	d.cards = newRemoteCards(func(msg tb.Editable, text string, kb *tb.ReplyMarkup) error {
+		_, err := b.Edit(msg, text, kb)
+		return err
+	})
+
+	b.Handle("/remote", func(m *tb.Message) {
+		d.remoteControl(m)
+	})
+
+	b.Handle(&tb.InlineButton{Unique: remoteUnique}, func(c *tb.Callback) {
+		d.remoteCallback(c)
 	})
 
 	b.Handle("/status", func(m *tb.Message) {
@@ -140,27 +232,138 @@ func NewTelegramLogger(config Config) (d *Bot) {
 		d.authorize(m)
 	})
 
+	b.Handle("/sleep", func(m *tb.Message) {
+		d.sleep(m)
+	})
+
+	b.Handle("/scene", func(m *tb.Message) {
+		d.scene(m)
+	})
+
+	b.Handle("/history", func(m *tb.Message) {
+		d.listeningHistory(m)
+	})
+
+	b.Handle("/users", func(m *tb.Message) {
+		d.listUsers(m)
+	})
+
+	b.Handle("/revoke", func(m *tb.Message) {
+		d.revoke(m)
+	})
+
+	b.Handle("/approve", func(m *tb.Message) {
+		d.approve(m)
+	})
+
+	b.Handle("/deny", func(m *tb.Message) {
+		d.deny(m)
+	})
+
+	b.Handle("/restrict", func(m *tb.Message) {
+		d.restrict(m)
+	})
+
+	b.Handle("/subscribe", func(m *tb.Message) {
+		d.subscribe(m, true)
+	})
+
+	b.Handle("/unsubscribe", func(m *tb.Message) {
+		d.subscribe(m, false)
+	})
+
+	for _, c := range remoteCommands {
+		b.Handle("/"+c.Name, func(m *tb.Message) {
+			d.remote(m, c)
+		})
+	}
+
 	b.Handle("/hello", func(m *tb.Message) {
-		b.Send(m.Sender, fmt.Sprintf("Hello %v(%v)!", m.Sender.FirstName, m.Sender.ID), menu)
+		b.Send(m.Sender, fmt.Sprintf("Hello %v(%v)!", m.Sender.FirstName, m.Sender.ID))
 	})
-	s, _ := strconv.ParseInt(d.Config.AuthorizedSender[0], 10, 64)
-	user := &tb.User{ID: s}
 	b.Handle(tb.OnText, func(m *tb.Message) {
 		mLogger.Infof("Recevived telegram message: %#v\n", m.Text)
 		mLogger.Infof("  by: %v\n", m.Sender)
-		if m.Sender.ID != s {
-			b.Send(user, fmt.Sprintf("Recevived telegram message: %#v\n  by: %v\n", m.Text, m.Sender))
+		for _, id := range d.users.admins() {
+			b.Send(&tb.User{ID: id}, fmt.Sprintf("Recevived telegram message: %#v\n  by: %v\n", m.Text, m.Sender))
 		}
-		b.Send(user, fmt.Sprintf("Recevived telegram message: %#v\n  by: %v\n", m.Text, m.Sender))
 	})
 
 	mLogger.Debugf("Initialised\n")
 
-	go b.Start()
-
 	return d
 }
 
+// SetHost gives the bot access to the plugins it controls, e.g. the sleep timer
+func (d *Bot) SetHost(h plugins.Host) { d.host = h }
+
+// Start starts polling telegram for messages and refreshing the remote control cards
+func (d *Bot) Start(ctx context.Context) error {
+	if d.bot == nil {
+		return nil
+	}
+	if err := d.bot.SetCommands(commands()); err != nil {
+		log.WithFields(log.Fields{
+			"Plugin": name,
+		}).Warnf("Could not register the commands: %v\n", err)
+	}
+	go d.bot.Start()
+	d.polling = true
+
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		d.cards.run(d.ctx)
+	}()
+	if len(d.notifier.notifications) > 0 {
+		d.running.Add(1)
+		go func() {
+			defer d.running.Done()
+			d.notifier.run(d.ctx)
+		}()
+	}
+	return nil
+}
+
+// Stop stops polling telegram for messages and refreshing the remote control cards
+func (d *Bot) Stop(ctx context.Context) error {
+	if !d.polling {
+		return nil
+	}
+	d.cancel()
+	if err := plugins.Wait(ctx, &d.running); err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.bot.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		d.polling = false
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notify sends msg to all authorized users
+func (d *Bot) Notify(msg string) error {
+	if d.bot == nil {
+		return fmt.Errorf("telegram bot not connected")
+	}
+	for _, u := range d.users.list() {
+		if _, err := d.bot.Send(&tb.User{ID: u.ID}, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Name returns the plugin name
 func (d *Bot) Name() string {
 	return name
@@ -176,19 +379,24 @@ func (d *Bot) SampleConfig() string { return sampleConfig }
 func (d *Bot) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (d *Bot) Disable() { d.suspended = true }
+func (d *Bot) Disable() { d.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (d *Bot) Enable() { d.suspended = false }
+func (d *Bot) Enable() { d.suspended.Store(d.bot == nil) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (d *Bot) IsEnabled() bool { return !d.suspended }
+func (d *Bot) IsEnabled() bool { return !d.suspended.Load() }
 
 // Execute runs the plugin with the given parameter
 func (d *Bot) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
 	if !d.IsEnabled() {
 		return
 	}
+	if d.cards.observe(update, speaker) {
+		d.cards.schedule(&speaker)
+	}
+	// notifications select the speakers and updates they are raised on themselves
+	d.notifier.observe(update, speaker)
 	if len(d.IgnoreMessages) > 0 && slices.Contains(d.IgnoreMessages, reflect.TypeOf(update.Value).Name()) {
 		return
 	}
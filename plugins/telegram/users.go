@@ -0,0 +1,380 @@
+package telegram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// The roles of the users. Admins may use all commands and approve authorization requests.
+const (
+	Admin  = "admin"
+	Member = "user"
+)
+
+// DefaultUsersFile is the file the authorized users are stored in if not configured otherwise
+const DefaultUsersFile = "telegram-users.json"
+
+// adminCommands may only be used by admins
+var adminCommands = []string{"users", "revoke", "approve", "deny", "restrict"}
+
+// Failed authorization attempts are limited to maxFailures per failureWindow
+const (
+	maxFailures   = 3
+	failureWindow = 10 * time.Minute
+)
+
+// User is a telegram user authorized to use the bot. Speakers and Commands restrict the user to
+// the speakers and commands listed, all if empty. Subscriptions are the names of the
+// notifications the user receives. Configured marks the restrictions and subscriptions stored
+// for a configured user, they authorize no one.
+type User struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	Role          string    `json:"role,omitempty"`
+	Speakers      []string  `json:"speakers,omitempty"`
+	Commands      []string  `json:"commands,omitempty"`
+	Subscriptions []string  `json:"subscriptions,omitempty"`
+	Authorized    time.Time `json:"authorized"`
+	Configured    bool      `json:"configured,omitempty"`
+}
+
+func (u User) String() string {
+	var b strings.Builder
+	if u.Name != "" {
+		b.WriteString(u.Name + " ")
+	}
+	fmt.Fprintf(&b, "(%d) %s", u.ID, u.Role)
+	if len(u.Speakers) > 0 {
+		fmt.Fprintf(&b, ", speakers %s", strings.Join(u.Speakers, ", "))
+	}
+	if len(u.Commands) > 0 {
+		fmt.Fprintf(&b, ", commands %s", strings.Join(u.Commands, ", "))
+	}
+	if len(u.Subscriptions) > 0 {
+		fmt.Fprintf(&b, ", subscribed to %s", strings.Join(u.Subscriptions, ", "))
+	}
+	return b.String()
+}
+
+// mayUse returns true if u may use command, e.g. volume
+func (u User) mayUse(command string) bool {
+	if u.Role == Admin {
+		return true
+	}
+	if slices.Contains(adminCommands, command) {
+		return false
+	}
+	return len(u.Commands) == 0 || slices.Contains(u.Commands, command)
+}
+
+// mayControl returns true if u may control the speaker
+func (u User) mayControl(speaker string) bool {
+	if u.Role == Admin || len(u.Speakers) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(u.Speakers, func(s string) bool { return strings.EqualFold(s, speaker) })
+}
+
+// users are the users authorized, either configured as authorized senders and admins or stored in
+// file, the pending authorization requests and the recent failed authorization attempts.
+// Restrictions of configured users are stored as well, configured admins stay admins. clock
+// returns the current time.
+type users struct {
+	file       string
+	mu         sync.Mutex
+	configured map[int64]User
+	stored     map[int64]User
+	pending    map[int64]User
+	failures   map[int64][]time.Time
+	clock      func() time.Time
+}
+
+// parseIDs returns the user ids of ids, name the configuration key they are listed under
+func parseIDs(name string, ids []string) ([]int64, error) {
+	var parsed []int64
+	for _, s := range ids {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is no user id", name, s)
+		}
+		parsed = append(parsed, id)
+	}
+	return parsed, nil
+}
+
+// loadUsers returns the users configured and those stored in file. A missing file stores no
+// users. The restrictions and subscriptions stored for users no longer configured are dropped.
+func loadUsers(file string, authorized, admins []int64) (*users, error) {
+	u := &users{
+		file:       file,
+		configured: map[int64]User{},
+		stored:     map[int64]User{},
+		pending:    map[int64]User{},
+		failures:   map[int64][]time.Time{},
+		clock:      time.Now,
+	}
+	for _, id := range authorized {
+		u.configured[id] = User{ID: id, Role: Member}
+	}
+	for _, id := range admins {
+		u.configured[id] = User{ID: id, Role: Admin}
+	}
+
+	buf, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []User
+	if err := json.Unmarshal(buf, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, s := range stored {
+		if _, ok := u.configured[s.ID]; s.Configured && !ok {
+			continue
+		}
+		u.stored[s.ID] = s
+	}
+	return u, nil
+}
+
+// save writes the stored users to file. The caller holds mu.
+func (u *users) save() error {
+	var stored []User
+	for _, s := range u.stored {
+		stored = append(stored, s)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	buf, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := u.file + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.file)
+}
+
+// lookup returns the authorized user with id. The caller holds mu.
+func (u *users) lookup(id int64) (User, bool) {
+	c, configured := u.configured[id]
+	s, stored := u.stored[id]
+	switch {
+	case configured && stored && s.Configured:
+		c.Name, c.Speakers, c.Commands, c.Subscriptions = s.Name, s.Speakers, s.Commands, s.Subscriptions
+		return c, true
+	case configured && stored:
+		if c.Role == Admin {
+			s.Role = Admin
+		}
+		return s, true
+	case stored:
+		return s, true
+	default:
+		return c, configured
+	}
+}
+
+// get returns the authorized user with id, false if the user is not authorized
+func (u *users) get(id int64) (User, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lookup(id)
+}
+
+// list returns the authorized users by id
+func (u *users) list() []User {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var list []User
+	for id := range u.configured {
+		s, _ := u.lookup(id)
+		list = append(list, s)
+	}
+	for id, s := range u.stored {
+		if _, ok := u.configured[id]; !ok {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// admins returns the ids of the admins
+func (u *users) admins() []int64 {
+	var ids []int64
+	for _, s := range u.list() {
+		if s.Role == Admin {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+// add authorizes and stores user, dropping a pending request
+func (u *users) add(user User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if user.Role == "" {
+		user.Role = Member
+	}
+	user.Authorized = u.clock()
+	u.stored[user.ID] = user
+	delete(u.pending, user.ID)
+	return u.save()
+}
+
+// revoke removes the authorization of the user with id. Configured users cannot be revoked.
+func (u *users) revoke(id int64) (User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.configured[id]; ok {
+		return User{}, fmt.Errorf("%d is configured, remove the user from the configuration", id)
+	}
+	s, ok := u.stored[id]
+	if !ok {
+		return User{}, fmt.Errorf("%d is not authorized", id)
+	}
+	delete(u.stored, id)
+	return s, u.save()
+}
+
+// update changes the authorized user with id by change and stores the user. Of configured users
+// only the restrictions and subscriptions are stored, the role is kept in the configuration.
+func (u *users) update(id int64, change func(s *User) error) (User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, ok := u.stored[id]
+	if !ok {
+		c, configured := u.configured[id]
+		if !configured {
+			return User{}, fmt.Errorf("%d is not authorized", id)
+		}
+		s = User{ID: id, Name: c.Name, Configured: true}
+	}
+	if err := change(&s); err != nil {
+		return User{}, err
+	}
+	u.stored[id] = s
+	updated, _ := u.lookup(id)
+	return updated, u.save()
+}
+
+// restrict limits the user with id to the speakers and commands, all if empty
+func (u *users) restrict(id int64, speakers, commands []string) (User, error) {
+	if s, ok := u.get(id); ok && s.Role == Admin {
+		return User{}, fmt.Errorf("%d is an admin, admins are not restricted", id)
+	}
+	return u.update(id, func(s *User) error {
+		s.Speakers, s.Commands = speakers, commands
+		return nil
+	})
+}
+
+// subscribe subscribes the user with id to the notifications, or unsubscribes if subscribe is
+// false
+func (u *users) subscribe(id int64, notifications []string, subscribe bool) (User, error) {
+	return u.update(id, func(s *User) error {
+		for _, n := range notifications {
+			i := slices.Index(s.Subscriptions, n)
+			switch {
+			case subscribe && i < 0:
+				s.Subscriptions = append(s.Subscriptions, n)
+			case !subscribe && i >= 0:
+				s.Subscriptions = slices.Delete(s.Subscriptions, i, i+1)
+			}
+		}
+		return nil
+	})
+}
+
+// request records the authorization request of user. It returns false if the user already
+// requested.
+func (u *users) request(user User) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.pending[user.ID]; ok {
+		return false
+	}
+	u.pending[user.ID] = user
+	return true
+}
+
+// requests returns the pending authorization requests by id
+func (u *users) requests() []User {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var list []User
+	for _, p := range u.pending {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// approve authorizes the user with id that requested authorization
+func (u *users) approve(id int64) (User, error) {
+	u.mu.Lock()
+	p, ok := u.pending[id]
+	u.mu.Unlock()
+	if !ok {
+		return User{}, fmt.Errorf("%d did not request authorization", id)
+	}
+	return p, u.add(p)
+}
+
+// deny drops the authorization request of the user with id
+func (u *users) deny(id int64) (User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p, ok := u.pending[id]
+	if !ok {
+		return User{}, fmt.Errorf("%d did not request authorization", id)
+	}
+	delete(u.pending, id)
+	return p, nil
+}
+
+// blocked returns true if the user with id failed to authorize too often lately
+func (u *users) blocked(id int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.recentFailures(id)) >= maxFailures
+}
+
+// fail records a failed authorization attempt of the user with id
+func (u *users) fail(id int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures[id] = append(u.recentFailures(id), u.clock())
+}
+
+// recentFailures returns the failures of the user with id within the failureWindow, forgetting
+// older ones. The caller holds mu.
+func (u *users) recentFailures(id int64) []time.Time {
+	since := u.clock().Add(-failureWindow)
+	var recent []time.Time
+	for _, t := range u.failures[id] {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(u.failures, id)
+	} else {
+		u.failures[id] = recent
+	}
+	return recent
+}
@@ -0,0 +1,157 @@
+package telegram
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+)
+
+func TestUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	u, err := loadUsers(file, []int64{1, 2}, []int64{2})
+	if err != nil {
+		t.Fatalf("loadUsers() error = %v", err)
+	}
+	if !u.request(User{ID: 3, Name: "carol"}) || u.request(User{ID: 3, Name: "carol"}) {
+		t.Errorf("request() twice, want true and false")
+	}
+	if _, err := u.approve(3); err != nil {
+		t.Errorf("approve() error = %v", err)
+	}
+	if err := u.add(User{ID: 4, Name: "dave"}); err != nil {
+		t.Errorf("add() error = %v", err)
+	}
+	if _, err := u.restrict(1, []string{"Kitchen"}, []string{"volume"}); err != nil {
+		t.Errorf("restrict() error = %v", err)
+	}
+	if _, err := u.restrict(2, []string{"Kitchen"}, nil); err == nil {
+		t.Errorf("restrict() of an admin succeeded")
+	}
+	if _, err := u.revoke(1); err == nil {
+		t.Errorf("revoke() of a configured user succeeded")
+	}
+	if _, err := u.revoke(4); err != nil {
+		t.Errorf("revoke() error = %v", err)
+	}
+
+	// authorizations survive a restart
+	u, err = loadUsers(file, []int64{1, 2}, []int64{2})
+	if err != nil {
+		t.Fatalf("loadUsers() error = %v", err)
+	}
+	var got []string
+	for _, s := range u.list() {
+		got = append(got, s.String())
+	}
+	want := []string{"(1) user, speakers Kitchen, commands volume", "(2) admin", "carol (3) user"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("list() = %q, want %q", got, want)
+	}
+	if admins := u.admins(); !reflect.DeepEqual(admins, []int64{2}) {
+		t.Errorf("admins() = %v, want [2]", admins)
+	}
+}
+
+func TestUsers_Configured(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	u, _ := loadUsers(file, []int64{1}, nil)
+	if _, err := u.restrict(1, []string{"Kitchen"}, nil); err != nil {
+		t.Fatalf("restrict() error = %v", err)
+	}
+	if _, err := u.subscribe(1, []string{"radio"}, true); err != nil {
+		t.Fatalf("subscribe() error = %v", err)
+	}
+	buf, _ := os.ReadFile(file)
+	if got := string(buf); !strings.Contains(got, `"configured": true`) || strings.Contains(got, `"role"`) {
+		t.Errorf("stored %s, want the restrictions of configured user 1 only", got)
+	}
+
+	u, _ = loadUsers(file, []int64{1}, nil)
+	if s, ok := u.get(1); !ok || s.String() != "(1) user, speakers Kitchen, subscribed to radio" {
+		t.Errorf("get(1) = %v, %v, want the restricted user", s, ok)
+	}
+
+	// removed from the configuration, user 1 is no longer authorized
+	u, _ = loadUsers(file, nil, nil)
+	if s, ok := u.get(1); ok {
+		t.Errorf("get(1) = %v of a user no longer configured", s)
+	}
+	if l := u.list(); len(l) != 0 {
+		t.Errorf("list() = %v, want no users", l)
+	}
+}
+
+func TestUser_Permissions(t *testing.T) {
+	admin := User{Role: Admin, Speakers: []string{"Kitchen"}}
+	user := User{Role: Member}
+	restricted := User{Role: Member, Speakers: []string{"Kitchen"}, Commands: []string{"volume", "users"}}
+	tests := []struct {
+		user    User
+		command string
+		speaker string
+		want    bool
+	}{
+		{admin, "users", "Office", true},
+		{user, "volume", "Office", true},
+		{user, "revoke", "Office", false},
+		{restricted, "volume", "kitchen", true},
+		{restricted, "volume", "Office", false},
+		{restricted, "off", "Kitchen", false},
+		{restricted, "users", "Kitchen", false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.mayUse(tt.command) && tt.user.mayControl(tt.speaker); got != tt.want {
+			t.Errorf("%v may use /%s on %s = %v, want %v", tt.user, tt.command, tt.speaker, got, tt.want)
+		}
+	}
+}
+
+func TestUsers_Failures(t *testing.T) {
+	clock := simulatortest.NewClock(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC))
+	u, _ := loadUsers(filepath.Join(t.TempDir(), "users.json"), nil, nil)
+	u.clock = clock.Now
+	for i := 0; i < maxFailures; i++ {
+		if u.blocked(5) {
+			t.Fatalf("blocked after %d failures", i)
+		}
+		u.fail(5)
+		clock.Advance(time.Minute)
+	}
+	if !u.blocked(5) {
+		t.Errorf("not blocked after %d failures", maxFailures)
+	}
+	clock.Advance(failureWindow - 2*time.Minute)
+	if u.blocked(5) {
+		t.Errorf("blocked after the first failure left the window")
+	}
+}
+
+func TestParseRestrictions(t *testing.T) {
+	tests := []struct {
+		words    string
+		speakers []string
+		commands []string
+		wantErr  bool
+	}{
+		{"none", nil, nil, false},
+		{"speakers Living Room, Kitchen", []string{"Living Room", "Kitchen"}, nil, false},
+		{"commands /volume,on speakers Office", []string{"Office"}, []string{"volume", "on"}, false},
+		{"Kitchen", nil, nil, true},
+		{"speakers", nil, nil, true},
+	}
+	for _, tt := range tests {
+		speakers, commands, err := parseRestrictions(strings.Fields(tt.words))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRestrictions(%q) error = %v", tt.words, err)
+			continue
+		}
+		if !reflect.DeepEqual(speakers, tt.speakers) || !reflect.DeepEqual(commands, tt.commands) {
+			t.Errorf("parseRestrictions(%q) = %q, %q, want %q, %q", tt.words, speakers, commands, tt.speakers, tt.commands)
+		}
+	}
+}
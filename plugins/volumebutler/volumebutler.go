@@ -1,11 +1,17 @@
 package volumebutler
 
 import (
+	"context"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	scribble "github.com/nanobox-io/golang-scribble"
 	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
 	soundtouch "github.com/theovassiliou/soundtouch-golang"
 	"golang.org/x/exp/slices"
 )
@@ -29,6 +35,14 @@ const sampleConfig = `
 
 const description = "Automatically adjust sets volume based on listening history."
 
+func init() {
+	plugins.Add("volumeButler", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewVolumeButler(*config.(*Config)) },
+	})
+}
+
 // Config contains the configuration of the plugin
 // Speakers list of SpeakerNames the handler is added. All if empty
 // Artists a list of artists for which episodes should be collected
@@ -38,21 +52,35 @@ type Config struct {
 	Database string   `toml:"database"`
 }
 
+// References returns the speakers the configuration refers to
+func (c *Config) References() plugins.References {
+	return plugins.References{Speakers: c.Speakers}
+}
+
 // VolumeButler describes the plugin. It has a
 // Config to store the configuration
 // Plugin the plugin function
 // suspended indicates that the plugin is temporarely suspended
 // scribbleDB a link to the volumes database
+// bus delivering the volume updates observed
 type VolumeButler struct {
 	Config
 	Plugin     soundtouch.PluginFunc
-	suspended  bool
+	suspended  atomic.Bool
 	scribbleDb *scribble.Driver
+	bus        *bus.Bus
+	ctx        context.Context
+	cancel     context.CancelFunc
+	executing  sync.WaitGroup
 }
 
+// observation is the time the volume is observed after an album has been found
+var observation = 60 * time.Second
+
 // NewVolumeButler creates a new Collector plugin with the configuration
 func NewVolumeButler(config Config) (d *VolumeButler) {
 	d = &VolumeButler{}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
 	if config.Database == "" {
 		return d
 	}
@@ -91,16 +119,34 @@ func (vb *VolumeButler) SampleConfig() string { return sampleConfig }
 func (vb *VolumeButler) Terminate() bool { return false }
 
 // Disable temporarely the execution of the plugin
-func (vb *VolumeButler) Disable() { vb.suspended = true }
+func (vb *VolumeButler) Disable() { vb.suspended.Store(true) }
 
 // Enable temporarely the execution of the plugin
-func (vb *VolumeButler) Enable() { vb.suspended = false }
+func (vb *VolumeButler) Enable() { vb.suspended.Store(false) }
 
 // IsEnabled returns true if the plugin is not suspened
-func (vb *VolumeButler) IsEnabled() bool { return !vb.suspended }
+func (vb *VolumeButler) IsEnabled() bool { return !vb.suspended.Load() }
+
+// SetBus gives the plugin access to the volume updates following an update
+func (vb *VolumeButler) SetBus(b *bus.Bus) { vb.bus = b }
+
+// Start binds pending volume observations to ctx
+func (vb *VolumeButler) Start(ctx context.Context) error {
+	vb.ctx, vb.cancel = context.WithCancel(ctx)
+	return nil
+}
+
+// Stop aborts pending volume observations and waits for them to finish
+func (vb *VolumeButler) Stop(ctx context.Context) error {
+	vb.suspended.Store(true)
+	vb.cancel()
+	return plugins.Wait(ctx, &vb.executing)
+}
 
 // Execute runs the plugin with the given parameter
 func (vb *VolumeButler) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	vb.executing.Add(1)
+	defer vb.executing.Done()
 
 	typeName := reflect.TypeOf(update.Value).Name()
 	mLogger := log.WithFields(log.Fields{
@@ -140,51 +186,55 @@ func (vb *VolumeButler) Execute(pluginName string, update soundtouch.Update, spe
 		mLogger.Infof("Stored volume was set more than 20minutes ago\n")
 		mLogger.Infof("Setting volume to %d\n", storedAlbum.Volume)
 		speaker.SetVolume(storedAlbum.Volume)
+		metrics.Actions.Inc(name, "SetVolume")
 	}
 
 	// wait for a minute and process last volume observed
 	// construct the mean value of current and past volumes
 	// store the update value
-	mLogger.Infof("Going to sleep for 60s\n")
-	time.Sleep(60 * time.Second)
+	// Observing in the background keeps Execute from blocking the next update
+	vb.executing.Add(1)
+	go vb.observeVolume(mLogger, speaker, album, storedAlbum)
+}
+
+// observeVolume observes the volume of speaker for a minute, then stores the mean of the last
+// volume observed and the stored volume of the album
+func (vb *VolumeButler) observeVolume(mLogger *log.Entry, speaker soundtouch.Speaker, album string, storedAlbum *DbEntry) {
+	defer vb.executing.Done()
+
+	if vb.bus == nil {
+		mLogger.Errorf("No update bus. Not observing the volume.\n")
+		return
+	}
+
+	mLogger.Infof("Observing volume for %v\n", observation)
+	sub := vb.bus.SubscribeFor(vb.ctx, observation, bus.Filter{
+		Speakers: []string{speaker.DeviceID()},
+		Types:    []string{"Volume"},
+	}, 0)
+	lastVolume := LastVolume(sub)
+	if vb.ctx.Err() != nil {
+		mLogger.Infof("Stopped while observing. --> Done!\n")
+		return
+	}
 
-	// clear message and keep last volume update
-	mLogger.Infof("Scanning for Volume\n")
-	lastVolume := ScanForVolume(&speaker)
 	ReadDB(vb.scribbleDb, speaker.Name(), album, storedAlbum)
 	if lastVolume != nil {
+		mLogger.Infof("lastVolume was %d\n", lastVolume.ActualVolume)
 		storedAlbum.Volume = storedAlbum.calcNewVolume(lastVolume.TargetVolume)
 		mLogger.Infof("writing volume to %v\n", storedAlbum.Volume)
 		vb.scribbleDb.Write(speaker.Name(), album, &storedAlbum)
 	}
 }
 
-// ScanForVolume listens for Volume updates and returns the latest received Volume, when the
-// channel is closed
-func ScanForVolume(spk *soundtouch.Speaker) *soundtouch.Volume {
+// LastVolume returns the latest Volume received by the subscription, when the subscription
+// has ended. nil if no Volume has been received.
+func LastVolume(sub *bus.Subscription) *soundtouch.Volume {
 	var lastVolume *soundtouch.Volume
-	var mLogger *log.Entry
-	for scanMsg := range spk.WebSocketCh {
-		typeName := reflect.TypeOf(scanMsg.Value).Name()
-		mLogger = log.WithFields(log.Fields{
-			"Plugin":        name,
-			"Speaker":       spk.Name(),
-			"UpdateMsgType": typeName,
-		})
-		if scanMsg.Is("Volume") {
-			aVol, _ := scanMsg.Value.(soundtouch.Volume)
+	for e := range sub.C() {
+		if aVol, ok := e.Update.Value.(soundtouch.Volume); ok {
 			lastVolume = &aVol
-			mLogger.Printf("Ignoring! Volume: %#v", lastVolume)
-		} else {
-			mLogger.Debugf("Ignoring!! %s\n", typeName)
-		}
-		if len(spk.WebSocketCh) == 0 {
-			break
 		}
 	}
-
-	if lastVolume != nil {
-		mLogger.Infof("lastVolume was %d\n", lastVolume.ActualVolume)
-	}
 	return lastVolume
 }
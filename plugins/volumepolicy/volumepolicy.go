@@ -0,0 +1,319 @@
+package volumepolicy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-automation/bus"
+	"github.com/theovassiliou/soundtouch-automation/metrics"
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+var name = "VolumePolicy"
+
+const description = "Enforces maximum volumes and limits how fast volumes increase"
+
+const sampleConfig = `
+## Enabling the volume policy plugin. Volumes exceeding a policy are set back.
+# [volumePolicy]
+
+## every policy applies to the speakers, sources and times given, all if empty.
+## max_volume caps the volume, max_increase limits the increase of the volume within per.
+## Where several policies apply the strictest wins.
+#	[[volumePolicy.policy]]
+#		name = "children night"
+#		speakers = ["Prinzessinen"]
+#		time = ["19:30-07:00"]
+#		max_volume = 20
+#	[[volumePolicy.policy]]
+#		name = "neighbours"
+#		sources = ["AUX", "BLUETOOTH", "PRODUCT"]
+#		time = ["22:00-07:00"]
+#		max_volume = 35
+#		max_increase = 10
+#		per = "10s"
+`
+
+func init() {
+	plugins.Add("volumePolicy", plugins.Creator{
+		SampleConfig: sampleConfig,
+		NewConfig:    func() interface{} { return &Config{} },
+		New:          func(config interface{}) soundtouch.Plugin { return NewVolumePolicy(*config.(*Config)) },
+	})
+}
+
+// Config contains the configuration of the plugin
+// Policies the policies enforced
+type Config struct {
+	Policies []Policy `toml:"policy"`
+}
+
+// Policy restricts the volume of speakers
+// Name identifies the policy in the log
+// Speakers names of the speakers the policy applies to, all if empty
+// Sources sources the speaker is playing from, e.g. "AUX", all if empty
+// Time local times of the day in the form "22:00-07:00", always if empty
+// MaxVolume the highest volume allowed
+// MaxIncrease the most the volume may increase within Per
+// Per the time window of MaxIncrease, e.g. "10s". Defaults to one minute.
+type Policy struct {
+	Name        string   `toml:"name"`
+	Speakers    []string `toml:"speakers"`
+	Sources     []string `toml:"sources"`
+	Time        []string `toml:"time"`
+	MaxVolume   *int     `toml:"max_volume"`
+	MaxIncrease int      `toml:"max_increase"`
+	Per         string   `toml:"per"`
+}
+
+func (p Policy) filter() plugins.Filter {
+	return plugins.Filter{Speakers: p.Speakers, Sources: p.Sources, Time: p.Time}
+}
+
+// References returns the speakers the policies refer to
+func (c *Config) References() plugins.References {
+	var r plugins.References
+	for _, p := range c.Policies {
+		r.Speakers = append(r.Speakers, p.Speakers...)
+	}
+	return r
+}
+
+// Validate checks the limits and times of the policies
+func (c *Config) Validate() error {
+	_, err := c.compile()
+	return err
+}
+
+// policy is a compiled Policy
+type policy struct {
+	Policy
+	matcher *plugins.Matcher
+	per     time.Duration
+}
+
+func (c *Config) compile() ([]policy, error) {
+	if len(c.Policies) == 0 {
+		return nil, fmt.Errorf("no policy configured")
+	}
+	var compiled []policy
+	for i, p := range c.Policies {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("policy %d", i+1)
+		}
+		m, err := p.filter().Compile()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+		cp := policy{Policy: p, matcher: m, per: time.Minute}
+		if p.MaxVolume == nil && p.MaxIncrease == 0 {
+			return nil, fmt.Errorf("%s: neither max_volume nor max_increase given", p.Name)
+		}
+		if p.MaxVolume != nil && (*p.MaxVolume < 0 || *p.MaxVolume > 100) {
+			return nil, fmt.Errorf("%s: max_volume %d not within 0-100", p.Name, *p.MaxVolume)
+		}
+		if p.MaxIncrease < 0 {
+			return nil, fmt.Errorf("%s: max_increase %d is negative", p.Name, p.MaxIncrease)
+		}
+		if p.Per != "" {
+			if cp.per, err = time.ParseDuration(p.Per); err != nil || cp.per <= 0 {
+				return nil, fmt.Errorf("%s: per %q is no positive duration", p.Name, p.Per)
+			}
+		}
+		compiled = append(compiled, cp)
+	}
+	return compiled, nil
+}
+
+// sample is a volume accepted at a time
+type sample struct {
+	at     time.Time
+	volume int
+}
+
+// VolumePolicy describes the plugin. It has a
+// Config to store the configuration
+// Plugin the plugin function
+// suspended indicates that the plugin is temporarely suspended
+// policies the compiled policies, nil if the configuration is invalid
+// sources the source of the last NowPlaying per device ID
+// accepted the volumes accepted recently per device ID, to limit increases
+// clock returns the current time
+type VolumePolicy struct {
+	Config
+	Plugin    soundtouch.PluginFunc
+	suspended atomic.Bool
+	policies  []policy
+	bus       *bus.Bus
+	mu        sync.Mutex
+	sources   map[string]string
+	accepted  map[string][]sample
+	clock     func() time.Time
+}
+
+// NewVolumePolicy creates a new VolumePolicy plugin with the configuration
+func NewVolumePolicy(config Config) (d *VolumePolicy) {
+	d = &VolumePolicy{Config: config, sources: map[string]string{}, accepted: map[string][]sample{}, clock: time.Now}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin": name,
+	})
+
+	p, err := config.compile()
+	if err != nil {
+		mLogger.Errorf("Invalid policy: %v. Suspending plugin.\n", err)
+		d.suspended.Store(true)
+		return d
+	}
+	d.policies = p
+
+	mLogger.Debugf("Initialised\n")
+	return d
+}
+
+// Name returns the plugin name
+func (d *VolumePolicy) Name() string {
+	return name
+}
+
+// Description returns a string explaining the purpose of this plugin
+func (d *VolumePolicy) Description() string { return description }
+
+// SampleConfig returns text explaining how plugin should be configured
+func (d *VolumePolicy) SampleConfig() string { return sampleConfig }
+
+// Terminate indicates that no further plugin will be executed on this speaker
+func (d *VolumePolicy) Terminate() bool { return false }
+
+// Disable temporarely the execution of the plugin
+func (d *VolumePolicy) Disable() { d.suspended.Store(true) }
+
+// Enable temporarely the execution of the plugin
+func (d *VolumePolicy) Enable() { d.suspended.Store(d.policies == nil) }
+
+// IsEnabled returns true if the plugin is not suspened
+func (d *VolumePolicy) IsEnabled() bool { return !d.suspended.Load() }
+
+// SetBus gives the plugin access to the source of speakers not seen playing yet
+func (d *VolumePolicy) SetBus(b *bus.Bus) { d.bus = b }
+
+// Execute runs the plugin with the given parameter
+func (d *VolumePolicy) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	if !d.IsEnabled() || update.Value == nil {
+		return
+	}
+
+	mLogger := log.WithFields(log.Fields{
+		"Plugin":        name,
+		"Speaker":       speaker.Name(),
+		"UpdateMsgType": reflect.TypeOf(update.Value).Name(),
+	})
+	mLogger.Traceln("Executing", pluginName)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := speaker.DeviceID()
+	if np, ok := update.Value.(soundtouch.NowPlaying); ok {
+		d.sources[id] = string(np.Source)
+		if np.Source == "STANDBY" {
+			// increases are limited while playing only
+			delete(d.accepted, id)
+		}
+		return
+	}
+	vol, ok := update.Value.(soundtouch.Volume)
+	if !ok {
+		return
+	}
+
+	now := d.clock()
+	values := plugins.NewValues(update, speaker, d.nowPlaying(id), nil, now)
+	if values.Source == "STANDBY" {
+		return
+	}
+
+	allowed, by := vol.TargetVolume, ""
+	for _, p := range d.policies {
+		if !p.matcher.Match(values) {
+			continue
+		}
+		if p.MaxVolume != nil && *p.MaxVolume < allowed {
+			allowed, by = *p.MaxVolume, p.Name
+		}
+		if p.MaxIncrease > 0 {
+			if base, ok := d.base(id, now, p.per); ok && base+p.MaxIncrease < allowed {
+				allowed, by = base+p.MaxIncrease, p.Name
+			}
+		}
+	}
+	d.accept(id, now, allowed)
+	if allowed == vol.TargetVolume {
+		return
+	}
+
+	mLogger.WithFields(log.Fields{
+		"Policy": by,
+		"Before": vol.TargetVolume,
+		"After":  allowed,
+	}).Infof("Volume %d violates %s. Setting volume %d\n", vol.TargetVolume, by, allowed)
+	speaker.SetVolume(allowed)
+	metrics.Actions.Inc(name, "SetVolume")
+}
+
+// nowPlaying returns the last NowPlaying of the speaker with device ID id, nil if unknown
+func (d *VolumePolicy) nowPlaying(id string) *soundtouch.NowPlaying {
+	if src, ok := d.sources[id]; ok {
+		return &soundtouch.NowPlaying{Source: soundtouch.Source(src)}
+	}
+	if d.bus == nil {
+		return nil
+	}
+	if e, ok := d.bus.Last(id, "NowPlaying"); ok {
+		if np, ok := e.Update.Value.(soundtouch.NowPlaying); ok {
+			return &np
+		}
+	}
+	return nil
+}
+
+// base returns the lowest volume of the speaker with device ID id within per before now,
+// including the volume it had when the window started. false if no volume is known.
+func (d *VolumePolicy) base(id string, now time.Time, per time.Duration) (int, bool) {
+	samples := d.accepted[id]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	start := now.Add(-per)
+	low := 101
+	for i, s := range samples {
+		inWindow := s.at.After(start)
+		atStart := !inWindow && (i == len(samples)-1 || samples[i+1].at.After(start))
+		if inWindow || atStart {
+			low = min(low, s.volume)
+		}
+	}
+	return low, true
+}
+
+// accept records volume as accepted for the speaker with device ID id and drops samples no
+// longer needed by any policy
+func (d *VolumePolicy) accept(id string, now time.Time, volume int) {
+	var longest time.Duration
+	for _, p := range d.policies {
+		longest = max(longest, p.per)
+	}
+	samples := append(d.accepted[id], sample{at: now, volume: volume})
+	start := now.Add(-longest)
+	// keep the last sample before the window, it is the volume when the window started
+	i := 0
+	for i+1 < len(samples) && !samples[i+1].at.After(start) {
+		i++
+	}
+	d.accepted[id] = samples[i:]
+}
@@ -0,0 +1,102 @@
+package volumepolicy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+	"github.com/theovassiliou/soundtouch-automation/simulator/simulatortest"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// simulate starts the simulated speaker Prinzessinen and returns a clock set to 20:00
+func simulate(t *testing.T) (*simulator.Device, *simulatortest.Clock) {
+	dev := simulatortest.Simulate(t, "Prinzessinen").Device("Prinzessinen")
+	dev.ResetCommands()
+	return dev, simulatortest.NewClock(time.Date(2024, 3, 1, 20, 0, 0, 0, time.Local))
+}
+
+// volumes returns the volumes set on dev
+func volumes(dev *simulator.Device) []string {
+	var v []string
+	for _, body := range dev.Received("/volume") {
+		v = append(v, strings.TrimSuffix(strings.TrimPrefix(body, "<volume>"), "</volume>"))
+	}
+	return v
+}
+
+func volume(v int) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.Volume{TargetVolume: v, ActualVolume: v}}
+}
+
+func playing(source string) soundtouch.Update {
+	return soundtouch.Update{Value: soundtouch.NowPlaying{Source: soundtouch.Source(source)}}
+}
+
+func intP(i int) *int { return &i }
+
+func TestVolumePolicy_MaxVolume(t *testing.T) {
+	dev, clock := simulate(t)
+	d := NewVolumePolicy(Config{Policies: []Policy{
+		{Name: "night", Speakers: []string{"Prinzessinen"}, Time: []string{"19:30-07:00"}, MaxVolume: intP(20)},
+		{Name: "aux", Sources: []string{"AUX", "BLUETOOTH"}, MaxVolume: intP(15)},
+	}})
+	d.clock = clock.Now
+	speaker := *dev.Speaker()
+
+	d.Execute("", playing("TUNEIN"), speaker)
+	d.Execute("", volume(18), speaker)
+	d.Execute("", volume(30), speaker)
+	clock.Advance(12 * time.Hour)
+	d.Execute("", volume(30), speaker)
+	d.Execute("", playing("AUX"), speaker)
+	d.Execute("", volume(30), speaker)
+	d.Execute("", playing("STANDBY"), speaker)
+	d.Execute("", volume(30), speaker)
+
+	if got, want := volumes(dev), []string{"20", "15"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("volumes set %v, want %v", got, want)
+	}
+}
+
+func TestVolumePolicy_MaxIncrease(t *testing.T) {
+	dev, clock := simulate(t)
+	d := NewVolumePolicy(Config{Policies: []Policy{{MaxIncrease: 10, Per: "10s"}}})
+	d.clock = clock.Now
+	speaker := *dev.Speaker()
+
+	steps := []struct {
+		after  time.Duration
+		volume int
+	}{
+		{0, 20},
+		{time.Second, 25},
+		{time.Second, 40}, // reverted to 30
+		{time.Second, 30},
+		{5 * time.Second, 20},
+		{4 * time.Second, 35}, // 20 is the lowest within 10s, reverted to 30
+		{30 * time.Second, 30},
+		{30 * time.Second, 45}, // reverted to 40
+	}
+	for _, s := range steps {
+		clock.Advance(s.after)
+		d.Execute("", volume(s.volume), speaker)
+	}
+
+	if got, want := volumes(dev), []string{"30", "30", "40"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("volumes set %v, want %v", got, want)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	simulatortest.CheckValidate(t, []simulatortest.ConfigTest{
+		{Name: "valid", Config: &Config{Policies: []Policy{{MaxVolume: intP(0)}, {MaxIncrease: 5}}}, Want: ""},
+		{Name: "empty", Config: &Config{}, Want: "no policy configured"},
+		{Name: "no limit", Config: &Config{Policies: []Policy{{Name: "night"}}}, Want: "night: neither max_volume nor max_increase given"},
+		{Name: "max volume", Config: &Config{Policies: []Policy{{MaxVolume: intP(120)}}}, Want: "policy 1: max_volume 120 not within 0-100"},
+		{Name: "per", Config: &Config{Policies: []Policy{{MaxIncrease: 5, Per: "-1s"}}}, Want: `policy 1: per "-1s" is no positive duration`},
+		{Name: "time", Config: &Config{Policies: []Policy{{MaxIncrease: 5, Time: []string{"22:00"}}}}, Want: `policy 1: time "22:00" is not of the form 07:00-09:30`},
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/presets"
+	"golang.org/x/exp/slices"
+)
+
+// presetsCmd compares, backs up and pushes the presets of the speakers
+type presetsCmd struct {
+	Backup           bool          `help:"read the presets of all speakers and store them as a new version"`
+	History          bool          `help:"list the versions stored"`
+	Push             []string      `help:"speakers the presets are pushed to, all for all speakers"`
+	From             string        `help:"speaker whose presets are pushed, each speaker gets its own if empty"`
+	Version          int           `help:"version the presets are shown or pushed from, the latest if 0"`
+	DiscoveryTimeout time.Duration `help:"Time to wait for speakers"`
+}
+
+// Run shows the presets of all speakers and where they differ. It backs up and pushes presets
+// using the file of the [presets] section of the config file given by --config. Speakers are
+// discovered as configured in the [global] section.
+func (p *presetsCmd) Run() error {
+	tConfig, _, err := readConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	var config presets.Config
+	for _, inst := range tConfig.Plugins {
+		if c, ok := inst.Config.(*presets.Config); ok {
+			config = *c
+		}
+	}
+	d := presets.NewPresets(config)
+
+	if p.History {
+		backups, err := d.Backups()
+		if err != nil {
+			return err
+		}
+		return printBackups(os.Stdout, backups)
+	}
+	if p.Version != 0 && len(p.Push) == 0 {
+		backups, err := d.Backups()
+		if err != nil {
+			return err
+		}
+		for _, b := range backups {
+			if b.Version == p.Version {
+				fmt.Printf("Version %d taken %s\n", b.Version, b.Taken.Format(time.RFC1123))
+				return printPresets(os.Stdout, b.Speakers)
+			}
+		}
+		return fmt.Errorf("no backup with version %d", p.Version)
+	}
+
+	discoverSpeakers(tConfig.Global, p.DiscoveryTimeout)
+	switch {
+	case p.Backup:
+		b, added, err := d.Backup()
+		if err != nil {
+			return err
+		}
+		if !added {
+			fmt.Printf("Presets unchanged since version %d\n", b.Version)
+			return nil
+		}
+		fmt.Printf("Stored the presets of %d speakers as version %d\n", len(b.Speakers), b.Version)
+		return nil
+	case len(p.Push) > 0:
+		to := p.Push
+		if slices.Contains(to, "all") {
+			to = nil
+			for _, sp := range d.Current() {
+				if sp.Name != p.From {
+					to = append(to, sp.Name)
+				}
+			}
+		}
+		changed, err := d.Push(to, p.From, p.Version)
+		names := make([]string, 0, len(changed))
+		for n := range changed {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Printf("%s: %d presets changed\n", n, changed[n])
+		}
+		return err
+	}
+	return printPresets(os.Stdout, d.Current())
+}
+
+// printPresets writes a table of the presets of the speakers. Presets differing between the
+// speakers are marked with *.
+func printPresets(w io.Writer, speakers []presets.SpeakerPresets) error {
+	if len(speakers) == 0 {
+		fmt.Fprintln(w, "No presets found")
+		return nil
+	}
+	differences := presets.Differences(speakers)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "PRESET")
+	for _, sp := range speakers {
+		fmt.Fprintf(tw, "\t%s", sp.Name)
+	}
+	fmt.Fprintln(tw)
+	for id := 1; id <= presets.Slots; id++ {
+		mark := " "
+		if slices.Contains(differences, id) {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%d%s", id, mark)
+		for _, sp := range speakers {
+			fmt.Fprintf(tw, "\t%s", sp.Slot(id))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// printBackups writes a table of the backups, oldest first
+func printBackups(w io.Writer, backups []presets.Backup) error {
+	if len(backups) == 0 {
+		fmt.Fprintln(w, "No backups stored. Use --backup")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tTAKEN\tSPEAKERS")
+	for _, b := range backups {
+		var names []string
+		for _, sp := range b.Speakers {
+			names = append(names, sp.Name)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%v\n", b.Version, b.Taken.Format("2006-01-02 15:04"), names)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configPollInterval is the interval in which the config file is checked for modifications
+const configPollInterval = 5 * time.Second
+
+// reloader rebuilds the hosted plugins whenever the config file changes or SIGHUP is received
+type reloader struct {
+	path    string
+	host    *host
+	global  global
+	modTime time.Time
+}
+
+// newReloader creates a reloader for the config file at path, whose global section
+// is already running.
+func newReloader(path string, h *host, g global) *reloader {
+	r := &reloader{
+		path:   path,
+		host:   h,
+		global: g,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	return r
+}
+
+// watch reloads the configuration on SIGHUP and on modification of the config file
+// until ctx is done.
+func (r *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infof("Received SIGHUP. Reloading %s\n", r.path)
+			r.reload()
+		case <-ticker.C:
+			if !r.modified() {
+				continue
+			}
+			log.Infof("%s modified. Reloading\n", r.path)
+			r.reload()
+		}
+	}
+}
+
+// modified returns true if the config file has been modified since it has been read last
+func (r *reloader) modified() bool {
+	fi, err := os.Stat(r.path)
+	return err == nil && fi.ModTime().After(r.modTime)
+}
+
+// reload parses the config file and applies the plugin sections to the host. If the file can't
+// be parsed, the running configuration is kept.
+func (r *reloader) reload() bool {
+	if fi, err := os.Stat(r.path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	tConfig, _, err := readConfig(r.path)
+	if err != nil {
+		log.Errorf("Reloading %s failed. Keeping running configuration. %v\n", r.path, err)
+		return false
+	}
+
+	if !reflect.DeepEqual(tConfig.Global, r.global) {
+		log.Warnln("Changes of the [global] section require a restart. Ignoring them.")
+	}
+
+	r.host.apply(tConfig.Plugins).log()
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("[logger]\nspeakers = [\"Office\"]\n")
+	h := newHost(context.Background())
+	r := newReloader(path, h, defaultGlobal)
+	if !r.reload() || len(h.Plugins()) != 1 {
+		t.Fatalf("reload() of valid config failed")
+	}
+	running := h.Plugins()[0]
+
+	write("[logger\nspeakers = [\"Office\"]\n")
+	if r.reload() {
+		t.Errorf("reload() of invalid config succeeded")
+	}
+	if pl := h.Plugins(); len(pl) != 1 || pl[0] != running || !running.IsEnabled() {
+		t.Errorf("reload() of invalid config changed running plugins")
+	}
+}
+
+func TestReloader_modified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[logger]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(path, newHost(context.Background()), defaultGlobal)
+	if r.modified() {
+		t.Errorf("modified() of the file read")
+	}
+
+	// edited and reloaded by SIGHUP before the next poll
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !r.modified() {
+		t.Errorf("modified() of the edited file = false")
+	}
+	r.reload()
+	if r.modified() {
+		t.Errorf("modified() after reload() = true, the poll would reload again")
+	}
+}
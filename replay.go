@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-automation/plugins/recorder"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// replayCmd feeds a recording of the recorder plugin through the configured plugins
+type replayCmd struct {
+	File  string  `opts:"mode=arg" help:"recording to replay"`
+	Speed float64 `help:"Replay speed relative to the original timing, e.g. 10 for ten times as fast. As fast as possible if 0"`
+}
+
+// Run replays the recording with the plugins configured in the config file given by --config
+func (r *replayCmd) Run() error {
+	if r.Speed < 0 {
+		return fmt.Errorf("speed %v must not be negative", r.Speed)
+	}
+
+	tConfig, _, err := readConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// replayed updates must not be recorded again
+	var instances []*plugins.Instance
+	for _, inst := range tConfig.Plugins {
+		if inst.Section == "recorder" {
+			log.Infof("Not replaying to [%s]\n", inst.ID())
+			continue
+		}
+		// replays are as fast as the plugins, no update is dropped
+		inst.Supervision.Drop = plugins.Block
+		instances = append(instances, inst)
+	}
+
+	h := newHost(ctx)
+	h.apply(instances)
+	defer h.shutdown(stopTimeout)
+
+	log.Infof("Replaying %s with speed %v\n", r.File, r.Speed)
+	n, err := replay(ctx, f, h, r.Speed)
+	log.Infof("Replayed %d updates\n", n)
+	return err
+}
+
+// replay parses every recorded update with soundtouch.NewUpdate and executes p with it on behalf
+// of a speaker that has the recorded name and device ID. Updates are delayed by the recorded
+// time between them divided by speed. speed 0 replays without delay. replay returns the number
+// of updates executed.
+func replay(ctx context.Context, r io.Reader, p soundtouch.Plugin, speed float64) (int, error) {
+	var n int
+	var last time.Time
+	err := recorder.Read(r, func(rec recorder.Record) error {
+		if speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			select {
+			case <-time.After(time.Duration(float64(rec.Time.Sub(last)) / speed)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		last = rec.Time
+
+		update, err := soundtouch.NewUpdate([]byte(rec.Raw))
+		if err == nil && update.Value == nil {
+			err = fmt.Errorf("unknown message")
+		}
+		if err != nil {
+			log.Warnf("Skipping %s of %s recorded at %v. %v\n", rec.Type, rec.Speaker, rec.Time, err)
+			return nil
+		}
+		if update.DeviceID == "" {
+			update.DeviceID = rec.DeviceID
+		}
+		speaker := soundtouch.Speaker{DeviceInfo: soundtouch.Info{Name: rec.Speaker, DeviceID: rec.DeviceID}}
+
+		log.Debugf("Replaying %s of %s recorded at %v\n", rec.Type, rec.Speaker, rec.Time)
+		p.Execute(p.Name(), *update, speaker)
+		n++
+		return ctx.Err()
+	})
+	return n, err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// executions records the speakers a plugin has been executed for
+type executions struct {
+	*host
+	speakers []string
+}
+
+func (e *executions) Execute(pluginName string, update soundtouch.Update, speaker soundtouch.Speaker) {
+	e.speakers = append(e.speakers, speaker.Name()+"/"+update.DeviceID)
+}
+
+const (
+	nowPlayingOffice = `<updates deviceID=\"A0F6FD4E8B31\"><nowPlayingUpdated><nowPlaying deviceID=\"A0F6FD4E8B31\" source=\"STANDBY\"><ContentItem source=\"STANDBY\" isPresetable=\"false\" /></nowPlaying></nowPlayingUpdated></updates>`
+	volumeKitchen    = `<updates deviceID=\"689E19B8BB8A\"><volumeUpdated><volume><targetvolume>20</targetvolume><actualvolume>20</actualvolume><muteenabled>false</muteenabled></volume></volumeUpdated></updates>`
+	volumeOffice     = `<updates deviceID=\"A0F6FD4E8B31\"><volumeUpdated><volume><targetvolume>30</targetvolume><actualvolume>30</actualvolume><muteenabled>false</muteenabled></volume></volumeUpdated></updates>`
+)
+
+var recording = `{"time":"2026-01-10T07:00:00Z","deviceID":"A0F6FD4E8B31","speaker":"Office","type":"NowPlaying","raw":"` + nowPlayingOffice + `"}
+{"time":"2026-01-10T07:00:00.1Z","deviceID":"A0F6FD4E8B31","speaker":"Office","type":"Unknown","raw":"<unknown/>"}
+{"time":"2026-01-10T07:00:00.2Z","deviceID":"689E19B8BB8A","speaker":"Kitchen","type":"Volume","raw":"` + volumeKitchen + `"}
+{"time":"2026-01-10T07:00:00.4Z","deviceID":"A0F6FD4E8B31","speaker":"Office","type":"Volume","raw":"` + volumeOffice + `"}
+`
+
+func Test_replay(t *testing.T) {
+	tests := []struct {
+		name     string
+		speed    float64
+		min, max time.Duration
+	}{
+		{"original timing", 1, 400 * time.Millisecond, 2 * time.Second},
+		{"accelerated", 4, 100 * time.Millisecond, 350 * time.Millisecond},
+		{"without delay", 0, 0, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &executions{host: &host{}}
+			started := time.Now()
+			n, err := replay(context.Background(), strings.NewReader(recording), e, tt.speed)
+			elapsed := time.Since(started)
+			if err != nil {
+				t.Fatalf("replay() error = %v", err)
+			}
+
+			want := []string{"Office/A0F6FD4E8B31", "Kitchen/689E19B8BB8A", "Office/A0F6FD4E8B31"}
+			if n != 3 || !reflect.DeepEqual(e.speakers, want) {
+				t.Errorf("replay() = %d, executed %v, want %v", n, e.speakers, want)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("replay() took %v, want within %v..%v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func Test_replay_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &executions{host: &host{}}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	n, err := replay(ctx, strings.NewReader(recording), e, 1)
+	if err == nil || n != 1 {
+		t.Errorf("replay() = %d, %v, want 1 and cancellation", n, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/scenes"
+)
+
+// sceneCmd lists, captures, restores and deletes the scenes of the scenes plugin
+type sceneCmd struct {
+	Capture          string        `help:"name of the scene the state of all speakers is captured as"`
+	Restore          string        `help:"name of the scene to restore"`
+	Delete           string        `help:"name of the scene to delete"`
+	DiscoveryTimeout time.Duration `help:"Time to wait for speakers before capturing or restoring"`
+}
+
+// Run lists the scenes stored in the file of the [scenes] section of the config file given by
+// --config, or captures, restores or deletes a scene. Speakers are discovered as configured in
+// the [global] section.
+func (s *sceneCmd) Run() error {
+	given := 0
+	for _, n := range []string{s.Capture, s.Restore, s.Delete} {
+		if n != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return fmt.Errorf("only one of --capture, --restore and --delete may be given")
+	}
+
+	tConfig, _, err := readConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	var config scenes.Config
+	for _, inst := range tConfig.Plugins {
+		if c, ok := inst.Config.(*scenes.Config); ok {
+			config = *c
+		}
+	}
+	d := scenes.NewScenes(config)
+
+	switch {
+	case s.Delete != "":
+		if err := d.Delete(s.Delete); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted scene %s\n", s.Delete)
+		return nil
+	case s.Capture != "":
+		discoverSpeakers(tConfig.Global, s.DiscoveryTimeout)
+		sc, err := d.Capture(s.Capture)
+		if err != nil {
+			return err
+		}
+		fmt.Print(sc)
+		return nil
+	case s.Restore != "":
+		discoverSpeakers(tConfig.Global, s.DiscoveryTimeout)
+		if err := d.Restore(s.Restore); err != nil {
+			return err
+		}
+		fmt.Printf("Restored scene %s\n", s.Restore)
+		return nil
+	}
+
+	list, err := d.Scenes()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("No scenes captured. Use --capture name")
+	}
+	for _, sc := range list {
+		fmt.Print(sc)
+	}
+	return nil
+}
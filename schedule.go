@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/scheduler"
+)
+
+// scheduleCmd lists the jobs of the scheduler plugin and skips their next runs
+type scheduleCmd struct {
+	Skip string `help:"name of the job whose next run is skipped once"`
+}
+
+// Run lists the jobs configured in the config file given by --config, or skips the next run of
+// a job. Skips are recorded in the state file of the scheduler, where a running daemon picks
+// them up.
+func (s *scheduleCmd) Run() error {
+	tConfig, _, err := readConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	var configs []*scheduler.Config
+	for _, inst := range tConfig.Plugins {
+		if c, ok := inst.Config.(*scheduler.Config); ok {
+			configs = append(configs, c)
+		}
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("%s: no [scheduler] configured", conf.Config)
+	}
+
+	now := time.Now()
+	if s.Skip != "" {
+		var errs []string
+		for _, c := range configs {
+			next, err := c.SkipOnce(s.Skip, now)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			fmt.Printf("Skipping %s at %s\n", s.Skip, next.Format(time.RFC1123))
+			return nil
+		}
+		return fmt.Errorf("can't skip %s: %s", s.Skip, strings.Join(errs, "; "))
+	}
+	return printSchedules(os.Stdout, configs, now)
+}
+
+// printSchedules writes a table of the jobs ordered by their next run
+func printSchedules(w io.Writer, configs []*scheduler.Config, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tCRON\tNEXT RUN\tACTION")
+	for _, c := range configs {
+		schedules, err := c.Schedules(now)
+		if err != nil {
+			return err
+		}
+		for _, s := range schedules {
+			next := "never"
+			if !s.Next.IsZero() {
+				next = s.Next.Format("Mon 2006-01-02 15:04 MST")
+			}
+			if s.Skipped {
+				next += " (skipped)"
+			}
+			fmt.Fprintf(tw, "%s\t%s (%s)\t%s\t%s\n", s.Job, s.Cron, s.Zone, next, s.Action)
+		}
+	}
+	return tw.Flush()
+}
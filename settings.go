@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+)
+
+// envPrefix is prepended to every environment variable that overrides a config file value.
+// A value is addressed as SOUNDTOUCH_<SECTION>_<KEY>, e.g. SOUNDTOUCH_GLOBAL_INTERFACE or
+// SOUNDTOUCH_INFLUXDB_INFLUXURL.
+const envPrefix = "SOUNDTOUCH"
+
+// origin names the configuration layer an effective value has been taken from
+type origin string
+
+const (
+	fromDefault origin = "default"
+	fromFile    origin = "config file"
+	fromEnv     origin = "environment"
+	fromFlag    origin = "command-line flag"
+)
+
+// provenance records for every "section.key" the layer that defined its effective value.
+// Keys not contained have their default value.
+type provenance map[string]origin
+
+func (p provenance) of(section, key string) origin {
+	if o, ok := p[section+"."+key]; ok {
+		return o
+	}
+	return fromDefault
+}
+
+func (p provenance) set(section, key string, o origin) {
+	p[section+"."+key] = o
+}
+
+// stringFlag is a command-line flag that remembers whether it has been set explicitly
+type stringFlag struct {
+	value string
+	set   bool
+}
+
+// Set implements opts.Setter
+func (f *stringFlag) Set(s string) error {
+	f.value, f.set = s, true
+	return nil
+}
+
+func (f stringFlag) String() string { return f.value }
+
+// intFlag is a command-line flag that remembers whether it has been set explicitly
+type intFlag struct {
+	value int
+	set   bool
+}
+
+// Set implements opts.Setter
+func (f *intFlag) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	f.value, f.set = v, true
+	return nil
+}
+
+func (f intFlag) String() string { return strconv.Itoa(f.value) }
+
+// loadConfig resolves the configuration layers defaults < config file < environment variables
+// for the global section and all plugin sections. tConfig is expected to carry the defaults already.
+// The plugin sections are validated once the environment variables have been applied.
+func loadConfig(buf []byte, tConfig *tomlConfig) (provenance, error) {
+	prov := provenance{}
+
+	tbl, err := toml.Parse(buf)
+	if err != nil {
+		return prov, err
+	}
+
+	// plugins.Decode strips alias, supervisor and filter from the tables, so the keys are taken
+	// before decoding
+	keys := map[*ast.Table][]string{}
+	for _, field := range tbl.Fields {
+		switch t := field.(type) {
+		case *ast.Table:
+			keys[t] = fileKeys(t)
+		case []*ast.Table:
+			for _, st := range t {
+				keys[st] = fileKeys(st)
+			}
+		}
+	}
+
+	for name, field := range tbl.Fields {
+		if name == "global" {
+			gt, ok := field.(*ast.Table)
+			if !ok {
+				return prov, fmt.Errorf("global is not a section")
+			}
+			if err := toml.UnmarshalTable(gt, &tConfig.Global); err != nil {
+				return prov, err
+			}
+			continue
+		}
+		instances, err := plugins.Decode(name, field)
+		if err != nil {
+			return prov, err
+		}
+		tConfig.Plugins = append(tConfig.Plugins, instances...)
+	}
+	sort.Slice(tConfig.Plugins, func(i, j int) bool { return tConfig.Plugins[i].Line < tConfig.Plugins[j].Line })
+
+	for _, s := range sections(tConfig, tbl) {
+		for _, key := range keys[s.table] {
+			prov.set(s.name, key, fromFile)
+		}
+		if err := overlayEnv(s.name, s.value, prov); err != nil {
+			return prov, err
+		}
+		if s.inst == nil {
+			continue
+		}
+		if err := s.inst.Validate(); err != nil {
+			return prov, err
+		}
+	}
+	return prov, nil
+}
+
+// fileKeys returns all keys of tbl, those of nested tables prefixed by the table name
+func fileKeys(tbl *ast.Table) []string {
+	var keys []string
+	for key, f := range tbl.Fields {
+		if st, ok := f.(*ast.Table); ok {
+			for _, k := range fileKeys(st) {
+				keys = append(keys, key+"."+k)
+			}
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// applyFlags overrides the global section with the explicitly set command-line flags
+func applyFlags(c config, g *global, prov provenance) {
+	if c.Interface.set {
+		g.Interface = c.Interface.value
+		prov.set("global", "interface", fromFlag)
+	}
+	if c.NoOfSoundtouchSystems.set {
+		g.NoOfSoundtouchSystems = c.NoOfSoundtouchSystems.value
+		prov.set("global", "no_of_soundtouch_systems", fromFlag)
+	}
+	if len(c.StaticSpeakers) > 0 {
+		g.StaticSpeakers = c.StaticSpeakers
+		prov.set("global", "static_speakers", fromFlag)
+	}
+}
+
+// section is a configured section of the toml file together with its decoded value
+// name identifies the section, i.e. section or section.alias
+// header is the toml table header
+// table is the section as read from the config file, if any
+// inst is the plugin instance configured by the section, nil for the global section
+type section struct {
+	name   string
+	header string
+	value  reflect.Value
+	table  *ast.Table
+	inst   *plugins.Instance
+}
+
+// sections returns the global section followed by all configured plugin sections
+func sections(tConfig *tomlConfig, tbl *ast.Table) []section {
+	s := []section{{
+		name:   "global",
+		header: "[global]",
+		value:  reflect.ValueOf(&tConfig.Global).Elem(),
+	}}
+	if tbl != nil {
+		s[0].table, _ = tbl.Fields["global"].(*ast.Table)
+	}
+
+	for _, inst := range tConfig.Plugins {
+		header := fmt.Sprintf("[%s]", inst.Section)
+		if inst.Alias != "" {
+			header = fmt.Sprintf("[[%s]]", inst.Section)
+		}
+		s = append(s, section{
+			name:   inst.ID(),
+			header: header,
+			value:  reflect.ValueOf(inst.Config).Elem(),
+			table:  inst.Table,
+			inst:   inst,
+		})
+	}
+	return s
+}
+
+// overlayEnv overrides every field of v for which an environment variable is set
+func overlayEnv(sectionName string, v reflect.Value, prov provenance) error {
+	if v.Kind() != reflect.Struct {
+		// sections keyed by user defined names (e.g. autoOff) can't be addressed
+		return nil
+	}
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+		if sf.Anonymous {
+			if err := overlayEnv(sectionName, v.Field(i), prov); err != nil {
+				return err
+			}
+			continue
+		}
+		key := tomlKey(sf)
+		if key == "-" {
+			continue
+		}
+		name := envName(sectionName, key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(v.Field(i), s); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		prov.set(sectionName, key, fromEnv)
+	}
+	return nil
+}
+
+// envName returns the environment variable addressing key in section
+func envName(section, key string) string {
+	r := strings.NewReplacer("-", "_", ".", "_")
+	return strings.ToUpper(r.Replace(strings.Join([]string{envPrefix, section, key}, "_")))
+}
+
+// tomlKey returns the key a struct field is configured with
+func tomlKey(sf reflect.StructField) string {
+	if tag := strings.Split(sf.Tag.Get("toml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(sf.Name)
+}
+
+// setFromString converts s into the type of fv. Lists are given comma separated.
+func setFromString(fv reflect.Value, s string) error {
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		parts := []string{}
+		if strings.TrimSpace(s) != "" {
+			parts = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(fv.Type(), 0, len(parts))
+		for _, p := range parts {
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := setFromString(elem, strings.TrimSpace(p)); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		fv.Set(slice)
+	default:
+		return fmt.Errorf("can't set %v from environment", fv.Type())
+	}
+	return nil
+}
+
+// printEffectiveConfig writes the resolved configuration in toml syntax. Each value is annotated
+// with the layer it has been taken from.
+func printEffectiveConfig(w io.Writer, tConfig *tomlConfig, prov provenance) {
+	for _, s := range sections(tConfig, nil) {
+		fmt.Fprintln(w, s.header)
+		if s.inst != nil && s.inst.Alias != "" {
+			fmt.Fprintf(w, "alias = %q  # %s\n", s.inst.Alias, prov.of(s.name, "alias"))
+		}
+		printSection(w, s.name, s.value, prov)
+		if s.inst != nil {
+			printSubSection(w, s, "supervisor", &s.inst.Supervision, prov)
+			printSubSection(w, s, "filter", &s.inst.Filter, prov)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// printSubSection writes the supervisor or filter sub-table v of plugin section s, if it differs
+// from its zero value or has been configured
+func printSubSection(w io.Writer, s section, key string, v interface{}, prov provenance) {
+	rv := reflect.ValueOf(v).Elem()
+	configured := false
+	for k := range prov {
+		configured = configured || strings.HasPrefix(k, s.name+"."+key+".")
+	}
+	if rv.IsZero() && !configured {
+		return
+	}
+	fmt.Fprintf(w, "  [%s.%s]\n", s.inst.Section, key)
+	printSection(w, s.name+"."+key, rv, prov)
+}
+
+func printSection(w io.Writer, sectionName string, v reflect.Value, prov provenance) {
+	if v.Kind() == reflect.Map {
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			fmt.Fprintf(w, "  [%s.%s]\n", sectionName, k.String())
+			printSection(w, sectionName+"."+k.String(), v.MapIndex(k), prov)
+		}
+		return
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if sf.Anonymous {
+			printSection(w, sectionName, v.Field(i), prov)
+			continue
+		}
+		key := tomlKey(sf)
+		if sf.PkgPath != "" || key == "-" {
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s  # %s\n", key, formatValue(v.Field(i)), prov.of(sectionName, key))
+	}
+}
+
+// formatValue renders v as toml value
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		parts := make([]string, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			parts[i] = formatValue(v.Index(i))
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", v.Interface())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins/influxconnector"
+	"github.com/theovassiliou/soundtouch-automation/plugins/logger"
+)
+
+const layeredConfig = `
+[global]
+interface="en1"
+no_of_soundtouch_systems=4
+
+[influxDB]
+influxURL = "http://localhost:8086"
+database = "soundtouch"
+`
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	t.Setenv("SOUNDTOUCH_GLOBAL_NO_OF_SOUNDTOUCH_SYSTEMS", "5")
+	t.Setenv("SOUNDTOUCH_INFLUXDB_INFLUXURL", "http://influxdb:8086")
+	t.Setenv("SOUNDTOUCH_INFLUXDB_SPEAKERS", "Office, Kitchen")
+
+	tConfig := tomlConfig{Global: defaultGlobal}
+	prov, err := loadConfig([]byte(layeredConfig), &tConfig)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if len(tConfig.Plugins) != 1 {
+		t.Fatalf("loadConfig() got %d plugin sections, want 1", len(tConfig.Plugins))
+	}
+	influx := tConfig.Plugins[0].Config.(*influxconnector.Config)
+
+	c := config{Interface: stringFlag{value: defaultGlobal.Interface}}
+	c.NoOfSoundtouchSystems.Set("7")
+	applyFlags(c, &tConfig.Global, prov)
+
+	tests := []struct {
+		section, key string
+		got, want    interface{}
+		origin       origin
+	}{
+		{"global", "interface", tConfig.Global.Interface, "en1", fromFile},
+		{"global", "no_of_soundtouch_systems", tConfig.Global.NoOfSoundtouchSystems, 7, fromFlag},
+		{"global", "static_speakers", len(tConfig.Global.StaticSpeakers), 0, fromDefault},
+		{"influxDB", "influxURL", influx.InfluxURL, "http://influxdb:8086", fromEnv},
+		{"influxDB", "database", influx.Database, "soundtouch", fromFile},
+		{"influxDB", "speakers", influx.Speakers, []string{"Office", "Kitchen"}, fromEnv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.section+"."+tt.key, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("value = %v, want %v", tt.got, tt.want)
+			}
+			if got := prov.of(tt.section, tt.key); got != tt.origin {
+				t.Errorf("origin = %v, want %v", got, tt.origin)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_InvalidEnv(t *testing.T) {
+	t.Setenv("SOUNDTOUCH_GLOBAL_NO_OF_SOUNDTOUCH_SYSTEMS", "many")
+
+	tConfig := tomlConfig{Global: defaultGlobal}
+	if _, err := loadConfig([]byte(layeredConfig), &tConfig); err == nil {
+		t.Errorf("loadConfig() expected error for invalid environment variable")
+	}
+}
+
+func TestLoadConfig_ValidatesEnv(t *testing.T) {
+	t.Setenv("SOUNDTOUCH_SLEEPTIMER_DURATION", "soon")
+
+	tConfig := tomlConfig{Global: defaultGlobal}
+	_, err := loadConfig([]byte("[sleeptimer]\nduration = \"30m\"\n"), &tConfig)
+	if err == nil || !strings.Contains(err.Error(), "soon") {
+		t.Errorf("loadConfig() error = %v, want the invalid duration of the environment variable", err)
+	}
+}
+
+func TestPrintEffectiveConfig(t *testing.T) {
+	tConfig := tomlConfig{Global: defaultGlobal}
+	prov, err := loadConfig([]byte(layeredConfig), &tConfig)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	var b strings.Builder
+	printEffectiveConfig(&b, &tConfig, prov)
+
+	for _, want := range []string{
+		"[global]\n",
+		"interface = \"en1\"  # config file\n",
+		"static_speakers = []  # default\n",
+		"[influxDB]\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("printEffectiveConfig() missing %q in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestPrintEffectiveConfig_Stripped(t *testing.T) {
+	tConfig := tomlConfig{Global: defaultGlobal}
+	prov, err := loadConfig([]byte(`
+[[logger]]
+alias = "office"
+[logger.supervisor]
+queue = 4
+[logger.filter]
+speakers = ["Office"]
+`), &tConfig)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	var b strings.Builder
+	printEffectiveConfig(&b, &tConfig, prov)
+
+	for _, want := range []string{
+		"[[logger]]\nalias = \"office\"  # config file\n",
+		"  [logger.supervisor]\nqueue = 4  # config file\ndrop = \"\"  # default\n",
+		"  [logger.filter]\nspeakers = [\"Office\"]  # config file\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("printEffectiveConfig() missing %q in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestLoadConfig_Instances(t *testing.T) {
+	t.Setenv("SOUNDTOUCH_LOGGER_OFFICE_SPEAKERS", "Office")
+
+	tConfig := tomlConfig{Global: defaultGlobal}
+	_, err := loadConfig([]byte(`
+[[logger]]
+alias = "office"
+speakers = ["Kitchen"]
+
+[[logger]]
+ignore_messages = ["Volume"]
+`), &tConfig)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	var ids []string
+	for _, inst := range tConfig.Plugins {
+		ids = append(ids, inst.ID())
+	}
+	if want := []string{"logger.office", "logger.2"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("loadConfig() instances = %v, want %v", ids, want)
+	}
+	if got := tConfig.Plugins[0].Config.(*logger.Config).Speakers; !reflect.DeepEqual(got, []string{"Office"}) {
+		t.Errorf("loadConfig() speakers of logger.office = %v, want [Office]", got)
+	}
+	if got := tConfig.Plugins[0].Create().Name(); got != "Logger[office]" {
+		t.Errorf("Create().Name() = %v, want Logger[office]", got)
+	}
+}
+
+func TestLoadConfig_UnknownSection(t *testing.T) {
+	tConfig := tomlConfig{Global: defaultGlobal}
+	if _, err := loadConfig([]byte("[unknown]\nkey = 1\n"), &tConfig); err == nil {
+		t.Errorf("loadConfig() expected error for unknown section")
+	}
+}
+
+func Test_envName(t *testing.T) {
+	tests := []struct {
+		section, key, want string
+	}{
+		{"global", "interface", "SOUNDTOUCH_GLOBAL_INTERFACE"},
+		{"influxDB", "influxURL", "SOUNDTOUCH_INFLUXDB_INFLUXURL"},
+		{"telegram", "apiKey", "SOUNDTOUCH_TELEGRAM_APIKEY"},
+		{"logger", "ignore_messages", "SOUNDTOUCH_LOGGER_IGNORE_MESSAGES"},
+	}
+	for _, tt := range tests {
+		if got := envName(tt.section, tt.key); got != tt.want {
+			t.Errorf("envName(%v, %v) = %v, want %v", tt.section, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+)
+
+// simulateCmd emulates SoundTouch devices on the local machine
+type simulateCmd struct {
+	Script   string   `help:"script describing the simulated speakers and their state changes"`
+	Speakers []string `help:"names of the speakers to simulate, if no script is given"`
+}
+
+// Run simulates the speakers until a termination signal is received. Speakers without an
+// address are assigned 127.0.0.1, 127.0.0.2, ... and listen on the ports of a real device.
+func (s *simulateCmd) Run() error {
+	var script simulator.Script
+	if s.Script != "" {
+		buf, err := os.ReadFile(s.Script)
+		if err != nil {
+			return err
+		}
+		if script, err = simulator.ParseScript(buf); err != nil {
+			return fmt.Errorf("%s: %v", s.Script, err)
+		}
+	} else {
+		if len(s.Speakers) == 0 {
+			s.Speakers = []string{"Simulator"}
+		}
+		for _, name := range s.Speakers {
+			script.Speakers = append(script.Speakers, simulator.SpeakerScript{Name: name})
+		}
+	}
+
+	var ips []string
+	for i := range script.Speakers {
+		sp := &script.Speakers[i]
+		if sp.IP == "" {
+			sp.IP = fmt.Sprintf("127.0.0.%d", i+1)
+		}
+		if sp.HTTPPort == 0 {
+			sp.HTTPPort = simulator.HTTPPort
+		}
+		if sp.WebSocketPort == 0 {
+			sp.WebSocketPort = simulator.WebSocketPort
+		}
+		ips = append(ips, fmt.Sprintf("%q", sp.IP))
+	}
+
+	n := simulator.NewNetwork()
+	defer n.Close()
+	if err := script.Start(n); err != nil {
+		return err
+	}
+	log.Infof("Simulating %d speakers. Configure static_speakers = [%s]\n", len(script.Speakers), strings.Join(ips, ", "))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	script.Run(ctx, n)
+
+	<-ctx.Done()
+	log.Infoln("Received termination signal. Shutting down.")
+	return nil
+}
@@ -0,0 +1,607 @@
+// Package simulator emulates SoundTouch devices on the local machine. A simulated device serves
+// the HTTP API on its HTTP port and sends updates over a websocket on its websocket port, like
+// a real device does on port 8090 and 8080. Every command a device receives is recorded, so
+// that tests can assert on what a plugin sent.
+package simulator
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// The ports of a real device
+const (
+	HTTPPort      = 8090
+	WebSocketPort = 8080
+)
+
+// Config describes a simulated device
+// Name the name of the device
+// DeviceID the device ID, derived from the name if empty
+// Type the product type, "SoundTouch 10" if empty
+// IP the address the device listens on, 127.0.0.1 if empty
+// HTTPPort the port of the HTTP API, random if 0
+// WebSocketPort the port of the websocket, random if 0
+type Config struct {
+	Name          string
+	DeviceID      string
+	Type          string
+	IP            string
+	HTTPPort      int
+	WebSocketPort int
+}
+
+// Command is a request that changed the state of a device
+// Path the API endpoint, e.g. /key
+// Body the message sent
+type Command struct {
+	Time time.Time
+	Path string
+	Body string
+}
+
+// Device is a simulated SoundTouch device
+type Device struct {
+	Config
+	network *Network
+
+	mu          sync.Mutex
+	poweredOn   bool
+	nowPlaying  NowPlaying
+	lastPlaying NowPlaying
+	volume      Volume
+	zone        Zone
+	presets     [6]*Preset
+	commands    []Command
+	clients     map[*websocket.Conn]bool
+
+	httpServer *http.Server
+	wsServer   *http.Server
+	httpAddr   net.Addr
+	wsAddr     net.Addr
+}
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{"gabbo"},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+// newDevice creates a device that is switched off
+func newDevice(n *Network, c Config) *Device {
+	if c.DeviceID == "" {
+		c.DeviceID = strings.ToUpper(fmt.Sprintf("%x", sha1.Sum([]byte(c.Name)))[:12])
+	}
+	if c.Type == "" {
+		c.Type = "SoundTouch 10"
+	}
+	if c.IP == "" {
+		c.IP = "127.0.0.1"
+	}
+	d := &Device{
+		Config:  c,
+		network: n,
+		clients: map[*websocket.Conn]bool{},
+	}
+	d.nowPlaying = d.standby()
+	d.lastPlaying = NowPlaying{
+		DeviceID:    d.DeviceID,
+		Source:      "AUX",
+		ContentItem: ContentItem{Source: "AUX", SourceAccount: "AUX", IsPresetable: true},
+		PlayStatus:  "PLAY_STATE",
+	}
+	d.volume = Volume{DeviceID: d.DeviceID, TargetVolume: 20, ActualVolume: 20}
+	return d
+}
+
+// start listens on the configured ports
+func (d *Device) start() error {
+	hl, err := net.Listen("tcp", net.JoinHostPort(d.IP, strconv.Itoa(d.Config.HTTPPort)))
+	if err != nil {
+		return err
+	}
+	wl, err := net.Listen("tcp", net.JoinHostPort(d.IP, strconv.Itoa(d.Config.WebSocketPort)))
+	if err != nil {
+		hl.Close()
+		return err
+	}
+	d.httpAddr, d.wsAddr = hl.Addr(), wl.Addr()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", d.handleInfo)
+	mux.HandleFunc("/now_playing", d.handleNowPlaying)
+	mux.HandleFunc("/volume", d.handleVolume)
+	mux.HandleFunc("/getZone", d.handleGetZone)
+	mux.HandleFunc("/setZone", d.handleZone)
+	mux.HandleFunc("/addZoneSlave", d.handleZone)
+	mux.HandleFunc("/removeZoneSlave", d.handleZone)
+	mux.HandleFunc("/key", d.handleKey)
+	mux.HandleFunc("/select", d.handleSelect)
+	mux.HandleFunc("/presets", d.handlePresets)
+	mux.HandleFunc("/storePreset", d.handlePreset)
+	mux.HandleFunc("/removePreset", d.handlePreset)
+	d.httpServer = &http.Server{Handler: mux}
+	d.wsServer = &http.Server{Handler: http.HandlerFunc(d.handleWebSocket)}
+
+	go d.serve(d.httpServer, hl)
+	go d.serve(d.wsServer, wl)
+
+	d.logger().Infof("Simulating %s at http://%s, ws://%s\n", d.Type, d.httpAddr, d.wsAddr)
+	return nil
+}
+
+func (d *Device) serve(s *http.Server, l net.Listener) {
+	if err := s.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		d.logger().Errorf("Serving failed. %v\n", err)
+	}
+}
+
+// close stops serving and disconnects all websocket clients
+func (d *Device) close(ctx context.Context) error {
+	d.mu.Lock()
+	for c := range d.clients {
+		c.Close()
+		delete(d.clients, c)
+	}
+	d.mu.Unlock()
+	return errors.Join(d.httpServer.Shutdown(ctx), d.wsServer.Shutdown(ctx))
+}
+
+func (d *Device) logger() *log.Entry {
+	return log.WithFields(log.Fields{
+		"Simulator": d.Name,
+	})
+}
+
+// HTTPAddr returns the address of the HTTP API
+func (d *Device) HTTPAddr() string { return d.httpAddr.String() }
+
+// WebSocketAddr returns the address of the websocket
+func (d *Device) WebSocketAddr() string { return d.wsAddr.String() }
+
+// Speaker returns a speaker connected to the device
+func (d *Device) Speaker() *soundtouch.Speaker {
+	return &soundtouch.Speaker{
+		IP:           net.ParseIP(d.IP),
+		Port:         d.httpAddr.(*net.TCPAddr).Port,
+		BaseHTTPURL:  url.URL{Scheme: "http", Host: d.HTTPAddr()},
+		WebSocketURL: url.URL{Scheme: "ws", Host: d.WebSocketAddr()},
+		DeviceInfo: soundtouch.Info{
+			DeviceID: d.DeviceID,
+			Name:     d.Name,
+			Type:     d.Type,
+		},
+	}
+}
+
+// Commands returns the commands received so far
+func (d *Device) Commands() []Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Command(nil), d.commands...)
+}
+
+// Received returns the bodies of the commands received at path, e.g. /key
+func (d *Device) Received(path string) []string {
+	var bodies []string
+	for _, c := range d.Commands() {
+		if c.Path == path {
+			bodies = append(bodies, c.Body)
+		}
+	}
+	return bodies
+}
+
+// ResetCommands forgets the commands received so far
+func (d *Device) ResetCommands() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.commands = nil
+}
+
+// IsPoweredOn returns true if the device is not in standby
+func (d *Device) IsPoweredOn() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.poweredOn
+}
+
+// NowPlaying returns what the device is playing
+func (d *Device) NowPlaying() NowPlaying {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nowPlaying
+}
+
+// Volume returns the volume of the device
+func (d *Device) Volume() Volume {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.volume
+}
+
+// Zone returns the zone the device is member of
+func (d *Device) Zone() Zone {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.zone
+}
+
+// Play switches the device on and plays np. The device ID of np is set to the one of the device.
+func (d *Device) Play(np NowPlaying) {
+	np.DeviceID = d.DeviceID
+	if np.ContentItem.Source == "" {
+		np.ContentItem.Source = np.Source
+		np.ContentItem.SourceAccount = np.SourceAccount
+	}
+	if np.PlayStatus == "" {
+		np.PlayStatus = "PLAY_STATE"
+	}
+
+	d.mu.Lock()
+	d.poweredOn = true
+	d.nowPlaying, d.lastPlaying = np, np
+	d.mu.Unlock()
+	d.broadcast(updates{NowPlayingUpdated: &nowPlayingUpdated{NowPlaying: np}})
+}
+
+// PowerOn switches the device on. It resumes what it played before.
+func (d *Device) PowerOn() {
+	d.mu.Lock()
+	if d.poweredOn {
+		d.mu.Unlock()
+		return
+	}
+	d.poweredOn = true
+	d.nowPlaying = d.lastPlaying
+	np := d.nowPlaying
+	d.mu.Unlock()
+	d.broadcast(updates{NowPlayingUpdated: &nowPlayingUpdated{NowPlaying: np}})
+}
+
+// PowerOff switches the device to standby
+func (d *Device) PowerOff() {
+	d.mu.Lock()
+	if !d.poweredOn {
+		d.mu.Unlock()
+		return
+	}
+	d.poweredOn = false
+	d.nowPlaying = d.standby()
+	np := d.nowPlaying
+	d.mu.Unlock()
+	d.broadcast(updates{NowPlayingUpdated: &nowPlayingUpdated{NowPlaying: np}})
+}
+
+// SetPlayStatus changes the play status, e.g. to PAUSE_STATE, of what is played
+func (d *Device) SetPlayStatus(status string) {
+	d.mu.Lock()
+	if !d.poweredOn {
+		d.mu.Unlock()
+		return
+	}
+	d.nowPlaying.PlayStatus = status
+	d.lastPlaying = d.nowPlaying
+	np := d.nowPlaying
+	d.mu.Unlock()
+	d.broadcast(updates{NowPlayingUpdated: &nowPlayingUpdated{NowPlaying: np}})
+}
+
+// SetVolume sets the volume of the device, limited to 0..100
+func (d *Device) SetVolume(v int) {
+	v = max(0, min(100, v))
+	d.mu.Lock()
+	d.volume.TargetVolume, d.volume.ActualVolume = v, v
+	vol := d.volume
+	d.mu.Unlock()
+	d.broadcast(updates{VolumeUpdated: &volumeUpdated{Volume: vol}})
+}
+
+// Presets returns the presets stored, ordered by their ID
+func (d *Device) Presets() []Preset {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var presets []Preset
+	for _, p := range d.presets {
+		if p != nil {
+			presets = append(presets, *p)
+		}
+	}
+	return presets
+}
+
+// StorePreset stores ci as preset id 1..6. A nil ci removes the preset.
+func (d *Device) StorePreset(id int, ci *ContentItem) {
+	if id < 1 || id > len(d.presets) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ci == nil {
+		d.presets[id-1] = nil
+		return
+	}
+	now := time.Now().Unix()
+	p := &Preset{ID: id, CreatedOn: now, UpdatedOn: now, ContentItem: ci}
+	if old := d.presets[id-1]; old != nil {
+		p.CreatedOn = old.CreatedOn
+	}
+	d.presets[id-1] = p
+}
+
+// setZone replaces the zone of the device
+func (d *Device) setZone(z Zone) {
+	d.mu.Lock()
+	d.zone = z
+	d.mu.Unlock()
+	d.broadcast(updates{ZoneUpdated: &zoneUpdated{Zone: z}})
+}
+
+func (d *Device) standby() NowPlaying {
+	return NowPlaying{
+		DeviceID:    d.DeviceID,
+		Source:      "STANDBY",
+		ContentItem: ContentItem{Source: "STANDBY", IsPresetable: true},
+	}
+}
+
+// record stores a command
+func (d *Device) record(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.commands = append(d.commands, Command{Time: time.Now(), Path: r.URL.Path, Body: string(body)})
+	d.mu.Unlock()
+	d.logger().Debugf("Received %s %s\n", r.URL.Path, body)
+	return body, nil
+}
+
+// broadcast sends the update to all websocket clients
+func (d *Device) broadcast(u updates) {
+	u.DeviceID = d.DeviceID
+	msg, err := xml.Marshal(u)
+	if err != nil {
+		d.logger().Errorf("Marshalling update failed. %v\n", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for c := range d.clients {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+			c.Close()
+			delete(d.clients, c)
+		}
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(append([]byte(xml.Header), b...))
+}
+
+// status is the reply to commands
+type status struct {
+	XMLName xml.Name `xml:"status"`
+	Value   string   `xml:",chardata"`
+}
+
+func writeOK(w http.ResponseWriter, path string) {
+	writeXML(w, status{Value: path})
+}
+
+func (d *Device) handleInfo(w http.ResponseWriter, r *http.Request) {
+	writeXML(w, Info{
+		DeviceID: d.DeviceID,
+		Name:     d.Name,
+		Type:     d.Type,
+		NetworkInfo: []NetworkInfo{
+			{Type: "SCM", MacAddress: d.DeviceID, IPAddress: d.IP},
+		},
+	})
+}
+
+func (d *Device) handleNowPlaying(w http.ResponseWriter, r *http.Request) {
+	writeXML(w, d.NowPlaying())
+}
+
+func (d *Device) handleVolume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeXML(w, d.Volume())
+		return
+	}
+	body, err := d.record(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v struct {
+		Value int `xml:",chardata"`
+	}
+	if err := xml.Unmarshal(body, &v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.SetVolume(v.Value)
+	writeOK(w, r.URL.Path)
+}
+
+func (d *Device) handleGetZone(w http.ResponseWriter, r *http.Request) {
+	writeXML(w, d.Zone())
+}
+
+func (d *Device) handleZone(w http.ResponseWriter, r *http.Request) {
+	body, err := d.record(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var z Zone
+	if err := xml.Unmarshal(body, &z); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/setZone":
+		d.network.setZone(d, z.Members)
+	case "/addZoneSlave":
+		d.network.addZoneSlaves(d, z.Members)
+	case "/removeZoneSlave":
+		d.network.removeZoneSlaves(d, z.Members)
+	}
+	writeOK(w, r.URL.Path)
+}
+
+func (d *Device) handleKey(w http.ResponseWriter, r *http.Request) {
+	body, err := d.record(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var k Key
+	if err := xml.Unmarshal(body, &k); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// like a real device, act when the key is released
+	if k.State != "release" {
+		writeOK(w, r.URL.Path)
+		return
+	}
+	switch k.Value {
+	case "POWER":
+		if d.IsPoweredOn() {
+			d.PowerOff()
+		} else {
+			d.PowerOn()
+		}
+	case "PLAY":
+		d.SetPlayStatus("PLAY_STATE")
+	case "PAUSE":
+		d.SetPlayStatus("PAUSE_STATE")
+	case "STOP":
+		d.SetPlayStatus("STOP_STATE")
+	case "PLAY_PAUSE":
+		if d.NowPlaying().PlayStatus == "PLAY_STATE" {
+			d.SetPlayStatus("PAUSE_STATE")
+		} else {
+			d.SetPlayStatus("PLAY_STATE")
+		}
+	case "VOLUME_UP":
+		d.SetVolume(d.Volume().ActualVolume + 1)
+	case "VOLUME_DOWN":
+		d.SetVolume(d.Volume().ActualVolume - 1)
+	case "AUX_INPUT":
+		d.Play(NowPlaying{Source: "AUX", SourceAccount: "AUX"})
+	case "PRESET_1", "PRESET_2", "PRESET_3", "PRESET_4", "PRESET_5", "PRESET_6":
+		id, _ := strconv.Atoi(strings.TrimPrefix(k.Value, "PRESET_"))
+		d.mu.Lock()
+		p := d.presets[id-1]
+		d.mu.Unlock()
+		if p != nil && p.ContentItem != nil {
+			d.playContent(*p.ContentItem)
+		}
+	}
+	writeOK(w, r.URL.Path)
+}
+
+func (d *Device) handleSelect(w http.ResponseWriter, r *http.Request) {
+	body, err := d.record(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ci ContentItem
+	if err := xml.Unmarshal(body, &ci); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.playContent(ci)
+	writeOK(w, r.URL.Path)
+}
+
+// playContent plays ci as selected or stored in a preset
+func (d *Device) playContent(ci ContentItem) {
+	d.Play(NowPlaying{
+		Source:        ci.Source,
+		SourceAccount: ci.SourceAccount,
+		ContentItem:   ci,
+		StationName:   ci.ItemName,
+	})
+}
+
+func (d *Device) handlePresets(w http.ResponseWriter, r *http.Request) {
+	writeXML(w, Presets{Presets: d.Presets()})
+}
+
+func (d *Device) handlePreset(w http.ResponseWriter, r *http.Request) {
+	body, err := d.record(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var p Preset
+	if err := xml.Unmarshal(body, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.ID < 1 || p.ID > len(d.presets) {
+		http.Error(w, fmt.Sprintf("invalid preset id %d", p.ID), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Path == "/removePreset" {
+		d.StorePreset(p.ID, nil)
+	} else if p.ContentItem == nil {
+		http.Error(w, "no ContentItem", http.StatusBadRequest)
+		return
+	} else {
+		d.StorePreset(p.ID, p.ContentItem)
+	}
+	writeXML(w, Presets{Presets: d.Presets()})
+}
+
+func (d *Device) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		d.logger().Errorf("Upgrading to websocket failed. %v\n", err)
+		return
+	}
+	d.mu.Lock()
+	d.clients[c] = true
+	d.mu.Unlock()
+
+	// clients don't send anything. Reading detects when they are gone.
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			d.mu.Lock()
+			delete(d.clients, c)
+			d.mu.Unlock()
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package simulator
+
+import "encoding/xml"
+
+// The messages of the SoundTouch Web API as exchanged with a device
+
+// Info is returned by /info
+type Info struct {
+	XMLName     xml.Name      `xml:"info"`
+	DeviceID    string        `xml:"deviceID,attr"`
+	Name        string        `xml:"name"`
+	Type        string        `xml:"type"`
+	NetworkInfo []NetworkInfo `xml:"networkInfo"`
+}
+
+// NetworkInfo describes a network interface of a device
+type NetworkInfo struct {
+	Type       string `xml:"type,attr"`
+	MacAddress string `xml:"macAddress"`
+	IPAddress  string `xml:"ipAddress"`
+}
+
+// ContentItem identifies what is played. It is sent to /select.
+type ContentItem struct {
+	XMLName       xml.Name `xml:"ContentItem"`
+	Source        string   `xml:"source,attr"`
+	Type          string   `xml:"type,attr,omitempty"`
+	Location      string   `xml:"location,attr,omitempty"`
+	SourceAccount string   `xml:"sourceAccount,attr,omitempty"`
+	IsPresetable  bool     `xml:"isPresetable,attr"`
+	ItemName      string   `xml:"itemName,omitempty"`
+}
+
+// NowPlaying is returned by /now_playing
+type NowPlaying struct {
+	XMLName       xml.Name    `xml:"nowPlaying"`
+	DeviceID      string      `xml:"deviceID,attr"`
+	Source        string      `xml:"source,attr"`
+	SourceAccount string      `xml:"sourceAccount,attr,omitempty"`
+	ContentItem   ContentItem `xml:"ContentItem"`
+	Track         string      `xml:"track,omitempty"`
+	Artist        string      `xml:"artist,omitempty"`
+	Album         string      `xml:"album,omitempty"`
+	StationName   string      `xml:"stationName,omitempty"`
+	PlayStatus    string      `xml:"playStatus,omitempty"`
+	StreamType    string      `xml:"streamType,omitempty"`
+}
+
+// Volume is returned by /volume
+type Volume struct {
+	XMLName      xml.Name `xml:"volume"`
+	DeviceID     string   `xml:"deviceID,attr,omitempty"`
+	TargetVolume int      `xml:"targetvolume"`
+	ActualVolume int      `xml:"actualvolume"`
+	MuteEnabled  bool     `xml:"muteenabled"`
+}
+
+// Member is a device of a zone
+type Member struct {
+	IPAddress string `xml:"ipaddress,attr"`
+	DeviceID  string `xml:",chardata"`
+}
+
+// Zone is returned by /getZone and sent to /setZone, /addZoneSlave and /removeZoneSlave
+type Zone struct {
+	XMLName         xml.Name `xml:"zone"`
+	Master          string   `xml:"master,attr,omitempty"`
+	SenderIPAddress string   `xml:"senderIPAddress,attr,omitempty"`
+	SenderIsMaster  bool     `xml:"senderIsMaster,attr,omitempty"`
+	Members         []Member `xml:"member"`
+}
+
+// Preset is a content stored in one of the six preset slots of a device. It is sent to
+// /storePreset and, with the ID only, to /removePreset.
+type Preset struct {
+	XMLName     xml.Name     `xml:"preset"`
+	ID          int          `xml:"id,attr"`
+	CreatedOn   int64        `xml:"createdOn,attr,omitempty"`
+	UpdatedOn   int64        `xml:"updatedOn,attr,omitempty"`
+	ContentItem *ContentItem `xml:"ContentItem"`
+}
+
+// Presets is returned by /presets
+type Presets struct {
+	XMLName xml.Name `xml:"presets"`
+	Presets []Preset `xml:"preset"`
+}
+
+// Key is sent to /key
+type Key struct {
+	XMLName xml.Name `xml:"key"`
+	State   string   `xml:"state,attr"`
+	Sender  string   `xml:"sender,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+// updates wraps the messages sent over the websocket
+type updates struct {
+	XMLName                xml.Name                `xml:"updates"`
+	DeviceID               string                  `xml:"deviceID,attr"`
+	NowPlayingUpdated      *nowPlayingUpdated      `xml:"nowPlayingUpdated,omitempty"`
+	VolumeUpdated          *volumeUpdated          `xml:"volumeUpdated,omitempty"`
+	ZoneUpdated            *zoneUpdated            `xml:"zoneUpdated,omitempty"`
+	ConnectionStateUpdated *connectionStateUpdated `xml:"connectionStateUpdated,omitempty"`
+}
+
+type nowPlayingUpdated struct {
+	NowPlaying NowPlaying
+}
+
+type volumeUpdated struct {
+	Volume Volume
+}
+
+type zoneUpdated struct {
+	Zone Zone
+}
+
+type connectionStateUpdated struct {
+	State  string `xml:"state,attr"`
+	Up     bool   `xml:"up,attr"`
+	Signal string `xml:"signal,attr"`
+}
@@ -0,0 +1,181 @@
+package simulator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-golang"
+)
+
+// Network is a group of simulated devices. Zone commands sent to a master are applied to the
+// member devices of the network.
+type Network struct {
+	mu      sync.Mutex
+	devices []*Device
+}
+
+// NewNetwork creates a network without any devices
+func NewNetwork() *Network {
+	return &Network{}
+}
+
+// Add starts simulating a device with the configuration
+func (n *Network) Add(c Config) (*Device, error) {
+	d := newDevice(n, c)
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.devices = append(n.devices, d)
+	n.mu.Unlock()
+	return d, nil
+}
+
+// Devices returns the simulated devices in the order they have been added
+func (n *Network) Devices() []*Device {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*Device(nil), n.devices...)
+}
+
+// Device returns the device with the name or device ID, nil if unknown
+func (n *Network) Device(nameOrID string) *Device {
+	for _, d := range n.Devices() {
+		if d.Name == nameOrID || d.DeviceID == nameOrID {
+			return d
+		}
+	}
+	return nil
+}
+
+// Close stops simulating all devices
+func (n *Network) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, d := range n.Devices() {
+		errs = append(errs, d.close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// setZone makes master the master of a zone with the members. Members of a previous zone of
+// master are released.
+func (n *Network) setZone(master *Device, members []Member) {
+	for _, m := range master.Zone().Members {
+		if s := n.Device(m.DeviceID); s != nil && s != master {
+			s.setZone(Zone{})
+		}
+	}
+	n.applyZone(master, withMaster(master, members))
+}
+
+// addZoneSlaves adds the members to the zone of master
+func (n *Network) addZoneSlaves(master *Device, members []Member) {
+	all := withMaster(master, master.Zone().Members)
+	for _, m := range members {
+		if !contains(all, m.DeviceID) {
+			all = append(all, m)
+		}
+	}
+	n.applyZone(master, all)
+}
+
+// removeZoneSlaves removes the members from the zone of master. The zone is dissolved if
+// no slave is left.
+func (n *Network) removeZoneSlaves(master *Device, members []Member) {
+	var left []Member
+	for _, m := range master.Zone().Members {
+		if m.DeviceID == master.DeviceID || !contains(members, m.DeviceID) {
+			left = append(left, m)
+			continue
+		}
+		if s := n.Device(m.DeviceID); s != nil {
+			s.setZone(Zone{})
+		}
+	}
+	if len(left) <= 1 {
+		master.setZone(Zone{})
+		return
+	}
+	n.applyZone(master, left)
+}
+
+// applyZone sets the zone on master and all members. Members play what master plays.
+func (n *Network) applyZone(master *Device, members []Member) {
+	master.setZone(Zone{
+		Master:          master.DeviceID,
+		SenderIPAddress: master.IP,
+		SenderIsMaster:  true,
+		Members:         members,
+	})
+
+	np := master.NowPlaying()
+	for _, m := range members {
+		s := n.Device(m.DeviceID)
+		if s == nil || s == master {
+			continue
+		}
+		s.setZone(Zone{
+			Master:          master.DeviceID,
+			SenderIPAddress: master.IP,
+			Members:         members,
+		})
+		if master.IsPoweredOn() {
+			s.Play(np)
+		}
+	}
+}
+
+// withMaster returns the members with master as first member
+func withMaster(master *Device, members []Member) []Member {
+	all := []Member{{IPAddress: master.IP, DeviceID: master.DeviceID}}
+	for _, m := range members {
+		if m.DeviceID != master.DeviceID {
+			all = append(all, m)
+		}
+	}
+	return all
+}
+
+func contains(members []Member, deviceID string) bool {
+	for _, m := range members {
+		if m.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Known returns the speakers of the devices by device ID. With ByName and ByDeviceID the network
+// implements plugins.Speakers, so that plugins act on the simulated devices.
+func (n *Network) Known() map[string]*soundtouch.Speaker {
+	known := map[string]*soundtouch.Speaker{}
+	for _, d := range n.Devices() {
+		known[d.DeviceID] = d.Speaker()
+	}
+	return known
+}
+
+// ByName returns the speaker of the device with the name, nil if unknown
+func (n *Network) ByName(name string) *soundtouch.Speaker {
+	for _, d := range n.Devices() {
+		if d.Name == name {
+			return d.Speaker()
+		}
+	}
+	return nil
+}
+
+// ByDeviceID returns the speaker of the device with the device ID, nil if unknown
+func (n *Network) ByDeviceID(deviceID string) *soundtouch.Speaker {
+	for _, d := range n.Devices() {
+		if d.DeviceID == deviceID {
+			return d.Speaker()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/influxdata/toml"
+)
+
+// Script describes the simulated devices and how their state changes over time
+//
+//	[[speaker]]
+//	name = "Office"
+//	ip = "127.0.0.2"
+//
+//	  [[speaker.step]]
+//	  after = "5s"
+//	  source = "TUNEIN"
+//	  station_name = "SWR3"
+//	  stream_type = "RADIO_STREAMING"
+//
+//	  [[speaker.step]]
+//	  after = "1m"
+//	  power = "off"
+type Script struct {
+	Speakers []SpeakerScript `toml:"speaker"`
+}
+
+// SpeakerScript describes a simulated device
+// Repeat starts over with the first step after the last one
+type SpeakerScript struct {
+	Name          string `toml:"name"`
+	DeviceID      string `toml:"device_id"`
+	Type          string `toml:"type"`
+	IP            string `toml:"ip"`
+	HTTPPort      int    `toml:"http_port"`
+	WebSocketPort int    `toml:"websocket_port"`
+	Repeat        bool   `toml:"repeat"`
+	Steps         []Step `toml:"step"`
+}
+
+// Step is a change of the state of a device
+// After the time to wait since the previous step, e.g. "30s"
+// Power "on" or "off"
+// Source what to play, e.g. "TUNEIN". The other content fields are used only together with Source.
+// PlayStatus e.g. "PAUSE_STATE"
+// Volume the volume to set
+type Step struct {
+	After         string `toml:"after"`
+	Power         string `toml:"power"`
+	Source        string `toml:"source"`
+	SourceAccount string `toml:"source_account"`
+	Location      string `toml:"location"`
+	ItemName      string `toml:"item_name"`
+	Artist        string `toml:"artist"`
+	Album         string `toml:"album"`
+	Track         string `toml:"track"`
+	StationName   string `toml:"station_name"`
+	StreamType    string `toml:"stream_type"`
+	PlayStatus    string `toml:"play_status"`
+	Volume        *int   `toml:"volume"`
+}
+
+// ParseScript parses a script in toml syntax
+func ParseScript(buf []byte) (Script, error) {
+	var s Script
+	if err := toml.Unmarshal(buf, &s); err != nil {
+		return s, err
+	}
+	for i, sp := range s.Speakers {
+		if sp.Name == "" {
+			return s, fmt.Errorf("speaker %d has no name", i+1)
+		}
+		for j, st := range sp.Steps {
+			if _, err := st.delay(); err != nil {
+				return s, fmt.Errorf("speaker %s, step %d: %v", sp.Name, j+1, err)
+			}
+			if st.Power != "" && st.Power != "on" && st.Power != "off" {
+				return s, fmt.Errorf("speaker %s, step %d: power must be on or off", sp.Name, j+1)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Start adds a device for every speaker of the script to the network
+func (s Script) Start(n *Network) error {
+	for _, sp := range s.Speakers {
+		_, err := n.Add(Config{
+			Name:          sp.Name,
+			DeviceID:      sp.DeviceID,
+			Type:          sp.Type,
+			IP:            sp.IP,
+			HTTPPort:      sp.HTTPPort,
+			WebSocketPort: sp.WebSocketPort,
+		})
+		if err != nil {
+			return fmt.Errorf("speaker %s: %v", sp.Name, err)
+		}
+	}
+	return nil
+}
+
+// Run applies the steps of every speaker to its device of the network until all steps are done
+// or ctx is done
+func (s Script) Run(ctx context.Context, n *Network) {
+	done := make(chan struct{})
+	for _, sp := range s.Speakers {
+		go func(sp SpeakerScript) {
+			defer func() { done <- struct{}{} }()
+			if d := n.Device(sp.Name); d != nil {
+				sp.run(ctx, d)
+			}
+		}(sp)
+	}
+	for range s.Speakers {
+		<-done
+	}
+}
+
+func (sp SpeakerScript) run(ctx context.Context, d *Device) {
+	for {
+		for _, st := range sp.Steps {
+			delay, _ := st.delay()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			d.logger().Infof("Step %+v\n", st)
+			st.apply(d)
+		}
+		if !sp.Repeat || len(sp.Steps) == 0 {
+			return
+		}
+	}
+}
+
+func (st Step) delay() (time.Duration, error) {
+	if st.After == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(st.After)
+}
+
+// apply changes the state of d
+func (st Step) apply(d *Device) {
+	switch st.Power {
+	case "on":
+		d.PowerOn()
+	case "off":
+		d.PowerOff()
+	}
+	if st.Source != "" {
+		d.Play(NowPlaying{
+			Source:        st.Source,
+			SourceAccount: st.SourceAccount,
+			ContentItem: ContentItem{
+				Source:        st.Source,
+				SourceAccount: st.SourceAccount,
+				Location:      st.Location,
+				ItemName:      st.ItemName,
+				IsPresetable:  true,
+			},
+			Artist:      st.Artist,
+			Album:       st.Album,
+			Track:       st.Track,
+			StationName: st.StationName,
+			StreamType:  st.StreamType,
+			PlayStatus:  st.PlayStatus,
+		})
+	} else if st.PlayStatus != "" {
+		d.SetPlayStatus(st.PlayStatus)
+	}
+	if st.Volume != nil {
+		d.SetVolume(*st.Volume)
+	}
+}
@@ -0,0 +1,224 @@
+package simulator
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newNetwork(t *testing.T, names ...string) (*Network, []*Device) {
+	t.Helper()
+	n := NewNetwork()
+	t.Cleanup(func() { n.Close() })
+
+	var devices []*Device
+	for _, name := range names {
+		d, err := n.Add(Config{Name: name})
+		if err != nil {
+			t.Fatalf("Add(%s) error = %v", name, err)
+		}
+		devices = append(devices, d)
+	}
+	return n, devices
+}
+
+func get(t *testing.T, d *Device, path string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get("http://" + d.HTTPAddr() + path)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", path, err)
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s decoding error = %v", path, err)
+	}
+}
+
+func post(t *testing.T, d *Device, path, body string) {
+	t.Helper()
+	resp, err := http.Post("http://"+d.HTTPAddr()+path, "text/xml", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s error = %v", path, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s = %d", path, resp.StatusCode)
+	}
+}
+
+func pressKey(t *testing.T, d *Device, key string) {
+	t.Helper()
+	post(t, d, "/key", `<key state="press" sender="Gabbo">`+key+`</key>`)
+	post(t, d, "/key", `<key state="release" sender="Gabbo">`+key+`</key>`)
+}
+
+func TestDevice_API(t *testing.T) {
+	_, devices := newNetwork(t, "Office")
+	office := devices[0]
+
+	var info Info
+	get(t, office, "/info", &info)
+	if info.Name != "Office" || info.DeviceID != office.DeviceID {
+		t.Errorf("GET /info = %+v", info)
+	}
+
+	var np NowPlaying
+	get(t, office, "/now_playing", &np)
+	if np.Source != "STANDBY" {
+		t.Errorf("GET /now_playing source = %s, want STANDBY", np.Source)
+	}
+
+	pressKey(t, office, "POWER")
+	if !office.IsPoweredOn() {
+		t.Errorf("POWER key did not switch on")
+	}
+
+	post(t, office, "/select", `<ContentItem source="TUNEIN" location="/v1/playback/station/s24896" isPresetable="true"><itemName>SWR3</itemName></ContentItem>`)
+	get(t, office, "/now_playing", &np)
+	if np.Source != "TUNEIN" || np.ContentItem.Location != "/v1/playback/station/s24896" || np.PlayStatus != "PLAY_STATE" {
+		t.Errorf("GET /now_playing after /select = %+v", np)
+	}
+
+	post(t, office, "/volume", "<volume>35</volume>")
+	var v Volume
+	get(t, office, "/volume", &v)
+	if v.ActualVolume != 35 {
+		t.Errorf("GET /volume = %d, want 35", v.ActualVolume)
+	}
+
+	if got := office.Received("/key"); len(got) != 2 || !strings.Contains(got[1], "release") {
+		t.Errorf("Received(/key) = %v", got)
+	}
+	if got := len(office.Commands()); got != 4 {
+		t.Errorf("Commands() = %d, want 4", got)
+	}
+}
+
+func TestDevice_Presets(t *testing.T) {
+	_, devices := newNetwork(t, "Office")
+	office := devices[0]
+
+	post(t, office, "/storePreset", `<preset id="2"><ContentItem source="TUNEIN" location="/v1/playback/station/s24896" isPresetable="true"><itemName>SWR3</itemName></ContentItem></preset>`)
+	post(t, office, "/storePreset", `<preset id="5"><ContentItem source="AUX" sourceAccount="AUX" isPresetable="true"></ContentItem></preset>`)
+	post(t, office, "/removePreset", `<preset id="5"></preset>`)
+
+	var presets Presets
+	get(t, office, "/presets", &presets)
+	if len(presets.Presets) != 1 || presets.Presets[0].ID != 2 || presets.Presets[0].ContentItem.ItemName != "SWR3" {
+		t.Fatalf("GET /presets = %+v, want SWR3 as preset 2", presets)
+	}
+
+	pressKey(t, office, "PRESET_2")
+	if np := office.NowPlaying(); np.Source != "TUNEIN" || np.StationName != "SWR3" {
+		t.Errorf("PRESET_2 key plays %+v, want SWR3", np)
+	}
+}
+
+func TestDevice_Zones(t *testing.T) {
+	_, devices := newNetwork(t, "Office", "Kitchen", "Bathroom")
+	office, kitchen, bathroom := devices[0], devices[1], devices[2]
+	office.Play(NowPlaying{Source: "TUNEIN", StationName: "SWR3"})
+
+	member := func(d *Device) string {
+		return `<member ipaddress="` + d.IP + `">` + d.DeviceID + `</member>`
+	}
+	post(t, office, "/setZone", `<zone master="`+office.DeviceID+`">`+member(office)+member(kitchen)+`</zone>`)
+	post(t, office, "/addZoneSlave", `<zone master="`+office.DeviceID+`">`+member(bathroom)+`</zone>`)
+
+	var z Zone
+	get(t, kitchen, "/getZone", &z)
+	if z.Master != office.DeviceID || len(z.Members) != 3 {
+		t.Errorf("GET /getZone of slave = %+v", z)
+	}
+	if np := bathroom.NowPlaying(); np.StationName != "SWR3" {
+		t.Errorf("slave plays %+v, want what master plays", np)
+	}
+
+	post(t, office, "/removeZoneSlave", `<zone master="`+office.DeviceID+`">`+member(kitchen)+member(bathroom)+`</zone>`)
+	if len(office.Zone().Members) != 0 || len(kitchen.Zone().Members) != 0 {
+		t.Errorf("zone not dissolved: master %+v, slave %+v", office.Zone(), kitchen.Zone())
+	}
+}
+
+func TestDevice_WebSocket(t *testing.T) {
+	_, devices := newNetwork(t, "Office")
+	office := devices[0]
+
+	dialer := websocket.Dialer{Subprotocols: []string{"gabbo"}}
+	c, _, err := dialer.Dial("ws://"+office.WebSocketAddr()+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	// the device registers the client after the handshake
+	time.Sleep(20 * time.Millisecond)
+
+	office.SetVolume(42)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	want := `<updates deviceID="` + office.DeviceID + `"><volumeUpdated><volume deviceID="` + office.DeviceID + `"><targetvolume>42</targetvolume><actualvolume>42</actualvolume><muteenabled>false</muteenabled></volume></volumeUpdated></updates>`
+	if string(msg) != want {
+		t.Errorf("ReadMessage() =\n%s\nwant\n%s", msg, want)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s, err := ParseScript([]byte(`
+[[speaker]]
+name = "Office"
+
+  [[speaker.step]]
+  source = "TUNEIN"
+  station_name = "SWR3"
+  volume = 30
+
+  [[speaker.step]]
+  after = "10ms"
+  power = "off"
+`))
+	if err != nil {
+		t.Fatalf("ParseScript() error = %v", err)
+	}
+
+	n := NewNetwork()
+	defer n.Close()
+	if err := s.Start(n); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	office := n.Device("Office")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Run(ctx, n)
+
+	if office.IsPoweredOn() || office.Volume().ActualVolume != 30 {
+		t.Errorf("after Run() powered on %v, volume %d", office.IsPoweredOn(), office.Volume().ActualVolume)
+	}
+
+	office.PowerOn()
+	if np := office.NowPlaying(); np.StationName != "SWR3" {
+		t.Errorf("PowerOn() resumed %+v, want SWR3", np)
+	}
+}
+
+func TestParseScript_Invalid(t *testing.T) {
+	for _, script := range []string{
+		"[[speaker]]\nip = \"127.0.0.2\"\n",
+		"[[speaker]]\nname = \"Office\"\n[[speaker.step]]\nafter = \"soon\"\n",
+		"[[speaker]]\nname = \"Office\"\n[[speaker.step]]\npower = \"standby\"\n",
+	} {
+		if _, err := ParseScript([]byte(script)); err == nil {
+			t.Errorf("ParseScript(%q) expected error", script)
+		}
+	}
+}
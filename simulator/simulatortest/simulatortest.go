@@ -0,0 +1,74 @@
+// Package simulatortest provides helpers for tests of plugins: a network of simulated devices
+// closed when the test ends, a clock only advancing when told to and a table test of Validate.
+package simulatortest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theovassiliou/soundtouch-automation/simulator"
+)
+
+// Simulate starts a network simulating devices with the names. The network is closed when the
+// test ends.
+func Simulate(t testing.TB, names ...string) *simulator.Network {
+	t.Helper()
+	n := simulator.NewNetwork()
+	t.Cleanup(func() { n.Close() })
+	for _, name := range names {
+		if _, err := n.Add(simulator.Config{Name: name}); err != nil {
+			t.Fatalf("simulating %s: %v", name, err)
+		}
+	}
+	return n
+}
+
+// Clock is a clock for tests that only advances when told to
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock showing now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the time of the clock
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// ConfigTest is a configuration and the message of the error its Validate returns, empty if it
+// is valid
+type ConfigTest struct {
+	Name   string
+	Config interface{ Validate() error }
+	Want   string
+}
+
+// CheckValidate validates the configuration of every test
+func CheckValidate(t *testing.T, tests []ConfigTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got := ""
+			if err := tt.Config.Validate(); err != nil {
+				got = err.Error()
+			}
+			if got != tt.Want {
+				t.Errorf("Validate() = %q, want %q", got, tt.Want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/theovassiliou/soundtouch-automation/plugins"
+	"github.com/theovassiliou/soundtouch-golang"
+	"golang.org/x/exp/slices"
+)
+
+// validateCmd checks the config file without running any plugin. It exits with status 1 if
+// the config file contains problems.
+type validateCmd struct {
+	Discover         bool          `help:"Discover the speakers (or ask the static_speakers) and check the speaker names referenced by plugins"`
+	DiscoveryTimeout time.Duration `help:"Time to wait for speakers during discovery"`
+}
+
+// issue is a problem found in the config file
+// line the line in the config file, 0 if unknown
+// section the section the problem has been found in
+type issue struct {
+	line    int
+	section string
+	msg     string
+}
+
+func (i issue) String() string {
+	if i.line == 0 {
+		return fmt.Sprintf("[%s] %s", i.section, i.msg)
+	}
+	return fmt.Sprintf("line %d: [%s] %s", i.line, i.section, i.msg)
+}
+
+// Run validates the config file given by --config
+func (v *validateCmd) Run() error {
+	buf, err := os.ReadFile(conf.Config)
+	if err != nil {
+		return err
+	}
+
+	tConfig, issues, err := validateConfig(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", conf.Config, err)
+	}
+	applyFlags(conf, &tConfig.Global, provenance{})
+
+	if v.Discover && len(issues) == 0 {
+		issues = append(issues, checkSpeakers(tConfig, discoverSpeakers(tConfig.Global, v.DiscoveryTimeout))...)
+	}
+
+	for _, i := range issues {
+		fmt.Printf("%s: %s\n", conf.Config, i)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%s: %d problems found", conf.Config, len(issues))
+	}
+	fmt.Printf("%s: ok\n", conf.Config)
+	return nil
+}
+
+// validateConfig loads the config file in buf and reports every unknown or unreadable key and
+// every unknown message type. The config file is decoded only if all keys are known. An error is
+// returned if buf is no valid toml.
+func validateConfig(buf []byte) (tomlConfig, []issue, error) {
+	tConfig := tomlConfig{Global: defaultGlobal}
+
+	tbl, err := toml.Parse(buf)
+	if err != nil {
+		return tConfig, nil, err
+	}
+
+	var issues []issue
+	for name, field := range tbl.Fields {
+		if name == "global" {
+			issues = append(issues, checkKeys(name, field, reflect.TypeOf(global{}))...)
+			continue
+		}
+		creator, ok := plugins.Get(name)
+		if !ok {
+			issues = append(issues, issue{line: line(field), section: name, msg: "unknown section"})
+			continue
+		}
+		issues = append(issues, checkKeys(name, field, reflect.TypeOf(creator.NewConfig()))...)
+	}
+	if len(issues) > 0 {
+		sortIssues(issues)
+		return tConfig, issues, nil
+	}
+
+	if _, err := loadConfig(buf, &tConfig); err != nil {
+		return tConfig, []issue{{section: "*", msg: err.Error()}}, nil
+	}
+
+	for _, inst := range tConfig.Plugins {
+		for _, mt := range references(inst).MessageTypes {
+			if !slices.Contains(plugins.MessageTypes, mt) {
+				issues = append(issues, issue{
+					line:    inst.Line,
+					section: inst.ID(),
+					msg:     fmt.Sprintf("unknown message type %q, expected one of %s", mt, strings.Join(plugins.MessageTypes, ", ")),
+				})
+			}
+		}
+	}
+	return tConfig, issues, nil
+}
+
+// references returns the speakers and message types referred to by the configuration and the
+// filter of inst
+func references(inst *plugins.Instance) plugins.References {
+	refs := inst.Filter.References()
+	if r, ok := inst.Config.(plugins.Referrer); ok {
+		c := r.References()
+		refs.Speakers = append(c.Speakers, refs.Speakers...)
+		refs.MessageTypes = append(c.MessageTypes, refs.MessageTypes...)
+	}
+	return refs
+}
+
+// checkKeys reports every key of field that can't be decoded into a value of type t. field is
+// a table or an array of tables as found in the config file.
+func checkKeys(sectionName string, field interface{}, t reflect.Type) []issue {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+
+	var issues []issue
+	switch f := field.(type) {
+	case []*ast.Table:
+		for _, tbl := range f {
+			issues = append(issues, checkKeys(sectionName, tbl, t)...)
+		}
+	case *ast.Table:
+		for key, value := range f.Fields {
+			if key == "alias" && sectionName != "global" && !strings.Contains(sectionName, ".") {
+				continue
+			}
+			if key == "supervisor" && sectionName != "global" && !strings.Contains(sectionName, ".") {
+				issues = append(issues, checkKeys(sectionName+".supervisor", value, reflect.TypeOf(plugins.Supervision{}))...)
+				continue
+			}
+			if key == "filter" && sectionName != "global" && !strings.Contains(sectionName, ".") {
+				issues = append(issues, checkKeys(sectionName+".filter", value, reflect.TypeOf(plugins.Filter{}))...)
+				continue
+			}
+			switch t.Kind() {
+			case reflect.Map:
+				if _, ok := value.(*ast.KeyValue); !ok {
+					issues = append(issues, checkKeys(sectionName+"."+key, value, t.Elem())...)
+				}
+			case reflect.Struct:
+				sf, ok := fieldByKey(t, key)
+				switch {
+				case !ok:
+					issues = append(issues, issue{line: line(value), section: sectionName, msg: fmt.Sprintf("unknown key %s", key)})
+				case tomlKey(sf) == "-":
+					issues = append(issues, issue{line: line(value), section: sectionName, msg: fmt.Sprintf("key %s can't be configured", key)})
+				default:
+					if _, ok := value.(*ast.KeyValue); !ok {
+						issues = append(issues, checkKeys(sectionName+"."+key, value, sf.Type)...)
+					}
+				}
+			}
+		}
+	default:
+		issues = append(issues, issue{line: line(field), section: sectionName, msg: "is not a section"})
+	}
+	return issues
+}
+
+// fieldByKey returns the field of the struct type t a key is decoded into. Like the toml decoder
+// it falls back to the field names Key, KeyName (for key_name) and KEY. So fields excluded by the
+// tag toml:"-" are returned as well.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		if tag := strings.Split(sf.Tag.Get("toml"), ",")[0]; tag == key && tag != "-" {
+			return sf, true
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if f, ok := fieldByKey(sf.Type, key); ok {
+				return f, true
+			}
+		}
+	}
+
+	camel := strings.ReplaceAll(strings.Title(strings.ReplaceAll(key, "_", " ")), " ", "")
+	for _, name := range []string{strings.Title(key), camel, strings.ToUpper(key)} {
+		if sf, ok := t.FieldByName(name); ok {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// checkSpeakers reports every speaker name referenced by a plugin that is not contained in known
+func checkSpeakers(tConfig tomlConfig, known []string) []issue {
+	var issues []issue
+	for _, inst := range tConfig.Plugins {
+		for _, speaker := range references(inst).Speakers {
+			if !slices.Contains(known, speaker) {
+				issues = append(issues, issue{
+					line:    inst.Line,
+					section: inst.ID(),
+					msg:     fmt.Sprintf("unknown speaker %q, found %s", speaker, strings.Join(known, ", ")),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+// discoverSpeakers returns the names of the speakers found within timeout. If g contains
+// static_speakers, only these are asked for their names.
+func discoverSpeakers(g global, timeout time.Duration) []string {
+	nConf := soundtouch.NetworkConfig{
+		InterfaceName:     g.Interface,
+		NoOfSystems:       g.NoOfSoundtouchSystems,
+		StaticIPAddresses: g.StaticSpeakers,
+	}
+	expected := g.NoOfSoundtouchSystems
+	if len(g.StaticSpeakers) > 0 {
+		expected = len(g.StaticSpeakers)
+	}
+
+	log.Infof("Discovering speakers for %v\n", timeout)
+	speakerCh := soundtouch.SearchDevices(nConf)
+	deadline := time.After(timeout)
+
+	var names []string
+	for expected < 0 || len(names) < expected {
+		select {
+		case speaker := <-speakerCh:
+			log.Infof("Found device %s-%s with IP %s\n", speaker.Name(), speaker.DeviceID(), speaker.IP)
+			names = append(names, speaker.Name())
+		case <-deadline:
+			log.Warnf("Found %d speakers within %v\n", len(names), timeout)
+			sort.Strings(names)
+			return names
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// line returns the line of a table, array of tables or key value in the config file
+func line(field interface{}) int {
+	switch f := field.(type) {
+	case *ast.Table:
+		return f.Line
+	case []*ast.Table:
+		if len(f) > 0 {
+			return f[0].Line
+		}
+	case *ast.KeyValue:
+		return f.Line
+	}
+	return 0
+}
+
+func sortIssues(issues []issue) {
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].line < issues[j].line })
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/toml"
+)
+
+func Test_validateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"valid", `
+[global]
+interface = "en1"
+
+[[logger]]
+alias = "office"
+speakers = ["Office"]
+ignore_messages = ["Volume"]
+
+[autoOff.Office]
+thenOff = ["Kitchen"]
+`, nil},
+		{"unknown keys", `
+[global]
+interfaces = "en1"
+
+[logger]
+speaker = ["Office"]
+
+[autoOff.Office]
+thenoff = ["Kitchen"]
+
+[unknown]
+`, []string{
+			"line 3: [global] unknown key interfaces",
+			"line 6: [logger] unknown key speaker",
+			"line 9: [autoOff.Office] unknown key thenoff",
+			"line 11: [unknown] unknown section",
+		}},
+		{"unknown message types", `
+[logger]
+ignore_messages = ["ConnectionStateUpdate", "Volume"]
+
+[influxDB]
+log_messages = ["NowPlaying", "volume"]
+`, []string{
+			`line 2: [logger] unknown message type "ConnectionStateUpdate", expected one of ConnectionStateUpdated, NowPlaying, Volume`,
+			`line 5: [influxDB] unknown message type "volume", expected one of ConnectionStateUpdated, NowPlaying, Volume`,
+		}},
+		{"supervisor", `
+[logger]
+speakers = ["Office"]
+
+  [logger.supervisor]
+  queue = 4
+  drop = "newest"
+  timeout = "5s"
+  retries = 3
+`, []string{"line 9: [logger.supervisor] unknown key retries"}},
+		{"invalid supervisor", `
+[logger]
+  [logger.supervisor]
+  drop = "all"
+`, []string{"[*] line 3: [logger.supervisor] drop must be one of oldest, newest or block"}},
+		{"filter", `
+[logger]
+  [logger.filter]
+  speakers = ["Office"]
+  types = ["Volume", "Volumes"]
+  expression = 'volume > 40'
+  speaker = "Office"
+`, []string{"line 7: [logger.filter] unknown key speaker"}},
+		{"invalid filter", `
+[logger]
+  [logger.filter]
+  expression = 'loudness > 40'
+`, []string{"[*] line 3: [logger.filter] expression: unknown value loudness, expected one of speaker, device_id, type, source, artist, album, track, station, play_status, stream_type, volume, actual_volume, muted, hour, weekday"}},
+		{"filter message types", `
+[logger]
+  [logger.filter]
+  types = ["Volumes"]
+`, []string{`line 2: [logger] unknown message type "Volumes", expected one of ConnectionStateUpdated, NowPlaying, Volume`}},
+		{"invalid value", `
+[logger]
+speakers = "Office"
+`, []string{"[*] [logger]: line 3: logger.Config.Speakers: `string' type is not assignable to `[]string' type"}},
+		{"rule", `
+[[rules]]
+  [rules.when]
+  speakers = ["Office"]
+  [[rules.then]]
+  do = "power_off"
+  speaker = ["Kitchen"]
+`, []string{"line 7: [rules.then] unknown key speaker"}},
+		{"invalid rule", `
+[[rules]]
+  [rules.when]
+  types = ["NowPlaying"]
+  [[rules.then]]
+  do = "reboot"
+`, []string{`[*] line 2: [rules] then 1: unknown action "reboot", expected one of power_on, power_off, set_volume, preset, join_zone, leave_zone, notify, capture_scene, restore_scene`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, issues, err := validateConfig([]byte(tt.config))
+			if err != nil {
+				t.Fatalf("validateConfig() error = %v", err)
+			}
+			var got []string
+			for _, i := range issues {
+				got = append(got, i.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateConfig() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func Test_validateConfig_Syntax(t *testing.T) {
+	if _, _, err := validateConfig([]byte("[logger\n")); err == nil {
+		t.Errorf("validateConfig() expected error for invalid toml")
+	}
+}
+
+func Test_checkKeys_Excluded(t *testing.T) {
+	type excluded struct {
+		Speakers []string `toml:"-"`
+	}
+	_, issues, _ := validateConfig([]byte("[magicZone]\nspeakers = [\"Office\"]\n"))
+	if len(issues) != 0 {
+		t.Errorf("validateConfig() = %v, want no issues", issues)
+	}
+
+	tbl, err := toml.Parse([]byte("speakers = [\"Office\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues = checkKeys("magicZone", tbl, reflect.TypeOf(excluded{}))
+	if len(issues) != 1 || issues[0].msg != "key speakers can't be configured" {
+		t.Errorf("checkKeys() = %v, want key speakers can't be configured", issues)
+	}
+}
+
+func Test_checkSpeakers(t *testing.T) {
+	tConfig, _, err := validateConfig([]byte(`
+[magicZone]
+speakers = ["Office", "Kitchen"]
+
+[autoOff.Wohnzimmer]
+thenOff = ["Office", "Schrank"]
+`))
+	if err != nil {
+		t.Fatalf("validateConfig() error = %v", err)
+	}
+
+	var got []string
+	for _, i := range checkSpeakers(tConfig, []string{"Kitchen", "Office", "Wohnzimmer"}) {
+		got = append(got, i.String())
+	}
+	want := []string{`line 5: [autoOff] unknown speaker "Schrank", found Kitchen, Office, Wohnzimmer`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("checkSpeakers() = %v, want %v", got, want)
+	}
+}